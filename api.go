@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// apiProbeResult is the result of a probe, as returned by the JSON API
+type apiProbeResult struct {
+	Target       string           `json:"target"`
+	Module       string           `json:"module"`
+	ProbeID      string           `json:"probe_id"`
+	Protocol     string           `json:"protocol,omitempty"`
+	Success      bool             `json:"success"`
+	Error        string           `json:"error,omitempty"`
+	TLS          *apiTLS          `json:"tls,omitempty"`
+	Verification *apiVerification `json:"verification,omitempty"`
+	Certificates []apiCertificate `json:"certificates,omitempty"`
+}
+
+type apiTLS struct {
+	Version            string `json:"version"`
+	CipherSuite        string `json:"cipher_suite"`
+	ServerName         string `json:"server_name,omitempty"`
+	NegotiatedProtocol string `json:"negotiated_protocol,omitempty"`
+}
+
+type apiVerification struct {
+	Verified bool   `json:"verified"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type apiCertificate struct {
+	Subject            string    `json:"subject"`
+	SubjectCN          string    `json:"subject_cn,omitempty"`
+	Issuer             string    `json:"issuer"`
+	IssuerCN           string    `json:"issuer_cn,omitempty"`
+	SerialNo           string    `json:"serial_no"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	DNSNames           []string  `json:"dnsnames,omitempty"`
+	IPs                []string  `json:"ips,omitempty"`
+	Emails             []string  `json:"emails,omitempty"`
+	OrganizationUnits  []string  `json:"subject_ou,omitempty"`
+	IsCA               bool      `json:"is_ca"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	FingerprintSHA256  string    `json:"fingerprint_sha256"`
+}
+
+// apiProbeHandler probes the target in the same way as probeHandler, but
+// returns the details of the connection and the certificate chain as JSON
+func apiProbeHandler(w http.ResponseWriter, r *http.Request, modules map[string]*module) {
+	exporter := newRequestExporter(w, r, modules, false)
+	if exporter == nil {
+		return
+	}
+	release, err := acquireProbeSlot(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	writeJSON(w, newAPIProbeResult(r.URL.Query().Get("module"), exporter))
+}
+
+// newAPIProbeResult probes the target with the exporter and returns the
+// result. The handshake completes even if the chain can't be verified, so
+// that the chain can be returned along with the reason it was rejected.
+func newAPIProbeResult(moduleName string, exporter *Exporter) *apiProbeResult {
+	exporter.recordVerifyErrors = true
+
+	result := &apiProbeResult{
+		Target:  exporter.target,
+		Module:  moduleName,
+		ProbeID: exporter.probeID,
+	}
+	if result.Module == "" {
+		result.Module = defaultModule
+	}
+
+	probeResult, err := exporter.probe()
+	if probeResult != nil {
+		result.Protocol = probeResult.Protocol
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	state, verifyErr := probeResult.State, probeResult.VerifyErr
+
+	result.Success = true
+	result.TLS = &apiTLS{
+		Version:            tls.VersionName(state.Version),
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+	}
+
+	result.Verification = &apiVerification{Verified: verifyErr == nil}
+	if exporter.tlsConfig != nil && exporter.tlsConfig.InsecureSkipVerify {
+		result.Verification = &apiVerification{Skipped: true}
+	}
+	if verifyErr != nil {
+		result.Verification.Error = verifyErr.Error()
+	}
+
+	for _, cert := range state.PeerCertificates {
+		var ips []string
+		for _, ip := range cert.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		fingerprint := sha256.Sum256(cert.Raw)
+
+		result.Certificates = append(result.Certificates, apiCertificate{
+			Subject:            cert.Subject.String(),
+			SubjectCN:          cert.Subject.CommonName,
+			Issuer:             cert.Issuer.String(),
+			IssuerCN:           cert.Issuer.CommonName,
+			SerialNo:           cert.SerialNumber.String(),
+			NotBefore:          cert.NotBefore,
+			NotAfter:           cert.NotAfter,
+			DNSNames:           cert.DNSNames,
+			IPs:                ips,
+			Emails:             cert.EmailAddresses,
+			OrganizationUnits:  cert.Subject.OrganizationalUnit,
+			IsCA:               cert.IsCA,
+			SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+			FingerprintSHA256:  hex.EncodeToString(fingerprint[:]),
+		})
+	}
+
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
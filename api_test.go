@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test that the details of the connection and chain are returned
+func TestAPIProbeHandler(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	result, rr := apiProbe(t, server.URL, &tls.Config{RootCAs: certPool()})
+
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON content type, got %s", rr.Header().Get("Content-Type"))
+	}
+	if result.ProbeID != rr.Header().Get(probeIDHeader) {
+		t.Errorf("expected the probe ID to match the header")
+	}
+	if !result.Success || result.Protocol != "https" || result.Module != defaultModule {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if result.TLS == nil || result.TLS.Version == "" || result.TLS.CipherSuite == "" {
+		t.Errorf("expected the TLS version and cipher suite, got %+v", result.TLS)
+	}
+	if result.Verification == nil || !result.Verification.Verified {
+		t.Errorf("expected the chain to be verified, got %+v", result.Verification)
+	}
+	if len(result.Certificates) == 0 {
+		t.Fatalf("expected the certificate chain")
+	}
+
+	cert := result.Certificates[0]
+	if cert.SerialNo == "" || cert.FingerprintSHA256 == "" || cert.NotAfter.IsZero() {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+}
+
+// Test that the chain is returned along with the reason it couldn't be
+// verified
+func TestAPIProbeHandlerVerifyError(t *testing.T) {
+	server, err := serverExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	result, _ := apiProbe(t, server.URL, &tls.Config{RootCAs: certPool()})
+
+	if !result.Success {
+		t.Errorf("expected the probe to succeed, got %s", result.Error)
+	}
+	if result.Verification == nil || result.Verification.Verified || result.Verification.Error == "" {
+		t.Errorf("expected a verification error, got %+v", result.Verification)
+	}
+	if len(result.Certificates) == 0 {
+		t.Errorf("expected the certificate chain")
+	}
+}
+
+// Test that verification is reported as skipped for insecure modules
+func TestAPIProbeHandlerInsecure(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	result, _ := apiProbe(t, server.URL, &tls.Config{InsecureSkipVerify: true})
+
+	if result.Verification == nil || !result.Verification.Skipped || result.Verification.Verified {
+		t.Errorf("expected verification to be skipped, got %+v", result.Verification)
+	}
+}
+
+// Test that a failed connection is reported in the result
+func TestAPIProbeHandlerError(t *testing.T) {
+	server, err := serverHTTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	result, rr := apiProbe(t, server.URL, &tls.Config{})
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if result.Success || result.Error == "" {
+		t.Errorf("expected an error, got %+v", result)
+	}
+	if result.Certificates != nil {
+		t.Errorf("expected no certificates")
+	}
+}
+
+func apiProbe(t *testing.T, target string, tlsConfig *tls.Config) (*apiProbeResult, *httptest.ResponseRecorder) {
+	req, err := http.NewRequest("GET", "/api/v1/probe?target="+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	apiProbeHandler(rr, req, testModules(tlsConfig))
+
+	result := &apiProbeResult{}
+	if err := json.Unmarshal(rr.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+
+	return result, rr
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxBatchTargets is the most targets that a batch request can probe
+	maxBatchTargets = 1000
+
+	// maxBatchBytes is the largest body of a batch request
+	maxBatchBytes = 1 << 20
+)
+
+// batchRequest is the body of a batch request, which probes several targets,
+// each with its own module and parameters
+type batchRequest struct {
+	Targets []batchTarget `json:"targets"`
+}
+
+// batchTarget is one of the targets of a batch request. The module, the
+// timeout and the server name are optional, and default to those of a single
+// probe.
+type batchTarget struct {
+	Target     string `json:"target"`
+	Module     string `json:"module"`
+	Timeout    string `json:"timeout"`
+	ServerName string `json:"servername"`
+}
+
+// batchProbe is the exporter for one of the targets of a batch request
+type batchProbe struct {
+	module   string
+	exporter *Exporter
+}
+
+// batchProbeHandler probes each of the targets in the body of a POST to the
+// probe path at the same time, and returns their metrics with target and
+// module labels. Each target takes one of the probe slots, and the request
+// fails if one of them can't get a slot.
+func batchProbeHandler(w http.ResponseWriter, r *http.Request, modules map[string]*module) {
+	probes := newBatchProbes(w, r, modules)
+	if probes == nil {
+		return
+	}
+
+	var limited int32
+	registry := prometheus.NewRegistry()
+	for _, p := range probes {
+		labels := prometheus.Labels{"target": p.exporter.target, "module": p.module}
+		prometheus.WrapRegistererWith(labels, registry).MustRegister(&slotCollector{
+			ctx:       r.Context(),
+			collector: p.exporter,
+			limited:   &limited,
+		})
+	}
+
+	mfs, err := registry.Gather()
+	if atomic.LoadInt32(&limited) != 0 {
+		http.Error(w, errProbeLimit.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "An error has occurred during metrics gathering:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h := metricsHandler(gathered(mfs))
+	h.ServeHTTP(w, r)
+}
+
+// apiBatchProbeHandler probes each of the targets in the body of the request
+// at the same time, and returns their results as a JSON array, in the order
+// of the request. Each target takes one of the probe slots, and the targets
+// that can't get one are returned with the error.
+func apiBatchProbeHandler(w http.ResponseWriter, r *http.Request, modules map[string]*module) {
+	probes := newBatchProbes(w, r, modules)
+	if probes == nil {
+		return
+	}
+
+	results := make([]*apiProbeResult, len(probes))
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, p batchProbe) {
+			defer wg.Done()
+			release, err := acquireProbeSlot(r.Context())
+			if err != nil {
+				results[i] = &apiProbeResult{
+					Target:  p.exporter.target,
+					Module:  p.module,
+					ProbeID: p.exporter.probeID,
+					Error:   err.Error(),
+				}
+				return
+			}
+			defer release()
+			results[i] = newAPIProbeResult(p.module, p.exporter)
+		}(i, p)
+	}
+	wg.Wait()
+
+	writeJSON(w, results)
+}
+
+// newBatchProbes returns the exporters for the targets in the body of a batch
+// request. A target that's repeated with the same module is only probed once.
+// If the request is invalid, it writes an error response and returns nil.
+func newBatchProbes(w http.ResponseWriter, r *http.Request, modules map[string]*module) []batchProbe {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Batch requests must be a POST", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	var req batchRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse the batch request: %s", err), http.StatusBadRequest)
+		return nil
+	}
+	if len(req.Targets) == 0 {
+		http.Error(w, "The batch request has no targets", http.StatusBadRequest)
+		return nil
+	}
+	if len(req.Targets) > maxBatchTargets {
+		http.Error(w, fmt.Sprintf("The batch request has %d targets, more than the limit of %d", len(req.Targets), maxBatchTargets), http.StatusBadRequest)
+		return nil
+	}
+
+	defaultTimeout, err := scrapeTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	var probes []batchProbe
+	seen := map[batchTarget]bool{}
+	for i, t := range req.Targets {
+		if t.Target == "" {
+			http.Error(w, fmt.Sprintf("Target %d of the batch request is empty", i), http.StatusBadRequest)
+			return nil
+		}
+		if t.Module == "" {
+			t.Module = defaultModule
+		}
+		module, ok := modules[t.Module]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q for target %s", t.Module, t.Target), http.StatusBadRequest)
+			return nil
+		}
+
+		timeout := defaultTimeout
+		if t.Timeout != "" {
+			timeout, err = time.ParseDuration(t.Timeout)
+			if err != nil || timeout <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid timeout %q for target %s", t.Timeout, t.Target), http.StatusBadRequest)
+				return nil
+			}
+		}
+
+		key := batchTarget{Target: t.Target, Module: t.Module}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		exporter := newModuleExporter(r, t.Target, module, timeout, false)
+		exporter.setServerName(t.ServerName)
+		probes = append(probes, batchProbe{
+			module:   t.Module,
+			exporter: exporter,
+		})
+	}
+
+	return probes
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that the targets of a batch request are probed with their own
+// modules, and their metrics told apart by target and module labels
+func TestBatchProbeHandler(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	modules := testModules(&tls.Config{RootCAs: certPool()})
+	modules["insecure"] = &module{tls: &tlsConfigLoader{config: &tls.Config{InsecureSkipVerify: true}}}
+
+	body := `{"targets": [
+		{"target": "` + server.URL + `"},
+		{"target": "` + server.URL + `", "module": "insecure", "timeout": "5s"},
+		{"target": "` + server.URL + `"}
+	]}`
+	rr := postBatch(t, "/probe", body, batchProbeHandler, modules)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	for _, want := range []string{
+		`ssl_tls_connect_success{module="` + defaultModule + `",target="` + server.URL + `"} 1`,
+		`ssl_tls_connect_success{module="insecure",target="` + server.URL + `"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected `%s`", want)
+		}
+	}
+}
+
+// Test that the results of a batch request to the JSON API are returned in
+// the order of the request
+func TestAPIBatchProbeHandler(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	expired, err := serverExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expired.Close()
+	plain, err := serverHTTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	body := `{"targets": [{"target": "` + server.URL + `"}, {"target": "` + expired.URL + `"}, {"target": "` + plain.URL + `"}]}`
+	rr := postBatch(t, "/api/v1/probes", body, apiBatchProbeHandler, testModules(&tls.Config{RootCAs: certPool()}))
+
+	var results []*apiProbeResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%s: %s", err, rr.Body.String())
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for i, target := range []string{server.URL, expired.URL, plain.URL} {
+		if results[i].Target != target || results[i].Module != defaultModule || results[i].ProbeID == "" {
+			t.Errorf("unexpected result %d: %+v", i, results[i])
+		}
+	}
+	if !results[0].Success || !results[0].Verification.Verified {
+		t.Errorf("expected %s to be verified, got %+v", server.URL, results[0])
+	}
+	if !results[1].Success || results[1].Verification.Verified {
+		t.Errorf("expected %s to fail verification, got %+v", expired.URL, results[1])
+	}
+	if results[2].Success || results[2].Error == "" {
+		t.Errorf("expected an error for %s, got %+v", plain.URL, results[2])
+	}
+}
+
+// Test that invalid batch requests are rejected before anything is probed
+func TestBatchProbeHandlerInvalid(t *testing.T) {
+	modules := testModules(&tls.Config{})
+
+	for _, body := range []string{
+		``,
+		`{"targets": []}`,
+		`{"targets": [{"target": ""}]}`,
+		`{"targets": [{"target": "example.com:443", "module": "unknown"}]}`,
+		`{"targets": [{"target": "example.com:443", "timeout": "soon"}]}`,
+		`{"targets": [{"target": "example.com:443", "debug": true}]}`,
+		`{"targets": [` + strings.Repeat(`{"target": "example.com:443"},`, maxBatchTargets) + `{"target": "example.com:443"}]}`,
+	} {
+		rr := postBatch(t, "/api/v1/probes", body, apiBatchProbeHandler, modules)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected a 400 for %.80s, got %d", body, rr.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/probes", nil)
+	rr := httptest.NewRecorder()
+	apiBatchProbeHandler(rr, req, modules)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a 405 for a GET, got %d", rr.Code)
+	}
+}
+
+func postBatch(t *testing.T, path, body string, handler func(http.ResponseWriter, *http.Request, map[string]*module), modules map[string]*module) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler(rr, req, modules)
+
+	return rr
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxAIADepth limits how many issuers are fetched to complete a chain
+const maxAIADepth = 5
+
+// aiaMaxAge is how long a fetched issuer is cached for, unless it expires
+// sooner
+const aiaMaxAge = 24 * time.Hour
+
+// maxAIAIssuer is the largest issuer that's downloaded. Certificates are a
+// few kilobytes.
+const maxAIAIssuer = 64 << 10
+
+var (
+	aiaClient = &http.Client{Timeout: 10 * time.Second}
+	aiaCache  = newIssuerCache(aiaMaxAge)
+)
+
+// chainHandler probes the target and returns the chain it presented as PEM.
+// With aia=true, the issuers that are missing from the end of the chain are
+// fetched from the URLs in their Authority Information Access extensions.
+func chainHandler(w http.ResponseWriter, r *http.Request, modules map[string]*module) {
+	exporter := newRequestExporter(w, r, modules, false)
+	if exporter == nil {
+		return
+	}
+	// Chains that can't be verified are usually the ones people want to look at
+	exporter.recordVerifyErrors = true
+
+	release, err := acquireProbeSlot(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	result, err := exporter.probe()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to probe %s: %s", exporter.target, err), http.StatusInternalServerError)
+		return
+	}
+
+	chain := result.State.PeerCertificates
+	if r.URL.Query().Get("aia") == "true" {
+		ctx, cancel := context.WithTimeout(exporter.ctx, exporter.timeout)
+		defer cancel()
+		chain, err = completeChain(ctx, chain)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to complete the chain for %s: %s", exporter.target, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, cert := range chain {
+		fmt.Fprintf(buf, "# Subject: %s\n# Issuer: %s\n", cert.Subject, cert.Issuer)
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(buf.Bytes())
+}
+
+// completeChain follows the issuing certificate URLs from the last
+// certificate in the chain until it reaches a self-signed certificate
+func completeChain(ctx context.Context, chain []*x509.Certificate) ([]*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return chain, nil
+	}
+
+	for i := 0; i < maxAIADepth; i++ {
+		last := chain[len(chain)-1]
+		if isSelfSigned(last) || len(last.IssuingCertificateURL) == 0 {
+			return chain, nil
+		}
+
+		issuer, err := aiaCache.get(ctx, last.IssuingCertificateURL[0], fetchIssuer)
+		if err != nil {
+			return nil, err
+		}
+		if err := last.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("certificate from %s didn't issue %s: %s", last.IssuingCertificateURL[0], last.Subject, err)
+		}
+		chain = append(chain, issuer)
+	}
+
+	return chain, nil
+}
+
+// issuerCache keeps the issuers fetched from AIA URLs, so that targets with
+// the same missing intermediate don't each download it. Concurrent requests
+// for the same URL share a single download. Failed downloads aren't cached.
+type issuerCache struct {
+	maxAge time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]*issuerEntry
+}
+
+type issuerEntry struct {
+	done    chan struct{}
+	cert    *x509.Certificate
+	err     error
+	expires time.Time
+}
+
+func newIssuerCache(maxAge time.Duration) *issuerCache {
+	return &issuerCache{
+		maxAge:  maxAge,
+		entries: map[string]*issuerEntry{},
+	}
+}
+
+// get returns the cached issuer for the URL, or fetches it
+func (c *issuerCache) get(ctx context.Context, url string, fetch func(context.Context, string) (*x509.Certificate, error)) (*x509.Certificate, error) {
+	now := time.Now()
+
+	c.mtx.Lock()
+	e, ok := c.entries[url]
+	if ok {
+		select {
+		case <-e.done:
+			if !now.Before(e.expires) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		for u, e := range c.entries {
+			select {
+			case <-e.done:
+				if !now.Before(e.expires) {
+					delete(c.entries, u)
+				}
+			default:
+			}
+		}
+
+		e = &issuerEntry{done: make(chan struct{})}
+		c.entries[url] = e
+		c.mtx.Unlock()
+
+		e.cert, e.err = fetch(ctx, url)
+		if e.err == nil {
+			e.expires = now.Add(c.maxAge)
+			if e.cert.NotAfter.Before(e.expires) {
+				e.expires = e.cert.NotAfter
+			}
+		}
+		close(e.done)
+
+		if e.err != nil {
+			c.mtx.Lock()
+			if c.entries[url] == e {
+				delete(c.entries, url)
+			}
+			c.mtx.Unlock()
+		}
+
+		return e.cert, e.err
+	}
+	c.mtx.Unlock()
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// The fetch ended with the context of the request that made it, which
+	// doesn't mean that this one has to fail too
+	if e.err != nil && (errors.Is(e.err, context.Canceled) || errors.Is(e.err, context.DeadlineExceeded)) {
+		return c.get(ctx, url, fetch)
+	}
+	return e.cert, e.err
+}
+
+// fetchIssuer downloads a DER or PEM encoded certificate
+func fetchIssuer(ctx context.Context, url string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := aiaClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d fetching %s", resp.StatusCode, url)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAIAIssuer+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxAIAIssuer {
+		return nil, fmt.Errorf("the certificate from %s is too large, it's more than %d bytes", url, maxAIAIssuer)
+	}
+
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		// PKCS#7 bundles (.p7c) aren't supported
+		return nil, errors.New("failed to parse the certificate from " + url + ": " + err.Error())
+	}
+
+	return cert, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the presented chain is returned as PEM
+func TestChainHandler(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rr := chainRequest(t, "/chain?target="+server.URL)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "application/x-pem-file" {
+		t.Errorf("unexpected content type %s", rr.Header().Get("Content-Type"))
+	}
+
+	certs := decodeChain(t, rr.Body.Bytes())
+	if len(certs) != 1 {
+		t.Fatalf("expected 1 certificate, got %d", len(certs))
+	}
+	if !strings.Contains(rr.Body.String(), "# Subject: "+certs[0].Subject.String()) {
+		t.Errorf("expected a comment with the subject of the certificate")
+	}
+}
+
+// Test that missing issuers are fetched from the AIA URL
+func TestChainHandlerAIA(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "AIA Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aia := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(caDER)
+	}))
+	defer aia.Close()
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IssuingCertificateURL: []string{aia.URL + "/root.der"},
+	}, caTemplate, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	rr := chainRequest(t, "/chain?aia=true&target="+server.URL)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	certs := decodeChain(t, rr.Body.Bytes())
+	if len(certs) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(certs))
+	}
+	if certs[1].Subject.CommonName != "AIA Root" {
+		t.Errorf("expected the root to be appended, got %s", certs[1].Subject)
+	}
+}
+
+// Test that issuers are fetched once, unless they fail or expire
+func TestIssuerCache(t *testing.T) {
+	var fetches int
+	fetch := func(ctx context.Context, url string) (*x509.Certificate, error) {
+		fetches++
+		switch url {
+		case "http://aia.example/error.der":
+			return nil, errors.New("failed")
+		case "http://aia.example/expired.der":
+			return &x509.Certificate{NotAfter: time.Now().Add(-time.Hour)}, nil
+		}
+		return &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}, nil
+	}
+
+	c := newIssuerCache(time.Hour)
+	for _, test := range []struct {
+		url     string
+		fetches int
+	}{
+		{"http://aia.example/ca.der", 1},
+		{"http://aia.example/ca.der", 1},
+		{"http://aia.example/error.der", 2},
+		{"http://aia.example/error.der", 3},
+		{"http://aia.example/expired.der", 4},
+		{"http://aia.example/expired.der", 5},
+	} {
+		c.get(context.Background(), test.url, fetch)
+		if fetches != test.fetches {
+			t.Errorf("%s: expected %d fetches, got %d", test.url, test.fetches, fetches)
+		}
+	}
+}
+
+// Test that issuers larger than the limit aren't downloaded
+func TestFetchIssuerTooLarge(t *testing.T) {
+	aia := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, maxAIAIssuer+1))
+	}))
+	defer aia.Close()
+
+	_, err := fetchIssuer(context.Background(), aia.URL+"/ca.der")
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected an error for the large issuer, got %v", err)
+	}
+}
+
+// Test that an error is returned when the probe fails
+func TestChainHandlerError(t *testing.T) {
+	server, err := serverHTTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rr := chainRequest(t, "/chain?target="+server.URL)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+func chainRequest(t *testing.T, uri string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	chainHandler(rr, req, testModules(&tls.Config{RootCAs: certPool()}))
+
+	return rr
+}
+
+func decodeChain(t *testing.T, b []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return certs
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// changeTracker remembers the leaf that each background target served on its
+// last probe, so that a renewal or an unexpected swap of the certificate
+// shows up as a change
+type changeTracker struct {
+	mtx    sync.Mutex
+	leaves map[string]leafState
+}
+
+// leafState is the last leaf seen for a target
+type leafState struct {
+	fingerprint [sha256.Size]byte
+	// changed is when the leaf replaced a different one. It's zero until a
+	// change has been seen.
+	changed time.Time
+	// seen is when the target last served the leaf
+	seen time.Time
+}
+
+// observation is what a probe revealed about the leaf of a target
+type observation struct {
+	// changed is whether the leaf differs from the one of the previous
+	// probe, and lastChange when the target last changed its leaf
+	changed    bool
+	lastChange time.Time
+	// previous is the state from before the probe, if known is set
+	previous leafState
+	known    bool
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{leaves: map[string]leafState{}}
+}
+
+// observe records the leaf that the target served at now, and compares it
+// with the one it served before. The first leaf seen for a target isn't a
+// change.
+func (t *changeTracker) observe(target string, leaf *x509.Certificate, now time.Time) observation {
+	fingerprint := sha256.Sum256(leaf.Raw)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	last, ok := t.leaves[target]
+	next := leafState{fingerprint: fingerprint, changed: last.changed, seen: now}
+	o := observation{previous: last, known: ok}
+	if ok && last.fingerprint != fingerprint {
+		next.changed = now
+		o.changed = true
+	}
+	t.leaves[target] = next
+	o.lastChange = next.changed
+
+	return o
+}
+
+// snapshot returns a copy of the leaves of the targets
+func (t *changeTracker) snapshot() map[string]leafState {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	leaves := make(map[string]leafState, len(t.leaves))
+	for target, l := range t.leaves {
+		leaves[target] = l
+	}
+	return leaves
+}
+
+// restore replaces the leaves of the targets, like with those of a snapshot
+// from before a restart
+func (t *changeTracker) restore(leaves map[string]leafState) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.leaves = leaves
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that a change is only reported on the probe where the leaf differs,
+// and that its time is kept for the later probes
+func TestChangeTrackerObserve(t *testing.T) {
+	tracker := newChangeTracker()
+	first := &x509.Certificate{Raw: []byte("first")}
+	second := &x509.Certificate{Raw: []byte("second")}
+	start := time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC)
+
+	for i, tc := range []struct {
+		target     string
+		leaf       *x509.Certificate
+		changed    bool
+		lastChange time.Time
+	}{
+		{target: "a", leaf: first},
+		{target: "a", leaf: first},
+		{target: "b", leaf: second},
+		{target: "a", leaf: second, changed: true, lastChange: start.Add(3 * time.Minute)},
+		{target: "a", leaf: second, lastChange: start.Add(3 * time.Minute)},
+		{target: "b", leaf: second},
+	} {
+		o := tracker.observe(tc.target, tc.leaf, start.Add(time.Duration(i)*time.Minute))
+		if o.changed != tc.changed || !o.lastChange.Equal(tc.lastChange) {
+			t.Errorf("%d: expected %v and %s, got %v and %s", i, tc.changed, tc.lastChange, o.changed, o.lastChange)
+		}
+	}
+}
+
+// Test that the background probes report whether the leaf changed, and that
+// probes through /probe don't
+func TestSchedulerChanges(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), nil)
+	target := Target{Target: server.URL, Module: defaultModule, Interval: time.Minute}
+	s.probe(target)
+	s.probe(target)
+
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "ssl_cert_changed":
+			found = true
+			if v := mf.GetMetric()[0].GetGauge().GetValue(); v != 0 {
+				t.Errorf("expected ssl_cert_changed 0 for the same leaf, got %v", v)
+			}
+		case "ssl_cert_last_change_timestamp_seconds":
+			t.Errorf("expected no ssl_cert_last_change_timestamp_seconds before a change")
+		}
+	}
+	if !found {
+		t.Errorf("expected ssl_cert_changed to be gathered")
+	}
+
+	rr, err := probe(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(rr.Body.String(), "ssl_cert_changed") {
+		t.Errorf("expected no ssl_cert_changed from /probe")
+	}
+}
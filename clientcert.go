@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/x509"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	clientCertNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "client_cert_not_before"),
+		"NotBefore of the client certificate that the exporter presents for a module, expressed as a Unix Epoch Time",
+		[]string{"module", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	clientCertNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "client_cert_not_after"),
+		"NotAfter of the client certificate that the exporter presents for a module, expressed as a Unix Epoch Time",
+		[]string{"module", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+)
+
+// clientCertCollector exposes the expiry of the client certificates of the
+// modules, which all of their probes fail without once they expire. The
+// certificates are the ones currently loaded, so a renewal shows up with the
+// next reload.
+type clientCertCollector struct {
+	// modules returns the current modules
+	modules func() map[string]*module
+}
+
+// Describe implements prometheus.Collector
+func (c clientCertCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientCertNotBefore
+	ch <- clientCertNotAfter
+}
+
+// Collect implements prometheus.Collector
+func (c clientCertCollector) Collect(ch chan<- prometheus.Metric) {
+	modules := c.modules()
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cert := modules[name].clientCert()
+		if cert == nil {
+			continue
+		}
+
+		labels := []string{name, cert.SerialNumber.String(), cert.Issuer.CommonName, cert.Subject.CommonName}
+		ch <- prometheus.MustNewConstMetric(clientCertNotBefore, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), labels...)
+		ch <- prometheus.MustNewConstMetric(clientCertNotAfter, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), labels...)
+	}
+}
+
+// clientCert returns the leaf of the module's client certificate, or nil if
+// it doesn't have one
+func (m *module) clientCert() *x509.Certificate {
+	return m.tls.leaf()
+}
+
+// leaf returns the leaf of the loaded certificate, or nil if there isn't one
+func (l *tlsConfigLoader) leaf() *x509.Certificate {
+	config := l.Config()
+	if config == nil || len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return nil
+	}
+
+	cert := config.Certificates[0]
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
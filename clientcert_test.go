@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Test that the expiry of the client certificate of each module that has
+// one is exposed
+func TestClientCertCollector(t *testing.T) {
+	clientCertificate, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(clientCert))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modules := map[string]*module{
+		"mtls":    {tls: &tlsConfigLoader{config: &tls.Config{Certificates: []tls.Certificate{clientCertificate}}}},
+		"default": {tls: &tlsConfigLoader{config: &tls.Config{}}},
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(clientCertCollector{modules: func() map[string]*module { return modules }})
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["module"] != "mtls" || labels["serial_no"] != leaf.SerialNumber.String() || labels["subject_cn"] != "cert.ribbybibby.me" {
+				t.Errorf("unexpected labels %v", labels)
+			}
+
+			want := leaf.NotAfter.Unix()
+			if mf.GetName() == "ssl_exporter_client_cert_not_before" {
+				want = leaf.NotBefore.Unix()
+			}
+			if v := m.GetGauge().GetValue(); v != float64(want) {
+				t.Errorf("expected %s %s, got %v", mf.GetName(), strconv.FormatInt(want, 10), v)
+			}
+			found[mf.GetName()] = true
+		}
+	}
+	if !found["ssl_exporter_client_cert_not_after"] || !found["ssl_exporter_client_cert_not_before"] {
+		t.Errorf("expected the expiry of the client certificate, got %v", found)
+	}
+}
@@ -0,0 +1,1229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/ribbybibby/ssl_exporter/pkg/metrics"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// defaultModule is the module used when a probe doesn't specify one. Unless
+	// it's defined in the configuration file, it's built from the --tls.* flags.
+	defaultModule = "default"
+
+	defaultInterval           = time.Minute
+	defaultTargetFilesRefresh = 5 * time.Minute
+	defaultTimeout            = 10 * time.Second
+	defaultRemoteTimeout      = 30 * time.Second
+	defaultWebhookTimeout     = 10 * time.Second
+)
+
+// methodRE matches HTTP methods
+var methodRE = regexp.MustCompile(`^[A-Z]+$`)
+
+// schemeRE matches the URL schemes that probers can be registered for
+var schemeRE = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+// Config is the configuration file for the exporter
+type Config struct {
+	Modules     map[string]Module           `yaml:"modules,omitempty"`
+	Targets     []Target                    `yaml:"targets,omitempty"`
+	TargetFiles *TargetFilesConfig          `yaml:"target_files,omitempty"`
+	Pushgateway *PushgatewayConfig          `yaml:"pushgateway,omitempty"`
+	RemoteWrite []*RemoteWriteConfig        `yaml:"remote_write,omitempty"`
+	Probers     map[string]ExecProberConfig `yaml:"probers,omitempty"`
+	Webhooks    []*WebhookConfig            `yaml:"webhooks,omitempty"`
+}
+
+// Module configures how a target is probed
+type Module struct {
+	// Prober is the protocol used for targets without a scheme, and decides
+	// the port for targets without one
+	Prober    string        `yaml:"prober,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	TLSConfig TLSConfig     `yaml:"tls_config,omitempty"`
+	// SANMetrics is how the subject alternative names are reported: labels,
+	// series, count or none
+	SANMetrics metrics.SANMode `yaml:"san_metrics,omitempty"`
+	// SANMaxEntries and SANMaxBytes truncate the lists of names in the SAN
+	// labels, which then end with a hash of the full list
+	SANMaxEntries int `yaml:"san_max_entries,omitempty"`
+	SANMaxBytes   int `yaml:"san_max_bytes,omitempty"`
+	// SerialFormat is how serial numbers are written in the serial_no
+	// label: decimal or hex
+	SerialFormat metrics.SerialFormat `yaml:"serial_format,omitempty"`
+	// LeafOnly only reports the certificate metrics of the leaf, leaving
+	// out those of the intermediates and roots
+	LeafOnly bool `yaml:"leaf_only,omitempty"`
+	// BaselineChecks checks the leaf against some of the CA/Browser Forum's
+	// Baseline Requirements
+	BaselineChecks bool `yaml:"baseline_checks,omitempty"`
+	// ExpiryThresholds, like 7d or 30d, add a ssl_cert_expires_within
+	// series for each certificate and threshold
+	ExpiryThresholds []model.Duration `yaml:"expiry_thresholds,omitempty"`
+	// DNSClientSubnet, like 203.0.113.0/24, is sent with the DNS queries for
+	// the targets in the EDNS Client Subnet option
+	DNSClientSubnet string `yaml:"dns_client_subnet,omitempty"`
+	// KeepAlive is how long the background probes of https targets reuse a
+	// connection for, rather than making a new one for each probe
+	KeepAlive time.Duration `yaml:"keep_alive,omitempty"`
+	// HTTP changes the request of the https prober
+	HTTP HTTPProbe `yaml:"http,omitempty"`
+	// GRPC changes the probes of grpc targets
+	GRPC GRPCProbe `yaml:"grpc,omitempty"`
+	// Kafka changes the probes of kafka targets
+	Kafka KafkaProbe `yaml:"kafka,omitempty"`
+	// VerifyStores are more trust stores, by name, that the chains are
+	// verified against, in ssl_verify_success
+	VerifyStores map[string]VerifyStore `yaml:"verify_stores,omitempty"`
+	// OCSP is the certificate whose status the ocsp prober requests from
+	// the responders it probes
+	OCSP OCSPProbe `yaml:"ocsp,omitempty"`
+	// CTLog, if set, looks up the leaf in the Certificate Transparency logs
+	CTLog *CTLogConfig `yaml:"ct_log,omitempty"`
+	// OCSPCheck, if set, asks the OCSP responder of the leaf for its status
+	// when the target doesn't staple a response
+	OCSPCheck *OCSPCheckConfig `yaml:"ocsp_check,omitempty"`
+	// CRLCheck, if set, downloads the CRLs of the distribution points of
+	// the leaf, and checks whether it's in them
+	CRLCheck *CRLCheckConfig `yaml:"crl_check,omitempty"`
+	// Expected is what the leaf should be, to catch targets that serve a
+	// stale certificate after a renewal
+	Expected ExpectedCert `yaml:"expected,omitempty"`
+	// AllAddresses also probes each of the addresses that the host of the
+	// target resolves to
+	AllAddresses bool `yaml:"all_addresses,omitempty"`
+	// TorSOCKSAddress, like 127.0.0.1:9050, is the SOCKS proxy of the Tor
+	// client that the targets on .onion names are dialed through
+	TorSOCKSAddress string `yaml:"tor_socks_address,omitempty"`
+	// ProxyURL, like http://proxy:3128 or socks5://proxy:1080, is the
+	// proxy that the targets are dialed through, rather than the one from
+	// the environment. It resolves the names of the targets itself.
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+	// ClientProfiles are the names of the old clients, like java8 or
+	// no-ecc, whose handshakes are tried as well
+	ClientProfiles []string `yaml:"client_profiles,omitempty"`
+	// CertCompression also offers to compress the certificate, in a
+	// handshake of its own, and reports what the target did
+	CertCompression bool `yaml:"cert_compression,omitempty"`
+	// Ports are probed, each with a port label, for the targets that don't
+	// have a port of their own
+	Ports []int `yaml:"ports,omitempty"`
+	// Workers is how many of the files that the file prober's pattern
+	// matches are read at the same time, and ItemTimeout how long each of
+	// them can take
+	Workers     int           `yaml:"workers,omitempty"`
+	ItemTimeout time.Duration `yaml:"item_timeout,omitempty"`
+	// KeystorePasswords are the passwords of the PKCS#12 and JKS stores
+	// that the truststore prober reads
+	KeystorePasswords KeystorePasswords `yaml:"keystore_passwords,omitempty"`
+	// SPIFFE is the trust bundle that the spiffe prober verifies the SVIDs
+	// against
+	SPIFFE SPIFFEProbe `yaml:"spiffe,omitempty"`
+	// Kubernetes is the cluster whose secrets the kubernetes prober reads
+	Kubernetes KubernetesProbe `yaml:"kubernetes,omitempty"`
+}
+
+// ExpectedCert is what the leaf that the targets of a module serve is
+// expected to be like. Only the fields that are set are checked.
+type ExpectedCert struct {
+	// CertFile is a PEM file whose first certificate is the expected leaf.
+	// It's read for every probe, so that it can be replaced on renewal.
+	CertFile string `yaml:"cert_file,omitempty"`
+	// MinNotAfter is the earliest that the leaf may expire, like the
+	// NotAfter of the renewed certificate
+	MinNotAfter time.Time `yaml:"min_not_after,omitempty"`
+	// Serial is the serial number of the leaf, in decimal or in colon
+	// separated hex
+	Serial string `yaml:"serial,omitempty"`
+	// Fingerprint is the SHA-256 of the leaf, in hex
+	Fingerprint string `yaml:"fingerprint,omitempty"`
+}
+
+// empty reports whether nothing is expected of the leaf
+func (e ExpectedCert) empty() bool {
+	return e.CertFile == "" && e.MinNotAfter.IsZero() && e.Serial == "" && e.Fingerprint == ""
+}
+
+// expectation returns what the module's targets are expected to serve,
+// reading the expected leaf from its file if there is one
+func (m Module) expectation() (*metrics.Expectation, error) {
+	e := &metrics.Expectation{MinNotAfter: m.Expected.MinNotAfter}
+
+	if m.Expected.Serial != "" {
+		serial, err := parseSerial(m.Expected.Serial)
+		if err != nil {
+			return nil, err
+		}
+		e.Serial = serial
+	}
+	if m.Expected.Fingerprint != "" {
+		fingerprint, err := parseSHA256(m.Expected.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		e.Fingerprint = fingerprint
+	}
+
+	if m.Expected.CertFile != "" {
+		certs, err := readCertificates(m.Expected.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		e.Cert = certs[0]
+	}
+
+	return e, nil
+}
+
+// parseSerial parses a serial number written in decimal, or in hex with
+// colons between the bytes like the hex serial_format
+func parseSerial(s string) (*big.Int, error) {
+	serial, ok := new(big.Int), false
+	if strings.Contains(s, ":") {
+		serial, ok = serial.SetString(strings.Replace(s, ":", "", -1), 16)
+	} else {
+		serial, ok = serial.SetString(s, 10)
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid serial %s", s)
+	}
+	return serial, nil
+}
+
+// parseSHA256 parses a hex encoded SHA-256, which may have colons between the
+// bytes
+func parseSHA256(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %s", s)
+	}
+	return b, nil
+}
+
+// CTLogConfig configures the lookup of the leaf in the Certificate
+// Transparency logs
+type CTLogConfig struct {
+	// URL is the base URL of a crt.sh compatible API (default
+	// https://crt.sh)
+	URL string `yaml:"url,omitempty"`
+	// RecheckInterval is how long until a certificate that wasn't found is
+	// looked up again (default 1h). Certificates that were found are
+	// cached until they expire.
+	RecheckInterval time.Duration `yaml:"recheck_interval,omitempty"`
+}
+
+// OCSPCheckConfig configures the requests for the status of the leaf to its
+// OCSP responder
+type OCSPCheckConfig struct {
+	// RecheckInterval is how long a response without a nextUpdate is
+	// cached for (default 1h). Those with one are cached until shortly
+	// before it.
+	RecheckInterval time.Duration `yaml:"recheck_interval,omitempty"`
+}
+
+// CRLCheckConfig configures the downloads of the CRLs of the distribution
+// points of the leaf
+type CRLCheckConfig struct {
+	// RecheckInterval is how long a CRL without a nextUpdate is cached for
+	// (default 1h). Those with one are cached until shortly before it.
+	RecheckInterval time.Duration `yaml:"recheck_interval,omitempty"`
+}
+
+// OCSPProbe configures the request of the ocsp prober
+type OCSPProbe struct {
+	// CertFile is a PEM file with the certificate, followed by its issuer
+	// unless IssuerFile is set
+	CertFile   string `yaml:"cert_file,omitempty"`
+	IssuerFile string `yaml:"issuer_file,omitempty"`
+}
+
+// SPIFFEProbe configures the verification of the spiffe prober
+type SPIFFEProbe struct {
+	// TrustBundle is a file with the trust bundle, in PEM or in the JSON of
+	// the SPIFFE bundle endpoints. The SVIDs of TLS servers can only be
+	// verified with one.
+	TrustBundle string `yaml:"trust_bundle,omitempty"`
+	// TrustDomain is the trust domain of the bundle, like example.org. A
+	// bundle without one is used for the SVIDs of any trust domain.
+	TrustDomain string `yaml:"trust_domain,omitempty"`
+}
+
+// KubernetesProbe is the cluster of the kubernetes prober. Without a
+// kubeconfig, it's the cluster that the exporter runs in, as the service
+// account of its pod.
+type KubernetesProbe struct {
+	// Kubeconfig is a kubeconfig file with the cluster and the credentials
+	Kubeconfig string `yaml:"kubeconfig,omitempty"`
+	// Context is the context of the kubeconfig, rather than its
+	// current-context
+	Context string `yaml:"context,omitempty"`
+}
+
+// VerifyStore is a trust store that the chains are verified against
+type VerifyStore struct {
+	TrustStore          TrustStore       `yaml:"trust_store"`
+	CAFile              string           `yaml:"ca_file,omitempty"`
+	JavaCACerts         string           `yaml:"java_cacerts,omitempty"`
+	JavaCACertsPassword KeystorePassword `yaml:"java_cacerts_password,omitempty"`
+}
+
+// tlsConfig returns the TLSConfig that loads the trust store
+func (s VerifyStore) tlsConfig() TLSConfig {
+	return TLSConfig{TrustStore: s.TrustStore, CAFile: s.CAFile, JavaCACerts: s.JavaCACerts, JavaCACertsPassword: s.JavaCACertsPassword}
+}
+
+// GRPCProbe configures the probes of grpc targets, for services behind a
+// proxy that routes on the authority, or that run the health checking
+// protocol
+type GRPCProbe struct {
+	// Authority replaces the host of the target in the :authority of the
+	// health check and in the server name of the handshake, like host:port
+	Authority string `yaml:"authority,omitempty"`
+	// HealthCheck calls grpc.health.v1.Health/Check for the Service, or for
+	// the server as a whole without one
+	HealthCheck bool   `yaml:"health_check,omitempty"`
+	Service     string `yaml:"service,omitempty"`
+}
+
+// grpcRequest returns the probes of the module's grpc targets
+func (m Module) grpcRequest() prober.GRPCRequest {
+	return prober.GRPCRequest{
+		Authority:   m.GRPC.Authority,
+		HealthCheck: m.GRPC.HealthCheck,
+		Service:     m.GRPC.Service,
+	}
+}
+
+// KafkaProbe configures the probes of kafka targets, for brokers whose
+// listeners need SASL authentication, or whose whole cluster is monitored
+// from one of them
+type KafkaProbe struct {
+	// SASL authenticates to the broker after the handshake
+	SASL *SASLConfig `yaml:"sasl,omitempty"`
+	// DiscoverBrokers also probes each of the brokers in the metadata of the
+	// cluster, with a broker label
+	DiscoverBrokers bool `yaml:"discover_brokers,omitempty"`
+}
+
+// SASLConfig configures SASL authentication to a Kafka broker. The password
+// file is read for every probe, so that the credentials can be rotated.
+type SASLConfig struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+	Mechanism    string `yaml:"mechanism"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// kafkaRequest returns the probes of the module's kafka targets, with the
+// password of the SASL authentication
+func (m Module) kafkaRequest() (prober.KafkaRequest, error) {
+	req := prober.KafkaRequest{DiscoverBrokers: m.Kafka.DiscoverBrokers}
+	if sasl := m.Kafka.SASL; sasl != nil {
+		auth := &BasicAuth{Username: sasl.Username, Password: sasl.Password, PasswordFile: sasl.PasswordFile}
+		password, err := auth.password()
+		if err != nil {
+			return req, err
+		}
+		req.SASL = &prober.SASL{Mechanism: sasl.Mechanism, Username: sasl.Username, Password: password}
+	}
+
+	return req, nil
+}
+
+// HTTPProbe configures the request that the https prober makes, for targets
+// that only respond properly to particular requests
+type HTTPProbe struct {
+	Method  string            `yaml:"method,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Body    string            `yaml:"body,omitempty"`
+	// Path is requested instead of the root of targets without a path of
+	// their own, like /healthz
+	Path string `yaml:"path,omitempty"`
+
+	// BasicAuth, BearerToken and BearerTokenFile authenticate the request,
+	// for endpoints behind a login. The files are read for every probe, so
+	// that the credentials can be rotated.
+	BasicAuth       *BasicAuth `yaml:"basic_auth,omitempty"`
+	BearerToken     string     `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string     `yaml:"bearer_token_file,omitempty"`
+
+	// FollowRedirects is how many redirects are followed, to report the
+	// certificates of each https hop
+	FollowRedirects int `yaml:"follow_redirects,omitempty"`
+}
+
+// httpRequest returns the request for the module's https probes, with the
+// credentials in the Authorization header
+func (m Module) httpRequest() (prober.HTTPRequest, error) {
+	req := prober.HTTPRequest{
+		Method:          m.HTTP.Method,
+		Body:            m.HTTP.Body,
+		Path:            m.HTTP.Path,
+		Header:          http.Header{},
+		FollowRedirects: m.HTTP.FollowRedirects,
+	}
+	for name, value := range m.HTTP.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if m.HTTP.BasicAuth != nil {
+		password, err := m.HTTP.BasicAuth.password()
+		if err != nil {
+			return req, err
+		}
+		credentials := m.HTTP.BasicAuth.Username + ":" + password
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	token := m.HTTP.BearerToken
+	if m.HTTP.BearerTokenFile != "" {
+		b, err := ioutil.ReadFile(m.HTTP.BearerTokenFile)
+		if err != nil {
+			return req, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req, nil
+}
+
+// proxyURL returns the parsed ProxyURL, or nil if there isn't one
+func (m Module) proxyURL() *url.URL {
+	if m.ProxyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(m.ProxyURL)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// clientSubnet returns the parsed DNSClientSubnet, or nil if there isn't one
+func (m Module) clientSubnet() *net.IPNet {
+	_, subnet, err := net.ParseCIDR(m.DNSClientSubnet)
+	if err != nil {
+		return nil
+	}
+	return subnet
+}
+
+// resolver returns the resolver for the module's targets, or nil for the
+// default
+func (m Module) resolver() prober.Resolver {
+	if subnet := m.clientSubnet(); subnet != nil {
+		return prober.NewClientSubnetResolver(subnet)
+	}
+	return nil
+}
+
+// clientProfiles returns the profiles of the old clients whose handshakes
+// the module's probes try
+func (m Module) clientProfiles() []prober.ClientProfile {
+	var profiles []prober.ClientProfile
+	for _, name := range m.ClientProfiles {
+		if p, ok := prober.LookupClientProfile(name); ok {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles
+}
+
+// blackboxMetrics adds the blackbox exporter's metrics to those of every
+// module. It's set by --compat.blackbox.
+var blackboxMetrics bool
+
+// metricsOptions returns the options for the metrics of the module's probes
+func (m Module) metricsOptions() metrics.Options {
+	var thresholds []time.Duration
+	for _, t := range m.ExpiryThresholds {
+		thresholds = append(thresholds, time.Duration(t))
+	}
+
+	return metrics.Options{
+		SANs:             m.SANMetrics,
+		SANMaxEntries:    m.SANMaxEntries,
+		SANMaxBytes:      m.SANMaxBytes,
+		SerialFormat:     m.SerialFormat,
+		LeafOnly:         m.LeafOnly,
+		Baseline:         m.BaselineChecks,
+		ExpiryThresholds: thresholds,
+		Blackbox:         blackboxMetrics,
+	}
+}
+
+// TLSConfig configures the TLS connection to the target
+type TLSConfig struct {
+	CAFile string `yaml:"ca_file,omitempty"`
+	// CertFile may refer to a kubernetes.io/tls secret instead, like
+	// kubernetes://<namespace>/<secret>, to take both the certificate and
+	// the key from it
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	// ServerName is sent in the handshake and verified against instead of
+	// the host of the target, to ask a load balancer that's dialled by its
+	// address for the certificate of one of its names
+	ServerName string `yaml:"server_name,omitempty"`
+	// PKCS11, if set, takes the key of the client certificate from a
+	// PKCS#11 token, like a HSM, instead of key_file
+	PKCS11 *PKCS11Config `yaml:"pkcs11,omitempty"`
+	// TrustStore is what certificates are verified against: system,
+	// mozilla, file for the ca_file or java for the java_cacerts
+	TrustStore  TrustStore `yaml:"trust_store,omitempty"`
+	JavaCACerts string     `yaml:"java_cacerts,omitempty"`
+	// JavaCACertsPassword is the password of the java_cacerts, which is
+	// needed to read a PKCS#12 store whose certificates are encrypted
+	JavaCACertsPassword KeystorePassword `yaml:"java_cacerts_password,omitempty"`
+}
+
+// trustStore returns the trust store, which defaults to the ca_file if there
+// is one
+func (c TLSConfig) trustStore() TrustStore {
+	switch {
+	case c.TrustStore != "":
+		return c.TrustStore
+	case c.CAFile != "":
+		return TrustStoreFile
+	}
+	return TrustStoreSystem
+}
+
+// validateTrustStore checks that the files the trust store needs are given,
+// and that there aren't any it doesn't use
+func (c TLSConfig) validateTrustStore() error {
+	switch c.trustStore() {
+	case TrustStoreSystem, TrustStoreMozilla:
+	case TrustStoreFile:
+		if c.CAFile == "" {
+			return errors.New("the file trust_store needs a ca_file")
+		}
+	case TrustStoreJava:
+		if c.JavaCACerts == "" {
+			return errors.New("the java trust_store needs java_cacerts")
+		}
+	default:
+		return errors.New("invalid trust_store " + string(c.TrustStore))
+	}
+
+	if c.CAFile != "" && c.trustStore() != TrustStoreFile {
+		return errors.New("ca_file is only used by the file trust_store")
+	}
+	if c.JavaCACerts != "" && c.trustStore() != TrustStoreJava {
+		return errors.New("java_cacerts is only used by the java trust_store")
+	}
+	if c.JavaCACertsPassword != (KeystorePassword{}) && c.trustStore() != TrustStoreJava {
+		return errors.New("java_cacerts_password is only used by the java trust_store")
+	}
+	if err := c.JavaCACertsPassword.validate(); err != nil {
+		return errors.New("java_cacerts_password: " + err.Error())
+	}
+
+	return nil
+}
+
+// KeystorePassword is the password of a PKCS#12 or JKS store, given in the
+// configuration, in an environment variable or in a file
+type KeystorePassword struct {
+	Password     string `yaml:"password,omitempty"`
+	PasswordEnv  string `yaml:"password_env,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+func (p KeystorePassword) validate() error {
+	n := 0
+	for _, v := range []string{p.Password, p.PasswordEnv, p.PasswordFile} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of password, password_env and password_file can be set")
+	}
+	return nil
+}
+
+// get returns the password, which is read from the environment variable or
+// the file every time, so that it can be rotated with the store
+func (p KeystorePassword) get() (string, error) {
+	switch {
+	case p.PasswordEnv != "":
+		v, ok := os.LookupEnv(p.PasswordEnv)
+		if !ok {
+			return "", errors.New("the environment variable " + p.PasswordEnv + " of the keystore password isn't set")
+		}
+		return v, nil
+	case p.PasswordFile != "":
+		b, err := ioutil.ReadFile(p.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return p.Password, nil
+}
+
+// KeystorePasswords are the passwords of the PKCS#12 and JKS stores that the
+// truststore prober reads
+type KeystorePasswords struct {
+	// The password of the stores that there isn't one for in Files
+	KeystorePassword `yaml:",inline"`
+	// Files are the passwords of particular stores, by their path or by a
+	// pattern like /opt/app/*/keystore.p12, for directories of stores that
+	// have different passwords
+	Files map[string]KeystorePassword `yaml:"files,omitempty"`
+}
+
+func (k KeystorePasswords) validate() error {
+	if err := k.KeystorePassword.validate(); err != nil {
+		return err
+	}
+	for pattern, p := range k.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("files: invalid pattern %s", pattern)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("files: %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// forFile returns the password of the store in the file: the one for its
+// path, or else for the longest pattern that matches it, or else the default
+func (k KeystorePasswords) forFile(file string) (string, error) {
+	if p, ok := k.Files[file]; ok {
+		return p.get()
+	}
+
+	patterns := make([]string, 0, len(k.Files))
+	for pattern := range k.Files {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, file); ok {
+			return k.Files[pattern].get()
+		}
+	}
+
+	return k.get()
+}
+
+// PKCS11Config locates the key of a client certificate on a PKCS#11 token.
+// It's only supported by builds with the pkcs11 tag.
+type PKCS11Config struct {
+	// Module is the path to the PKCS#11 library of the token
+	Module string `yaml:"module"`
+	Slot   uint   `yaml:"slot"`
+	// PINFile is read for the PIN to log in to the token with
+	PINFile string `yaml:"pin_file"`
+	// KeyLabel selects the key by its label, when the token has more than
+	// one
+	KeyLabel string `yaml:"key_label,omitempty"`
+}
+
+// Target is a target that the exporter probes on its own schedule
+type Target struct {
+	Target   string        `yaml:"target"`
+	Module   string        `yaml:"module,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// TargetFilesConfig configures reading more targets from files, which are
+// read again every RefreshInterval, so that targets can be added and removed
+// without reloading the configuration
+type TargetFilesConfig struct {
+	// Files are the paths of the files, which may contain the patterns of
+	// filepath.Match in their last element, like targets/*.yml
+	Files           []string      `yaml:"files"`
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// PushgatewayConfig configures pushing the results of the background probes
+// to a Pushgateway
+type PushgatewayConfig struct {
+	URL      string            `yaml:"url"`
+	Job      string            `yaml:"job,omitempty"`
+	Grouping map[string]string `yaml:"grouping,omitempty"`
+}
+
+// ExecProberConfig configures an external command that probes targets with
+// a scheme the exporter doesn't support itself
+type ExecProberConfig struct {
+	Command     []string `yaml:"command"`
+	DefaultPort string   `yaml:"default_port,omitempty"`
+}
+
+// RemoteWriteConfig configures sending the results of the background probes
+// to a Prometheus remote write endpoint
+type RemoteWriteConfig struct {
+	URL             string            `yaml:"url"`
+	RemoteTimeout   time.Duration     `yaml:"remote_timeout,omitempty"`
+	Headers         map[string]string `yaml:"headers,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty"`
+	BasicAuth       *BasicAuth        `yaml:"basic_auth,omitempty"`
+	BearerToken     string            `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string            `yaml:"bearer_token_file,omitempty"`
+	TLSConfig       TLSConfig         `yaml:"tls_config,omitempty"`
+}
+
+// WebhookConfig configures an endpoint that the events of the background
+// probes, like a change of a target's leaf, are posted to
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Timeout time.Duration     `yaml:"timeout,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// BasicAuth configures HTTP basic authentication
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// password returns the password, reading it from the password file if one is
+// configured
+func (b *BasicAuth) password() (string, error) {
+	if b.PasswordFile == "" {
+		return b.Password, nil
+	}
+
+	p, err := ioutil.ReadFile(b.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(p)), nil
+}
+
+// loadConfig reads and validates the configuration file
+func loadConfig(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(b)
+}
+
+func parseConfig(b []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, err
+	}
+
+	for name, module := range c.Modules {
+		if c := module.TLSConfig; strings.HasPrefix(c.CertFile, kubernetesScheme) {
+			if _, _, err := parseSecretRef(c.CertFile); err != nil {
+				return nil, fmt.Errorf("module %s: %s", name, err)
+			}
+			if (c.KeyFile != "" && c.KeyFile != c.CertFile) || c.PKCS11 != nil {
+				return nil, fmt.Errorf("module %s: the key is taken from the secret in cert_file, key_file and pkcs11 must not be set", name)
+			}
+		} else if p := module.TLSConfig.PKCS11; p != nil {
+			if module.TLSConfig.CertFile == "" || module.TLSConfig.KeyFile != "" {
+				return nil, fmt.Errorf("module %s: pkcs11 must be provided with cert_file and without key_file", name)
+			}
+			if p.Module == "" || p.PINFile == "" {
+				return nil, fmt.Errorf("module %s: pkcs11 must have a module and a pin_file", name)
+			}
+		} else if (module.TLSConfig.CertFile == "") != (module.TLSConfig.KeyFile == "") {
+			return nil, fmt.Errorf("module %s: cert_file and key_file must be provided together", name)
+		}
+		if err := module.TLSConfig.validateTrustStore(); err != nil {
+			return nil, fmt.Errorf("module %s: %s", name, err)
+		}
+		for store, v := range module.VerifyStores {
+			if v.TrustStore == "" {
+				return nil, fmt.Errorf("module %s: verify_stores: %s must have a trust_store", name, store)
+			}
+			if err := v.tlsConfig().validateTrustStore(); err != nil {
+				return nil, fmt.Errorf("module %s: verify_stores: %s: %s", name, store, err)
+			}
+		}
+		if err := module.KeystorePasswords.validate(); err != nil {
+			return nil, fmt.Errorf("module %s: keystore_passwords: %s", name, err)
+		}
+		if module.Prober != trustStoreProber && (module.KeystorePasswords.KeystorePassword != (KeystorePassword{}) || len(module.KeystorePasswords.Files) > 0) {
+			return nil, fmt.Errorf("module %s: keystore_passwords are only used by the truststore prober", name)
+		}
+		if module.Prober != "" && !knownProber(c, module.Prober) {
+			return nil, fmt.Errorf("module %s: unknown prober %s", name, module.Prober)
+		}
+		if module.Prober == ocspProber && module.OCSP.CertFile == "" {
+			return nil, fmt.Errorf("module %s: the ocsp prober needs an ocsp cert_file", name)
+		}
+		if module.Prober != ocspProber && module.OCSP != (OCSPProbe{}) {
+			return nil, fmt.Errorf("module %s: ocsp is only used by the ocsp prober", name)
+		}
+		if module.Prober != spiffeProber && module.SPIFFE != (SPIFFEProbe{}) {
+			return nil, fmt.Errorf("module %s: spiffe is only used by the spiffe prober", name)
+		}
+		if module.Prober != kubernetesProber && module.Kubernetes != (KubernetesProbe{}) {
+			return nil, fmt.Errorf("module %s: kubernetes is only used by the kubernetes prober", name)
+		}
+		if module.Kubernetes.Context != "" && module.Kubernetes.Kubeconfig == "" {
+			return nil, fmt.Errorf("module %s: kubernetes context is a context of the kubeconfig, which must be set", name)
+		}
+		for _, p := range module.ClientProfiles {
+			if _, ok := prober.LookupClientProfile(p); !ok {
+				return nil, fmt.Errorf("module %s: unknown client profile %s, expected one of %s", name, p, strings.Join(prober.ClientProfileNames(), ", "))
+			}
+		}
+		if len(module.ClientProfiles) > 0 {
+			switch module.Prober {
+			case ocspProber, trustStoreProber, sshProber, spiffeProber, fileProber, kubernetesProber:
+				return nil, fmt.Errorf("module %s: client_profiles aren't used by the %s prober", name, module.Prober)
+			}
+		}
+		for _, p := range module.Ports {
+			if p < 1 || p > 65535 {
+				return nil, fmt.Errorf("module %s: invalid port %d", name, p)
+			}
+		}
+		if len(module.Ports) > 0 {
+			switch module.Prober {
+			case ocspProber, trustStoreProber, sshProber, spiffeProber, fileProber, kubernetesProber:
+				return nil, fmt.Errorf("module %s: ports aren't used by the %s prober", name, module.Prober)
+			}
+		}
+		if module.Workers < 0 || module.ItemTimeout < 0 {
+			return nil, fmt.Errorf("module %s: workers and item_timeout must not be negative", name)
+		}
+		if module.Prober != fileProber && (module.Workers != 0 || module.ItemTimeout != 0) {
+			return nil, fmt.Errorf("module %s: workers and item_timeout are only used by the file prober", name)
+		}
+		if module.CertCompression && module.Prober != "" && module.Prober != "https" && module.Prober != "tcp" && !prober.ImplicitTLS(module.Prober) {
+			return nil, fmt.Errorf("module %s: cert_compression is only used by the https and tcp probers", name)
+		}
+		if td := module.SPIFFE.TrustDomain; td != "" {
+			if module.SPIFFE.TrustBundle == "" {
+				return nil, fmt.Errorf("module %s: spiffe trust_domain is the trust domain of the trust_bundle, which must be set", name)
+			}
+			if !trustDomainRE.MatchString(td) {
+				return nil, fmt.Errorf("module %s: invalid spiffe trust_domain %s", name, td)
+			}
+		}
+		switch module.SANMetrics {
+		case "", metrics.SANLabels, metrics.SANSeries, metrics.SANCount, metrics.SANNone:
+		default:
+			return nil, fmt.Errorf("module %s: invalid san_metrics %s", name, module.SANMetrics)
+		}
+		switch module.SerialFormat {
+		case "", metrics.SerialDecimal, metrics.SerialHex:
+		default:
+			return nil, fmt.Errorf("module %s: invalid serial_format %s", name, module.SerialFormat)
+		}
+		for _, t := range module.ExpiryThresholds {
+			if t <= 0 {
+				return nil, fmt.Errorf("module %s: expiry_thresholds must be positive", name)
+			}
+		}
+		if module.DNSClientSubnet != "" {
+			if _, _, err := net.ParseCIDR(module.DNSClientSubnet); err != nil {
+				return nil, fmt.Errorf("module %s: invalid dns_client_subnet %s", name, module.DNSClientSubnet)
+			}
+		}
+		if module.TorSOCKSAddress != "" {
+			if _, _, err := net.SplitHostPort(module.TorSOCKSAddress); err != nil {
+				return nil, fmt.Errorf("module %s: invalid tor_socks_address %s", name, module.TorSOCKSAddress)
+			}
+		}
+		if module.ProxyURL != "" {
+			u, err := url.Parse(module.ProxyURL)
+			if err != nil {
+				return nil, fmt.Errorf("module %s: invalid proxy_url: %s", name, err)
+			}
+			if err := prober.CheckProxyURL(u); err != nil {
+				return nil, fmt.Errorf("module %s: invalid proxy_url: %s", name, err)
+			}
+			if module.AllAddresses || module.DNSClientSubnet != "" {
+				return nil, fmt.Errorf("module %s: all_addresses and dns_client_subnet can't be used with a proxy_url, which resolves the targets itself", name)
+			}
+		}
+		if module.HTTP.Method != "" && !methodRE.MatchString(module.HTTP.Method) {
+			return nil, fmt.Errorf("module %s: invalid http method %s", name, module.HTTP.Method)
+		}
+		if p := module.HTTP.Path; p != "" {
+			if u, err := url.Parse(p); err != nil || !strings.HasPrefix(p, "/") || u.Host != "" {
+				return nil, fmt.Errorf("module %s: invalid http path %s", name, p)
+			}
+		}
+		if module.HTTP.FollowRedirects < 0 {
+			return nil, fmt.Errorf("module %s: follow_redirects must not be negative", name)
+		}
+		auth := 0
+		if module.HTTP.BasicAuth != nil {
+			auth++
+			if module.HTTP.BasicAuth.Password != "" && module.HTTP.BasicAuth.PasswordFile != "" {
+				return nil, fmt.Errorf("module %s: at most one of password and password_file may be configured", name)
+			}
+		}
+		if module.HTTP.BearerToken != "" {
+			auth++
+		}
+		if module.HTTP.BearerTokenFile != "" {
+			auth++
+		}
+		if auth > 1 {
+			return nil, fmt.Errorf("module %s: at most one of basic_auth, bearer_token and bearer_token_file may be configured", name)
+		}
+		for header := range module.HTTP.Headers {
+			if auth > 0 && http.CanonicalHeaderKey(header) == "Authorization" {
+				return nil, fmt.Errorf("module %s: the Authorization header can't be set with basic_auth or a bearer token", name)
+			}
+		}
+		if module.GRPC != (GRPCProbe{}) {
+			switch module.Prober {
+			case ocspProber, trustStoreProber, sshProber, spiffeProber, fileProber, kubernetesProber:
+				return nil, fmt.Errorf("module %s: grpc isn't used by the %s prober", name, module.Prober)
+			}
+		}
+		if a := module.GRPC.Authority; a != "" && (strings.ContainsAny(a, "/ ") || strings.Contains(a, "://")) {
+			return nil, fmt.Errorf("module %s: invalid grpc authority %s, expected a host with an optional port", name, a)
+		}
+		if module.GRPC.Service != "" && !module.GRPC.HealthCheck {
+			return nil, fmt.Errorf("module %s: grpc service is the service of the health check, which must be enabled with health_check", name)
+		}
+		if module.Kafka != (KafkaProbe{}) {
+			switch module.Prober {
+			case ocspProber, trustStoreProber, sshProber, spiffeProber, fileProber, kubernetesProber:
+				return nil, fmt.Errorf("module %s: kafka isn't used by the %s prober", name, module.Prober)
+			}
+		}
+		if sasl := module.Kafka.SASL; sasl != nil {
+			switch sasl.Mechanism {
+			case prober.SASLPlain, prober.SASLSCRAMSHA256, prober.SASLSCRAMSHA512:
+			default:
+				return nil, fmt.Errorf("module %s: unknown sasl mechanism %q, expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", name, sasl.Mechanism)
+			}
+			if sasl.Username == "" {
+				return nil, fmt.Errorf("module %s: sasl username must be configured", name)
+			}
+			if sasl.Password != "" && sasl.PasswordFile != "" {
+				return nil, fmt.Errorf("module %s: at most one of sasl password and password_file may be configured", name)
+			}
+		}
+		if ct := module.CTLog; ct != nil {
+			if ct.URL != "" {
+				if u, err := url.Parse(ct.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return nil, fmt.Errorf("module %s: invalid ct_log url %s", name, ct.URL)
+				}
+			}
+			if ct.RecheckInterval < 0 {
+				return nil, fmt.Errorf("module %s: ct_log recheck_interval must not be negative", name)
+			}
+		}
+		if check := module.OCSPCheck; check != nil {
+			switch module.Prober {
+			case ocspProber, trustStoreProber, sshProber, spiffeProber, fileProber, kubernetesProber:
+				return nil, fmt.Errorf("module %s: ocsp_check isn't used by the %s prober", name, module.Prober)
+			}
+			if check.RecheckInterval < 0 {
+				return nil, fmt.Errorf("module %s: ocsp_check recheck_interval must not be negative", name)
+			}
+		}
+		if check := module.CRLCheck; check != nil {
+			switch module.Prober {
+			case ocspProber, trustStoreProber, sshProber, spiffeProber, fileProber, kubernetesProber:
+				return nil, fmt.Errorf("module %s: crl_check isn't used by the %s prober", name, module.Prober)
+			}
+			if check.RecheckInterval < 0 {
+				return nil, fmt.Errorf("module %s: crl_check recheck_interval must not be negative", name)
+			}
+		}
+		if module.Expected.Serial != "" {
+			if _, err := parseSerial(module.Expected.Serial); err != nil {
+				return nil, fmt.Errorf("module %s: expected: %s", name, err)
+			}
+		}
+		if module.Expected.Fingerprint != "" {
+			if _, err := parseSHA256(module.Expected.Fingerprint); err != nil {
+				return nil, fmt.Errorf("module %s: expected: %s", name, err)
+			}
+		}
+		if module.KeepAlive < 0 {
+			return nil, fmt.Errorf("module %s: keep_alive must not be negative", name)
+		}
+		if module.SANMaxEntries < 0 || module.SANMaxBytes < 0 {
+			return nil, fmt.Errorf("module %s: san_max_entries and san_max_bytes must not be negative", name)
+		}
+	}
+
+	if err := c.checkTargets(c.Targets, map[string]bool{}); err != nil {
+		return nil, fmt.Errorf("targets: %s", err)
+	}
+
+	if f := c.TargetFiles; f != nil {
+		if len(f.Files) == 0 {
+			return nil, errors.New("target_files: files must not be empty")
+		}
+		for _, pattern := range f.Files {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("target_files: invalid pattern %s", pattern)
+			}
+		}
+		if f.RefreshInterval < 0 {
+			return nil, errors.New("target_files: refresh_interval must not be negative")
+		}
+		if f.RefreshInterval == 0 {
+			f.RefreshInterval = defaultTargetFilesRefresh
+		}
+	}
+
+	if p := c.Pushgateway; p != nil {
+		if p.URL == "" {
+			return nil, errors.New("pushgateway: url must not be empty")
+		}
+		if p.Job == "" {
+			p.Job = namespace + "_exporter"
+		}
+		for name := range p.Grouping {
+			if !model.LabelName(name).IsValid() || name == "job" || name == "target" {
+				return nil, fmt.Errorf("pushgateway: invalid grouping label %s", name)
+			}
+		}
+	}
+
+	for scheme, p := range c.Probers {
+		if !schemeRE.MatchString(scheme) || builtinProber(scheme) {
+			return nil, fmt.Errorf("probers: invalid scheme %s", scheme)
+		}
+		if len(p.Command) == 0 {
+			return nil, fmt.Errorf("probers: %s: command must not be empty", scheme)
+		}
+		if p.DefaultPort != "" {
+			if _, err := strconv.ParseUint(p.DefaultPort, 10, 16); err != nil {
+				return nil, fmt.Errorf("probers: %s: invalid default_port %s", scheme, p.DefaultPort)
+			}
+		}
+	}
+
+	for _, rw := range c.RemoteWrite {
+		if rw.URL == "" {
+			return nil, errors.New("remote_write: url must not be empty")
+		}
+		if rw.RemoteTimeout == 0 {
+			rw.RemoteTimeout = defaultRemoteTimeout
+		}
+
+		auth := 0
+		if rw.BasicAuth != nil {
+			auth++
+			if rw.BasicAuth.Password != "" && rw.BasicAuth.PasswordFile != "" {
+				return nil, fmt.Errorf("remote_write %s: at most one of password and password_file may be configured", rw.URL)
+			}
+		}
+		if rw.BearerToken != "" {
+			auth++
+		}
+		if rw.BearerTokenFile != "" {
+			auth++
+		}
+		if auth > 1 {
+			return nil, fmt.Errorf("remote_write %s: at most one of basic_auth, bearer_token and bearer_token_file may be configured", rw.URL)
+		}
+
+		if (rw.TLSConfig.CertFile == "") != (rw.TLSConfig.KeyFile == "") {
+			return nil, fmt.Errorf("remote_write %s: cert_file and key_file must be provided together", rw.URL)
+		}
+		if err := rw.TLSConfig.validateTrustStore(); err != nil {
+			return nil, fmt.Errorf("remote_write %s: %s", rw.URL, err)
+		}
+		for name := range rw.Labels {
+			if !model.LabelName(name).IsValid() || name == model.MetricNameLabel || name == "target" {
+				return nil, fmt.Errorf("remote_write %s: invalid label %s", rw.URL, name)
+			}
+		}
+	}
+
+	for _, w := range c.Webhooks {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhooks: invalid url %s", w.URL)
+		}
+		if w.Timeout < 0 {
+			return nil, fmt.Errorf("webhooks %s: timeout must not be negative", w.URL)
+		}
+		if w.Timeout == 0 {
+			w.Timeout = defaultWebhookTimeout
+		}
+	}
+
+	return c, nil
+}
+
+// checkTargets checks the targets, and sets the default module and interval
+// of those without. The targets in seen, and those checked, can't be
+// defined again.
+func (c *Config) checkTargets(targets []Target, seen map[string]bool) error {
+	for i, target := range targets {
+		if target.Target == "" {
+			return errors.New("target must not be empty")
+		}
+		if seen[target.Target] {
+			return fmt.Errorf("%s is defined more than once", target.Target)
+		}
+		seen[target.Target] = true
+
+		if target.Module == "" {
+			targets[i].Module = defaultModule
+		}
+		if _, ok := c.Modules[targets[i].Module]; !ok && targets[i].Module != defaultModule {
+			return fmt.Errorf("%s refers to unknown module %s", target.Target, target.Module)
+		}
+
+		if target.Interval == 0 {
+			targets[i].Interval = defaultInterval
+		}
+		if targets[i].Interval < 0 {
+			return fmt.Errorf("%s has a negative interval", target.Target)
+		}
+	}
+	return nil
+}
+
+// builtinProber reports whether name is one of the exporter's own probers
+func builtinProber(name string) bool {
+	switch name {
+	case "https", "tcp", "grpc", "kafka", "quic", ocspProber, trustStoreProber, sshProber, spiffeProber, fileProber, kubernetesProber:
+		return true
+	}
+	return false
+}
+
+// knownProber reports whether name is a built in prober, the scheme of a
+// protocol that starts with a TLS handshake or is upgraded with STARTTLS, one
+// registered in the binary or one defined in the configuration
+func knownProber(c *Config, name string) bool {
+	if builtinProber(name) || prober.ImplicitTLS(name) || prober.StartTLS(name) {
+		return true
+	}
+	if _, ok := c.Probers[name]; ok {
+		return true
+	}
+	for _, scheme := range prober.Registered() {
+		if scheme == name {
+			return true
+		}
+	}
+	return false
+}
+
+// module is a Module along with the TLS configuration loaded from its files
+type module struct {
+	Module
+	tls *tlsConfigLoader
+	// stores load the VerifyStores
+	stores map[string]*tlsConfigLoader
+	// ct looks up the leaf in the CT logs, if the module has a CTLog
+	ct *ctLog
+	// ocsp asks the leaf's OCSP responder for its status, if the module
+	// has an OCSPCheck
+	ocsp *ocspCache
+	// crl downloads the CRLs of the leaf, if the module has a CRLCheck
+	crl *crlCache
+	// done stops watching the files of the module, once a reload has
+	// replaced it
+	done chan struct{}
+}
+
+// trustStores returns the roots of the VerifyStores
+func (m *module) trustStores() map[string]*x509.CertPool {
+	if len(m.stores) == 0 {
+		return nil
+	}
+	pools := map[string]*x509.CertPool{}
+	for name, l := range m.stores {
+		pools[name] = l.Config().RootCAs
+	}
+	return pools
+}
+
+// loadModules loads the TLS files for each of the modules in the
+// configuration. The default module is built from defaultTLS, unless the
+// configuration defines it.
+func loadModules(c *Config, defaultTLS TLSConfig) (map[string]*module, error) {
+	return reloadModules(c, defaultTLS, nil)
+}
+
+// reloadModules is like loadModules, but keeps the modules of previous that
+// are configured the same, rather than loading their files again, so that
+// they keep their caches and the files they have open
+func reloadModules(c *Config, defaultTLS TLSConfig, previous map[string]*module) (map[string]*module, error) {
+	configs := map[string]Module{}
+	for name, m := range c.Modules {
+		configs[name] = m
+	}
+	if _, ok := configs[defaultModule]; !ok {
+		configs[defaultModule] = Module{TLSConfig: defaultTLS}
+	}
+
+	modules := map[string]*module{}
+	for name, m := range configs {
+		if p, ok := previous[name]; ok && reflect.DeepEqual(p.Module, m) {
+			modules[name] = p
+			continue
+		}
+
+		l, err := newTLSConfigLoader("modules/"+name, m.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %s", name, err)
+		}
+		modules[name] = &module{Module: m, tls: l, done: make(chan struct{})}
+		if m.CTLog != nil {
+			modules[name].ct = newCTLog(*m.CTLog)
+		}
+		if m.OCSPCheck != nil {
+			modules[name].ocsp = newOCSPCache(*m.OCSPCheck)
+		}
+		if m.CRLCheck != nil {
+			modules[name].crl = newCRLCache(*m.CRLCheck)
+		}
+
+		for store, v := range m.VerifyStores {
+			l, err := newTLSConfigLoader("modules/"+name+"/verify_stores/"+store, v.tlsConfig())
+			if err != nil {
+				return nil, fmt.Errorf("module %s: verify_stores: %s: %s", name, store, err)
+			}
+			if modules[name].stores == nil {
+				modules[name].stores = map[string]*tlsConfigLoader{}
+			}
+			modules[name].stores[store] = l
+		}
+	}
+
+	return modules, nil
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that targets get the default module and interval
+func TestParseConfigTargetDefaults(t *testing.T) {
+	c, err := parseConfig([]byte(`
+targets:
+  - target: example.com:443
+  - target: example.org:443
+    interval: 5m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Targets[0].Module != defaultModule {
+		t.Errorf("expected module %s, got %s", defaultModule, c.Targets[0].Module)
+	}
+	if c.Targets[0].Interval != defaultInterval {
+		t.Errorf("expected interval %s, got %s", defaultInterval, c.Targets[0].Interval)
+	}
+	if c.Targets[1].Interval != 5*time.Minute {
+		t.Errorf("expected interval 5m, got %s", c.Targets[1].Interval)
+	}
+}
+
+// Test that a module is parsed correctly
+func TestParseConfigModule(t *testing.T) {
+	c, err := parseConfig([]byte(`
+modules:
+  internal:
+    timeout: 5s
+    tls_config:
+      ca_file: /etc/ssl/internal.pem
+      insecure_skip_verify: true
+    expiry_thresholds: [7d, 30d]
+    leaf_only: true
+targets:
+  - target: internal.example.com:443
+    module: internal
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := c.Modules["internal"]
+	if m.Timeout != 5*time.Second {
+		t.Errorf("expected timeout 5s, got %s", m.Timeout)
+	}
+	if m.TLSConfig.CAFile != "/etc/ssl/internal.pem" {
+		t.Errorf("unexpected ca_file %s", m.TLSConfig.CAFile)
+	}
+	if !m.TLSConfig.InsecureSkipVerify {
+		t.Errorf("expected insecure_skip_verify to be true")
+	}
+	if o := m.metricsOptions(); len(o.ExpiryThresholds) != 2 || o.ExpiryThresholds[1] != 30*24*time.Hour {
+		t.Errorf("expected the expiry thresholds 7d and 30d, got %v", o.ExpiryThresholds)
+	}
+	if !m.metricsOptions().LeafOnly {
+		t.Errorf("expected leaf_only to be true")
+	}
+}
+
+// Test that the scheme of a protocol that starts with a TLS handshake can be
+// the prober of a module, but not an unknown one
+func TestParseConfigImplicitTLSProber(t *testing.T) {
+	if _, err := parseConfig([]byte(`
+modules:
+  syslog:
+    prober: syslog-tls
+    tls_config:
+      cert_file: /etc/ssl/client.pem
+      key_file: /etc/ssl/client-key.pem
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseConfig([]byte(`
+modules:
+  syslog:
+    prober: syslog-udp
+`)); err == nil {
+		t.Errorf("expected an error for an unknown prober")
+	}
+}
+
+// Test that invalid configurations are rejected
+func TestParseConfigInvalid(t *testing.T) {
+	for name, conf := range map[string]string{
+		"unknown field": `
+modules:
+  default:
+    timeuot: 5s
+`,
+		"unknown module": `
+targets:
+  - target: example.com:443
+    module: missing
+`,
+		"duplicate target": `
+targets:
+  - target: example.com:443
+  - target: example.com:443
+`,
+		"empty target": `
+targets:
+  - module: default
+`,
+		"pushgateway without url": `
+pushgateway:
+  job: ssl
+`,
+		"pushgateway target grouping": `
+pushgateway:
+  url: http://localhost:9091
+  grouping:
+    target: example.com
+`,
+		"remote_write without url": `
+remote_write:
+  - remote_timeout: 10s
+`,
+		"remote_write with two auth methods": `
+remote_write:
+  - url: http://localhost:9009/api/v1/push
+    bearer_token: secret
+    basic_auth:
+      username: ssl
+      password: secret
+`,
+		"remote_write target label": `
+remote_write:
+  - url: http://localhost:9009/api/v1/push
+    labels:
+      target: example.com
+`,
+		"prober for a built in scheme": `
+probers:
+  https:
+    command: [/usr/local/bin/probe]
+`,
+		"module with unknown prober": `
+modules:
+  mail:
+    prober: carrier-pigeon
+`,
+		"module with invalid san_metrics": `
+modules:
+  sans:
+    san_metrics: some
+`,
+		"module with invalid serial_format": `
+modules:
+  serials:
+    serial_format: octal
+`,
+		"module with invalid dns_client_subnet": `
+modules:
+  ecs:
+    dns_client_subnet: 203.0.113.1
+`,
+		"module with an unknown client profile": `
+modules:
+  legacy:
+    client_profiles: [netscape]
+`,
+		"module with client profiles for the ssh prober": `
+modules:
+  legacy:
+    prober: ssh
+    client_profiles: [java8]
+`,
+		"module with cert_compression for the ssh prober": `
+modules:
+  compression:
+    prober: ssh
+    cert_compression: true
+`,
+		"module with workers for the https prober": `
+modules:
+  web:
+    workers: 4
+`,
+		"module with a negative item_timeout": `
+modules:
+  files:
+    prober: file
+    item_timeout: -1s
+`,
+		"module with ports for the file prober": `
+modules:
+  files:
+    prober: file
+    ports: [443]
+`,
+		"module with an invalid port": `
+modules:
+  admin:
+    ports: [443, 70000]
+`,
+		"module with invalid tor_socks_address": `
+modules:
+  tor:
+    tor_socks_address: 127.0.0.1
+`,
+		"module with an unsupported proxy_url scheme": `
+modules:
+  dmz:
+    proxy_url: ftp://proxy.example.com
+`,
+		"module with a proxy_url and all_addresses": `
+modules:
+  dmz:
+    proxy_url: http://proxy.example.com:3128
+    all_addresses: true
+`,
+		"module with invalid http method": `
+modules:
+  api:
+    http:
+      method: get /
+`,
+		"module with invalid trust_store": `
+modules:
+  jvm:
+    tls_config:
+      trust_store: windows
+`,
+		"module with java trust_store without java_cacerts": `
+modules:
+  jvm:
+    tls_config:
+      trust_store: java
+`,
+		"module with ca_file and mozilla trust_store": `
+modules:
+  browsers:
+    tls_config:
+      trust_store: mozilla
+      ca_file: /etc/ssl/internal.pem
+`,
+		"module with a verify_store without a trust_store": `
+modules:
+  stores:
+    verify_stores:
+      corp-ca:
+        ca_file: /etc/ssl/corp-ca.pem
+`,
+		"module with negative follow_redirects": `
+modules:
+  api:
+    http:
+      follow_redirects: -1
+`,
+		"module with two auth methods": `
+modules:
+  api:
+    http:
+      basic_auth:
+        username: monitoring
+        password: secret
+      bearer_token: secret
+`,
+		"module with auth and an authorization header": `
+modules:
+  api:
+    http:
+      headers:
+        authorization: Basic c2VjcmV0
+      bearer_token_file: /etc/ssl_exporter/api-token
+`,
+		"ocsp prober without cert_file": `
+modules:
+  responder:
+    prober: ocsp
+`,
+		"module with ocsp without the ocsp prober": `
+modules:
+  responder:
+    ocsp:
+      cert_file: /etc/ssl/leaf.pem
+`,
+		"module with an invalid ct_log url": `
+modules:
+  ct:
+    ct_log:
+      url: crt.sh
+`,
+		"module with a negative ct_log recheck_interval": `
+modules:
+  ct:
+    ct_log:
+      recheck_interval: -1h
+`,
+		"module with negative keep_alive": `
+modules:
+  pooled:
+    keep_alive: -1m
+`,
+		"module with negative san_max_entries": `
+modules:
+  sans:
+    san_max_entries: -1
+`,
+		"prober without command": `
+probers:
+  ldap: {}
+`,
+		"pkcs11 with key_file": `
+modules:
+  hsm:
+    tls_config:
+      cert_file: cert.pem
+      key_file: key.pem
+      pkcs11:
+        module: /usr/lib/softhsm/libsofthsm2.so
+        pin_file: pin
+`,
+		"pkcs11 without pin_file": `
+modules:
+  hsm:
+    tls_config:
+      cert_file: cert.pem
+      pkcs11:
+        module: /usr/lib/softhsm/libsofthsm2.so
+`,
+		"secret with key_file": `
+modules:
+  k8s:
+    tls_config:
+      cert_file: kubernetes://monitoring/probe-identity
+      key_file: key.pem
+`,
+		"cert without key": `
+modules:
+  client:
+    tls_config:
+      cert_file: cert.pem
+`,
+		"invalid expected serial": `
+modules:
+  renewed:
+    expected:
+      serial: 0x1f
+`,
+		"short expected fingerprint": `
+modules:
+  renewed:
+    expected:
+      fingerprint: 5e8a
+`,
+		"webhook without a scheme": `
+webhooks:
+  - url: hooks.example.com/tls
+`,
+		"negative webhook timeout": `
+webhooks:
+  - url: https://hooks.example.com/tls
+    timeout: -1s
+`,
+		"two keystore passwords": `
+modules:
+  keystores:
+    prober: truststore
+    keystore_passwords:
+      password: changeit
+      password_env: KEYSTORE_PASSWORD
+`,
+		"keystore passwords of another prober": `
+modules:
+  https:
+    keystore_passwords:
+      password: changeit
+`,
+		"java_cacerts_password without java": `
+modules:
+  https:
+    tls_config:
+      ca_file: ca.pem
+      java_cacerts_password:
+        password: changeit
+`,
+		"spiffe of another prober": `
+modules:
+  https:
+    spiffe:
+      trust_bundle: bundle.pem
+`,
+		"spiffe trust_domain without a bundle": `
+modules:
+  spiffe:
+    prober: spiffe
+    spiffe:
+      trust_domain: example.org
+`,
+		"spiffe trust_domain with a scheme": `
+modules:
+  spiffe:
+    prober: spiffe
+    spiffe:
+      trust_bundle: bundle.pem
+      trust_domain: spiffe://example.org
+`,
+		"ocsp_check for the ssh prober": `
+modules:
+  ssh:
+    prober: ssh
+    ocsp_check: {}
+`,
+		"ocsp_check with a negative recheck_interval": `
+modules:
+  https:
+    ocsp_check:
+      recheck_interval: -1m
+`,
+		"crl_check for the file prober": `
+modules:
+  file:
+    prober: file
+    crl_check: {}
+`,
+		"crl_check with a negative recheck_interval": `
+modules:
+  https:
+    crl_check:
+      recheck_interval: -1m
+`,
+		"http path without a slash": `
+modules:
+  https:
+    http:
+      path: healthz
+`,
+		"http path with a host": `
+modules:
+  https:
+    http:
+      path: //example.com/healthz
+`,
+		"target_files without files": `
+target_files:
+  refresh_interval: 1m
+`,
+		"target_files with an invalid pattern": `
+target_files:
+  files: ["targets/[.yml"]
+`,
+		"kubernetes of another prober": `
+modules:
+  https:
+    kubernetes:
+      kubeconfig: kubeconfig.yaml
+`,
+		"kubernetes context without a kubeconfig": `
+modules:
+  secrets:
+    prober: kubernetes
+    kubernetes:
+      context: production
+`,
+		"grpc for the file prober": `
+modules:
+  files:
+    prober: file
+    grpc:
+      health_check: true
+`,
+		"grpc authority with a scheme": `
+modules:
+  grpc:
+    prober: grpc
+    grpc:
+      authority: https://api.example.com
+`,
+		"grpc service without health_check": `
+modules:
+  grpc:
+    prober: grpc
+    grpc:
+      service: payments
+`,
+		"kafka for the ssh prober": `
+modules:
+  ssh:
+    prober: ssh
+    kafka:
+      discover_brokers: true
+`,
+		"unknown sasl mechanism": `
+modules:
+  kafka:
+    prober: kafka
+    kafka:
+      sasl:
+        mechanism: GSSAPI
+        username: kafka
+`,
+		"sasl without a username": `
+modules:
+  kafka:
+    prober: kafka
+    kafka:
+      sasl:
+        mechanism: PLAIN
+        password: secret
+`,
+		"sasl password and password_file": `
+modules:
+  kafka:
+    prober: kafka
+    kafka:
+      sasl:
+        mechanism: SCRAM-SHA-512
+        username: monitoring
+        password: secret
+        password_file: /etc/ssl_exporter/kafka-password
+`,
+		"module with ports for the kubernetes prober": `
+modules:
+  secrets:
+    prober: kubernetes
+    ports: [443]
+`,
+	} {
+		if _, err := parseConfig([]byte(conf)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// Test that the Pushgateway job has a default
+func TestParseConfigPushgatewayDefaults(t *testing.T) {
+	c, err := parseConfig([]byte(`
+pushgateway:
+  url: http://localhost:9091
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Pushgateway.Job != "ssl_exporter" {
+		t.Errorf("expected job ssl_exporter, got %s", c.Pushgateway.Job)
+	}
+}
+
+// Test that remote_write endpoints get a default timeout
+func TestParseConfigRemoteWriteDefaults(t *testing.T) {
+	c, err := parseConfig([]byte(`
+remote_write:
+  - url: http://localhost:9009/api/v1/push
+  - url: http://localhost:9010/api/v1/push
+    remote_timeout: 5s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RemoteWrite[0].RemoteTimeout != defaultRemoteTimeout {
+		t.Errorf("expected timeout %s, got %s", defaultRemoteTimeout, c.RemoteWrite[0].RemoteTimeout)
+	}
+	if c.RemoteWrite[1].RemoteTimeout != 5*time.Second {
+		t.Errorf("expected timeout 5s, got %s", c.RemoteWrite[1].RemoteTimeout)
+	}
+}
+
+// Test that the expected serial and fingerprint are parsed in either of the
+// formats
+func TestModuleExpectation(t *testing.T) {
+	c, err := parseConfig([]byte(`
+modules:
+  decimal:
+    expected:
+      min_not_after: 2024-08-01T00:00:00Z
+      serial: "255"
+      fingerprint: 1f2e3d4c5b6a79880f1e2d3c4b5a69781f2e3d4c5b6a79880f1e2d3c4b5a6978
+  hex:
+    expected:
+      serial: "00:FF"
+      fingerprint: 1F:2E:3D:4C:5B:6A:79:88:0F:1E:2D:3C:4B:5A:69:78:1F:2E:3D:4C:5B:6A:79:88:0F:1E:2D:3C:4B:5A:69:78
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fingerprint []byte
+	for _, name := range []string{"decimal", "hex"} {
+		e, err := c.Modules[name].expectation()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if e.Serial.Int64() != 255 || len(e.Fingerprint) != 32 || e.Cert != nil {
+			t.Errorf("%s: unexpected expectation %+v", name, e)
+		}
+		if fingerprint != nil && !bytes.Equal(e.Fingerprint, fingerprint) {
+			t.Errorf("%s: expected the same fingerprint in hex with colons", name)
+		}
+		fingerprint = e.Fingerprint
+	}
+	if e, _ := c.Modules["decimal"].expectation(); !e.MinNotAfter.Equal(time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected min_not_after 2024-08-01, got %s", e.MinNotAfter)
+	}
+}
+
+// Test that webhooks get a default timeout
+func TestParseConfigWebhookDefaults(t *testing.T) {
+	c, err := parseConfig([]byte(`
+webhooks:
+  - url: https://hooks.example.com/tls
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Webhooks[0].Timeout != defaultWebhookTimeout {
+		t.Errorf("expected timeout %s, got %s", defaultWebhookTimeout, c.Webhooks[0].Timeout)
+	}
+}
+
+// Test that the credentials of the https prober are read from their files
+// for each probe
+func TestModuleHTTPRequestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := Module{HTTP: HTTPProbe{BasicAuth: &BasicAuth{Username: "monitoring", PasswordFile: passwordFile}}}
+	for _, password := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(passwordFile, []byte(password+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		req, err := m.httpRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &http.Request{Header: req.Header}
+		if u, p, ok := r.BasicAuth(); !ok || u != "monitoring" || p != password {
+			t.Errorf("expected monitoring:%s, got %s:%s", password, u, p)
+		}
+	}
+
+	m = Module{HTTP: HTTPProbe{BearerTokenFile: tokenFile}}
+	req, err := m.httpRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := req.Header.Get("Authorization"); a != "Bearer token" {
+		t.Errorf("expected Bearer token, got %s", a)
+	}
+
+	m = Module{HTTP: HTTPProbe{BearerTokenFile: filepath.Join(dir, "missing")}}
+	if _, err := m.httpRequest(); err == nil {
+		t.Errorf("expected an error for a missing token file")
+	}
+}
+
+// Test that the SASL password of kafka targets is read from its file for
+// every probe
+func TestModuleKafkaRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+
+	m := Module{Kafka: KafkaProbe{
+		SASL:            &SASLConfig{Mechanism: "SCRAM-SHA-256", Username: "monitoring", PasswordFile: passwordFile},
+		DiscoverBrokers: true,
+	}}
+	for _, password := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(passwordFile, []byte(password+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		req, err := m.kafkaRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !req.DiscoverBrokers || req.SASL == nil || req.SASL.Mechanism != "SCRAM-SHA-256" || req.SASL.Username != "monitoring" || req.SASL.Password != password {
+			t.Errorf("expected monitoring:%s with SCRAM-SHA-256, got %+v", password, req.SASL)
+		}
+	}
+
+	os.Remove(passwordFile)
+	if _, err := m.kafkaRequest(); err == nil {
+		t.Errorf("expected an error for a missing password file")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// defaultCRLRecheck is how long a CRL without a nextUpdate is cached for, by
+// default
+const defaultCRLRecheck = time.Hour
+
+// crlCache downloads the CRLs of the distribution points of leaves. Like
+// the OCSP responses, a CRL is cached until shortly before its nextUpdate,
+// by its URL, so that the targets that share a CA share its CRL, and it's
+// still used until its nextUpdate when the distribution point fails. It's
+// refreshed with a conditional request, so that a CRL of tens of megabytes
+// that hasn't changed isn't downloaded again, and the lookups that need the
+// same CRL while it's downloaded wait for that download.
+type crlCache struct {
+	recheck time.Duration
+
+	mtx       sync.Mutex
+	cache     map[string]crlEntry
+	downloads map[string]*crlDownload
+}
+
+type crlEntry struct {
+	// list is the DER of the CRL and parsed is the CRL that it holds, which
+	// is checked against the time of each lookup
+	list   []byte
+	parsed *x509.RevocationList
+	// issuer is the DER of the certificate that the signature of the CRL was
+	// last verified with, and signatureErr is the outcome, so that it's only
+	// verified again for another issuer
+	issuer       []byte
+	signatureErr error
+	refresh      time.Time
+	expires      time.Time
+	// lastModified and etag are the validators of the CRL, for the
+	// conditional requests
+	lastModified string
+	etag         string
+}
+
+// crlDownload is a download of a CRL that's in progress
+type crlDownload struct {
+	// done is closed once result and err are set
+	done   chan struct{}
+	result *prober.CRLResult
+	err    error
+}
+
+func newCRLCache(c CRLCheckConfig) *crlCache {
+	l := &crlCache{
+		recheck:   c.RecheckInterval,
+		cache:     map[string]crlEntry{},
+		downloads: map[string]*crlDownload{},
+	}
+	if l.recheck == 0 {
+		l.recheck = defaultCRLRecheck
+	}
+	return l
+}
+
+// crlURLs returns the http and https distribution points of the
+// certificate, which are the ones that can be downloaded
+func crlURLs(cert *x509.Certificate) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, u := range cert.CRLDistributionPoints {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || seen[u] {
+			continue
+		}
+		seen[u] = true
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// lookup returns the CRL of the distribution point, from the cache or
+// downloaded from it
+func (l *crlCache) lookup(ctx context.Context, u string, issuer *x509.Certificate, opts prober.Options) (*prober.CRLResult, error) {
+	now := time.Now()
+
+	l.mtx.Lock()
+	e, ok := l.cache[u]
+	if ok && now.Before(e.refresh) {
+		l.mtx.Unlock()
+		return l.result(u, e, issuer, now), nil
+	}
+	d, downloading := l.downloads[u]
+	if !downloading {
+		d = &crlDownload{done: make(chan struct{})}
+		l.downloads[u] = d
+	}
+	l.mtx.Unlock()
+
+	if downloading {
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The download ended with the context of the lookup that made it,
+		// which doesn't mean that this one has to fail too
+		if d.err != nil && (errors.Is(d.err, context.Canceled) || errors.Is(d.err, context.DeadlineExceeded)) {
+			return l.lookup(ctx, u, issuer, opts)
+		}
+	} else {
+		d.result, d.err = l.download(ctx, u, opts)
+		l.mtx.Lock()
+		delete(l.downloads, u)
+		close(d.done)
+		l.mtx.Unlock()
+	}
+
+	l.mtx.Lock()
+	e, ok = l.cache[u]
+	l.mtx.Unlock()
+	if d.err != nil {
+		if ok && now.Before(e.expires) {
+			if opts.Logger != nil {
+				opts.Logger.Errorln("Error downloading the CRL from " + u + ", using the cached CRL: " + d.err.Error())
+			}
+			return l.result(u, e, issuer, now), nil
+		}
+		return d.result, d.err
+	}
+
+	result := l.result(u, e, issuer, now)
+	result.Duration, result.NotModified = d.result.Duration, d.result.NotModified
+	return result, nil
+}
+
+// download downloads the CRL from the distribution point, or finds out that
+// the cached one hasn't changed, and caches it
+func (l *crlCache) download(ctx context.Context, u string, opts prober.Options) (*prober.CRLResult, error) {
+	l.mtx.Lock()
+	e, ok := l.cache[u]
+	l.mtx.Unlock()
+
+	var cached *prober.CRLResult
+	if ok {
+		cached = &prober.CRLResult{LastModified: e.lastModified, ETag: e.etag}
+	}
+	// The signature is verified by the lookups, against their issuers
+	result, err := prober.ProbeCRL(ctx, u, nil, cached, opts)
+	if err == nil && (result == nil || (result.List == nil && !result.NotModified)) {
+		err = errors.New("no CRL from " + u)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now()
+	if !result.NotModified {
+		e = crlEntry{
+			list:         result.Raw,
+			parsed:       result.List,
+			lastModified: result.LastModified,
+			etag:         result.ETag,
+		}
+	}
+	e.refresh, e.expires = now.Add(l.recheck), now.Add(l.recheck)
+	if list := e.parsed; !list.NextUpdate.IsZero() && list.NextUpdate.After(now) {
+		e.expires = list.NextUpdate
+		e.refresh = list.NextUpdate.Add(-time.Duration(rand.Float64() * ocspJitter * float64(list.NextUpdate.Sub(list.ThisUpdate))))
+		if e.refresh.Before(now) {
+			e.refresh = now
+		}
+	}
+	// A CRL that hasn't changed close to its nextUpdate is asked for again
+	// after the recheck interval, rather than on every lookup
+	if result.NotModified && !e.refresh.After(now) {
+		e.refresh = now.Add(l.recheck)
+		if e.refresh.After(e.expires) {
+			e.refresh = e.expires
+		}
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for u, e := range l.cache {
+		if !now.Before(e.expires) {
+			delete(l.cache, u)
+		}
+	}
+	l.cache[u] = e
+
+	return result, nil
+}
+
+// result returns the cached CRL of the distribution point, checked against
+// the issuer and the time. The signature is only verified again when the
+// issuer isn't the one that it was last verified with.
+func (l *crlCache) result(u string, e crlEntry, issuer *x509.Certificate, now time.Time) *prober.CRLResult {
+	result := &prober.CRLResult{
+		URL:          u,
+		List:         e.parsed,
+		Raw:          e.list,
+		LastModified: e.lastModified,
+		ETag:         e.etag,
+	}
+
+	if issuer != nil {
+		if e.issuer == nil || !bytes.Equal(e.issuer, issuer.Raw) {
+			signatureErr := e.parsed.CheckSignatureFrom(issuer)
+			l.mtx.Lock()
+			if c, ok := l.cache[u]; ok && c.parsed == e.parsed {
+				c.issuer, c.signatureErr = issuer.Raw, signatureErr
+				l.cache[u] = c
+			}
+			l.mtx.Unlock()
+			e.signatureErr = signatureErr
+		}
+		result.ListErr = e.signatureErr
+	}
+	if result.ListErr == nil {
+		result.ListErr = prober.CheckCRLTimes(e.parsed, now)
+	}
+
+	return result
+}
+
+// snapshot returns a copy of the cached CRLs
+func (l *crlCache) snapshot() map[string]crlEntry {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	cache := make(map[string]crlEntry, len(l.cache))
+	for u, e := range l.cache {
+		cache[u] = e
+	}
+	return cache
+}
+
+// restore replaces the cached CRLs, like with those of a snapshot from
+// before a restart
+func (l *crlCache) restore(cache map[string]crlEntry) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.cache = cache
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// newCRLTestChain returns a chain whose leaf has the distribution point
+func newCRLTestChain(t *testing.T, distributionPoint string) *ocspTestChain {
+	c := newOCSPTestChain(t, "")
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		CRLDistributionPoints: []string{distributionPoint, "ldap://ldap.example.com/cn=ca"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, c.leafKey.Public(), c.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// crl returns a CRL of the CA with the serial numbers
+func (c *ocspTestChain) crl(t *testing.T, nextUpdate time.Duration, serials ...int64) []byte {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute).Truncate(time.Second),
+		NextUpdate: time.Now().Add(nextUpdate).Truncate(time.Second),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Hour),
+		})
+	}
+	b, err := x509.CreateRevocationList(rand.Reader, template, c.ca, c.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test that CRLs are cached by their URL until shortly before their
+// nextUpdate, and that a cached CRL is still used when the distribution
+// point fails
+func TestCRLCacheLookup(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+		fail     bool
+		crl      []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(crl)
+	}))
+	defer server.Close()
+
+	chain := newCRLTestChain(t, server.URL)
+	crl = chain.crl(t, time.Hour, 1, 2)
+	cache := newCRLCache(CRLCheckConfig{})
+
+	if urls := crlURLs(chain.leaf); len(urls) != 1 || urls[0] != server.URL {
+		t.Fatalf("expected only the http distribution point, got %v", urls)
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := cache.lookup(context.Background(), server.URL, chain.ca, prober.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ListErr != nil || result.Revoked(chain.leaf) == nil {
+			t.Errorf("expected a valid CRL with the leaf in it, got %+v", result)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the CRL to be cached, got %d requests", requests)
+	}
+
+	// Past the refresh, a distribution point that fails falls back on the
+	// cached CRL until its nextUpdate
+	mtx.Lock()
+	fail = true
+	mtx.Unlock()
+	cache.mtx.Lock()
+	e := cache.cache[server.URL]
+	e.refresh = time.Now().Add(-time.Second)
+	cache.cache[server.URL] = e
+	cache.mtx.Unlock()
+	result, err := cache.lookup(context.Background(), server.URL, chain.ca, prober.Options{Logger: newProbeLogger("", false)})
+	if err != nil || result.List == nil || result.URL != server.URL {
+		t.Errorf("expected the cached CRL while the distribution point fails, got %+v, %v", result, err)
+	}
+	if requests != 2 {
+		t.Errorf("expected the distribution point to be asked again after the refresh, got %d requests", requests)
+	}
+
+	cache.mtx.Lock()
+	e.expires = time.Now().Add(-time.Second)
+	cache.cache[server.URL] = e
+	cache.mtx.Unlock()
+	if _, err := cache.lookup(context.Background(), server.URL, chain.ca, prober.Options{}); err == nil {
+		t.Errorf("expected an error once the cached CRL has expired")
+	}
+}
+
+// Test that a cached CRL is refreshed with a conditional request, and kept
+// when the distribution point says that it hasn't changed
+func TestCRLCacheConditionalRefresh(t *testing.T) {
+	var (
+		mtx       sync.Mutex
+		requests  int
+		downloads int
+		crl       []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(crl)
+	}))
+	defer server.Close()
+
+	chain := newCRLTestChain(t, server.URL)
+	crl = chain.crl(t, time.Hour, 2)
+	cache := newCRLCache(CRLCheckConfig{})
+
+	if _, err := cache.lookup(context.Background(), server.URL, chain.ca, prober.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.mtx.Lock()
+	e := cache.cache[server.URL]
+	e.refresh = time.Now().Add(-time.Second)
+	cache.cache[server.URL] = e
+	cache.mtx.Unlock()
+	result, err := cache.lookup(context.Background(), server.URL, chain.ca, prober.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.NotModified || result.ListErr != nil || result.Revoked(chain.leaf) == nil {
+		t.Errorf("expected the cached CRL with the leaf in it, got %+v", result)
+	}
+	if requests != 2 || downloads != 1 {
+		t.Errorf("expected a conditional request without a download, got %d requests and %d downloads", requests, downloads)
+	}
+
+	cache.mtx.Lock()
+	refresh := cache.cache[server.URL].refresh
+	cache.mtx.Unlock()
+	if !refresh.After(time.Now()) {
+		t.Errorf("expected the refresh to be pushed back, got %s", refresh)
+	}
+}
+
+// Test that the lookups of a CRL that's being downloaded wait for that
+// download, and that the parsed CRL is shared by the lookups
+func TestCRLCacheConcurrentLookups(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	var crl []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write(crl)
+	}))
+	defer server.Close()
+
+	chain := newCRLTestChain(t, server.URL)
+	crl = chain.crl(t, time.Hour, 2)
+	cache := newCRLCache(CRLCheckConfig{})
+
+	results := make([]*prober.CRLResult, 5)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := cache.lookup(context.Background(), server.URL, chain.ca, prober.Options{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = result
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected one download for the concurrent lookups, got %d", n)
+	}
+	for _, result := range results {
+		if result == nil || result.ListErr != nil || result.Revoked(chain.leaf) == nil {
+			t.Fatalf("expected a valid CRL with the leaf in it, got %+v", result)
+		}
+	}
+
+	result, err := cache.lookup(context.Background(), server.URL, chain.ca, prober.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.List != results[0].List {
+		t.Errorf("expected the cached CRL to not be parsed again")
+	}
+	if result, err := cache.lookup(context.Background(), server.URL, chain.leaf, prober.Options{}); err != nil || result.ListErr == nil {
+		t.Errorf("expected the signature to be checked against another issuer, got %v", err)
+	}
+}
+
+// Test that a module with crl_check reports the CRLs of the leaf
+func TestProbeHandlerCRLCheck(t *testing.T) {
+	var chain *ocspTestChain
+	distributionPoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(chain.crl(t, 24*time.Hour, 2, 3, 4))
+	}))
+	defer distributionPoint.Close()
+	chain = newCRLTestChain(t, distributionPoint.URL)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{chain.tlsCertificate()}}
+	server.StartTLS()
+	defer server.Close()
+
+	c, err := parseConfig([]byte(`
+modules:
+  check:
+    tls_config:
+      insecure_skip_verify: true
+    crl_check: {}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/probe?module=check&target="+server.URL, nil)
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, modules)
+
+	for _, want := range []string{
+		`ssl_crl_up{url="` + distributionPoint.URL + `"} 1`,
+		`ssl_crl_valid{url="` + distributionPoint.URL + `"} 1`,
+		`ssl_crl_entries{url="` + distributionPoint.URL + `"} 3`,
+		`ssl_crl_cert_revoked{url="` + distributionPoint.URL + `"} 1`,
+		`ssl_crl_next_update{url="` + distributionPoint.URL + `"} `,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected `%s`", want)
+		}
+	}
+	if strings.Contains(rr.Body.String(), "ldap://") {
+		t.Errorf("expected the ldap distribution point to be left out")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCTLogURL = "https://crt.sh"
+
+	// defaultCTLogRecheck is how long a certificate that wasn't found in
+	// the logs is cached for, by default. Logging can take a while after
+	// issuance, but crt.sh doesn't take kindly to being asked every scrape.
+	defaultCTLogRecheck = time.Hour
+
+	// maxCTLogResponse is the most that's read of a response from the API
+	maxCTLogResponse = 10 << 20
+)
+
+// ctLogTimeFormats are the formats of entry_timestamp: crt.sh leaves out the
+// time zone, which is UTC
+var ctLogTimeFormats = []string{"2006-01-02T15:04:05.999999999", time.RFC3339Nano}
+
+// ctLog looks up certificates in the Certificate Transparency logs through
+// a crt.sh compatible API. Certificates that were found are cached until
+// they expire, as they stay logged, and those that weren't for the recheck
+// interval.
+type ctLog struct {
+	url     string
+	recheck time.Duration
+	client  *http.Client
+
+	mtx   sync.Mutex
+	cache map[[sha256.Size]byte]ctLogEntry
+}
+
+type ctLogEntry struct {
+	loggedAt time.Time
+	expires  time.Time
+}
+
+func newCTLog(c CTLogConfig) *ctLog {
+	l := &ctLog{
+		url:     c.URL,
+		recheck: c.RecheckInterval,
+		client:  &http.Client{},
+		cache:   map[[sha256.Size]byte]ctLogEntry{},
+	}
+	if l.url == "" {
+		l.url = defaultCTLogURL
+	}
+	if l.recheck == 0 {
+		l.recheck = defaultCTLogRecheck
+	}
+	return l
+}
+
+// lookup returns when the certificate was first logged, or the zero time if
+// it wasn't found
+func (l *ctLog) lookup(ctx context.Context, cert *x509.Certificate) (time.Time, error) {
+	fingerprint := sha256.Sum256(cert.Raw)
+	now := time.Now()
+
+	l.mtx.Lock()
+	e, ok := l.cache[fingerprint]
+	l.mtx.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.loggedAt, nil
+	}
+
+	loggedAt, err := l.query(ctx, hex.EncodeToString(fingerprint[:]))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	e = ctLogEntry{loggedAt: loggedAt, expires: now.Add(l.recheck)}
+	if !loggedAt.IsZero() {
+		e.expires = cert.NotAfter
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for f, e := range l.cache {
+		if !now.Before(e.expires) {
+			delete(l.cache, f)
+		}
+	}
+	l.cache[fingerprint] = e
+
+	return loggedAt, nil
+}
+
+// query asks the API for the entries of the certificate with the SHA-256
+// fingerprint and returns the earliest timestamp among them
+func (l *ctLog) query(ctx context.Context, fingerprint string) (time.Time, error) {
+	u, err := url.Parse(l.url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	u.RawQuery = url.Values{"sha256": {fingerprint}, "output": {"json"}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("unexpected status code %d looking up %s in the CT logs", resp.StatusCode, fingerprint)
+	}
+
+	var entries []struct {
+		EntryTimestamp string `json:"entry_timestamp"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxCTLogResponse)).Decode(&entries); err != nil {
+		return time.Time{}, errors.New("failed to parse the CT log entries for " + fingerprint + ": " + err.Error())
+	}
+
+	var earliest time.Time
+	for _, entry := range entries {
+		if entry.EntryTimestamp == "" {
+			continue
+		}
+		ts, err := parseCTLogTime(entry.EntryTimestamp)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if earliest.IsZero() || ts.Before(earliest) {
+			earliest = ts
+		}
+	}
+
+	return earliest, nil
+}
+
+func parseCTLogTime(s string) (time.Time, error) {
+	for _, format := range ctLogTimeFormats {
+		if ts, err := time.Parse(format, s); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid entry_timestamp %q", s)
+}
+
+// snapshot returns a copy of the cached lookups
+func (l *ctLog) snapshot() map[[sha256.Size]byte]ctLogEntry {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	cache := make(map[[sha256.Size]byte]ctLogEntry, len(l.cache))
+	for fingerprint, e := range l.cache {
+		cache[fingerprint] = e
+	}
+	return cache
+}
+
+// restore replaces the cached lookups, like with those of a snapshot from
+// before a restart
+func (l *ctLog) restore(cache map[[sha256.Size]byte]ctLogEntry) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.cache = cache
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that the leaf of a target is looked up by its fingerprint, and that
+// the earliest entry is reported
+func TestProbeHandlerCTLog(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	block, _ := pem.Decode([]byte(serverCert))
+	fingerprint := sha256.Sum256(block.Bytes)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("output") != "json" || r.URL.Query().Get("sha256") != hex.EncodeToString(fingerprint[:]) {
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Write([]byte(`[{"id":2,"entry_timestamp":"2023-05-02T10:00:00.5"},{"id":1,"entry_timestamp":"2023-05-01T09:30:00.123"}]`))
+	}))
+	defer api.Close()
+
+	modules := testModules(&tls.Config{RootCAs: certPool()})
+	modules[defaultModule].ct = newCTLog(CTLogConfig{URL: api.URL})
+
+	req, _ := http.NewRequest("GET", "/probe?target="+server.URL, nil)
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, modules)
+
+	loggedAt := time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC).Unix()
+	for name, value := range map[string]string{
+		"ssl_cert_ct_logged":        "1",
+		"ssl_cert_ct_log_timestamp": strconv.FormatFloat(float64(loggedAt), 'g', -1, 64),
+	} {
+		found := false
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if strings.HasPrefix(line, name+"{") && strings.HasSuffix(line, "} "+value) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s %s", name, value)
+		}
+	}
+}
+
+// Test that certificates that were found are cached until they expire and
+// the others for the recheck interval
+func TestCTLogCache(t *testing.T) {
+	var queries int32
+	logged := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		if !logged {
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Write([]byte(`[{"entry_timestamp":"2023-05-01T09:30:00"}]`))
+	}))
+	defer api.Close()
+
+	cert := &x509.Certificate{Raw: []byte("leaf"), NotAfter: time.Now().Add(time.Hour)}
+	l := newCTLog(CTLogConfig{URL: api.URL, RecheckInterval: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		loggedAt, err := l.lookup(context.Background(), cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loggedAt.IsZero() {
+			t.Errorf("expected the certificate not to be logged, got %s", loggedAt)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("expected 1 query, got %d", n)
+	}
+
+	// Once the recheck interval is up, it's looked up again
+	logged = true
+	for f, e := range l.cache {
+		e.expires = time.Now()
+		l.cache[f] = e
+	}
+	for i := 0; i < 2; i++ {
+		loggedAt, err := l.lookup(context.Background(), cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loggedAt.Equal(time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC)) {
+			t.Errorf("unexpected logged time %s", loggedAt)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("expected 2 queries, got %d", n)
+	}
+}
+
+// Test that failed lookups are errors, rather than not logged
+func TestCTLogLookupError(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		"html": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html>"))
+		},
+		"timestamp": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[{"entry_timestamp":"yesterday"}]`))
+		},
+	} {
+		api := httptest.NewServer(handler)
+		l := newCTLog(CTLogConfig{URL: api.URL})
+		if _, err := l.lookup(context.Background(), &x509.Certificate{Raw: []byte("leaf")}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		api.Close()
+	}
+}
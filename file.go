@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/metrics"
+)
+
+// fileProber is the prober whose targets are glob patterns of PEM files on
+// the exporter's host, like /etc/kubernetes/pki/*.crt, whose certificates are
+// read rather than probed
+const fileProber = "file"
+
+// maxPEMBlockSize is the largest PEM block that's read from a file. Lines
+// outside of the blocks aren't kept, so the memory that a file takes is
+// bounded by this rather than by its size.
+const maxPEMBlockSize = 1 << 20
+
+// probeFiles reads the certificates in each of the files that the pattern in
+// the target matches, with the module's workers, within the timeout, in a
+// span of its own. Directories are skipped.
+func (e *Exporter) probeFiles() ([]metrics.FileResult, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	ctx, span := probeTracer.Start(ctx, "probe", spanKindInternal)
+	span.SetAttribute("target", e.target)
+	span.SetAttribute("probe_id", e.probeID)
+	span.SetAttribute("protocol", fileProber)
+	defer span.End()
+
+	if !filepath.IsAbs(e.target) {
+		err := errors.New("the target of the file prober must be an absolute path, or a pattern of them, not " + e.target)
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return nil, err
+	}
+	files, err := filepath.Glob(e.target)
+	if err != nil {
+		err = fmt.Errorf("invalid pattern %s: %s", e.target, err)
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return nil, err
+	}
+	e.logger.Debugln(fmt.Sprintf("The pattern %s matched %d files", e.target, len(files)))
+
+	results := make([]metrics.FileResult, len(files))
+	skip := make([]bool, len(files))
+	forEachItem(ctx, len(files), e.workers, e.itemTimeout, func(ctx context.Context, i int) {
+		if info, err := os.Stat(files[i]); err == nil && info.IsDir() {
+			skip[i] = true
+			return
+		}
+		certs, err := readCertFile(ctx, files[i], e.metricsOptions.LeafOnly)
+		if err != nil {
+			e.logger.Errorln(err)
+		}
+		results[i] = metrics.FileResult{File: files[i], Certs: certs, Err: err}
+	})
+
+	var read []metrics.FileResult
+	for i, r := range results {
+		if !skip[i] {
+			read = append(read, r)
+		}
+	}
+
+	return read, nil
+}
+
+// readCertFile returns the certificates in the PEM blocks of the file, or
+// only the first of them with leafOnly. The file is read a line at a time, so
+// that large bundles aren't read into memory whole, and the reading stops
+// once the context is done.
+func readCertFile(ctx context.Context, file string, leafOnly bool) ([]*x509.Certificate, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var certs []*x509.Certificate
+	var block []byte
+	inBlock, continued := false, false
+	r := bufio.NewReader(f)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+
+		line, isPrefix, err := r.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		// The rest of a line that was too long for the buffer isn't the
+		// start of a block
+		start := !continued
+		continued = isPrefix
+
+		if !inBlock {
+			if start && bytes.HasPrefix(line, []byte("-----BEGIN ")) {
+				inBlock, block = true, append(block[:0], line...)
+				if !isPrefix {
+					block = append(block, '\n')
+				}
+			}
+			continue
+		}
+
+		block = append(block, line...)
+		if !isPrefix {
+			block = append(block, '\n')
+		}
+		if len(block) > maxPEMBlockSize {
+			return nil, fmt.Errorf("%s: a PEM block is larger than %d bytes", file, maxPEMBlockSize)
+		}
+		if isPrefix || !start || !bytes.HasPrefix(line, []byte("-----END ")) {
+			continue
+		}
+
+		inBlock = false
+		p, _ := pem.Decode(block)
+		if p == nil || p.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(p.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		certs = append(certs, cert)
+		if leafOnly {
+			break
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found in " + file)
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// keyLogWriter, if set, receives the TLS secrets of every probe, in the
+// NSS key log format that Wireshark reads. It's set by --tls.key-log-file.
+var keyLogWriter io.Writer
+
+// openKeyLog opens the key log file for appending, creating it if it doesn't
+// exist. Only the owner can read it, as anyone who can could decrypt the
+// probes.
+func openKeyLog(path string) (io.Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedWriter{w: f}, nil
+}
+
+// lockedWriter keeps the lines written by concurrent probes from being
+// interleaved
+type lockedWriter struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.w.Write(b)
+}
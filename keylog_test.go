@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that the secrets of the probes are written to the key log
+func TestKeyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte(caCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keyLog := filepath.Join(dir, "keys.log")
+	w, err := openKeyLog(keyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyLogWriter = w
+	defer func() { keyLogWriter = nil }()
+
+	loader, err := newTLSConfigLoader("test", TLSConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rr := probeWithLoader(server.URL, loader)
+	if !strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1") {
+		t.Fatalf("expected `ssl_tls_connect_success 1`")
+	}
+
+	b, err := ioutil.ReadFile(keyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("CLIENT_")) {
+		t.Errorf("expected the key log to contain the secrets, got %q", b)
+	}
+
+	info, err := os.Stat(keyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key log to only be readable by its owner, got %s", info.Mode())
+	}
+}
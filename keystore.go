@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// errKeystorePassword is returned for a store that can't be read with the
+// password it was given
+var errKeystorePassword = errors.New("the keystore password is incorrect")
+
+// verifyJKS checks the digest at the end of a JKS, which keytool derives
+// from the password of the store
+func verifyJKS(b []byte, password string) error {
+	if len(b) < sha1.Size {
+		return errTruncatedJKS
+	}
+	data, digest := b[:len(b)-sha1.Size], b[len(b)-sha1.Size:]
+
+	h := sha1.New()
+	for _, c := range utf16.Encode([]rune(password)) {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(data)
+
+	if !hmac.Equal(h.Sum(nil), digest) {
+		return errKeystorePassword
+	}
+	return nil
+}
+
+var (
+	oidEncryptedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type pkcs12MacData struct {
+	Mac struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}
+	Salt       []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pkcs12EncryptedData struct {
+	Version              int
+	EncryptedContentInfo struct {
+		ContentType                asn1.ObjectIdentifier
+		ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+		EncryptedContent           []byte `asn1:"tag:0,optional"`
+	}
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// verifyPKCS12MAC checks the MAC of the authenticated safe of a PKCS#12
+// store, which is keyed with its password. MACs of other kinds than those
+// with the key derivation of PKCS#12 aren't checked, which leaves it to the
+// decryption to notice a wrong password.
+func verifyPKCS12MAC(macData asn1.RawValue, authSafe []byte, password string) error {
+	var md pkcs12MacData
+	if _, err := asn1.Unmarshal(macData.FullBytes, &md); err != nil {
+		return err
+	}
+
+	h := digestHash(md.Mac.Algorithm.Algorithm)
+	if h == nil {
+		return nil
+	}
+	key := pkcs12KDF(h, bmpString(password), md.Salt, 3, md.Iterations, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(authSafe)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		return errKeystorePassword
+	}
+	return nil
+}
+
+func digestHash(oid asn1.ObjectIdentifier) func() hash.Hash {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New
+	case oid.Equal(oidSHA256):
+		return sha256.New
+	case oid.Equal(oidSHA384):
+		return sha512.New384
+	case oid.Equal(oidSHA512):
+		return sha512.New
+	}
+	return nil
+}
+
+// decryptPKCS12Data returns the content of an encrypted ContentInfo of a
+// PKCS#12 store, with the schemes of PKCS#12 that Java and OpenSSL used to
+// default to or the PBES2 that they default to now
+func decryptPKCS12Data(ci pkcs12ContentInfo, password string) ([]byte, error) {
+	var ed pkcs12EncryptedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, err
+	}
+	alg := ed.EncryptedContentInfo.ContentEncryptionAlgorithm
+
+	var (
+		block cipher.Block
+		iv    []byte
+		err   error
+	)
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC), alg.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC), alg.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		var params pkcs12PBEParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		p := bmpString(password)
+		switch {
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+			block, err = des.NewTripleDESCipher(pkcs12KDF(sha1.New, p, params.Salt, 1, params.Iterations, 24))
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2CBC):
+			block = newRC2(pkcs12KDF(sha1.New, p, params.Salt, 1, params.Iterations, 16), 128)
+		default:
+			block = newRC2(pkcs12KDF(sha1.New, p, params.Salt, 1, params.Iterations, 5), 40)
+		}
+		iv = pkcs12KDF(sha1.New, p, params.Salt, 2, params.Iterations, 8)
+	case alg.Algorithm.Equal(oidPBES2):
+		block, iv, err = pbes2Cipher(alg.Parameters.FullBytes, password)
+	default:
+		return nil, errors.New("unsupported PKCS#12 encryption " + alg.Algorithm.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := ed.EncryptedContentInfo.EncryptedContent
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 || len(iv) != block.BlockSize() {
+		return nil, errors.New("invalid encrypted PKCS#12 content")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// A wrong password leaves the padding garbled, most of the time
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errKeystorePassword
+	}
+	return plain[:len(plain)-n], nil
+}
+
+// pbes2Cipher returns the cipher and the IV of PBES2, with the key derived
+// from the password with PBKDF2
+func pbes2Cipher(b []byte, password string) (cipher.Block, []byte, error) {
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(b, &params); err != nil {
+		return nil, nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, errors.New("unsupported PBES2 key derivation " + params.KeyDerivationFunc.Algorithm.String())
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, err
+	}
+
+	var prf func() hash.Hash
+	switch alg := kdf.PRF.Algorithm; {
+	case len(alg) == 0, alg.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case alg.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case alg.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case alg.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, nil, errors.New("unsupported PBKDF2 PRF " + alg.String())
+	}
+
+	var (
+		keyLen    int
+		newCipher func([]byte) (cipher.Block, error)
+	)
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case alg.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case alg.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case alg.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, errors.New("unsupported PBES2 encryption " + alg.String())
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, err
+	}
+
+	block, err := newCipher(pbkdf2.Key([]byte(password), kdf.Salt, kdf.Iterations, keyLen, prf))
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, iv, nil
+}
+
+// bmpString returns the password as PKCS#12 has it for its key derivation:
+// the UTF-16 code units, big endian and terminated with a zero
+func bmpString(s string) []byte {
+	b := &bytes.Buffer{}
+	for _, c := range utf16.Encode([]rune(s)) {
+		binary.Write(b, binary.BigEndian, c)
+	}
+	b.Write([]byte{0, 0})
+	return b.Bytes()
+}
+
+// pkcs12KDF derives a key, IV or MAC key, by the id, from the password as in
+// appendix B.2 of RFC 7292
+func pkcs12KDF(h func() hash.Hash, password, salt []byte, id byte, iterations, size int) []byte {
+	u := h().Size()
+	v := h().BlockSize()
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		filled := make([]byte, v*((len(b)+v-1)/v))
+		for i := range filled {
+			filled[i] = b[i%len(b)]
+		}
+		return filled
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	var key []byte
+	for len(key) < size {
+		a := h()
+		a.Write(d)
+		a.Write(i)
+		sum := a.Sum(nil)
+		for r := 1; r < iterations; r++ {
+			a.Reset()
+			a.Write(sum)
+			sum = a.Sum(nil)
+		}
+		key = append(key, sum...)
+
+		// Each block of I becomes I + B + 1, with B the sum repeated
+		b := make([]byte, v)
+		for j := range b {
+			b[j] = sum[j%u]
+		}
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(i[j+k]) + int(b[k])
+				i[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+
+	return key[:size]
+}
+
+// rc2 is the decryption of RC2, from RFC 2268, which stores from before
+// PBES2 encrypt their certificates with
+type rc2 [64]uint16
+
+var rc2PITable = [256]byte{
+	0xd9, 0x78, 0xf9, 0xc4, 0x19, 0xdd, 0xb5, 0xed, 0x28, 0xe9, 0xfd, 0x79, 0x4a, 0xa0, 0xd8, 0x9d,
+	0xc6, 0x7e, 0x37, 0x83, 0x2b, 0x76, 0x53, 0x8e, 0x62, 0x4c, 0x64, 0x88, 0x44, 0x8b, 0xfb, 0xa2,
+	0x17, 0x9a, 0x59, 0xf5, 0x87, 0xb3, 0x4f, 0x13, 0x61, 0x45, 0x6d, 0x8d, 0x09, 0x81, 0x7d, 0x32,
+	0xbd, 0x8f, 0x40, 0xeb, 0x86, 0xb7, 0x7b, 0x0b, 0xf0, 0x95, 0x21, 0x22, 0x5c, 0x6b, 0x4e, 0x82,
+	0x54, 0xd6, 0x65, 0x93, 0xce, 0x60, 0xb2, 0x1c, 0x73, 0x56, 0xc0, 0x14, 0xa7, 0x8c, 0xf1, 0xdc,
+	0x12, 0x75, 0xca, 0x1f, 0x3b, 0xbe, 0xe4, 0xd1, 0x42, 0x3d, 0xd4, 0x30, 0xa3, 0x3c, 0xb6, 0x26,
+	0x6f, 0xbf, 0x0e, 0xda, 0x46, 0x69, 0x07, 0x57, 0x27, 0xf2, 0x1d, 0x9b, 0xbc, 0x94, 0x43, 0x03,
+	0xf8, 0x11, 0xc7, 0xf6, 0x90, 0xef, 0x3e, 0xe7, 0x06, 0xc3, 0xd5, 0x2f, 0xc8, 0x66, 0x1e, 0xd7,
+	0x08, 0xe8, 0xea, 0xde, 0x80, 0x52, 0xee, 0xf7, 0x84, 0xaa, 0x72, 0xac, 0x35, 0x4d, 0x6a, 0x2a,
+	0x96, 0x1a, 0xd2, 0x71, 0x5a, 0x15, 0x49, 0x74, 0x4b, 0x9f, 0xd0, 0x5e, 0x04, 0x18, 0xa4, 0xec,
+	0xc2, 0xe0, 0x41, 0x6e, 0x0f, 0x51, 0xcb, 0xcc, 0x24, 0x91, 0xaf, 0x50, 0xa1, 0xf4, 0x70, 0x39,
+	0x99, 0x7c, 0x3a, 0x85, 0x23, 0xb8, 0xb4, 0x7a, 0xfc, 0x02, 0x36, 0x5b, 0x25, 0x55, 0x97, 0x31,
+	0x2d, 0x5d, 0xfa, 0x98, 0xe3, 0x8a, 0x92, 0xae, 0x05, 0xdf, 0x29, 0x10, 0x67, 0x6c, 0xba, 0xc9,
+	0xd3, 0x00, 0xe6, 0xcf, 0xe1, 0x9e, 0xa8, 0x2c, 0x63, 0x16, 0x01, 0x3f, 0x58, 0xe2, 0x89, 0xa9,
+	0x0d, 0x38, 0x34, 0x1b, 0xab, 0x33, 0xff, 0xb0, 0xbb, 0x48, 0x0c, 0x5f, 0xb9, 0xb1, 0xcd, 0x2e,
+	0xc5, 0xf3, 0xdb, 0x47, 0xe5, 0xa5, 0x9c, 0x77, 0x0a, 0xa6, 0x20, 0x68, 0xfe, 0x7f, 0xc1, 0xad,
+}
+
+// newRC2 expands the key, with the effective key length in bits
+func newRC2(key []byte, bits int) *rc2 {
+	l := make([]byte, 128)
+	copy(l, key)
+	for i := len(key); i < 128; i++ {
+		l[i] = rc2PITable[l[i-1]+l[i-len(key)]]
+	}
+	t8 := (bits + 7) / 8
+	l[128-t8] = rc2PITable[l[128-t8]&byte(0xff>>uint(8*t8-bits))]
+	for i := 127 - t8; i >= 0; i-- {
+		l[i] = rc2PITable[l[i+1]^l[i+t8]]
+	}
+
+	c := &rc2{}
+	for i := range c {
+		c[i] = uint16(l[2*i]) | uint16(l[2*i+1])<<8
+	}
+	return c
+}
+
+func (c *rc2) BlockSize() int { return 8 }
+
+func (c *rc2) Encrypt(dst, src []byte) {
+	panic("rc2: only decryption is supported")
+}
+
+func (c *rc2) Decrypt(dst, src []byte) {
+	var r [4]uint16
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint16(src[2*i:])
+	}
+	shifts := [4]uint{1, 2, 3, 5}
+
+	j := 63
+	// The rounds of the encryption in reverse: 5 of mixing, a mashing, 6
+	// of mixing, a mashing and 5 of mixing
+	for _, rounds := range []int{5, 6, 5} {
+		if j < 63 {
+			for i := 3; i >= 0; i-- {
+				r[i] -= c[r[(i+3)%4]&63]
+			}
+		}
+		for n := 0; n < rounds; n++ {
+			for i := 3; i >= 0; i-- {
+				r[i] = r[i]>>shifts[i] | r[i]<<(16-shifts[i])
+				r[i] -= c[j] + (r[(i+3)%4] & r[(i+2)%4]) + (^r[(i+3)%4] & r[(i+1)%4])
+				j--
+			}
+		}
+	}
+
+	for i := range r {
+		binary.LittleEndian.PutUint16(dst[2*i:], r[i])
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// PKCS#12 stores of the test CA with the password secret, made by OpenSSL 3
+// with its defaults, with -legacy and with -certpbe PBE-SHA1-3DES
+var testPKCS12Stores = map[string]string{
+	"pbes2": `
+MIIDdwIBAzCCAy0GCSqGSIb3DQEHAaCCAx4EggMaMIIDFjCCAxIGCSqGSIb3DQEHBqCCAwMwggL/AgEAMIIC+AYJKoZIhvcNAQcB
+MFcGCSqGSIb3DQEFDTBKMCkGCSqGSIb3DQEFDDAcBAhMVhDnXGkl/gICCAAwDAYIKoZIhvcNAgkFADAdBglghkgBZQMEASoEELIi
+OUYJxVhp9YNWtXi1mU2AggKQuS/9cSGq3e6fADpuVIau40145elAd7JgvvacpQxAUEGKvJITc7pnyUrOcYy1ovN8AZP/Zq9poA46
+iAGCxalL1IWNYbWQ1QJk5z43nBBXJWWSzcuU8oX0slYCLukp6r3zLwB+e0W6QH4yh3Ru2WauEqxaRAl7j9dgBEUMngM0rV3562Hd
+cnlkTR+mh/aAv++q+XQdAML5m3vqNDohb82jbCv7hr423HboqSRwA5S2uaicwSBRy+8N9V60ehubo+UXHOe1hajprq2wOvod/A9z
+2GhQhMOKnTVPFQGmI4ZpK/w/G5nPA5Lao0ac/cHusU0omO8EOpx7IuwW8GWlPC/m0+EAh3oIPS/9CORLgucji1KMTCmseCKo23/+
+DNu1LjuYdO7u75yb0kfiKSzVi5t6ANiyL7Cjxy8WglpphFggiPt+/3tRbdn0gOXcQXfFBGV1IBeZ9lOd+8YQVIVs4H6gJHH5hlUn
+7o4A1+nNfLvHp4kB+EaJ+YGFlNHs4LwmkEMM++1qlDbhBS5HjKShPhW764ZKsuLCdDBqPJUSzDSS1eQex7OjGcY6Ih6Cz+eEdVjK
+G7OqZ8oQgV9fSJCNaIoY+P/EUOqgjeCq5qRQS5TJRczHxAJdDFFHRE7M+wE+M6auxZjDipHghbsb4z0pyWP+k+7uglWay/+yhPKM
+pwKTbw/nPm+Ta/hV8oyouClacarz8RAyvSwegKWntXe6HflFDm/C9dkVFTGA9AuD8mrgBS3joEcui2pee2QGsgzDE2FJkzb9AIXE
+UZDXCQBvod9/dxBAJQa0fxXF9lwZIDcbi3SRrsNWayrX1C3s2Xv7xbpsvMfdz/BTJH7QlOWqsDeuy0A5N7/NlyWfqPsYUmSwS74w
+QTAxMA0GCWCGSAFlAwQCAQUABCACGr1j/d2RyCAt9CHZKq45cyUQ46gwB1QrzWzBeyRdegQIcGiHIIbrTkICAggA`,
+	"rc2": `
+MIIDJAIBAzCCAuoGCSqGSIb3DQEHAaCCAtsEggLXMIIC0zCCAs8GCSqGSIb3DQEHBqCCAsAwggK8AgEAMIICtQYJKoZIhvcNAQcB
+MBwGCiqGSIb3DQEMAQYwDgQI5EfBjXXeu08CAggAgIICiEs3t0cEJNiLBNQLrlMaVcHaCun1tMXli8SOpOGz60x1XxQUj75kGGK6
+wPqXcanMUa/x+BMf90PGhbO9ON8D6QEmH0TCME+nnbBiOqEK1L5XVaZzXn9CS46Tym8GpV7BL3JZIfAwUQ36pU34u3Wq/ffy0N00
+QE6mU54xTp1CtI8it98qH5E4kmbgzTzy0d+2TlaKIKgQsCwAGkCOUo2F733esAO7kWuC2z58ik+m9+mUAvOofWzVH1QgY3vbt1/P
+LgiXtnX7q0DjvAgPPrq8QapgLtM+fpcxVk9iJKNKbziyd9zD+Ea2N96WVl8avLgEOcZrFEPYxsQh5/LKD7967o6wyUSPe6lH15v2
+CV+IuI1EQOQm44UWBryvNndTdwdhfdajZ5o4iEkp/zsLtxWVQgWaXw44HcoEAufB1JT5DUCMv3WC0JT2XQkQQAVwyl33G1J5+RLS
+w/oORmLVJsdEFlxBLdv/HuOoEn1XEQIao3ItuYhykMh88r1iNy4732LTfQ+hM+ffSN/gauRXqn5kHwIyWP9IPQs5YmEhSev221sw
+usyAhSKNMmebrAjLtZnD9daS0t+VfVEss4fyteNI5wkwpZ60pNKfyihKBnNuj3wYkdl5Rq8zcWHDj/2PQ2xah2YZlkJd7FmO5+6F
+3RiMgdqyDiLWw5WI4hrrUIHip8rX9zCD6xL+tKfYQWNWgxiL80nl+AnyqKcqOGtCFZchxoQTt/mTp8gATxq1G0R5dAkhy46swCFr
+Oh6hpaC+MfFmVhYgv/kN7QOkA7jUzpZ4lMU5tURBJJ3r/VQiHDZEr8wPJV0H2bzC6prLIxj1NisXoEDkYq6KGZu10/Hk6gFTmM64
+Cd2ojBk6wTAxMCEwCQYFKw4DAhoFAAQU3ykO6KXI+ZJekO2jM30VVAnfXvgECJGwTX7i1uRDAgIIAA==`,
+	"3des": `
+MIIDJAIBAzCCAuoGCSqGSIb3DQEHAaCCAtsEggLXMIIC0zCCAs8GCSqGSIb3DQEHBqCCAsAwggK8AgEAMIICtQYJKoZIhvcNAQcB
+MBwGCiqGSIb3DQEMAQMwDgQIChIIep5QgRcCAggAgIICiM3dtm+9MhC7glwHpLBRCf83GE8wCYbauDwi1wUxjdP84FvdDFLJ4Nsr
+x4kh0oaj9xcWJo5IiGqx9ChGd4jbsjpS1OiqMk6LG+KoNE7r0X/P0xoN6OFyjMUBKcJPGf5lOeT31u+qHELAfvlYtCYLavfxAaVZ
+/fYJtwiOE/fLXZDxV3sDVcMn/8Mw4JWsYEVFmpqoLK6sCXghg/v1KmLBzxBpZdYHN/KHpYDHlIroFAjQphsw/ACcC0zHpJfHNRQF
+jfGh9tDi5QINWorWiZaKbaCs4BEFVbsDZC/2OHN0cgiap71s9vi0FHAri5zFzhWaPSu/dJur1toec7RvLhK1yw/3Pdm9y74rk1w7
+a7L0zaCS5yK4fs21YMkiHYyZTp/3O2Z7k7mpXFE6J0s9VIAiHlcSJqHktYVCvAiRY5uv1ACBCpEK2m3F+2iKeRvTxUSW3kiI128z
+8BAUubOk6idtmBSLheCY6KHP5ob4AO5tE64DtcAV0IgT8Vl6Oxjk4CdaFYMpyJuw13BdWfmZAKVplftGwiiqo+rI/NJey+8a3k5i
+QgEb32+ZlaLo9tzQ58Jn/BqLNqo9o3UPgMIXHBERg1RZn9yfuiIh1gTsfwHlViXf1foH9XgoixPUgLxU6QwR7ZIHJG8QS7QNvRIs
+nTELBokkPrDAHoJF/ZeAgaoeKRUcEwpCqLvy542c2sUE1OYCMdNRYztrOAt2UVpm5mAS3kQmKBFsxr7b9Oy4zC/n3ZOoZUneTyJk
+DPSDNfohXDYluz41oMNuK7jmLj46n7QWYVELPSEFRCxu7I+v3Nzt9JFQzWWHzEs6nZNbEFWpmbt6V+0pSumNpevwCiVXO4XtyABG
+QotK86UNyDAxMCEwCQYFKw4DAhoFAAQUvMd56yaJhQRMvfQhtoqlRyX2opMECJi+TsASTE5RAgIIAA==`,
+}
+
+func testPKCS12Store(t *testing.T, name string) []byte {
+	b, err := base64.StdEncoding.DecodeString(strings.Replace(testPKCS12Stores[name], "\n", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test that the encrypted certificates of PKCS#12 stores are read with the
+// password, whichever scheme they're encrypted with
+func TestParseJavaKeyStorePKCS12Password(t *testing.T) {
+	for name := range testPKCS12Stores {
+		b := testPKCS12Store(t, name)
+
+		certs, err := parseJavaKeyStore(b, "secret")
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(certs) != 1 || certs[0].Cert.Subject.CommonName != "ribbybibby.me" {
+			t.Errorf("%s: expected the test CA, got %v", name, certs)
+		}
+
+		if _, err := parseJavaKeyStore(b, ""); err == nil {
+			t.Errorf("%s: expected an error without the password", name)
+		}
+		if _, err := parseJavaKeyStore(b, "wrong"); err != errKeystorePassword {
+			t.Errorf("%s: expected %q with the wrong password, got %v", name, errKeystorePassword, err)
+		}
+	}
+}
+
+// Test that the java trust store reads the java_cacerts with its password
+func TestTLSConfigLoaderJavaPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacerts := filepath.Join(dir, "cacerts")
+	if err := ioutil.WriteFile(cacerts, testPKCS12Store(t, "pbes2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTLSConfigLoader("test", TLSConfig{TrustStore: TrustStoreJava, JavaCACerts: cacerts}); err == nil {
+		t.Errorf("expected an error without the password")
+	}
+	loader, err := newTLSConfigLoader("test", TLSConfig{
+		TrustStore:          TrustStoreJava,
+		JavaCACerts:         cacerts,
+		JavaCACertsPassword: KeystorePassword{Password: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loader.Config().RootCAs == nil {
+		t.Errorf("expected the roots of the java_cacerts")
+	}
+}
+
+// Test that the digest of a JKS is checked with the password
+func TestParseJavaKeyStoreJKSPassword(t *testing.T) {
+	block, _ := pem.Decode([]byte(caCert))
+	jks := testJKSWithPassword(block.Bytes, "changeit")
+
+	if certs, err := parseJavaKeyStore(jks, "changeit"); err != nil || len(certs) != 1 {
+		t.Errorf("expected the certificate with the password, got %v, %v", certs, err)
+	}
+	if _, err := parseJavaKeyStore(jks, ""); err != nil {
+		t.Errorf("expected the certificate without the password, got %v", err)
+	}
+	if _, err := parseJavaKeyStore(jks, "wrong"); err != errKeystorePassword {
+		t.Errorf("expected %q with the wrong password, got %v", errKeystorePassword, err)
+	}
+}
+
+// testJKSWithPassword returns testJKS with the digest that keytool writes
+// for the password
+func testJKSWithPassword(der []byte, password string) []byte {
+	jks := testJKS(der)
+	data := jks[:len(jks)-sha1.Size]
+
+	h := sha1.New()
+	for _, c := range password {
+		h.Write([]byte{0, byte(c)})
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(data)
+
+	return append(data, h.Sum(nil)...)
+}
+
+// Test that the password of a store is the one for its path, or for the
+// longest pattern that matches it, or else the default
+func TestKeystorePasswordsForFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SSL_EXPORTER_TEST_KEYSTORE_PASSWORD", "from-env")
+	defer os.Unsetenv("SSL_EXPORTER_TEST_KEYSTORE_PASSWORD")
+
+	passwords := KeystorePasswords{
+		KeystorePassword: KeystorePassword{Password: "default"},
+		Files: map[string]KeystorePassword{
+			"/opt/app/a/keystore.p12": {PasswordFile: passwordFile},
+			"/opt/app/*/keystore.p12": {PasswordEnv: "SSL_EXPORTER_TEST_KEYSTORE_PASSWORD"},
+			"/opt/app/*/*.p12":        {Password: "any-p12"},
+			"/opt/other/keystore.p12": {PasswordEnv: "SSL_EXPORTER_TEST_UNSET"},
+		},
+	}
+	for file, want := range map[string]string{
+		"/opt/app/a/keystore.p12": "from-file",
+		"/opt/app/b/keystore.p12": "from-env",
+		"/opt/app/b/legacy.p12":   "any-p12",
+		"/etc/ssl/cacerts":        "default",
+	} {
+		if p, err := passwords.forFile(file); err != nil || p != want {
+			t.Errorf("%s: expected the password %s, got %s, %v", file, want, p, err)
+		}
+	}
+	if _, err := passwords.forFile("/opt/other/keystore.p12"); err == nil {
+		t.Errorf("expected an error for an environment variable that isn't set")
+	}
+}
+
+// Test that the truststore prober reads the stores in a directory with the
+// passwords of the module
+func TestProbeHandlerTrustStorePasswords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	block, _ := pem.Decode([]byte(caCert))
+	files := map[string][]byte{
+		"keystore.p12": testPKCS12Store(t, "pbes2"),
+		"legacy.p12":   testPKCS12Store(t, "rc2"),
+		"keystore.jks": testJKSWithPassword(block.Bytes, "changeit"),
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := parseConfig([]byte(`
+modules:
+  keystores:
+    prober: truststore
+    keystore_passwords:
+      password: changeit
+      files:
+        ` + filepath.Join(dir, "*.p12") + `:
+          password: secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range files {
+		req, _ := http.NewRequest("GET", "/probe?module=keystores&target="+filepath.Join(dir, name), nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+
+		if !strings.Contains(rr.Body.String(), "ssl_truststore_certs 1") {
+			t.Errorf("%s: expected `ssl_truststore_certs 1`", name)
+		}
+	}
+}
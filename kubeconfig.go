@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// kubeconfig is the part of a kubeconfig file that the exporter uses to
+// reach a cluster from outside of it
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string      `yaml:"token"`
+			TokenFile             string      `yaml:"tokenFile"`
+			ClientCertificate     string      `yaml:"client-certificate"`
+			ClientCertificateData string      `yaml:"client-certificate-data"`
+			ClientKey             string      `yaml:"client-key"`
+			ClientKeyData         string      `yaml:"client-key-data"`
+			Exec                  interface{} `yaml:"exec"`
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// kubeconfigClient returns a client for the cluster of the context in the
+// kubeconfig file, or of its current context. Only the users with a token or
+// a client certificate are supported, not those that need a credential
+// plugin. Relative paths in the file are relative to its directory, as they
+// are for kubectl.
+func kubeconfigClient(file, contextName string) (*kubernetesClient, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := &kubeconfig{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	if contextName == "" {
+		contextName = c.CurrentContext
+	}
+	if contextName == "" {
+		return nil, errors.New(file + " has no current-context, set the context of the module")
+	}
+	var clusterName, userName string
+	found := false
+	for _, named := range c.Contexts {
+		if named.Name == contextName {
+			clusterName, userName, found = named.Context.Cluster, named.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s has no context %s", file, contextName)
+	}
+
+	dir := filepath.Dir(file)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	client := &kubernetesClient{}
+	config := &tls.Config{}
+	found = false
+	for _, cluster := range c.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		found = true
+
+		client.host = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		config.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+		ca, err := fileOrData(resolve(cluster.Cluster.CertificateAuthority), cluster.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cluster %s: %s", file, clusterName, err)
+		}
+		if ca != nil {
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("%s: cluster %s: no certificates found in the certificate authority", file, clusterName)
+			}
+		}
+	}
+	if !found || client.host == "" {
+		return nil, fmt.Errorf("%s has no server for the cluster %s", file, clusterName)
+	}
+
+	for _, user := range c.Users {
+		if user.Name != userName {
+			continue
+		}
+		u := user.User
+		if u.Exec != nil || u.AuthProvider != nil {
+			return nil, fmt.Errorf("%s: user %s: credential plugins aren't supported, use a user with a token or a client certificate", file, userName)
+		}
+
+		client.token, client.tokenFile = u.Token, resolve(u.TokenFile)
+		cert, err := fileOrData(resolve(u.ClientCertificate), u.ClientCertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %s", file, userName, err)
+		}
+		key, err := fileOrData(resolve(u.ClientKey), u.ClientKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %s", file, userName, err)
+		}
+		if cert != nil || key != nil {
+			keyPair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: user %s: %s", file, userName, err)
+			}
+			config.Certificates = []tls.Certificate{keyPair}
+		}
+	}
+
+	client.client = &http.Client{
+		Timeout:   defaultTimeout,
+		Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+	}
+
+	return client, nil
+}
+
+// fileOrData returns the contents of the file, or the base64 data in its
+// place in a kubeconfig, or nil if neither is set
+func fileOrData(file, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
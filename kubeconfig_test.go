@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that the kubernetes prober reaches the cluster of a kubeconfig's
+// context, trusting its certificate authority and sending the user's token
+func TestProbeHandlerKubeconfig(t *testing.T) {
+	api := newSecretsAPI(t, "token", []kubernetesSecret{
+		newTLSSecret("ingress", "example-tls", serverCert),
+	})
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: api.Certificate().Raw}))
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: production
+  cluster:
+    server: `+api.URL+`
+    certificate-authority-data: `+ca+`
+contexts:
+- name: production
+  context:
+    cluster: production
+    user: exporter
+- name: staging
+  context:
+    cluster: production
+    user: intruder
+users:
+- name: exporter
+  user:
+    tokenFile: token
+- name: intruder
+  user:
+    token: wrong
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := parseConfig([]byte(`
+modules:
+  production:
+    prober: kubernetes
+    kubernetes:
+      kubeconfig: ` + kubeconfig + `
+      context: production
+  current:
+    prober: kubernetes
+    kubernetes:
+      kubeconfig: ` + kubeconfig + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for module, expected := range map[string][]string{
+		"production": {
+			"ssl_kubernetes_list_success 1",
+			`ssl_kubernetes_secret_certs{namespace="ingress",secret="example-tls"} 1`,
+		},
+		"current": {"ssl_kubernetes_list_success 0"},
+	} {
+		req, _ := http.NewRequest("GET", "/probe?module="+module+"&target=kubernetes/ingress/*", nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+
+		for _, want := range expected {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Errorf("%s: expected `%s`", module, want)
+			}
+		}
+	}
+}
+
+// Test that the kubeconfigs that the exporter can't use are rejected
+func TestKubeconfigClientInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, conf := range map[string]string{
+		"no current-context": `
+clusters:
+- name: production
+  cluster:
+    server: https://127.0.0.1:6443
+`,
+		"unknown context": `
+current-context: staging
+`,
+		"no server": `
+current-context: production
+contexts:
+- name: production
+  context:
+    cluster: production
+    user: exporter
+`,
+		"exec user": `
+current-context: production
+clusters:
+- name: production
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: production
+  context:
+    cluster: production
+    user: exporter
+users:
+- name: exporter
+  user:
+    exec:
+      command: aws
+`,
+	} {
+		file := filepath.Join(dir, "kubeconfig")
+		if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kubeconfigClient(file, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
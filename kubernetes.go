@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// kubernetesScheme is the prefix of the references to Kubernetes secrets
+// that can be used in place of a cert_file
+const kubernetesScheme = "kubernetes://"
+
+// serviceAccountDir is where Kubernetes mounts the credentials of the pod's
+// service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// parseSecretRef parses a reference to a secret, like
+// kubernetes://monitoring/probe-identity
+func parseSecretRef(ref string) (namespace, name string, err error) {
+	if !strings.HasPrefix(ref, kubernetesScheme) {
+		return "", "", errors.New("not a kubernetes:// reference: " + ref)
+	}
+	parts := strings.Split(strings.TrimPrefix(ref, kubernetesScheme), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("invalid secret reference " + ref + ", expected kubernetes://<namespace>/<secret>")
+	}
+	return parts[0], parts[1], nil
+}
+
+// kubernetesClient reads from the Kubernetes API as the service account of
+// the pod that the exporter runs in, or as the user of a kubeconfig
+type kubernetesClient struct {
+	// host is the base URL of the API server
+	host string
+	// token is the bearer token of the requests, or tokenFile the file it's
+	// in, which is read for every request, as the token is rotated. Neither
+	// is set for a user with a client certificate.
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+// kubernetesSecret is the part of a Secret that the exporter uses
+type kubernetesSecret struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+// kubernetesSecretList is a page of a list of secrets
+type kubernetesSecretList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []kubernetesSecret `json:"items"`
+}
+
+// secretListLimit is how many secrets are asked for in each page of a list
+const secretListLimit = 500
+
+var (
+	kubernetesMtx sync.Mutex
+	kubernetesAPI *kubernetesClient
+)
+
+// kubernetes returns the client for the API server of the cluster the
+// exporter runs in, creating it the first time it's needed
+func kubernetes() (*kubernetesClient, error) {
+	kubernetesMtx.Lock()
+	defer kubernetesMtx.Unlock()
+
+	if kubernetesAPI != nil {
+		return kubernetesAPI, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not in a Kubernetes pod, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set")
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in the service account's ca.crt")
+	}
+
+	kubernetesAPI = &kubernetesClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		client: &http.Client{
+			Timeout:   defaultTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		},
+	}
+
+	return kubernetesAPI, nil
+}
+
+// secret fetches a secret from the API
+func (c *kubernetesClient) secret(namespace, name string) (*kubernetesSecret, error) {
+	secret := &kubernetesSecret{}
+	if err := c.get(context.Background(), "/api/v1/namespaces/"+url.PathEscape(namespace)+"/secrets/"+url.PathEscape(name), secret); err != nil {
+		return nil, fmt.Errorf("fetching secret %s/%s: %s", namespace, name, err)
+	}
+
+	return secret, nil
+}
+
+// secrets lists the secrets of the type in the namespace, or in every
+// namespace if it's empty, a page at a time
+func (c *kubernetesClient) secrets(ctx context.Context, namespace, secretType string) ([]kubernetesSecret, error) {
+	path := "/api/v1/secrets"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+	}
+
+	var secrets []kubernetesSecret
+	next := ""
+	for {
+		query := url.Values{
+			"fieldSelector": {"type=" + secretType},
+			"limit":         {strconv.Itoa(secretListLimit)},
+		}
+		if next != "" {
+			query.Set("continue", next)
+		}
+
+		list := &kubernetesSecretList{}
+		if err := c.get(ctx, path+"?"+query.Encode(), list); err != nil {
+			if namespace == "" {
+				return nil, fmt.Errorf("listing secrets: %s", err)
+			}
+			return nil, fmt.Errorf("listing secrets in %s: %s", namespace, err)
+		}
+		secrets = append(secrets, list.Items...)
+
+		if next = list.Metadata.Continue; next == "" {
+			return secrets, nil
+		}
+	}
+}
+
+// get decodes the JSON that the API returns for the path into v
+func (c *kubernetesClient) get(ctx context.Context, path string, v interface{}) error {
+	token := c.token
+	if c.tokenFile != "" {
+		b, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	req, err := http.NewRequest("GET", c.host+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// secretKeyPair fetches a kubernetes.io/tls secret, like those cert-manager
+// issues, and parses the certificate and key in it
+func secretKeyPair(ref string) (tls.Certificate, string, error) {
+	namespace, name, err := parseSecretRef(ref)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+
+	client, err := kubernetes()
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+
+	secret, err := client.secret(namespace, name)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data["tls.crt"], secret.Data["tls.key"])
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("secret %s/%s: %s", namespace, name, err)
+	}
+
+	return cert, secret.Metadata.ResourceVersion, nil
+}
+
+// secretVersion returns the resourceVersion of the secret, which changes
+// whenever the secret does
+func secretVersion(ref string) (string, error) {
+	namespace, name, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := kubernetes()
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := client.secret(namespace, name)
+	if err != nil {
+		return "", err
+	}
+
+	return secret.Metadata.ResourceVersion, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Test that the client certificate is loaded from a secret and reloaded when
+// the secret changes
+func TestTLSConfigLoaderSecret(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		version = "1"
+	)
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/monitoring/secrets/probe-identity" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		secret := kubernetesSecret{Data: map[string][]byte{
+			"tls.crt": []byte(clientCert),
+			"tls.key": []byte(clientKey),
+		}}
+		secret.Metadata.ResourceVersion = version
+		json.NewEncoder(w).Encode(secret)
+	}))
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kubernetesAPI = &kubernetesClient{host: api.URL, tokenFile: tokenFile, client: api.Client()}
+	defer func() { kubernetesAPI = nil }()
+
+	loader, err := newTLSConfigLoader("test", TLSConfig{CertFile: "kubernetes://monitoring/probe-identity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(loader.Config().Certificates); n != 1 {
+		t.Fatalf("expected the client certificate from the secret, got %d certificates", n)
+	}
+
+	if loader.changed() {
+		t.Errorf("expected no change to be detected")
+	}
+
+	mtx.Lock()
+	version = "2"
+	mtx.Unlock()
+	if !loader.changed() {
+		t.Errorf("expected a change to the secret to be detected")
+	}
+
+	if _, err := newTLSConfigLoader("test", TLSConfig{CertFile: "kubernetes://monitoring/missing"}); err == nil {
+		t.Errorf("expected an error for a missing secret")
+	}
+}
+
+// Test that secret references are parsed
+func TestParseSecretRef(t *testing.T) {
+	namespace, name, err := parseSecretRef("kubernetes://monitoring/probe-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace != "monitoring" || name != "probe-identity" {
+		t.Errorf("unexpected namespace %s and name %s", namespace, name)
+	}
+
+	for _, ref := range []string{"kubernetes://probe-identity", "kubernetes://monitoring/", "kubernetes://a/b/c"} {
+		if _, _, err := parseSecretRef(ref); err == nil {
+			t.Errorf("expected an error for %s", ref)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+)
+
+// probeIDHeader is the response header that carries the ID of the probe
+const probeIDHeader = "X-Probe-ID"
+
+// newProbeID returns a random identifier for a probe request
+func newProbeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// probeLogger tags the log lines for a single probe with its ID. When debug
+// output has been requested it also keeps a copy of them, at debug level,
+// for the response.
+//
+// Only the *ln methods are captured for the debug output.
+type probeLogger struct {
+	log.Logger
+
+	mtx   sync.Mutex
+	buf   *bytes.Buffer
+	debug log.Logger
+}
+
+func newProbeLogger(probeID string, debug bool) *probeLogger {
+	l := &probeLogger{
+		Logger: log.With("probe_id", probeID),
+	}
+
+	if debug {
+		l.buf = &bytes.Buffer{}
+		dl := log.NewLogger(l.buf)
+		dl.SetLevel("debug")
+		l.debug = dl.With("probe_id", probeID)
+	}
+
+	return l
+}
+
+// Debugln logs a message at level Debug
+func (l *probeLogger) Debugln(args ...interface{}) {
+	l.Logger.Debugln(args...)
+	l.capture(func(dl log.Logger) { dl.Debugln(args...) })
+}
+
+// Infoln logs a message at level Info
+func (l *probeLogger) Infoln(args ...interface{}) {
+	l.Logger.Infoln(args...)
+	l.capture(func(dl log.Logger) { dl.Infoln(args...) })
+}
+
+// Warnln logs a message at level Warn
+func (l *probeLogger) Warnln(args ...interface{}) {
+	l.Logger.Warnln(args...)
+	l.capture(func(dl log.Logger) { dl.Warnln(args...) })
+}
+
+// Errorln logs a message at level Error
+func (l *probeLogger) Errorln(args ...interface{}) {
+	l.Logger.Errorln(args...)
+	l.capture(func(dl log.Logger) { dl.Errorln(args...) })
+}
+
+func (l *probeLogger) capture(fn func(log.Logger)) {
+	if l.debug == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	fn(l.debug)
+}
+
+// String returns the captured log lines
+func (l *probeLogger) String() string {
+	if l.buf == nil {
+		return ""
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.buf.String()
+}
+
+// writeDebugOutput writes the logs of a probe, followed by the metrics it would
+// have returned, in a format intended for humans
+func writeDebugOutput(w http.ResponseWriter, probeID string, mfs []*dto.MetricFamily, err error, logger *probeLogger) {
+	if err != nil {
+		logger.Errorln("Error gathering metrics: ", err)
+	}
+
+	metrics := &bytes.Buffer{}
+	for _, mf := range mfs {
+		expfmt.MetricFamilyToText(metrics, mf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Logs for probe %s:\n%s\n\n", probeID, logger.String())
+	fmt.Fprintf(w, "Metrics that would have been returned:\n%s", metrics.String())
+}
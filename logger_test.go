@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that each probe returns a unique ID in the response header
+func TestProbeHandlerProbeID(t *testing.T) {
+	first, err := probe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := probe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := first.Header().Get(probeIDHeader)
+	if id == "" {
+		t.Fatalf("expected a %s header", probeIDHeader)
+	}
+	if id == second.Header().Get(probeIDHeader) {
+		t.Errorf("expected probes to have different IDs")
+	}
+}
+
+// Test that the debug output includes the logs and metrics for the probe
+func TestProbeHandlerDebug(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", "/probe?debug=true&target="+server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, testModules(&tls.Config{}))
+
+	id := rr.Header().Get(probeIDHeader)
+	body := rr.Body.String()
+
+	if !strings.Contains(body, "Logs for probe "+id) {
+		t.Errorf("expected the debug output to contain the probe ID")
+	}
+	if !strings.Contains(body, "probe_id="+id) {
+		t.Errorf("expected the log lines to contain the probe ID")
+	}
+	if !strings.Contains(body, "ssl_tls_connect_success 0") {
+		t.Errorf("expected the debug output to contain the metrics")
+	}
+	if !strings.Contains(body, "ClientHello offered versions") || !strings.Contains(body, "ServerHello chose version") {
+		t.Errorf("expected the debug output to contain the parameters of the handshake")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+// newPKCS11Signer fails, as PKCS#11 needs cgo and can't be used by the static
+// builds of the exporter
+func newPKCS11Signer(c *PKCS11Config, public crypto.PublicKey) (crypto.Signer, error) {
+	return nil, errors.New("this build of the exporter doesn't support pkcs11, rebuild it with -tags pkcs11")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// ocspProber is the prober whose targets are the URLs of OCSP responders,
+// rather than TLS servers
+const ocspProber = "ocsp"
+
+// ocspCerts returns the certificate and issuer that the ocsp prober asks
+// about. The files are read for every probe, like the bearer token, so that
+// the certificate can be renewed.
+func (m Module) ocspCerts() (*x509.Certificate, *x509.Certificate, error) {
+	certs, err := readCertificates(m.OCSP.CertFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.OCSP.IssuerFile != "" {
+		issuers, err := readCertificates(m.OCSP.IssuerFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs[:1], issuers[0])
+	}
+	if len(certs) < 2 {
+		return nil, nil, errors.New("no issuer found after the certificate in " + m.OCSP.CertFile + ", set issuer_file")
+	}
+
+	return certs[0], certs[1], nil
+}
+
+// readCertificates returns the certificates in a PEM file, in order
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePEMCertificates(file, b)
+}
+
+// parsePEMCertificates returns the certificates in the PEM of a file, in
+// order
+func parsePEMCertificates(file string, b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found in " + file)
+	}
+
+	return certs, nil
+}
+
+// defaultOCSPRecheck is how long a response without a nextUpdate is cached
+// for, by default
+const defaultOCSPRecheck = time.Hour
+
+// ocspJitter is the most of the validity period of a response, from its
+// thisUpdate to its nextUpdate, that it's refreshed before its nextUpdate.
+// The refreshes of the responses that a CA produced at the same time are
+// spread out, rather than all asked for in the same scrape.
+const ocspJitter = 0.1
+
+// ocspCache asks the OCSP responders of leaves for their status, as the
+// servers didn't staple a response. A response is cached until shortly
+// before its nextUpdate, so that frequent scrapes don't flood the responder,
+// and it's still used until its nextUpdate when the responder fails, so
+// that an outage of the responder doesn't make the metrics flap.
+type ocspCache struct {
+	recheck time.Duration
+
+	mtx   sync.Mutex
+	cache map[[sha256.Size]byte]ocspEntry
+}
+
+type ocspEntry struct {
+	// response is the DER of the response, which is parsed again for each
+	// lookup, so that its validity is checked against the time of the
+	// lookup
+	response []byte
+	// refresh is when the responder is asked again, and expires when the
+	// response can't be used any more, even if the responder fails
+	refresh time.Time
+	expires time.Time
+}
+
+func newOCSPCache(c OCSPCheckConfig) *ocspCache {
+	o := &ocspCache{
+		recheck: c.RecheckInterval,
+		cache:   map[[sha256.Size]byte]ocspEntry{},
+	}
+	if o.recheck == 0 {
+		o.recheck = defaultOCSPRecheck
+	}
+	return o
+}
+
+// lookup returns the status of the leaf from the first of its OCSP
+// responders, or from the cache. It's nil for a leaf without a responder.
+func (o *ocspCache) lookup(ctx context.Context, leaf, issuer *x509.Certificate, opts prober.Options) (*prober.OCSPResult, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil
+	}
+	if issuer == nil {
+		return nil, errors.New("the issuer of the leaf isn't known")
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	now := time.Now()
+
+	o.mtx.Lock()
+	e, ok := o.cache[fingerprint]
+	o.mtx.Unlock()
+	if ok && now.Before(e.refresh) {
+		return prober.ParseOCSPResponse(e.response, leaf, issuer)
+	}
+
+	result, err := prober.ProbeOCSP(ctx, leaf.OCSPServer[0], leaf, issuer, opts)
+	if err == nil && (result == nil || result.Response == nil) {
+		err = errors.New("no response from " + leaf.OCSPServer[0])
+	}
+	if err != nil {
+		if ok && now.Before(e.expires) {
+			if opts.Logger != nil {
+				opts.Logger.Errorln("Error asking " + leaf.OCSPServer[0] + " for the status of the leaf, using the cached response: " + err.Error())
+			}
+			return prober.ParseOCSPResponse(e.response, leaf, issuer)
+		}
+		return nil, err
+	}
+
+	e = ocspEntry{response: result.Raw, refresh: now.Add(o.recheck), expires: now.Add(o.recheck)}
+	if resp := result.Response; !resp.NextUpdate.IsZero() && resp.NextUpdate.After(now) {
+		e.expires = resp.NextUpdate
+		e.refresh = resp.NextUpdate.Add(-time.Duration(rand.Float64() * ocspJitter * float64(resp.NextUpdate.Sub(resp.ThisUpdate))))
+		if e.refresh.Before(now) {
+			e.refresh = now
+		}
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for f, e := range o.cache {
+		if !now.Before(e.expires) {
+			delete(o.cache, f)
+		}
+	}
+	o.cache[fingerprint] = e
+
+	return result, nil
+}
+
+// snapshot returns a copy of the cached responses
+func (o *ocspCache) snapshot() map[[sha256.Size]byte]ocspEntry {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	cache := make(map[[sha256.Size]byte]ocspEntry, len(o.cache))
+	for fingerprint, e := range o.cache {
+		cache[fingerprint] = e
+	}
+	return cache
+}
+
+// restore replaces the cached responses, like with those of a snapshot from
+// before a restart
+func (o *ocspCache) restore(cache map[[sha256.Size]byte]ocspEntry) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	o.cache = cache
+}
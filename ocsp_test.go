@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Test that a module with the ocsp prober asks the responder in the target
+// about the certificate in its cert_file
+func TestProbeHandlerOCSP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "chain.pem")
+	if err := ioutil.WriteFile(certFile, []byte(serverCert+"\n"+caCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(serverCert))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ = pem.Decode([]byte(caCert))
+	issuer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key of the test CA isn't available, so the response is signed by
+	// a responder that the CA didn't delegate to
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "responder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ocsp.CreateResponse(issuer, responderCert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   time.Now().Add(time.Hour),
+		Certificate:  responderCert,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	c, err := parseConfig([]byte(`
+modules:
+  responder:
+    prober: ocsp
+    ocsp:
+      cert_file: ` + certFile + `
+  missing:
+    prober: ocsp
+    ocsp:
+      cert_file: ` + filepath.Join(dir, "missing.pem") + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for module, expected := range map[string][]string{
+		"responder": {
+			"ssl_ocsp_responder_up 1",
+			`ssl_ocsp_response_status{status="good"} 1`,
+			"ssl_ocsp_response_valid 0",
+		},
+		"missing": {
+			"ssl_ocsp_responder_up 0",
+		},
+	} {
+		req, _ := http.NewRequest("GET", "/probe?module="+module+"&target="+responder.URL, nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+
+		for _, want := range expected {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Errorf("%s: expected `%s`", module, want)
+			}
+		}
+		if strings.Contains(rr.Body.String(), "ssl_tls_connect_success") {
+			t.Errorf("%s: expected no metrics of a TLS probe", module)
+		}
+	}
+}
+
+// Test that the issuer is taken from issuer_file, or from after the
+// certificate in cert_file
+func TestModuleOCSPCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"leaf.pem":  serverCert,
+		"chain.pem": serverCert + "\n" + caCert,
+		"ca.pem":    caCert,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, o := range []OCSPProbe{
+		{CertFile: filepath.Join(dir, "chain.pem")},
+		{CertFile: filepath.Join(dir, "leaf.pem"), IssuerFile: filepath.Join(dir, "ca.pem")},
+	} {
+		cert, issuer, err := Module{OCSP: o}.ocspCerts()
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %s", o, err)
+			continue
+		}
+		if cert.Subject.String() == issuer.Subject.String() || cert.CheckSignatureFrom(issuer) != nil {
+			t.Errorf("%+v: expected the leaf and its issuer, got %s and %s", o, cert.Subject, issuer.Subject)
+		}
+	}
+
+	if _, _, err := (Module{OCSP: OCSPProbe{CertFile: filepath.Join(dir, "leaf.pem")}}).ocspCerts(); err == nil {
+		t.Errorf("expected an error without an issuer")
+	}
+}
+
+// ocspTestChain is a leaf whose OCSP responder is a test server, and the CA
+// that issued it and signs the responses
+type ocspTestChain struct {
+	ca, leaf *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	leafKey  *ecdsa.PrivateKey
+}
+
+func newOCSPTestChain(t *testing.T, responder string) *ocspTestChain {
+	c := &ocspTestChain{}
+	var err error
+	if c.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if c.leafKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, c.caKey.Public(), c.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	if responder != "" {
+		leafTemplate.OCSPServer = []string{responder}
+	}
+	der, err = x509.CreateCertificate(rand.Reader, leafTemplate, c.ca, c.leafKey.Public(), c.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// response returns a response with the status of the leaf, signed by the CA
+func (c *ocspTestChain) response(t *testing.T, status int, nextUpdate time.Duration) []byte {
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: c.leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute).Truncate(time.Second),
+		NextUpdate:   time.Now().Add(nextUpdate).Truncate(time.Second),
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = time.Now().Add(-time.Hour).Truncate(time.Second)
+	}
+	b, err := ocsp.CreateResponse(c.ca, c.ca, template, c.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// tlsCertificate returns the leaf and its chain to serve
+func (c *ocspTestChain) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.leaf.Raw, c.ca.Raw}, PrivateKey: c.leafKey}
+}
+
+// Test that the responses of the leaf's responder are cached until shortly
+// before their nextUpdate, and that a cached response is still used when the
+// responder fails
+func TestOCSPCacheLookup(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+		fail     bool
+		resp     []byte
+	)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	chain := newOCSPTestChain(t, responder.URL)
+	resp = chain.response(t, ocsp.Good, time.Hour)
+	cache := newOCSPCache(OCSPCheckConfig{})
+
+	for i := 0; i < 2; i++ {
+		result, err := cache.lookup(context.Background(), chain.leaf, chain.ca, prober.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Response.Status != ocsp.Good || result.ResponseErr != nil {
+			t.Errorf("expected a valid good response, got %+v", result)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the response to be cached, got %d requests", requests)
+	}
+	fingerprint := sha256.Sum256(chain.leaf.Raw)
+	e := cache.snapshot()[fingerprint]
+	nextUpdate := time.Now().Add(time.Hour)
+	if e.refresh.After(e.expires) || e.expires.Sub(e.refresh) > 7*time.Minute || e.expires.After(nextUpdate) {
+		t.Errorf("expected the response to be refreshed within a tenth of its validity before its nextUpdate, got %+v", e)
+	}
+
+	// Past the refresh, a responder that fails falls back on the cached
+	// response until its nextUpdate
+	mtx.Lock()
+	fail = true
+	mtx.Unlock()
+	e.refresh = time.Now().Add(-time.Second)
+	cache.restore(map[[sha256.Size]byte]ocspEntry{fingerprint: e})
+	result, err := cache.lookup(context.Background(), chain.leaf, chain.ca, prober.Options{Logger: newProbeLogger("", false)})
+	if err != nil || result.Response.Status != ocsp.Good {
+		t.Errorf("expected the cached response while the responder fails, got %+v, %v", result, err)
+	}
+	if requests != 2 {
+		t.Errorf("expected the responder to be asked again after the refresh, got %d requests", requests)
+	}
+
+	e.expires = time.Now().Add(-time.Second)
+	cache.restore(map[[sha256.Size]byte]ocspEntry{fingerprint: e})
+	if _, err := cache.lookup(context.Background(), chain.leaf, chain.ca, prober.Options{}); err == nil {
+		t.Errorf("expected an error once the cached response has expired")
+	}
+
+	if result, err := cache.lookup(context.Background(), newOCSPTestChain(t, "").leaf, chain.ca, prober.Options{}); result != nil || err != nil {
+		t.Errorf("expected nothing for a leaf without a responder, got %+v, %v", result, err)
+	}
+}
+
+// Test that the response that a target staples is reported, and that the
+// leaf's responder is only asked with ocsp_check when the target doesn't
+// staple one
+func TestProbeHandlerOCSPStapling(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	var chain *ocspTestChain
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+		w.Write(chain.response(t, ocsp.Revoked, time.Hour))
+	}))
+	defer responder.Close()
+	chain = newOCSPTestChain(t, responder.URL)
+
+	stapled := chain.tlsCertificate()
+	stapled.OCSPStaple = chain.response(t, ocsp.Good, time.Hour)
+	stapling := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	stapling.TLS = &tls.Config{Certificates: []tls.Certificate{stapled}}
+	stapling.StartTLS()
+	defer stapling.Close()
+
+	notStapling := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	notStapling.TLS = &tls.Config{Certificates: []tls.Certificate{chain.tlsCertificate()}}
+	notStapling.StartTLS()
+	defer notStapling.Close()
+
+	c, err := parseConfig([]byte(`
+modules:
+  check:
+    tls_config:
+      insecure_skip_verify: true
+    ocsp_check: {}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		module, target string
+		expected       []string
+		unexpected     []string
+	}{
+		{
+			module:     "default",
+			target:     stapling.URL,
+			expected:   []string{"ssl_ocsp_response_stapled 1", `ssl_ocsp_response_status{status="good"} 1`, "ssl_ocsp_response_valid 1"},
+			unexpected: []string{"ssl_ocsp_response_revoked_at"},
+		},
+		{
+			module:     "default",
+			target:     notStapling.URL,
+			expected:   []string{"ssl_ocsp_response_stapled 0"},
+			unexpected: []string{"ssl_ocsp_response_status"},
+		},
+		{
+			module:   "check",
+			target:   stapling.URL,
+			expected: []string{"ssl_ocsp_response_stapled 1", `ssl_ocsp_response_status{status="good"} 1`},
+		},
+		{
+			module:   "check",
+			target:   notStapling.URL,
+			expected: []string{"ssl_ocsp_response_stapled 0", `ssl_ocsp_response_status{status="revoked"} 1`, "ssl_ocsp_response_revoked_at "},
+		},
+	} {
+		req, _ := http.NewRequest("GET", "/probe?module="+test.module+"&target="+test.target, nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+
+		for _, want := range test.expected {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Errorf("%s %s: expected `%s`", test.module, test.target, want)
+			}
+		}
+		for _, unwanted := range test.unexpected {
+			if strings.Contains(rr.Body.String(), unwanted) {
+				t.Errorf("%s %s: expected no `%s`", test.module, test.target, unwanted)
+			}
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the responder to be asked once, for the target that doesn't staple, got %d requests", requests)
+	}
+}
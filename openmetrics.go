@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// openMetricsUnits are the metric name suffixes that are announced as units
+var openMetricsUnits = []string{"seconds", "bytes"}
+
+// metricsHandler serves the metrics from the gatherer in the OpenMetrics
+// format when the client asks for it, and in the Prometheus formats otherwise
+func metricsHandler(g prometheus.Gatherer) http.Handler {
+	h := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsOpenMetrics(r.Header.Get("Accept")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		mfs, err := g.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred during metrics gathering:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", openMetricsContentType)
+		if err := writeOpenMetrics(w, mfs); err != nil {
+			http.Error(w, "An error has occurred during metrics encoding:\n\n"+err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if mediaType == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOpenMetrics writes the metric families in the OpenMetrics text format:
+//
+//	https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+func writeOpenMetrics(w io.Writer, mfs []*dto.MetricFamily) error {
+	bw := bufio.NewWriter(w)
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		typ := "unknown"
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			typ = "gauge"
+		case dto.MetricType_COUNTER:
+			typ = "counter"
+			// Counter samples have a _total suffix, which isn't part of the
+			// name of the family
+			name = strings.TrimSuffix(name, "_total")
+		case dto.MetricType_SUMMARY:
+			typ = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typ = "histogram"
+		}
+
+		if mf.Help != nil {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeOpenMetrics(mf.GetHelp()))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		for _, unit := range openMetricsUnits {
+			if strings.HasSuffix(name, "_"+unit) {
+				fmt.Fprintf(bw, "# UNIT %s %s\n", name, unit)
+			}
+		}
+
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				writeOpenMetricsSample(bw, name, m, m.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				writeOpenMetricsSample(bw, name+"_total", m, m.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				writeOpenMetricsSample(bw, name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					writeOpenMetricsSample(bw, name, m, q.GetValue(), "quantile", formatOpenMetricsFloat(q.GetQuantile()))
+				}
+				writeOpenMetricsSample(bw, name+"_sum", m, m.GetSummary().GetSampleSum())
+				writeOpenMetricsSample(bw, name+"_count", m, float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				for _, b := range m.GetHistogram().GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					writeOpenMetricsSample(bw, name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatOpenMetricsFloat(b.GetUpperBound()))
+				}
+				writeOpenMetricsSample(bw, name+"_bucket", m, float64(m.GetHistogram().GetSampleCount()), "le", "+Inf")
+				writeOpenMetricsSample(bw, name+"_sum", m, m.GetHistogram().GetSampleSum())
+				writeOpenMetricsSample(bw, name+"_count", m, float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+
+	bw.WriteString("# EOF\n")
+
+	return bw.Flush()
+}
+
+// writeOpenMetricsSample writes a single sample, with the labels of the metric
+// and an extra label if one is given. Timestamps are written in seconds.
+func writeOpenMetricsSample(w *bufio.Writer, name string, m *dto.Metric, value float64, extra ...string) {
+	w.WriteString(name)
+
+	var labels []string
+	for _, lp := range m.GetLabel() {
+		labels = append(labels, lp.GetName()+`="`+escapeOpenMetrics(lp.GetValue())+`"`)
+	}
+	if len(extra) == 2 {
+		labels = append(labels, extra[0]+`="`+extra[1]+`"`)
+	}
+	if len(labels) > 0 {
+		w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+
+	w.WriteString(" " + formatFloat(value))
+	if m.TimestampMs != nil {
+		w.WriteString(" " + strconv.FormatFloat(float64(m.GetTimestampMs())/1000, 'f', -1, 64))
+	}
+	w.WriteString("\n")
+}
+
+// formatOpenMetricsFloat formats a quantile or bucket bound in the canonical
+// form, which always includes a decimal point
+func formatOpenMetricsFloat(f float64) string {
+	s := formatFloat(f)
+	if !strings.ContainsAny(s, ".eEIN") {
+		s += ".0"
+	}
+	return s
+}
+
+func escapeOpenMetrics(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Test that the probe endpoint returns OpenMetrics when it's negotiated
+func TestProbeHandlerOpenMetrics(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", "/probe?target="+server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, testModules(nil))
+
+	if rr.Header().Get("Content-Type") != openMetricsContentType {
+		t.Errorf("expected content type %s, got %s", openMetricsContentType, rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	for _, s := range []string{
+		"# HELP ssl_tls_connect_success If the TLS connection was a success\n",
+		"# TYPE ssl_tls_connect_success gauge\n",
+		"ssl_tls_connect_success 0\n",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected the output to contain %q", s)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("expected the output to end with # EOF")
+	}
+}
+
+// Test that the Prometheus text format is still returned by default
+func TestProbeHandlerTextFormat(t *testing.T) {
+	rr, err := probe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(rr.Body.String(), "# EOF") {
+		t.Errorf("expected the Prometheus text format")
+	}
+}
+
+// Test the encoding of counters, units, histograms and timestamps
+func TestWriteOpenMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ssl_exporter_failures_total",
+		Help: "Failures with a \"quote\"",
+	})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ssl_probe_duration_seconds",
+		Help:    "Duration",
+		Buckets: []float64{1},
+	})
+	registry.MustRegister(counter, histogram)
+	counter.Add(2)
+	histogram.Observe(0.5)
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := int64(1500)
+	mfs = append(mfs, &dto.MetricFamily{
+		Name:   stringp("ssl_cert_not_after"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: float64p(1)}, TimestampMs: &ms}},
+	})
+
+	buf := &bytes.Buffer{}
+	if err := writeOpenMetrics(buf, mfs); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP ssl_exporter_failures Failures with a \"quote\"
+# TYPE ssl_exporter_failures counter
+ssl_exporter_failures_total 2
+# HELP ssl_probe_duration_seconds Duration
+# TYPE ssl_probe_duration_seconds histogram
+# UNIT ssl_probe_duration_seconds seconds
+ssl_probe_duration_seconds_bucket{le="1.0"} 1
+ssl_probe_duration_seconds_bucket{le="+Inf"} 1
+ssl_probe_duration_seconds_sum 0.5
+ssl_probe_duration_seconds_count 1
+# TYPE ssl_cert_not_after gauge
+ssl_cert_not_after 1 1.5
+# EOF
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func stringp(s string) *string {
+	return &s
+}
+
+func float64p(f float64) *float64 {
+	return &f
+}
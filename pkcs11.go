@@ -0,0 +1,181 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Signer is a crypto.Signer for a private key on a PKCS#11 token. The
+// digests are signed by the token, so the key never leaves it.
+type pkcs11Signer struct {
+	ctx    *pkcs11.Ctx
+	key    pkcs11.ObjectHandle
+	public crypto.PublicKey
+
+	// A session can only be used for one operation at a time
+	mtx     sync.Mutex
+	session pkcs11.SessionHandle
+}
+
+// newPKCS11Signer logs in to the token and finds the private key for the
+// public key of the client certificate
+func newPKCS11Signer(c *PKCS11Config, public crypto.PublicKey) (crypto.Signer, error) {
+	pin, err := ioutil.ReadFile(c.PINFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(c.Module)
+	if ctx == nil {
+		return nil, errors.New("can't load the PKCS#11 module " + c.Module)
+	}
+	// Another module of the exporter may have initialized the library
+	// already
+	if err := ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(c.Slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("opening a session on slot %d: %s", c.Slot, err)
+	}
+	err = ctx.Login(session, pkcs11.CKU_USER, strings.TrimSpace(string(pin)))
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return nil, fmt.Errorf("logging in to slot %d: %s", c.Slot, err)
+	}
+
+	keyType := uint(pkcs11.CKK_RSA)
+	switch public.(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		keyType = pkcs11.CKK_EC
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+	}
+	if c.KeyLabel != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, c.KeyLabel))
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	keys, _, err := ctx.FindObjects(session, 2)
+	ctx.FindObjectsFinal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(keys) == 0:
+		return nil, fmt.Errorf("no matching private key found on slot %d", c.Slot)
+	case len(keys) > 1:
+		return nil, fmt.Errorf("more than one private key found on slot %d, set key_label to choose one", c.Slot)
+	}
+
+	return &pkcs11Signer{ctx: ctx, key: keys[0], public: public, session: session}, nil
+}
+
+// Public implements crypto.Signer
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mechanism, input, err := pkcs11Mechanism(s.public, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.key); err != nil {
+		return nil, err
+	}
+	sig, err := s.ctx.Sign(s.session, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		return ecdsaSignature(sig)
+	}
+	return sig, nil
+}
+
+// pkcs11Hashes are the mechanism and mask generation function for each of
+// the hashes TLS signs with
+var pkcs11Hashes = map[crypto.Hash][2]uint{
+	crypto.SHA1:   {pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1},
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// digestInfoPrefixes are the DER of the DigestInfo that precedes the digest
+// in a PKCS #1 v1.5 signature, as CKM_RSA_PKCS leaves it to the caller
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11Mechanism returns the mechanism to sign the digest with and what to
+// pass to the token for it
+func pkcs11Mechanism(public crypto.PublicKey, digest []byte, opts crypto.SignerOpts) (*pkcs11.Mechanism, []byte, error) {
+	if _, ok := public.(*ecdsa.PublicKey); ok {
+		return pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest, nil
+	}
+
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		hash, ok := pkcs11Hashes[pss.Hash]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported hash %s", pss.Hash)
+		}
+		saltLength := pss.SaltLength
+		if saltLength == rsa.PSSSaltLengthEqualsHash || saltLength == rsa.PSSSaltLengthAuto {
+			saltLength = pss.Hash.Size()
+		}
+		params := pkcs11.NewPSSParams(hash[0], hash[1], uint(saltLength))
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params), digest, nil
+	}
+
+	prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported hash %s", opts.HashFunc())
+	}
+	return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), append(append([]byte{}, prefix...), digest...), nil
+}
+
+// ecdsaSignature converts the r and s that PKCS#11 returns, concatenated, to
+// the ASN.1 that TLS expects
+func ecdsaSignature(sig []byte) ([]byte, error) {
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, errors.New("malformed ECDSA signature from the token")
+	}
+	n := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(sig[:n]),
+		S: new(big.Int).SetBytes(sig[n:]),
+	})
+}
@@ -0,0 +1,84 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Test that the input for a PKCS #1 v1.5 signature is what crypto/rsa signs
+func TestPKCS11MechanismRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("ssl_exporter"))
+
+	mechanism, input, err := pkcs11Mechanism(key.Public(), digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mechanism.Mechanism != pkcs11.CKM_RSA_PKCS {
+		t.Errorf("expected CKM_RSA_PKCS, got %d", mechanism.Mechanism)
+	}
+
+	// Signing the input without a hash is what the token does
+	raw, err := rsa.SignPKCS1v15(nil, key, 0, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, expected) {
+		t.Errorf("expected the input to be the DigestInfo of the digest")
+	}
+
+	mechanism, _, err = pkcs11Mechanism(key.Public(), digest[:], &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mechanism.Mechanism != pkcs11.CKM_RSA_PKCS_PSS {
+		t.Errorf("expected CKM_RSA_PKCS_PSS, got %d", mechanism.Mechanism)
+	}
+}
+
+// Test that the ECDSA signatures from the token are converted to ASN.1
+func TestECDSASignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("ssl_exporter"))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := append(padded(r, 32), padded(s, 32)...)
+
+	sig, err := ecdsaSignature(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+		t.Errorf("expected the converted signature to verify")
+	}
+}
+
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
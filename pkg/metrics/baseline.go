@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxValidityPeriod is the longest validity period the CA/Browser Forum's
+// Baseline Requirements allow for a leaf certificate issued since September
+// 2020
+const maxValidityPeriod = 398 * 24 * time.Hour
+
+var baselineCompliant = prometheus.NewDesc(
+	prometheus.BuildFQName(Namespace, "", "cert_baseline_compliant"),
+	"If the leaf certificate complies with the checks from the CA/Browser Forum's Baseline Requirements. The reason is set for each failed check.",
+	[]string{"serial_no", "issuer_cn", "reason"}, nil,
+)
+
+// collectBaseline sends a series for each of the checks that the
+// certificate fails, or a single series with a value of 1 if it passes all
+// of them
+func collectBaseline(ch chan<- prometheus.Metric, cert *x509.Certificate, serialNum string) {
+	reasons := baselineViolations(cert)
+	if len(reasons) == 0 {
+		ch <- prometheus.MustNewConstMetric(
+			baselineCompliant, prometheus.GaugeValue, 1, serialNum, cert.Issuer.CommonName, "",
+		)
+		return
+	}
+
+	for _, reason := range reasons {
+		ch <- prometheus.MustNewConstMetric(
+			baselineCompliant, prometheus.GaugeValue, 0, serialNum, cert.Issuer.CommonName, reason,
+		)
+	}
+}
+
+// baselineViolations returns the reasons the leaf certificate doesn't meet
+// a subset of the Baseline Requirements that can be checked from the
+// certificate alone
+func baselineViolations(cert *x509.Certificate) []string {
+	var reasons []string
+
+	if cert.NotAfter.Sub(cert.NotBefore) > maxValidityPeriod {
+		reasons = append(reasons, "validity_period")
+	}
+
+	if len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0 {
+		reasons = append(reasons, "no_san")
+	} else if cn := cert.Subject.CommonName; cn != "" && !inSANs(cert, cn) {
+		reasons = append(reasons, "common_name_not_in_san")
+	}
+
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			reasons = append(reasons, "key_size")
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			reasons = append(reasons, "key_algorithm")
+		}
+	default:
+		reasons = append(reasons, "key_algorithm")
+	}
+
+	switch cert.SignatureAlgorithm {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+		x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+	default:
+		reasons = append(reasons, "signature_algorithm")
+	}
+
+	return reasons
+}
+
+// inSANs reports whether the name, a common name, is one of the DNS names or
+// IP addresses of the certificate
+func inSANs(cert *x509.Certificate, name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, san := range cert.IPAddresses {
+			if san.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, san := range cert.DNSNames {
+		if strings.EqualFold(san, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the leaf is checked against the Baseline Requirements
+func TestBaselineViolations(t *testing.T) {
+	now := time.Now()
+	compliant := func() *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:       big.NewInt(1),
+			Subject:            pkix.Name{CommonName: "example.com"},
+			DNSNames:           []string{"example.com", "www.example.com"},
+			NotBefore:          now,
+			NotAfter:           now.Add(90 * 24 * time.Hour),
+			PublicKey:          &ecdsa.PublicKey{Curve: elliptic.P256()},
+			SignatureAlgorithm: x509.ECDSAWithSHA256,
+		}
+	}
+
+	for name, test := range map[string]struct {
+		modify  func(*x509.Certificate)
+		reasons []string
+	}{
+		"compliant": {func(c *x509.Certificate) {}, nil},
+		"ip common name": {func(c *x509.Certificate) {
+			c.Subject.CommonName = "192.0.2.1"
+			c.IPAddresses = []net.IP{net.ParseIP("192.0.2.1")}
+		}, nil},
+		"too long": {func(c *x509.Certificate) {
+			c.NotAfter = now.Add(2 * 365 * 24 * time.Hour)
+		}, []string{"validity_period"}},
+		"common name only": {func(c *x509.Certificate) {
+			c.DNSNames = nil
+		}, []string{"no_san"}},
+		"common name not in san": {func(c *x509.Certificate) {
+			c.Subject.CommonName = "other.example.com"
+		}, []string{"common_name_not_in_san"}},
+		"small rsa key": {func(c *x509.Certificate) {
+			c.PublicKey = &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537}
+			c.SignatureAlgorithm = x509.SHA256WithRSA
+		}, []string{"key_size"}},
+		"ed25519 key": {func(c *x509.Certificate) {
+			c.PublicKey = ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))
+		}, []string{"key_algorithm"}},
+		"sha1 signature": {func(c *x509.Certificate) {
+			c.SignatureAlgorithm = x509.ECDSAWithSHA1
+		}, []string{"signature_algorithm"}},
+	} {
+		cert := compliant()
+		test.modify(cert)
+		if reasons := baselineViolations(cert); !reflect.DeepEqual(reasons, test.reasons) {
+			t.Errorf("%s: expected %v, got %v", name, test.reasons, reasons)
+		}
+	}
+}
+
+// Test that the checks are only reported when they're enabled
+func TestCollectBaseline(t *testing.T) {
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "example.com"}}
+	result := &prober.Result{
+		Protocol: "https",
+		State:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}},
+	}
+
+	if _, ok := collect(t, result, nil, Options{})["ssl_cert_baseline_compliant"]; ok {
+		t.Errorf("expected no ssl_cert_baseline_compliant by default")
+	}
+
+	mfs := collect(t, result, nil, Options{Baseline: true})
+	for _, m := range mfs["ssl_cert_baseline_compliant"].GetMetric() {
+		if v := m.GetGauge().GetValue(); v != 0 {
+			t.Errorf("expected the leaf to fail the checks, got %v", v)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"crypto/tls"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// The metrics below have the same names and meaning as those of the
+// blackbox exporter's tcp prober with tls enabled, so that its alerts keep
+// working against this exporter
+var (
+	probeSuccess = prometheus.NewDesc(
+		"probe_success",
+		"Displays whether or not the probe was a success",
+		nil, nil,
+	)
+	probeSSLEarliestCertExpiry = prometheus.NewDesc(
+		"probe_ssl_earliest_cert_expiry",
+		"Returns earliest SSL cert expiry date",
+		nil, nil,
+	)
+	probeTLSVersionInfo = prometheus.NewDesc(
+		"probe_tls_version_info",
+		"Returns the TLS version used, or NaN when unknown",
+		[]string{"version"}, nil,
+	)
+)
+
+func describeBlackbox(ch chan<- *prometheus.Desc) {
+	ch <- probeSuccess
+	ch <- probeSSLEarliestCertExpiry
+	ch <- probeTLSVersionInfo
+}
+
+// collectBlackbox sends the blackbox exporter's metrics for the result of a
+// probe. Like the blackbox exporter, a chain that couldn't be verified fails
+// the probe.
+func collectBlackbox(ch chan<- prometheus.Metric, result *prober.Result, err error) {
+	if err != nil || result == nil || result.State == nil || result.VerifyErr != nil {
+		ch <- prometheus.MustNewConstMetric(probeSuccess, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(probeSuccess, prometheus.GaugeValue, 1)
+
+	var earliest int64
+	for _, cert := range result.State.PeerCertificates {
+		if expiry := cert.NotAfter.Unix(); earliest == 0 || expiry < earliest {
+			earliest = expiry
+		}
+	}
+	if earliest != 0 {
+		ch <- prometheus.MustNewConstMetric(probeSSLEarliestCertExpiry, prometheus.GaugeValue, float64(earliest))
+	}
+
+	ch <- prometheus.MustNewConstMetric(probeTLSVersionInfo, prometheus.GaugeValue, 1, tls.VersionName(result.State.Version))
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the blackbox exporter's metrics are sent when they're enabled
+func TestCollectBlackbox(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	result := &prober.Result{
+		Protocol: "tcp",
+		State: &tls.ConnectionState{
+			Version: tls.VersionTLS12,
+			PeerCertificates: []*x509.Certificate{
+				{NotAfter: expiry.Add(time.Hour)},
+				{NotAfter: expiry},
+			},
+		},
+	}
+
+	mfs := collect(t, result, nil, Options{Blackbox: true})
+	if v := mfs["probe_success"].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("expected probe_success 1, got %v", v)
+	}
+	if v := mfs["probe_ssl_earliest_cert_expiry"].GetMetric()[0].GetGauge().GetValue(); v != float64(expiry.Unix()) {
+		t.Errorf("expected probe_ssl_earliest_cert_expiry %d, got %v", expiry.Unix(), v)
+	}
+	if v := mfs["probe_tls_version_info"].GetMetric()[0].GetLabel()[0].GetValue(); v != "TLS 1.2" {
+		t.Errorf("expected probe_tls_version_info{version=\"TLS 1.2\"}, got %s", v)
+	}
+
+	mfs = collect(t, &prober.Result{Protocol: "tcp"}, errors.New("connection refused"), Options{Blackbox: true})
+	if v := mfs["probe_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected probe_success 0, got %v", v)
+	}
+	if _, ok := mfs["probe_ssl_earliest_cert_expiry"]; ok {
+		t.Errorf("expected no probe_ssl_earliest_cert_expiry for a failed probe")
+	}
+
+	mfs = collect(t, result, nil, Options{})
+	if _, ok := mfs["probe_success"]; ok {
+		t.Errorf("expected no probe_success by default")
+	}
+}
+
+func collect(t *testing.T, result *prober.Result, err error, opts Options) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectWithOptions(ch, result, err, opts)
+	}))
+
+	return gather(t, registry)
+}
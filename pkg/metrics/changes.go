@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	certChanged = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_changed"),
+		"If the leaf certificate differs from the one the target served on the previous probe",
+		nil, nil,
+	)
+	certLastChange = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_last_change_timestamp_seconds"),
+		"When the target last started serving a different leaf certificate, expressed as a Unix Epoch Time",
+		nil, nil,
+	)
+)
+
+func describeChanges(ch chan<- *prometheus.Desc) {
+	ch <- certChanged
+	ch <- certLastChange
+}
+
+// CollectChange sends whether the leaf changed since the previous probe of
+// the target, and when it last changed. A zero lastChange means that it
+// hasn't been seen to change.
+func CollectChange(ch chan<- prometheus.Metric, changed bool, lastChange time.Time) {
+	value := 0.0
+	if changed {
+		value = 1
+	}
+	ch <- prometheus.MustNewConstMetric(certChanged, prometheus.GaugeValue, value)
+
+	if !lastChange.IsZero() {
+		ch <- prometheus.MustNewConstMetric(certLastChange, prometheus.GaugeValue, float64(lastChange.Unix()))
+	}
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Test that the time of the last change is only sent once there's been one
+func TestCollectChange(t *testing.T) {
+	lastChange := time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		changed    bool
+		lastChange time.Time
+		want       float64
+	}{
+		{changed: false},
+		{changed: true, lastChange: lastChange, want: 1},
+		{changed: false, lastChange: lastChange},
+	} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+			CollectChange(ch, tc.changed, tc.lastChange)
+		}))
+		mfs := gather(t, registry)
+
+		if v := mfs["ssl_cert_changed"].GetMetric()[0].GetGauge().GetValue(); v != tc.want {
+			t.Errorf("expected ssl_cert_changed %v, got %v", tc.want, v)
+		}
+
+		ts, ok := mfs["ssl_cert_last_change_timestamp_seconds"]
+		if tc.lastChange.IsZero() {
+			if ok {
+				t.Errorf("expected no ssl_cert_last_change_timestamp_seconds without a change")
+			}
+			continue
+		}
+		if v := ts.GetMetric()[0].GetGauge().GetValue(); v != float64(lastChange.Unix()) {
+			t.Errorf("expected ssl_cert_last_change_timestamp_seconds %d, got %v", lastChange.Unix(), v)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// The metrics below are for the handshake that offers certificate
+// compression, of RFC 8879
+var (
+	certCompressed = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_cert_compressed"),
+		"If the server compressed its Certificate message when it was offered to",
+		nil, nil,
+	)
+	certCompressionInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_cert_compression_info"),
+		"The algorithm that the server compressed its Certificate message with",
+		[]string{"algorithm"}, nil,
+	)
+	certMessageBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_cert_message_bytes"),
+		"The length of the Certificate message as the server sent it",
+		nil, nil,
+	)
+	certUncompressedBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_cert_uncompressed_bytes"),
+		"The length of the Certificate message once it's uncompressed",
+		nil, nil,
+	)
+)
+
+func describeCertCompression(ch chan<- *prometheus.Desc) {
+	ch <- certCompressed
+	ch <- certCompressionInfo
+	ch <- certMessageBytes
+	ch <- certUncompressedBytes
+}
+
+// collectCertCompression sends what the server did when it was offered
+// certificate compression, if it was
+func collectCertCompression(ch chan<- prometheus.Metric, c *prober.CertCompression) {
+	if c == nil {
+		return
+	}
+
+	var compressed float64
+	if c.Algorithm != "" {
+		compressed = 1
+		ch <- prometheus.MustNewConstMetric(certCompressionInfo, prometheus.GaugeValue, 1, c.Algorithm)
+	}
+	ch <- prometheus.MustNewConstMetric(certCompressed, prometheus.GaugeValue, compressed)
+	ch <- prometheus.MustNewConstMetric(certMessageBytes, prometheus.GaugeValue, float64(c.Length))
+	ch <- prometheus.MustNewConstMetric(certUncompressedBytes, prometheus.GaugeValue, float64(c.UncompressedLength))
+}
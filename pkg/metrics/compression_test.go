@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the algorithm is only reported for a compressed certificate, and
+// nothing at all when compression wasn't offered
+func TestCollectCertCompression(t *testing.T) {
+	result := &prober.Result{
+		Protocol:        "tcp",
+		State:           &tls.ConnectionState{},
+		CertCompression: &prober.CertCompression{Algorithm: "zstd", Length: 1500, UncompressedLength: 3500},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	for name, want := range map[string]float64{
+		"ssl_tls_cert_compressed":         1,
+		"ssl_tls_cert_message_bytes":      1500,
+		"ssl_tls_cert_uncompressed_bytes": 3500,
+	} {
+		if v := mfs[name].GetMetric()[0].GetGauge().GetValue(); v != want {
+			t.Errorf("expected %s %v, got %v", name, want, v)
+		}
+	}
+	if v := labelValue(mfs["ssl_tls_cert_compression_info"].GetMetric()[0], "algorithm"); v != "zstd" {
+		t.Errorf("expected the algorithm zstd, got %s", v)
+	}
+
+	result.CertCompression = &prober.CertCompression{Length: 3500, UncompressedLength: 3500}
+	mfs = collect(t, result, nil, Options{})
+	if v := mfs["ssl_tls_cert_compressed"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_tls_cert_compressed 0, got %v", v)
+	}
+	if _, ok := mfs["ssl_tls_cert_compression_info"]; ok {
+		t.Errorf("expected no ssl_tls_cert_compression_info for an uncompressed certificate")
+	}
+
+	result.CertCompression = nil
+	if _, ok := collect(t, result, nil, Options{})["ssl_tls_cert_compressed"]; ok {
+		t.Errorf("expected no ssl_tls_cert_compressed when compression wasn't offered")
+	}
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// The metrics below are for the CRLs of the distribution points of the leaf,
+// by their URL
+var (
+	crlUp = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "crl_up"),
+		"If the CRL could be downloaded from the distribution point",
+		[]string{"url"}, nil,
+	)
+	crlValid = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "crl_valid"),
+		"If the CRL is signed by the issuer and within its validity period",
+		[]string{"url"}, nil,
+	)
+	crlThisUpdate = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "crl_this_update"),
+		"ThisUpdate of the CRL expressed as a Unix Epoch Time",
+		[]string{"url"}, nil,
+	)
+	crlNextUpdate = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "crl_next_update"),
+		"NextUpdate of the CRL expressed as a Unix Epoch Time",
+		[]string{"url"}, nil,
+	)
+	crlEntries = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "crl_entries"),
+		"The number of revoked certificates in the CRL",
+		[]string{"url"}, nil,
+	)
+	crlCertRevoked = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "crl_cert_revoked"),
+		"If the serial number of the leaf certificate is in the CRL",
+		[]string{"url"}, nil,
+	)
+)
+
+func describeCRL(ch chan<- *prometheus.Desc) {
+	ch <- crlUp
+	ch <- crlValid
+	ch <- crlThisUpdate
+	ch <- crlNextUpdate
+	ch <- crlEntries
+	ch <- crlCertRevoked
+}
+
+// CollectCRL sends the metrics for the CRL of a distribution point of the
+// certificate and the error that downloading it returned. Only whether it
+// could be downloaded is sent when it couldn't be.
+func CollectCRL(ch chan<- prometheus.Metric, url string, result *prober.CRLResult, err error, cert *x509.Certificate) {
+	if err != nil || result == nil || result.List == nil {
+		ch <- prometheus.MustNewConstMetric(crlUp, prometheus.GaugeValue, 0, url)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(crlUp, prometheus.GaugeValue, 1, url)
+
+	list := result.List
+	valid := 1.0
+	if result.ListErr != nil {
+		valid = 0
+	}
+	ch <- prometheus.MustNewConstMetric(crlValid, prometheus.GaugeValue, valid, url)
+
+	ch <- prometheus.MustNewConstMetric(crlThisUpdate, prometheus.GaugeValue, float64(list.ThisUpdate.Unix()), url)
+	if !list.NextUpdate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(crlNextUpdate, prometheus.GaugeValue, float64(list.NextUpdate.Unix()), url)
+	}
+	ch <- prometheus.MustNewConstMetric(crlEntries, prometheus.GaugeValue, float64(len(list.RevokedCertificateEntries)), url)
+
+	revoked := 0.0
+	if result.Revoked(cert) != nil {
+		revoked = 1
+	}
+	ch <- prometheus.MustNewConstMetric(crlCertRevoked, prometheus.GaugeValue, revoked, url)
+}
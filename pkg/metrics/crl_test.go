@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the dates, the entries and the revocation of the leaf are sent
+// for a CRL, and only that it's down for one that couldn't be downloaded
+func TestCollectCRL(t *testing.T) {
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(42)}
+	result := &prober.CRLResult{
+		List: &x509.RevocationList{
+			ThisUpdate: thisUpdate,
+			NextUpdate: thisUpdate.Add(24 * time.Hour),
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: big.NewInt(41)},
+				{SerialNumber: big.NewInt(42)},
+			},
+		},
+		ListErr: errors.New("the CRL expired"),
+	}
+
+	mfs := collectCRL(t, result, nil, leaf)
+	for name, want := range map[string]float64{
+		"ssl_crl_up":           1,
+		"ssl_crl_valid":        0,
+		"ssl_crl_this_update":  float64(thisUpdate.Unix()),
+		"ssl_crl_next_update":  float64(thisUpdate.Add(24 * time.Hour).Unix()),
+		"ssl_crl_entries":      2,
+		"ssl_crl_cert_revoked": 1,
+	} {
+		m := mfs[name].GetMetric()
+		if len(m) != 1 || m[0].GetGauge().GetValue() != want || labelValue(m[0], "url") != "http://crl.example.com/ca.crl" {
+			t.Errorf("expected %s %v for the url, got %v", name, want, m)
+		}
+	}
+
+	mfs = collectCRL(t, &prober.CRLResult{Duration: time.Second}, errors.New("404 Not Found"), leaf)
+	if v := mfs["ssl_crl_up"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_crl_up 0, got %v", v)
+	}
+	if _, ok := mfs["ssl_crl_next_update"]; ok {
+		t.Errorf("expected no ssl_crl_next_update without a CRL")
+	}
+}
+
+func collectCRL(t *testing.T, result *prober.CRLResult, err error, cert *x509.Certificate) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectCRL(ch, "http://crl.example.com/ca.crl", result, err, cert)
+	}))
+
+	return gather(t, registry)
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ctLogged = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_ct_logged"),
+		"If the leaf certificate was found in the Certificate Transparency logs",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	ctLogTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_ct_log_timestamp"),
+		"When the leaf certificate was first logged in the Certificate Transparency logs, expressed as a Unix Epoch Time",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+)
+
+func describeCTLog(ch chan<- *prometheus.Desc) {
+	ch <- ctLogged
+	ch <- ctLogTimestamp
+}
+
+// CollectCTLog sends whether the leaf was found in the Certificate
+// Transparency logs, and when it was first logged. A zero loggedAt means it
+// wasn't found.
+func CollectCTLog(ch chan<- prometheus.Metric, cert *x509.Certificate, loggedAt time.Time, opts Options) {
+	serialNum := opts.serial(cert)
+
+	if loggedAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(ctLogged, prometheus.GaugeValue, 0, serialNum, cert.Issuer.CommonName)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(ctLogged, prometheus.GaugeValue, 1, serialNum, cert.Issuer.CommonName)
+	ch <- prometheus.MustNewConstMetric(ctLogTimestamp, prometheus.GaugeValue, float64(loggedAt.Unix()), serialNum, cert.Issuer.CommonName)
+}
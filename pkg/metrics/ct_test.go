@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Test that the time of the first entry is only sent for logged leaves
+func TestCollectCTLog(t *testing.T) {
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(255), Issuer: pkix.Name{CommonName: "Test CA"}}
+	loggedAt := time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC)
+
+	for logged, want := range map[time.Time]float64{loggedAt: 1, {}: 0} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+			CollectCTLog(ch, leaf, logged, Options{SerialFormat: SerialHex})
+		}))
+		mfs := gather(t, registry)
+
+		m := mfs["ssl_cert_ct_logged"].GetMetric()[0]
+		if v := m.GetGauge().GetValue(); v != want {
+			t.Errorf("expected ssl_cert_ct_logged %v, got %v", want, v)
+		}
+		if s := labelValue(m, "serial_no"); s != "FF" {
+			t.Errorf("expected the serial in the serial format, got %s", s)
+		}
+
+		ts, ok := mfs["ssl_cert_ct_log_timestamp"]
+		if want == 0 {
+			if ok {
+				t.Errorf("expected no ssl_cert_ct_log_timestamp for a leaf that wasn't logged")
+			}
+			continue
+		}
+		if v := ts.GetMetric()[0].GetGauge().GetValue(); v != float64(loggedAt.Unix()) {
+			t.Errorf("expected ssl_cert_ct_log_timestamp %d, got %v", loggedAt.Unix(), v)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// evPolicies are the certificate policy OIDs that mark a certificate as
+// Extended Validation: the CA/Browser Forum's own and those that some of the
+// larger CAs used before it existed, and still do
+var evPolicies = []asn1.ObjectIdentifier{
+	{2, 23, 140, 1, 1},                         // CA/Browser Forum
+	{2, 16, 840, 1, 114412, 2, 1},              // DigiCert
+	{2, 16, 840, 1, 114028, 10, 1, 2},          // Entrust
+	{1, 3, 6, 1, 4, 1, 4146, 1, 1},             // GlobalSign
+	{1, 3, 6, 1, 4, 1, 6449, 1, 2, 1, 5, 1},    // Sectigo
+	{2, 16, 840, 1, 114413, 1, 7, 23, 3},       // GoDaddy
+	{2, 16, 840, 1, 114414, 1, 7, 23, 3},       // Starfield
+	{1, 3, 6, 1, 4, 1, 34697, 2, 1},            // AffirmTrust
+	{2, 16, 756, 1, 89, 1, 2, 1, 1},            // SwissSign
+	{1, 3, 6, 1, 4, 1, 17326, 10, 14, 2, 1, 2}, // Camerfirma
+}
+
+// isEV reports whether the certificate has one of the EV policies
+func isEV(cert *x509.Certificate) bool {
+	for _, policy := range cert.PolicyIdentifiers {
+		for _, ev := range evPolicies {
+			if policy.Equal(ev) {
+				return true
+			}
+		}
+	}
+	return false
+}
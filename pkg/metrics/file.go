@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FileResult is the certificates read from one of the files that the pattern
+// of a file target matched, or the reason they couldn't be
+type FileResult struct {
+	File  string
+	Certs []*x509.Certificate
+	Err   error
+}
+
+// The metrics below are for the certificates in files on the exporter's host,
+// which are read rather than probed
+var (
+	fileMatched = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "file_matched"),
+		"The number of files that the pattern of the target matched",
+		nil, nil,
+	)
+	fileReadSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "file_read_success"),
+		"If the certificates of the file could be read",
+		[]string{"file"}, nil,
+	)
+	fileCerts = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "file_certs"),
+		"The number of certificates in the file",
+		[]string{"file"}, nil,
+	)
+	fileNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "file_cert_not_before"),
+		"NotBefore of a certificate in the file expressed as a Unix Epoch Time",
+		[]string{"file", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	fileNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "file_cert_not_after"),
+		"NotAfter of a certificate in the file expressed as a Unix Epoch Time",
+		[]string{"file", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+)
+
+func describeFile(ch chan<- *prometheus.Desc) {
+	ch <- fileMatched
+	ch <- fileReadSuccess
+	ch <- fileCerts
+	ch <- fileNotBefore
+	ch <- fileNotAfter
+}
+
+// CollectFiles sends the metrics for the certificates of each of the files
+// that the pattern of a file target matched. An error, like an invalid
+// pattern, matches no files.
+func CollectFiles(ch chan<- prometheus.Metric, results []FileResult, err error, opts Options) {
+	if err != nil {
+		results = nil
+	}
+	ch <- prometheus.MustNewConstMetric(fileMatched, prometheus.GaugeValue, float64(len(results)))
+
+	for _, r := range results {
+		if r.Err != nil {
+			ch <- prometheus.MustNewConstMetric(fileReadSuccess, prometheus.GaugeValue, 0, r.File)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(fileReadSuccess, prometheus.GaugeValue, 1, r.File)
+
+		ch <- prometheus.MustNewConstMetric(fileCerts, prometheus.GaugeValue, float64(len(r.Certs)), r.File)
+
+		// A bundle can have more than one copy of a certificate
+		for _, cert := range uniq(r.Certs) {
+			serialNum := opts.serial(cert)
+			issuerCN := cert.Issuer.CommonName
+			subjectCN := cert.Subject.CommonName
+
+			ch <- prometheus.MustNewConstMetric(fileNotBefore, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), r.File, serialNum, issuerCN, subjectCN)
+			ch <- prometheus.MustNewConstMetric(fileNotAfter, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), r.File, serialNum, issuerCN, subjectCN)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Test that the certificates of each file are sent with a file label, and
+// only whether it could be read when it couldn't
+func TestCollectFiles(t *testing.T) {
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kubelet"},
+		Issuer:       pkix.Name{CommonName: "kubernetes"},
+		NotAfter:     time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+
+	mfs := collectFiles(t, []FileResult{
+		{File: "/etc/kubernetes/pki/kubelet.crt", Certs: []*x509.Certificate{cert, cert}},
+		{File: "/etc/kubernetes/pki/broken.crt", Err: errors.New("no certificates found")},
+	}, nil)
+	if v := mfs["ssl_file_matched"].GetMetric()[0].GetGauge().GetValue(); v != 2 {
+		t.Errorf("expected ssl_file_matched 2, got %v", v)
+	}
+	for _, m := range mfs["ssl_file_read_success"].GetMetric() {
+		want := 1.0
+		if labelValue(m, "file") == "/etc/kubernetes/pki/broken.crt" {
+			want = 0
+		}
+		if v := m.GetGauge().GetValue(); v != want {
+			t.Errorf("%s: expected ssl_file_read_success %v, got %v", labelValue(m, "file"), want, v)
+		}
+	}
+	if series := mfs["ssl_file_certs"].GetMetric(); len(series) != 1 || series[0].GetGauge().GetValue() != 2 {
+		t.Errorf("expected ssl_file_certs 2 for the one file that could be read, got %v", series)
+	}
+	series := mfs["ssl_file_cert_not_after"].GetMetric()
+	if len(series) != 1 {
+		t.Fatalf("expected 1 ssl_file_cert_not_after series, got %d", len(series))
+	}
+	if labelValue(series[0], "file") != "/etc/kubernetes/pki/kubelet.crt" || series[0].GetGauge().GetValue() != float64(cert.NotAfter.Unix()) {
+		t.Errorf("unexpected ssl_file_cert_not_after %v", series[0])
+	}
+
+	mfs = collectFiles(t, nil, errors.New("syntax error in pattern"))
+	if v := mfs["ssl_file_matched"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_file_matched 0 for an invalid pattern, got %v", v)
+	}
+}
+
+func collectFiles(t *testing.T, results []FileResult, err error) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectFiles(ch, results, err, Options{})
+	}))
+
+	return gather(t, registry)
+}
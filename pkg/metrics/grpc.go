@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// The metrics below are for the health check of a grpc target, like the
+// blackbox exporter's grpc prober
+var (
+	grpcStatusCode = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "grpc_status_code"),
+		"The grpc-status of the health check, 0 when it succeeded",
+		nil, nil,
+	)
+	grpcHealthCheckResponse = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "grpc_healthcheck_response"),
+		"The serving status in the response to the health check",
+		[]string{"serving_status"}, nil,
+	)
+)
+
+func describeGRPC(ch chan<- *prometheus.Desc) {
+	ch <- grpcStatusCode
+	ch <- grpcHealthCheckResponse
+}
+
+// collectGRPCHealth sends the outcome of the health check, if there was one.
+// A call that didn't get a grpc-status has neither metric.
+func collectGRPCHealth(ch chan<- prometheus.Metric, health *prober.GRPCHealth) {
+	if health == nil || health.Err != nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(grpcStatusCode, prometheus.GaugeValue, float64(health.Code))
+	if health.Status == "" {
+		return
+	}
+	for _, status := range prober.GRPCServingStatuses {
+		value := 0.0
+		if status == health.Status {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(grpcHealthCheckResponse, prometheus.GaugeValue, value, status)
+	}
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the serving status is reported against each of the statuses,
+// and that only the code is reported for a call that failed
+func TestCollectGRPCHealth(t *testing.T) {
+	result := &prober.Result{
+		Protocol:   "grpc",
+		State:      &tls.ConnectionState{},
+		GRPCHealth: &prober.GRPCHealth{Status: "NOT_SERVING"},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	if v := mfs["ssl_grpc_status_code"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_grpc_status_code 0, got %v", v)
+	}
+	statuses := map[string]float64{}
+	for _, m := range mfs["ssl_grpc_healthcheck_response"].GetMetric() {
+		statuses[labelValue(m, "serving_status")] = m.GetGauge().GetValue()
+	}
+	if len(statuses) != 4 || statuses["NOT_SERVING"] != 1 || statuses["SERVING"] != 0 {
+		t.Errorf("unexpected ssl_grpc_healthcheck_response %v", statuses)
+	}
+
+	result.GRPCHealth = &prober.GRPCHealth{Code: 12}
+	mfs = collect(t, result, nil, Options{})
+	if v := mfs["ssl_grpc_status_code"].GetMetric()[0].GetGauge().GetValue(); v != 12 {
+		t.Errorf("expected ssl_grpc_status_code 12, got %v", v)
+	}
+	if _, ok := mfs["ssl_grpc_healthcheck_response"]; ok {
+		t.Errorf("expected no ssl_grpc_healthcheck_response for a failed call")
+	}
+
+	result.GRPCHealth = &prober.GRPCHealth{Err: errors.New("unexpected HTTP status 404 Not Found")}
+	if _, ok := collect(t, result, nil, Options{})["ssl_grpc_status_code"]; ok {
+		t.Errorf("expected no ssl_grpc_status_code without a grpc-status")
+	}
+}
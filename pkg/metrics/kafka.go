@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// The metrics below are for the SASL authentication to a kafka target and
+// the brokers of its cluster. The metrics of each of the brokers are those of
+// a target, with a broker label.
+var (
+	kafkaSASLSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kafka_sasl_success"),
+		"If the SASL authentication to the broker succeeded",
+		nil, nil,
+	)
+	kafkaBrokers = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kafka_brokers"),
+		"The number of brokers in the metadata of the cluster",
+		nil, nil,
+	)
+)
+
+func describeKafka(ch chan<- *prometheus.Desc) {
+	ch <- kafkaSASLSuccess
+	ch <- kafkaBrokers
+}
+
+// collectKafka sends the outcome of the SASL authentication and the results
+// of the probes of each of the brokers, when there were any
+func collectKafka(ch chan<- prometheus.Metric, result *prober.KafkaResult, opts Options) {
+	if result == nil {
+		return
+	}
+
+	if result.SASL {
+		success := 1.0
+		if result.SASLErr != nil {
+			success = 0
+		}
+		ch <- prometheus.MustNewConstMetric(kafkaSASLSuccess, prometheus.GaugeValue, success)
+	}
+	if result.BrokersErr != nil || len(result.Brokers) == 0 {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(kafkaBrokers, prometheus.GaugeValue, float64(len(result.Brokers)))
+	for _, b := range result.Brokers {
+		WithLabel(ch, "broker", b.Address, func(ch chan<- prometheus.Metric) {
+			if b.Err != nil || b.State == nil {
+				ch <- prometheus.MustNewConstMetric(tlsConnectSuccess, prometheus.GaugeValue, 0)
+				return
+			}
+			ch <- prometheus.MustNewConstMetric(tlsConnectSuccess, prometheus.GaugeValue, 1)
+			collectCerts(ch, b.State, opts)
+		})
+	}
+}
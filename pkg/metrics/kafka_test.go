@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the SASL authentication is reported, and that each of the
+// brokers has the metrics of a target with its broker label
+func TestCollectKafka(t *testing.T) {
+	cert := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Unix(1700000000, 0)}
+	result := &prober.Result{
+		Protocol: "kafka",
+		State:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+		Kafka: &prober.KafkaResult{
+			SASL: true,
+			Brokers: []prober.KafkaBroker{
+				{ID: 1, Address: "broker-1.example.com:9093", State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+				{ID: 2, Address: "broker-2.example.com:9093", Err: errors.New("connection refused")},
+			},
+		},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	if v := mfs["ssl_kafka_sasl_success"].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("expected ssl_kafka_sasl_success 1, got %v", v)
+	}
+	if v := mfs["ssl_kafka_brokers"].GetMetric()[0].GetGauge().GetValue(); v != 2 {
+		t.Errorf("expected ssl_kafka_brokers 2, got %v", v)
+	}
+	success := map[string]float64{}
+	for _, m := range mfs["ssl_tls_connect_success"].GetMetric() {
+		success[labelValue(m, "broker")] = m.GetGauge().GetValue()
+	}
+	if len(success) != 3 || success[""] != 1 || success["broker-1.example.com:9093"] != 1 || success["broker-2.example.com:9093"] != 0 {
+		t.Errorf("unexpected ssl_tls_connect_success %v", success)
+	}
+	brokers := map[string]bool{}
+	for _, m := range mfs["ssl_cert_not_after"].GetMetric() {
+		brokers[labelValue(m, "broker")] = true
+	}
+	if len(brokers) != 2 || !brokers[""] || !brokers["broker-1.example.com:9093"] {
+		t.Errorf("expected ssl_cert_not_after for the target and broker 1, got %v", brokers)
+	}
+
+	result.Kafka = &prober.KafkaResult{SASL: true, SASLErr: errors.New("authentication failed")}
+	mfs = collect(t, result, nil, Options{})
+	if v := mfs["ssl_kafka_sasl_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_kafka_sasl_success 0, got %v", v)
+	}
+	if _, ok := mfs["ssl_kafka_brokers"]; ok {
+		t.Errorf("expected no ssl_kafka_brokers without discovery")
+	}
+
+	result.Kafka = &prober.KafkaResult{BrokersErr: errors.New("truncated Kafka response")}
+	mfs = collect(t, result, nil, Options{})
+	if _, ok := mfs["ssl_kafka_sasl_success"]; ok {
+		t.Errorf("expected no ssl_kafka_sasl_success without SASL")
+	}
+}
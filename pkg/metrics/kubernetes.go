@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SecretResult is the certificates read from the tls.crt of one of the
+// secrets that the pattern of a kubernetes target matched, or the reason they
+// couldn't be
+type SecretResult struct {
+	Namespace string
+	Name      string
+	Certs     []*x509.Certificate
+	Err       error
+}
+
+// The metrics below are for the certificates in Kubernetes secrets, which are
+// read from the API rather than probed
+var (
+	kubernetesListSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kubernetes_list_success"),
+		"If the secrets could be listed from the Kubernetes API",
+		nil, nil,
+	)
+	kubernetesSecretsMatched = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kubernetes_secrets_matched"),
+		"The number of TLS secrets that the pattern of the target matched",
+		nil, nil,
+	)
+	kubernetesSecretReadSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kubernetes_secret_read_success"),
+		"If the certificates in the tls.crt of the secret could be read",
+		[]string{"namespace", "secret"}, nil,
+	)
+	kubernetesSecretCerts = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kubernetes_secret_certs"),
+		"The number of certificates in the tls.crt of the secret",
+		[]string{"namespace", "secret"}, nil,
+	)
+	kubernetesSecretNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kubernetes_secret_cert_not_before"),
+		"NotBefore of a certificate in the secret expressed as a Unix Epoch Time",
+		[]string{"namespace", "secret", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	kubernetesSecretNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "kubernetes_secret_cert_not_after"),
+		"NotAfter of a certificate in the secret expressed as a Unix Epoch Time",
+		[]string{"namespace", "secret", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+)
+
+func describeKubernetes(ch chan<- *prometheus.Desc) {
+	ch <- kubernetesListSuccess
+	ch <- kubernetesSecretsMatched
+	ch <- kubernetesSecretReadSuccess
+	ch <- kubernetesSecretCerts
+	ch <- kubernetesSecretNotBefore
+	ch <- kubernetesSecretNotAfter
+}
+
+// CollectSecrets sends the metrics for the certificates of each of the
+// secrets that the pattern of a kubernetes target matched. An error, like a
+// failed list, matches no secrets.
+func CollectSecrets(ch chan<- prometheus.Metric, results []SecretResult, err error, opts Options) {
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(kubernetesListSuccess, prometheus.GaugeValue, 0)
+		ch <- prometheus.MustNewConstMetric(kubernetesSecretsMatched, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(kubernetesListSuccess, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(kubernetesSecretsMatched, prometheus.GaugeValue, float64(len(results)))
+
+	for _, r := range results {
+		if r.Err != nil {
+			ch <- prometheus.MustNewConstMetric(kubernetesSecretReadSuccess, prometheus.GaugeValue, 0, r.Namespace, r.Name)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(kubernetesSecretReadSuccess, prometheus.GaugeValue, 1, r.Namespace, r.Name)
+
+		ch <- prometheus.MustNewConstMetric(kubernetesSecretCerts, prometheus.GaugeValue, float64(len(r.Certs)), r.Namespace, r.Name)
+
+		for _, cert := range uniq(r.Certs) {
+			serialNum := opts.serial(cert)
+			issuerCN := cert.Issuer.CommonName
+			subjectCN := cert.Subject.CommonName
+
+			ch <- prometheus.MustNewConstMetric(kubernetesSecretNotBefore, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), r.Namespace, r.Name, serialNum, issuerCN, subjectCN)
+			ch <- prometheus.MustNewConstMetric(kubernetesSecretNotAfter, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), r.Namespace, r.Name, serialNum, issuerCN, subjectCN)
+		}
+	}
+}
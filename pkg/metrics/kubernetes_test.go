@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Test that the certificates of each secret are sent with namespace and
+// secret labels, and only whether it could be read when it couldn't
+func TestCollectSecrets(t *testing.T) {
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		Issuer:       pkix.Name{CommonName: "letsencrypt"},
+		NotAfter:     time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+
+	mfs := collectSecrets(t, []SecretResult{
+		{Namespace: "ingress", Name: "example-tls", Certs: []*x509.Certificate{cert}},
+		{Namespace: "ingress", Name: "broken-tls", Err: errors.New("no certificates found")},
+	}, nil)
+	if v := mfs["ssl_kubernetes_list_success"].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("expected ssl_kubernetes_list_success 1, got %v", v)
+	}
+	if v := mfs["ssl_kubernetes_secrets_matched"].GetMetric()[0].GetGauge().GetValue(); v != 2 {
+		t.Errorf("expected ssl_kubernetes_secrets_matched 2, got %v", v)
+	}
+	for _, m := range mfs["ssl_kubernetes_secret_read_success"].GetMetric() {
+		want := 1.0
+		if labelValue(m, "secret") == "broken-tls" {
+			want = 0
+		}
+		if v := m.GetGauge().GetValue(); v != want {
+			t.Errorf("%s: expected ssl_kubernetes_secret_read_success %v, got %v", labelValue(m, "secret"), want, v)
+		}
+	}
+	if series := mfs["ssl_kubernetes_secret_certs"].GetMetric(); len(series) != 1 || series[0].GetGauge().GetValue() != 1 {
+		t.Errorf("expected ssl_kubernetes_secret_certs 1 for the one secret that could be read, got %v", series)
+	}
+	series := mfs["ssl_kubernetes_secret_cert_not_after"].GetMetric()
+	if len(series) != 1 {
+		t.Fatalf("expected 1 ssl_kubernetes_secret_cert_not_after series, got %d", len(series))
+	}
+	if labelValue(series[0], "namespace") != "ingress" || labelValue(series[0], "secret") != "example-tls" || series[0].GetGauge().GetValue() != float64(cert.NotAfter.Unix()) {
+		t.Errorf("unexpected ssl_kubernetes_secret_cert_not_after %v", series[0])
+	}
+
+	mfs = collectSecrets(t, nil, errors.New("403 Forbidden"))
+	if v := mfs["ssl_kubernetes_list_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_kubernetes_list_success 0 for a failed list, got %v", v)
+	}
+	if v := mfs["ssl_kubernetes_secrets_matched"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_kubernetes_secrets_matched 0 for a failed list, got %v", v)
+	}
+}
+
+func collectSecrets(t *testing.T, results []SecretResult, err error) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectSecrets(ch, results, err, Options{})
+	}))
+
+	return gather(t, registry)
+}
@@ -0,0 +1,880 @@
+// Package metrics builds the ssl_* metrics from the result of a probe
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Namespace is the prefix of all of the metric names
+const Namespace = "ssl"
+
+// SANMode decides how the subject alternative names of the certificates are
+// reported
+type SANMode string
+
+const (
+	// SANLabels reports the names in the labels of the
+	// ssl_cert_subject_alternative_* metrics. It's the default.
+	SANLabels SANMode = "labels"
+	// SANCount only reports the number of names, for certificates with too
+	// many of them to put in a label
+	SANCount SANMode = "count"
+	// SANNone doesn't report the names at all
+	SANNone SANMode = "none"
+	// SANSeries reports each DNS name as a series of its own in
+	// ssl_cert_san, so they can be matched individually. The IPs and email
+	// addresses are still reported as labels.
+	SANSeries SANMode = "series"
+)
+
+// SerialFormat is how serial numbers are written in the serial_no label
+type SerialFormat string
+
+const (
+	// SerialDecimal writes serial numbers in decimal. It's the default.
+	SerialDecimal SerialFormat = "decimal"
+	// SerialHex writes serial numbers as colon separated, upper case hex
+	// bytes, like 0A:1B:2C, which is how CAs and browsers usually show them
+	SerialHex SerialFormat = "hex"
+)
+
+// Options changes which metrics are collected
+type Options struct {
+	SANs SANMode
+
+	// SANMaxEntries and SANMaxBytes truncate the lists of subject
+	// alternative names in the labels to at most this many names, or this
+	// many bytes, and append a hash of the full list so that the labels
+	// still change when any of the names do. Zero means no limit.
+	SANMaxEntries int
+	SANMaxBytes   int
+
+	SerialFormat SerialFormat
+
+	// ExpiryThresholds sends ssl_cert_expires_within for each certificate
+	// and threshold, which is 1 if the certificate expires within it
+	ExpiryThresholds []time.Duration
+
+	// Baseline checks the leaf against some of the CA/Browser Forum's
+	// Baseline Requirements and sends ssl_cert_baseline_compliant
+	Baseline bool
+
+	// LeafOnly leaves out the metrics of the certificates other than the
+	// leaf. The chain is verified all the same.
+	LeafOnly bool
+
+	// Blackbox also sends probe_success, probe_ssl_earliest_cert_expiry and
+	// probe_tls_version_info, as the blackbox exporter does
+	Blackbox bool
+
+	// Expected sends ssl_cert_matches_expected, which is 1 if the leaf
+	// meets the expectation
+	Expected *Expectation
+}
+
+// Expectation is what the leaf that a target serves should be like. Only the
+// fields that are set are checked.
+type Expectation struct {
+	// Cert is the exact certificate
+	Cert *x509.Certificate
+	// MinNotAfter is the earliest the leaf may expire, like the NotAfter of
+	// a renewed certificate
+	MinNotAfter time.Time
+	Serial      *big.Int
+	// Fingerprint is the SHA-256 of the leaf
+	Fingerprint []byte
+}
+
+// Matches reports whether the leaf meets the expectation
+func (e *Expectation) Matches(leaf *x509.Certificate) bool {
+	if e.Cert != nil && !bytes.Equal(leaf.Raw, e.Cert.Raw) {
+		return false
+	}
+	if !e.MinNotAfter.IsZero() && leaf.NotAfter.Before(e.MinNotAfter) {
+		return false
+	}
+	if e.Serial != nil && (leaf.SerialNumber == nil || leaf.SerialNumber.Cmp(e.Serial) != 0) {
+		return false
+	}
+	if e.Fingerprint != nil {
+		fingerprint := sha256.Sum256(leaf.Raw)
+		if !bytes.Equal(fingerprint[:], e.Fingerprint) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	tlsConnectSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_connect_success"),
+		"If the TLS connection was a success",
+		nil, nil,
+	)
+	clientProtocol = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "client_protocol"),
+		"The protocol used by the exporter to connect to the target",
+		[]string{"protocol"}, nil,
+	)
+	ja3s = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_ja3s"),
+		"The JA3S fingerprint of the server's handshake",
+		[]string{"ja3s"}, nil,
+	)
+	tlsVersion = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_version_info"),
+		"The TLS version of the connection",
+		[]string{"version"}, nil,
+	)
+	tlsCipherSuite = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "tls_cipher_suite_info"),
+		"The cipher suite of the connection",
+		[]string{"cipher"}, nil,
+	)
+	clientCertRequested = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "client_cert_requested"),
+		"If the server asked for a client certificate during the handshake",
+		nil, nil,
+	)
+	clientCertRequired = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "client_cert_required"),
+		"If the server rejected the connection without a client certificate, when it asked for one and none was sent",
+		nil, nil,
+	)
+	matchesExpected = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_matches_expected"),
+		"If the leaf certificate is like the one the target is expected to serve",
+		nil, nil,
+	)
+	clockSkew = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "server_clock_skew_seconds"),
+		"How far the clock of the server, from the Date header of its response, is ahead of the exporter's",
+		nil, nil,
+	)
+	verifySuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "verify_success"),
+		"If the presented chain could be verified against the trust store",
+		[]string{"store"}, nil,
+	)
+	notBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_not_before"),
+		"NotBefore expressed as a Unix Epoch Time",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	notAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_not_after"),
+		"NotAfter expressed as a Unix Epoch Time",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	expiresWithin = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_expires_within"),
+		"If the certificate expires within the threshold",
+		[]string{"serial_no", "issuer_cn", "threshold"}, nil,
+	)
+	validityPeriod = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_validity_period_seconds"),
+		"Length of the validity period of the leaf certificate, from NotBefore to NotAfter",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	extendedValidation = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_ev"),
+		"If the leaf certificate has an Extended Validation policy",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	precertificate = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_precertificate"),
+		"If the leaf certificate is a Certificate Transparency precertificate, which should never be served",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	commonName = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_subject_common_name"),
+		"Subject Common Name",
+		[]string{"serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	keyIdentifiers = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_key_id_info"),
+		"The Authority and Subject Key Identifiers of the certificate, in hex",
+		[]string{"serial_no", "issuer_cn", "authority_key_id", "subject_key_id"}, nil,
+	)
+	certInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_info"),
+		"The SHA-256 fingerprint, public key and signature algorithm of the certificate",
+		[]string{"serial_no", "issuer_cn", "fingerprint_sha256", "key_algorithm", "key_size", "signature_algorithm"}, nil,
+	)
+	subjectAlernativeDNSNames = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_subject_alternative_dnsnames"),
+		"Subject Alternative DNS Names",
+		[]string{"serial_no", "issuer_cn", "dnsnames"}, nil,
+	)
+	subjectAlernativeIPs = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_subject_alternative_ips"),
+		"Subject Alternative IPs",
+		[]string{"serial_no", "issuer_cn", "ips"}, nil,
+	)
+	subjectAlernativeEmailAddresses = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_subject_alternative_emails"),
+		"Subject Alternative Email Addresses",
+		[]string{"serial_no", "issuer_cn", "emails"}, nil,
+	)
+	subjectAlternativeNames = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_subject_alternative_names"),
+		"Number of Subject Alternative Names",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	sanCount = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_san_count"),
+		"Number of Subject Alternative Names of the leaf, of any type",
+		[]string{"serial_no", "issuer_cn"}, nil,
+	)
+	subjectAlternativeName = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_san"),
+		"Subject Alternative DNS Name",
+		[]string{"serial_no", "issuer_cn", "dnsname"}, nil,
+	)
+	chainIssuers = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "chain_issuers"),
+		"Issuer Common Names of the presented chain, in order from the leaf",
+		[]string{"issuers"}, nil,
+	)
+	chainFingerprint = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "chain_fingerprint_sha256"),
+		"SHA-256 fingerprint of the presented chain",
+		[]string{"fingerprint"}, nil,
+	)
+	verifiedNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "verified_cert_not_before"),
+		"NotBefore of a certificate in a verified chain expressed as a Unix Epoch Time",
+		[]string{"chain_no", "position", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	verifiedNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "verified_cert_not_after"),
+		"NotAfter of a certificate in a verified chain expressed as a Unix Epoch Time",
+		[]string{"chain_no", "position", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	subjectOrganizationUnits = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "cert_subject_organization_units"),
+		"Subject Organization Units",
+		[]string{"serial_no", "issuer_cn", "subject_ou"}, nil,
+	)
+)
+
+// Describe sends the descriptions of the metrics
+func Describe(ch chan<- *prometheus.Desc) {
+	ch <- tlsConnectSuccess
+	ch <- clientProtocol
+	ch <- ja3s
+	ch <- tlsVersion
+	ch <- tlsCipherSuite
+	ch <- clientCertRequested
+	ch <- clientCertRequired
+	ch <- verifySuccess
+	ch <- clockSkew
+	ch <- matchesExpected
+	ch <- notBefore
+	ch <- notAfter
+	ch <- expiresWithin
+	ch <- validityPeriod
+	ch <- extendedValidation
+	ch <- precertificate
+	ch <- commonName
+	ch <- keyIdentifiers
+	ch <- certInfo
+	ch <- subjectAlernativeDNSNames
+	ch <- subjectAlernativeIPs
+	ch <- subjectAlernativeEmailAddresses
+	ch <- subjectAlternativeNames
+	ch <- sanCount
+	ch <- subjectAlternativeName
+	ch <- subjectOrganizationUnits
+	ch <- chainIssuers
+	ch <- chainFingerprint
+	ch <- verifiedNotBefore
+	ch <- verifiedNotAfter
+	ch <- baselineCompliant
+	describeBlackbox(ch)
+	describeOCSP(ch)
+	describeCRL(ch)
+	describeCTLog(ch)
+	describeTrustStore(ch)
+	describeFile(ch)
+	describeKubernetes(ch)
+	describeChanges(ch)
+	describeSSH(ch)
+	describeSPIFFE(ch)
+	describeClientProfiles(ch)
+	describeGRPC(ch)
+	describeKafka(ch)
+	describeCertCompression(ch)
+	describeTimings(ch)
+}
+
+// collectClientCert sends whether the server asked for a client certificate,
+// and whether it required one when that could be told, even if the probe
+// failed
+func collectClientCert(ch chan<- prometheus.Metric, req prober.ClientCertRequest) {
+	if req == prober.ClientCertUnknown {
+		return
+	}
+
+	requested := 1.0
+	if req == prober.ClientCertNotRequested {
+		requested = 0
+	}
+	ch <- prometheus.MustNewConstMetric(clientCertRequested, prometheus.GaugeValue, requested)
+
+	switch req {
+	case prober.ClientCertRequired:
+		ch <- prometheus.MustNewConstMetric(clientCertRequired, prometheus.GaugeValue, 1)
+	case prober.ClientCertOptional:
+		ch <- prometheus.MustNewConstMetric(clientCertRequired, prometheus.GaugeValue, 0)
+	}
+}
+
+// Collect sends the metrics for the result of a probe and the error that
+// prober.Probe returned with it
+func Collect(ch chan<- prometheus.Metric, result *prober.Result, err error) {
+	CollectWithOptions(ch, result, err, Options{})
+}
+
+// CollectWithOptions is like Collect, with the metrics chosen by opts
+func CollectWithOptions(ch chan<- prometheus.Metric, result *prober.Result, err error, opts Options) {
+	if opts.Blackbox {
+		collectBlackbox(ch, result, err)
+	}
+
+	if result != nil {
+		protos := []string{"https", "tcp"}
+		if result.Protocol != "https" && result.Protocol != "tcp" {
+			protos = append(protos, result.Protocol)
+		}
+		for _, proto := range protos {
+			value := 0.0
+			if proto == result.Protocol {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				clientProtocol, prometheus.GaugeValue, value, proto,
+			)
+		}
+		collectClientCert(ch, result.ClientCert)
+		for store, err := range result.TrustStoreErrors {
+			success := 1.0
+			if err != nil {
+				success = 0
+			}
+			ch <- prometheus.MustNewConstMetric(verifySuccess, prometheus.GaugeValue, success, store)
+		}
+		collectAddresses(ch, result.Addresses, opts)
+		collectClientProfiles(ch, result.ClientProfiles)
+	}
+
+	if err != nil || result == nil || result.State == nil {
+		ch <- prometheus.MustNewConstMetric(
+			tlsConnectSuccess, prometheus.GaugeValue, 0,
+		)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		tlsConnectSuccess, prometheus.GaugeValue, 1,
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		tlsVersion, prometheus.GaugeValue, 1, tls.VersionName(result.State.Version),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		tlsCipherSuite, prometheus.GaugeValue, 1, tls.CipherSuiteName(result.State.CipherSuite),
+	)
+	if result.ServerHello != nil {
+		ch <- prometheus.MustNewConstMetric(
+			ja3s, prometheus.GaugeValue, 1, result.ServerHello.JA3S(),
+		)
+	}
+	collectCertCompression(ch, result.CertCompression)
+	collectStapledOCSP(ch, result.State)
+	collectGRPCHealth(ch, result.GRPCHealth)
+	collectKafka(ch, result.Kafka, opts)
+	if !result.ServerDate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(clockSkew, prometheus.GaugeValue, result.ClockSkew.Seconds())
+	}
+
+	collectCerts(ch, result.State, opts)
+	collectRedirects(ch, result.Redirects, opts)
+
+	if opts.Expected != nil && len(result.State.PeerCertificates) > 0 {
+		matches := 0.0
+		if opts.Expected.Matches(result.State.PeerCertificates[0]) {
+			matches = 1
+		}
+		ch <- prometheus.MustNewConstMetric(matchesExpected, prometheus.GaugeValue, matches)
+	}
+}
+
+// collectCerts sends the metrics for the chain the server presented
+func collectCerts(ch chan<- prometheus.Metric, state *tls.ConnectionState, opts Options) {
+	if len(state.PeerCertificates) > 0 {
+		h := sha256.New()
+		for _, cert := range state.PeerCertificates {
+			h.Write(cert.Raw)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			chainFingerprint, prometheus.GaugeValue, 1, hex.EncodeToString(h.Sum(nil)),
+		)
+	}
+
+	// Remove duplicate certificates from the response
+	peerCertificates := uniq(state.PeerCertificates)
+
+	if len(peerCertificates) > 0 {
+		var issuers []string
+		for _, cert := range peerCertificates {
+			issuers = append(issuers, cert.Issuer.CommonName)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			chainIssuers, prometheus.GaugeValue, 1, ","+strings.Join(issuers, ",")+",",
+		)
+	}
+
+	now := time.Now()
+	for i, cert := range peerCertificates {
+		if i > 0 && opts.LeafOnly {
+			break
+		}
+		collectCert(ch, cert, i == 0, opts, now)
+	}
+	collectVerifiedChains(ch, state, opts)
+	if opts.LeafOnly {
+		return
+	}
+
+	// The roots that the chain was verified through come from the trust
+	// store, as servers don't send them, and are labelled with from_store
+	for _, root := range storeRoots(state, peerCertificates) {
+		WithLabel(ch, "from_store", "true", func(ch chan<- prometheus.Metric) {
+			collectCert(ch, root, false, opts, now)
+		})
+	}
+}
+
+// collectCert sends the metrics of a certificate. Some of them are only for
+// the leaf.
+func collectCert(ch chan<- prometheus.Metric, cert *x509.Certificate, leaf bool, opts Options, now time.Time) {
+	subjectCN := cert.Subject.CommonName
+	issuerCN := cert.Issuer.CommonName
+	subjectDNSNames := cert.DNSNames
+	subjectEmails := cert.EmailAddresses
+	subjectIPs := cert.IPAddresses
+	serialNum := opts.serial(cert)
+	subjectOUs := cert.Subject.OrganizationalUnit
+
+	if !cert.NotAfter.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			notAfter, prometheus.GaugeValue, float64(cert.NotAfter.UnixNano()/1e9), serialNum, issuerCN,
+		)
+	}
+
+	if !cert.NotBefore.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			notBefore, prometheus.GaugeValue, float64(cert.NotBefore.UnixNano()/1e9), serialNum, issuerCN,
+		)
+	}
+
+	for _, threshold := range opts.ExpiryThresholds {
+		within := 0.0
+		if now.Add(threshold).After(cert.NotAfter) {
+			within = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			expiresWithin, prometheus.GaugeValue, within, serialNum, issuerCN, model.Duration(threshold).String(),
+		)
+	}
+
+	// The limits on the validity period, like the CA/Browser Forum's 398
+	// days, only apply to the leaf
+	if leaf && !cert.NotBefore.IsZero() && !cert.NotAfter.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			validityPeriod, prometheus.GaugeValue, cert.NotAfter.Sub(cert.NotBefore).Seconds(), serialNum, issuerCN,
+		)
+	}
+
+	if leaf {
+		ev := 0.0
+		if isEV(cert) {
+			ev = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			extendedValidation, prometheus.GaugeValue, ev, serialNum, issuerCN,
+		)
+
+		precert := 0.0
+		if isPrecertificate(cert) {
+			precert = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			precertificate, prometheus.GaugeValue, precert, serialNum, issuerCN,
+		)
+
+		// The count is cheap, whatever san_metrics is, and it's what the
+		// limits of CAs on the names of a certificate are about
+		ch <- prometheus.MustNewConstMetric(
+			sanCount, prometheus.GaugeValue, float64(len(subjectDNSNames)+len(subjectEmails)+len(subjectIPs)+len(cert.URIs)), serialNum, issuerCN,
+		)
+	}
+
+	if leaf && opts.Baseline {
+		collectBaseline(ch, cert, serialNum)
+	}
+
+	if subjectCN != "" {
+		ch <- prometheus.MustNewConstMetric(
+			commonName, prometheus.GaugeValue, 1, serialNum, issuerCN, subjectCN,
+		)
+	}
+
+	// The key identifiers link each certificate to its issuer, whose
+	// subject_key_id is the authority_key_id of the certificate
+	if len(cert.AuthorityKeyId) > 0 || len(cert.SubjectKeyId) > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			keyIdentifiers, prometheus.GaugeValue, 1, serialNum, issuerCN, hex.EncodeToString(cert.AuthorityKeyId), hex.EncodeToString(cert.SubjectKeyId),
+		)
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	ch <- prometheus.MustNewConstMetric(
+		certInfo, prometheus.GaugeValue, 1, serialNum, issuerCN, hex.EncodeToString(fingerprint[:]),
+		cert.PublicKeyAlgorithm.String(), strconv.Itoa(keySize(cert)), cert.SignatureAlgorithm.String(),
+	)
+
+	switch opts.SANs {
+	case SANNone:
+	case SANCount:
+		ch <- prometheus.MustNewConstMetric(
+			subjectAlternativeNames, prometheus.GaugeValue, float64(len(subjectDNSNames)+len(subjectEmails)+len(subjectIPs)), serialNum, issuerCN,
+		)
+	default:
+		if opts.SANs == SANSeries {
+			for _, name := range uniqStrings(subjectDNSNames) {
+				ch <- prometheus.MustNewConstMetric(
+					subjectAlternativeName, prometheus.GaugeValue, 1, serialNum, issuerCN, name,
+				)
+			}
+		} else if len(subjectDNSNames) > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				subjectAlernativeDNSNames, prometheus.GaugeValue, 1, serialNum, issuerCN, opts.joinSANs(subjectDNSNames),
+			)
+		}
+
+		if len(subjectEmails) > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				subjectAlernativeEmailAddresses, prometheus.GaugeValue, 1, serialNum, issuerCN, opts.joinSANs(subjectEmails),
+			)
+		}
+
+		if len(subjectIPs) > 0 {
+			var ips []string
+			for _, ip := range subjectIPs {
+				ips = append(ips, ip.String())
+			}
+			ch <- prometheus.MustNewConstMetric(
+				subjectAlernativeIPs, prometheus.GaugeValue, 1, serialNum, issuerCN, opts.joinSANs(ips),
+			)
+		}
+	}
+
+	if len(subjectOUs) > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			subjectOrganizationUnits, prometheus.GaugeValue, 1, serialNum, issuerCN, ","+strings.Join(subjectOUs, ",")+",",
+		)
+	}
+}
+
+// keySize returns the size of the public key of the certificate in bits: the
+// modulus of RSA and DSA keys and the curve of ECDSA and Ed25519 keys. It's 0
+// for keys that can't be parsed.
+func keySize(cert *x509.Certificate) int {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	case *dsa.PublicKey:
+		return key.P.BitLen()
+	}
+	return 0
+}
+
+// collectVerifiedChains sends the dates of the certificates in each of the
+// chains that the presented certificates were verified through, which is
+// the chain that clients trust, with cross-signed intermediates and roots
+// from the trust store that the server didn't send. The chains are numbered
+// from 0, and the certificates in them by their position from the leaf.
+func collectVerifiedChains(ch chan<- prometheus.Metric, state *tls.ConnectionState, opts Options) {
+	for i, chain := range state.VerifiedChains {
+		chainNo := strconv.Itoa(i)
+		for position, cert := range chain {
+			if position > 0 && opts.LeafOnly {
+				break
+			}
+			labels := []string{chainNo, strconv.Itoa(position), opts.serial(cert), cert.Issuer.CommonName, cert.Subject.CommonName}
+			ch <- prometheus.MustNewConstMetric(verifiedNotBefore, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), labels...)
+			ch <- prometheus.MustNewConstMetric(verifiedNotAfter, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), labels...)
+		}
+	}
+}
+
+// storeRoots returns the roots of the verified chains that aren't among the
+// certificates the server presented
+func storeRoots(state *tls.ConnectionState, presented []*x509.Certificate) []*x509.Certificate {
+	var roots []*x509.Certificate
+	for _, chain := range state.VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		roots = append(roots, chain[len(chain)-1])
+	}
+
+	var fromStore []*x509.Certificate
+	for _, root := range uniq(roots) {
+		found := false
+		for _, cert := range presented {
+			if bytes.Equal(cert.Raw, root.Raw) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fromStore = append(fromStore, root)
+		}
+	}
+	return fromStore
+}
+
+// WithLabel sends the metrics that fn sends with an extra label, like the
+// address or the port of one of several probes of a target
+func WithLabel(ch chan<- prometheus.Metric, name, value string, fn func(ch chan<- prometheus.Metric)) {
+	labelled := make(chan prometheus.Metric)
+	go func() {
+		defer close(labelled)
+		fn(labelled)
+	}()
+
+	for m := range labelled {
+		ch <- labelledMetric{Metric: m, name: name, value: value}
+	}
+}
+
+// collectRedirects sends ssl_tls_connect_success and the certificate metrics
+// for each https hop of the redirects, with a redirect_step label that counts
+// the hops from 1. The metrics of the target itself don't have the label.
+func collectRedirects(ch chan<- prometheus.Metric, redirects []prober.Redirect, opts Options) {
+	for i, r := range redirects {
+		if r.State == nil && r.Err == nil {
+			continue
+		}
+
+		WithLabel(ch, "redirect_step", strconv.Itoa(i+1), func(ch chan<- prometheus.Metric) {
+			if r.Err != nil {
+				ch <- prometheus.MustNewConstMetric(tlsConnectSuccess, prometheus.GaugeValue, 0)
+				return
+			}
+			ch <- prometheus.MustNewConstMetric(tlsConnectSuccess, prometheus.GaugeValue, 1)
+			collectCerts(ch, r.State, opts)
+		})
+	}
+}
+
+// collectAddresses sends the result of the probe of each of the addresses of
+// the target, with an address label
+func collectAddresses(ch chan<- prometheus.Metric, addresses []prober.AddressResult, opts Options) {
+	for _, a := range addresses {
+		WithLabel(ch, "address", a.Address, func(ch chan<- prometheus.Metric) {
+			if a.Err != nil || a.State == nil {
+				ch <- prometheus.MustNewConstMetric(tlsConnectSuccess, prometheus.GaugeValue, 0)
+				return
+			}
+			ch <- prometheus.MustNewConstMetric(tlsConnectSuccess, prometheus.GaugeValue, 1)
+			collectCerts(ch, a.State, opts)
+		})
+	}
+}
+
+// labelledMetric adds a label to a metric, like the redirect_step of the
+// metrics of a redirect
+type labelledMetric struct {
+	prometheus.Metric
+	name  string
+	value string
+}
+
+func (m labelledMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	name, value := m.name, m.value
+	out.Label = append(out.Label, &dto.LabelPair{Name: &name, Value: &value})
+	sort.Slice(out.Label, func(i, j int) bool {
+		return out.Label[i].GetName() < out.Label[j].GetName()
+	})
+	return nil
+}
+
+// Collector is a prometheus.Collector that probes a target each time it's
+// collected, so that it can be registered with any registry
+type Collector struct {
+	Target  string
+	Timeout time.Duration
+	Options prober.Options
+
+	// Metrics chooses the metrics that are collected
+	Metrics Options
+}
+
+// NewCollector returns a Collector for the target
+func NewCollector(target string, timeout time.Duration, opts prober.Options) *Collector {
+	return &Collector{
+		Target:  target,
+		Timeout: timeout,
+		Options: opts,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	result, err := prober.Probe(ctx, c.Target, c.Options)
+	CollectWithOptions(ch, result, err, c.Metrics)
+}
+
+// ctPoison is the OID of the critical extension that makes a certificate a
+// precertificate, from RFC 6962
+var ctPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+// isPrecertificate reports whether the certificate has the CT poison
+// extension
+func isPrecertificate(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(ctPoison) {
+			return true
+		}
+	}
+	return false
+}
+
+// serial formats the serial number of the certificate
+func (o Options) serial(cert *x509.Certificate) string {
+	if o.SerialFormat != SerialHex {
+		return cert.SerialNumber.String()
+	}
+
+	b := cert.SerialNumber.Bytes()
+	if len(b) == 0 {
+		return "00"
+	}
+
+	s := make([]string, len(b))
+	for i := range b {
+		s[i] = fmt.Sprintf("%02X", b[i])
+	}
+
+	return strings.Join(s, ":")
+}
+
+// joinSANs joins the names with commas, truncating the list to the limits
+// in the options. A truncated list ends with the number of names that were
+// left out and a hash of the full list, like ",a,b,+3 sha256:0123456789abcdef,".
+func (o Options) joinSANs(names []string) string {
+	full := "," + strings.Join(names, ",") + ","
+
+	n := len(names)
+	if o.SANMaxEntries > 0 && n > o.SANMaxEntries {
+		n = o.SANMaxEntries
+	}
+	if o.SANMaxBytes > 0 {
+		length := 1
+		for i := 0; i < n; i++ {
+			length += len(names[i]) + 1
+			if length > o.SANMaxBytes {
+				n = i
+				break
+			}
+		}
+	}
+	if n == len(names) {
+		return full
+	}
+
+	sum := sha256.Sum256([]byte(full))
+	truncated := "," + strings.Join(names[:n], ",") + ","
+	if n == 0 {
+		truncated = ","
+	}
+
+	return truncated + "+" + strconv.Itoa(len(names)-n) + " sha256:" + hex.EncodeToString(sum[:8]) + ","
+}
+
+// uniqStrings removes duplicates, which would otherwise be reported as
+// duplicate series
+func uniqStrings(s []string) []string {
+	seen := map[string]bool{}
+	r := []string{}
+
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			r = append(r, v)
+		}
+	}
+
+	return r
+}
+
+func uniq(certs []*x509.Certificate) []*x509.Certificate {
+	r := []*x509.Certificate{}
+
+	for _, c := range certs {
+		if !contains(r, c) {
+			r = append(r, c)
+		}
+	}
+
+	return r
+}
+
+func contains(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if (c.SerialNumber.String() == cert.SerialNumber.String()) && (c.Issuer.CommonName == cert.Issuer.CommonName) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,751 @@
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that a Collector can be registered with a registry of its own
+func TestCollector(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(server.URL, time.Second, prober.Options{
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}))
+
+	mfs := gather(t, registry)
+	if v := mfs["ssl_tls_connect_success"].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("expected ssl_tls_connect_success 1, got %v", v)
+	}
+	if _, ok := mfs["ssl_cert_not_after"]; !ok {
+		t.Errorf("expected ssl_cert_not_after")
+	}
+	for _, m := range mfs["ssl_client_protocol"].GetMetric() {
+		value := m.GetGauge().GetValue()
+		if proto := m.GetLabel()[0].GetValue(); (proto == "https") != (value == 1) {
+			t.Errorf("unexpected ssl_client_protocol{protocol=%q} %v", proto, value)
+		}
+	}
+}
+
+// Test that a failed probe only reports the protocol and connection failure
+func TestCollectError(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		Collect(ch, &prober.Result{Protocol: "tcp"}, errors.New("connection refused"))
+	}))
+
+	mfs := gather(t, registry)
+	if len(mfs) != 2 {
+		t.Errorf("expected 2 metric families, got %d", len(mfs))
+	}
+	if v := mfs["ssl_tls_connect_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_tls_connect_success 0, got %v", v)
+	}
+}
+
+// Test that the subject alternative names can be counted or left out
+func TestCollectSANs(t *testing.T) {
+	cert := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		DNSNames:       []string{"example.com", "www.example.com"},
+		EmailAddresses: []string{"admin@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	result := &prober.Result{
+		Protocol: "https",
+		State:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+	}
+
+	names := []string{
+		"ssl_cert_subject_alternative_dnsnames",
+		"ssl_cert_subject_alternative_emails",
+		"ssl_cert_subject_alternative_ips",
+	}
+
+	for mode, want := range map[SANMode][]string{
+		"":        names,
+		SANLabels: names,
+		SANCount:  {"ssl_cert_subject_alternative_names"},
+		SANSeries: {"ssl_cert_san", "ssl_cert_subject_alternative_emails", "ssl_cert_subject_alternative_ips"},
+		SANNone:   nil,
+	} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+			CollectWithOptions(ch, result, nil, Options{SANs: mode})
+		}))
+
+		wanted := map[string]bool{}
+		for _, name := range want {
+			wanted[name] = true
+		}
+
+		mfs := gather(t, registry)
+		for _, name := range append(names, "ssl_cert_subject_alternative_names", "ssl_cert_san") {
+			if _, ok := mfs[name]; ok != wanted[name] {
+				t.Errorf("san mode %q: expected %s to be reported: %t, got %t", mode, name, wanted[name], ok)
+			}
+		}
+		if mode == SANCount {
+			if v := mfs["ssl_cert_subject_alternative_names"].GetMetric()[0].GetGauge().GetValue(); v != 4 {
+				t.Errorf("expected ssl_cert_subject_alternative_names 4, got %v", v)
+			}
+		}
+		if mode == SANSeries {
+			if n := len(mfs["ssl_cert_san"].GetMetric()); n != 2 {
+				t.Errorf("expected a ssl_cert_san series for each of the 2 DNS names, got %d", n)
+			}
+		}
+	}
+}
+
+// Test that the names of the leaf are counted with any san_metrics
+func TestCollectSANCount(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/web")
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{
+				SerialNumber:   big.NewInt(1),
+				DNSNames:       []string{"example.com", "www.example.com"},
+				EmailAddresses: []string{"admin@example.com"},
+				IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+				URIs:           []*url.URL{uri},
+			},
+			{SerialNumber: big.NewInt(2), DNSNames: []string{"ca.example.com"}},
+		}},
+	}
+
+	for _, mode := range []SANMode{"", SANCount, SANSeries, SANNone} {
+		mfs := collect(t, result, nil, Options{SANs: mode})
+		metrics := mfs["ssl_cert_san_count"].GetMetric()
+		if len(metrics) != 1 {
+			t.Fatalf("san mode %q: expected 1 ssl_cert_san_count, got %d", mode, len(metrics))
+		}
+		if v := metrics[0].GetGauge().GetValue(); v != 5 || labelValue(metrics[0], "serial_no") != "1" {
+			t.Errorf("san mode %q: expected ssl_cert_san_count 5 for the leaf, got %v for %s", mode, v, labelValue(metrics[0], "serial_no"))
+		}
+	}
+}
+
+// Test that long lists of subject alternative names are truncated with a hash
+// of the full list
+func TestJoinSANs(t *testing.T) {
+	names := []string{"a.example", "b.example", "c.example"}
+
+	if v := (Options{}).joinSANs(names); v != ",a.example,b.example,c.example," {
+		t.Errorf("unexpected untruncated list %s", v)
+	}
+	if v := (Options{SANMaxEntries: 3, SANMaxBytes: 100}).joinSANs(names); v != ",a.example,b.example,c.example," {
+		t.Errorf("expected a list within the limits to be left alone, got %s", v)
+	}
+
+	byEntries := (Options{SANMaxEntries: 2}).joinSANs(names)
+	if !strings.HasPrefix(byEntries, ",a.example,b.example,+1 sha256:") || !strings.HasSuffix(byEntries, ",") {
+		t.Errorf("unexpected list truncated by entries %s", byEntries)
+	}
+	byBytes := (Options{SANMaxBytes: 21}).joinSANs(names)
+	if byBytes != byEntries {
+		t.Errorf("expected %s, got %s", byEntries, byBytes)
+	}
+	if v := (Options{SANMaxBytes: 5}).joinSANs(names); !strings.HasPrefix(v, ",+3 sha256:") {
+		t.Errorf("unexpected list truncated to nothing %s", v)
+	}
+
+	changed := (Options{SANMaxEntries: 2}).joinSANs([]string{"a.example", "b.example", "d.example"})
+	if changed == byEntries {
+		t.Errorf("expected the hash to change with the names that were left out")
+	}
+}
+
+// Test that the issuers of the chain are summarised in order
+func TestCollectChainIssuers(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{SerialNumber: big.NewInt(1), Issuer: pkix.Name{CommonName: "Intermediate CA"}},
+			{SerialNumber: big.NewInt(2), Issuer: pkix.Name{CommonName: "Root CA"}},
+			{SerialNumber: big.NewInt(2), Issuer: pkix.Name{CommonName: "Root CA"}},
+		}},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	if v := mfs["ssl_chain_issuers"].GetMetric()[0].GetLabel()[0].GetValue(); v != ",Intermediate CA,Root CA," {
+		t.Errorf("expected the issuers ,Intermediate CA,Root CA, got %s", v)
+	}
+}
+
+// Test that the fingerprint of the chain changes with any of its certificates
+func TestCollectChainFingerprint(t *testing.T) {
+	fingerprint := func(raws ...string) string {
+		var certs []*x509.Certificate
+		for i, raw := range raws {
+			certs = append(certs, &x509.Certificate{SerialNumber: big.NewInt(int64(i)), Raw: []byte(raw)})
+		}
+		result := &prober.Result{Protocol: "https", State: &tls.ConnectionState{PeerCertificates: certs}}
+
+		mfs := collect(t, result, nil, Options{})
+		return mfs["ssl_chain_fingerprint_sha256"].GetMetric()[0].GetLabel()[0].GetValue()
+	}
+
+	chain := fingerprint("leaf", "intermediate")
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte("leafintermediate"))); chain != want {
+		t.Errorf("expected the fingerprint %s, got %s", want, chain)
+	}
+	if fingerprint("leaf", "other intermediate") == chain {
+		t.Errorf("expected the fingerprint to change with the intermediate")
+	}
+	if fingerprint("leaf") == chain {
+		t.Errorf("expected the fingerprint to change when the intermediate is missing")
+	}
+}
+
+// Test that the validity period is only reported for the leaf
+func TestCollectValidityPeriod(t *testing.T) {
+	notBefore := time.Now().Truncate(time.Second)
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{SerialNumber: big.NewInt(1), NotBefore: notBefore, NotAfter: notBefore.Add(90 * 24 * time.Hour)},
+			{SerialNumber: big.NewInt(2), NotBefore: notBefore, NotAfter: notBefore.Add(10 * 365 * 24 * time.Hour)},
+		}},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	metrics := mfs["ssl_cert_validity_period_seconds"].GetMetric()
+	if len(metrics) != 1 {
+		t.Fatalf("expected 1 ssl_cert_validity_period_seconds, got %d", len(metrics))
+	}
+	if v := metrics[0].GetGauge().GetValue(); v != (90 * 24 * time.Hour).Seconds() {
+		t.Errorf("expected a validity period of 90 days, got %vs", v)
+	}
+}
+
+// Test that EV policies are detected on the leaf
+func TestCollectEV(t *testing.T) {
+	for _, test := range []struct {
+		policies []asn1.ObjectIdentifier
+		ev       float64
+	}{
+		{nil, 0},
+		{[]asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}}, 0},
+		{[]asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}, {2, 23, 140, 1, 1}}, 1},
+		{[]asn1.ObjectIdentifier{{2, 16, 840, 1, 114412, 2, 1}}, 1},
+	} {
+		result := &prober.Result{
+			Protocol: "https",
+			State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{SerialNumber: big.NewInt(1), PolicyIdentifiers: test.policies},
+			}},
+		}
+
+		mfs := collect(t, result, nil, Options{})
+		if v := mfs["ssl_cert_ev"].GetMetric()[0].GetGauge().GetValue(); v != test.ev {
+			t.Errorf("%v: expected ssl_cert_ev %v, got %v", test.policies, test.ev, v)
+		}
+	}
+}
+
+// Test that precertificates are detected by their poison extension
+func TestCollectPrecertificate(t *testing.T) {
+	for _, test := range []struct {
+		extensions []pkix.Extension
+		precert    float64
+	}{
+		{nil, 0},
+		{[]pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 17}}}, 0},
+		{[]pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}, Critical: true, Value: []byte{5, 0}}}, 1},
+	} {
+		result := &prober.Result{
+			Protocol: "https",
+			State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{SerialNumber: big.NewInt(1), Extensions: test.extensions},
+			}},
+		}
+
+		mfs := collect(t, result, nil, Options{})
+		if v := mfs["ssl_cert_precertificate"].GetMetric()[0].GetGauge().GetValue(); v != test.precert {
+			t.Errorf("%v: expected ssl_cert_precertificate %v, got %v", test.extensions, test.precert, v)
+		}
+	}
+}
+
+// Test that there's a series for each expiry threshold
+func TestCollectExpiresWithin(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(10 * 24 * time.Hour)},
+		}},
+	}
+
+	mfs := collect(t, result, nil, Options{ExpiryThresholds: []time.Duration{7 * 24 * time.Hour, 30 * 24 * time.Hour}})
+
+	within := map[string]float64{}
+	for _, m := range mfs["ssl_cert_expires_within"].GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "threshold" {
+				within[l.GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	if len(within) != 2 || within["7d"] != 0 || within["30d"] != 1 {
+		t.Errorf("expected the certificate to expire within 30d but not 7d, got %v", within)
+	}
+}
+
+// Test that the client certificate request is reported, even when the probe
+// failed, and that whether it's required is only reported when it's known
+func TestCollectClientCert(t *testing.T) {
+	for req, expected := range map[prober.ClientCertRequest][2]float64{
+		prober.ClientCertNotRequested: {0, -1},
+		prober.ClientCertRequested:    {1, -1},
+		prober.ClientCertOptional:     {1, 0},
+		prober.ClientCertRequired:     {1, 1},
+		prober.ClientCertUnknown:      {-1, -1},
+	} {
+		var err error
+		if req == prober.ClientCertRequired {
+			err = errors.New("remote error: tls: certificate required")
+		}
+
+		mfs := collect(t, &prober.Result{Protocol: "https", ClientCert: req}, err, Options{})
+		for i, name := range []string{"ssl_client_cert_requested", "ssl_client_cert_required"} {
+			v := -1.0
+			if mf, ok := mfs[name]; ok {
+				v = mf.GetMetric()[0].GetGauge().GetValue()
+			}
+			if v != expected[i] {
+				t.Errorf("%q: expected %s %v, got %v", req, name, expected[i], v)
+			}
+		}
+	}
+}
+
+// Test that the JA3S fingerprint is reported when the ServerHello was read
+func TestCollectJA3S(t *testing.T) {
+	result := &prober.Result{
+		Protocol:    "tcp",
+		State:       &tls.ConnectionState{},
+		ServerHello: &prober.ServerHello{Version: 771, CipherSuite: 4865, Extensions: []uint16{43, 51}},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	if v := mfs["ssl_tls_ja3s"].GetMetric()[0].GetLabel()[0].GetValue(); v != "f4febc55ea12b31ae17cfb7e614afda8" {
+		t.Errorf("unexpected ja3s %s", v)
+	}
+
+	result.ServerHello = nil
+	if _, ok := collect(t, result, nil, Options{})["ssl_tls_ja3s"]; ok {
+		t.Errorf("expected no ssl_tls_ja3s without a ServerHello")
+	}
+}
+
+// Test that the version and cipher suite of the connection are sent by name
+func TestCollectTLSVersionCipherSuite(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "tcp",
+		State:    &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	if v := labelValue(mfs["ssl_tls_version_info"].GetMetric()[0], "version"); v != "TLS 1.2" {
+		t.Errorf("expected ssl_tls_version_info{version=\"TLS 1.2\"}, got %s", v)
+	}
+	if v := labelValue(mfs["ssl_tls_cipher_suite_info"].GetMetric()[0], "cipher"); v != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+		t.Errorf("expected ssl_tls_cipher_suite_info{cipher=\"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\"}, got %s", v)
+	}
+
+	if _, ok := collect(t, result, errors.New("connection refused"), Options{})["ssl_tls_version_info"]; ok {
+		t.Errorf("expected no ssl_tls_version_info for a failed probe")
+	}
+}
+
+// Test that the clock skew is reported, including a negative one, when there
+// was a Date
+func TestCollectClockSkew(t *testing.T) {
+	result := &prober.Result{
+		Protocol:   "https",
+		State:      &tls.ConnectionState{},
+		ServerDate: time.Now(),
+		ClockSkew:  -90 * time.Second,
+	}
+
+	mfs := collect(t, result, nil, Options{})
+	if v := mfs["ssl_server_clock_skew_seconds"].GetMetric()[0].GetGauge().GetValue(); v != -90 {
+		t.Errorf("expected ssl_server_clock_skew_seconds -90, got %v", v)
+	}
+
+	result.ServerDate = time.Time{}
+	if _, ok := collect(t, result, nil, Options{})["ssl_server_clock_skew_seconds"]; ok {
+		t.Errorf("expected no ssl_server_clock_skew_seconds without a Date")
+	}
+}
+
+// Test that the leaf is checked against each part of the expectation, when
+// there is one
+func TestCollectMatchesExpected(t *testing.T) {
+	leaf := &x509.Certificate{Raw: []byte("leaf"), SerialNumber: big.NewInt(1), NotAfter: time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)}
+	result := &prober.Result{
+		Protocol: "https",
+		State:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}},
+	}
+	fingerprint := sha256.Sum256([]byte("leaf"))
+	stale := sha256.Sum256([]byte("stale"))
+
+	for name, tc := range map[string]struct {
+		expected *Expectation
+		want     float64
+	}{
+		"cert":                {&Expectation{Cert: &x509.Certificate{Raw: []byte("leaf")}}, 1},
+		"other cert":          {&Expectation{Cert: &x509.Certificate{Raw: []byte("stale")}}, 0},
+		"min not after":       {&Expectation{MinNotAfter: leaf.NotAfter}, 1},
+		"later min not after": {&Expectation{MinNotAfter: leaf.NotAfter.Add(time.Second)}, 0},
+		"serial":              {&Expectation{Serial: big.NewInt(1)}, 1},
+		"other serial":        {&Expectation{Serial: big.NewInt(2)}, 0},
+		"fingerprint":         {&Expectation{Fingerprint: fingerprint[:]}, 1},
+		"other fingerprint":   {&Expectation{Fingerprint: stale[:]}, 0},
+		"all":                 {&Expectation{MinNotAfter: leaf.NotAfter, Serial: big.NewInt(1), Fingerprint: fingerprint[:]}, 1},
+		"all but one":         {&Expectation{MinNotAfter: leaf.NotAfter, Serial: big.NewInt(2), Fingerprint: fingerprint[:]}, 0},
+	} {
+		mfs := collect(t, result, nil, Options{Expected: tc.expected})
+		if v := mfs["ssl_cert_matches_expected"].GetMetric()[0].GetGauge().GetValue(); v != tc.want {
+			t.Errorf("%s: expected ssl_cert_matches_expected %v, got %v", name, tc.want, v)
+		}
+	}
+
+	if _, ok := collect(t, result, nil, Options{})["ssl_cert_matches_expected"]; ok {
+		t.Errorf("expected no ssl_cert_matches_expected without an expectation")
+	}
+}
+
+// Test that the verification against each trust store is reported, even
+// when the probe failed
+func TestCollectTrustStores(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "tcp",
+		TrustStoreErrors: map[string]error{
+			"mozilla": nil,
+			"corp-ca": errors.New("x509: certificate signed by unknown authority"),
+		},
+	}
+
+	mfs := collect(t, result, errors.New("x509: certificate signed by unknown authority"), Options{})
+	success := map[string]float64{}
+	for _, m := range mfs["ssl_verify_success"].GetMetric() {
+		success[labelValue(m, "store")] = m.GetGauge().GetValue()
+	}
+	if len(success) != 2 || success["mozilla"] != 1 || success["corp-ca"] != 0 {
+		t.Errorf("unexpected ssl_verify_success %v", success)
+	}
+}
+
+// Test that the https hops of the redirects are reported with a
+// redirect_step label
+func TestCollectRedirects(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{SerialNumber: big.NewInt(1), NotAfter: time.Unix(100, 0)},
+		}},
+		Redirects: []prober.Redirect{
+			{URL: "http://example.com/"},
+			{URL: "https://cdn.example.com/", State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{SerialNumber: big.NewInt(2), NotAfter: time.Unix(200, 0)},
+			}}},
+			{URL: "https://broken.example.com/", Err: errors.New("connection refused")},
+		},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+
+	notAfter := map[string]float64{}
+	for _, m := range mfs["ssl_cert_not_after"].GetMetric() {
+		notAfter[labelValue(m, "redirect_step")] = m.GetGauge().GetValue()
+	}
+	if len(notAfter) != 2 || notAfter[""] != 100 || notAfter["2"] != 200 {
+		t.Errorf("unexpected ssl_cert_not_after %v", notAfter)
+	}
+
+	success := map[string]float64{}
+	for _, m := range mfs["ssl_tls_connect_success"].GetMetric() {
+		success[labelValue(m, "redirect_step")] = m.GetGauge().GetValue()
+	}
+	if len(success) != 3 || success[""] != 1 || success["2"] != 1 || success["3"] != 0 {
+		t.Errorf("unexpected ssl_tls_connect_success %v", success)
+	}
+}
+
+// Test that the key identifiers are sent for the certificates that have
+// them
+func TestCollectKeyIdentifiers(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{Raw: []byte("leaf"), SerialNumber: big.NewInt(1), AuthorityKeyId: []byte{0xab, 0xcd}, SubjectKeyId: []byte{0x01, 0x02}},
+			{Raw: []byte("intermediate"), SerialNumber: big.NewInt(2), SubjectKeyId: []byte{0xab, 0xcd}},
+			{Raw: []byte("legacy"), SerialNumber: big.NewInt(3)},
+		}},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+
+	ids := map[string][2]string{}
+	for _, m := range mfs["ssl_cert_key_id_info"].GetMetric() {
+		ids[labelValue(m, "serial_no")] = [2]string{labelValue(m, "authority_key_id"), labelValue(m, "subject_key_id")}
+	}
+	if len(ids) != 2 || ids["1"] != [2]string{"abcd", "0102"} || ids["2"] != [2]string{"", "abcd"} {
+		t.Errorf("unexpected ssl_cert_key_id_info %v", ids)
+	}
+}
+
+// Test that the fingerprint, the key and the signature algorithm are sent for
+// each certificate, so that weak keys and SHA-1 signatures can be alerted on
+func TestCollectCertInfo(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			{
+				Raw:                []byte("leaf"),
+				SerialNumber:       big.NewInt(1),
+				PublicKeyAlgorithm: x509.ECDSA,
+				PublicKey:          &ecKey.PublicKey,
+				SignatureAlgorithm: x509.SHA256WithRSA,
+			},
+			{
+				Raw:                []byte("intermediate"),
+				SerialNumber:       big.NewInt(2),
+				PublicKeyAlgorithm: x509.RSA,
+				PublicKey:          &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023), E: 65537},
+				SignatureAlgorithm: x509.SHA1WithRSA,
+			},
+		}},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+
+	info := map[string][4]string{}
+	for _, m := range mfs["ssl_cert_info"].GetMetric() {
+		info[labelValue(m, "serial_no")] = [4]string{
+			labelValue(m, "fingerprint_sha256"), labelValue(m, "key_algorithm"), labelValue(m, "key_size"), labelValue(m, "signature_algorithm"),
+		}
+	}
+	leaf := sha256.Sum256([]byte("leaf"))
+	if info["1"] != [4]string{fmt.Sprintf("%x", leaf), "ECDSA", "384", "SHA256-RSA"} {
+		t.Errorf("unexpected ssl_cert_info for the leaf %v", info["1"])
+	}
+	if i := info["2"]; i[1] != "RSA" || i[2] != "1024" || i[3] != "SHA1-RSA" {
+		t.Errorf("unexpected ssl_cert_info for the intermediate %v", info["2"])
+	}
+}
+
+// Test that the roots of the verified chains that the server didn't present
+// are sent with from_store="true"
+func TestCollectStoreRoots(t *testing.T) {
+	leaf := &x509.Certificate{Raw: []byte("leaf"), SerialNumber: big.NewInt(1), NotAfter: time.Unix(300, 0)}
+	intermediate := &x509.Certificate{Raw: []byte("intermediate"), SerialNumber: big.NewInt(2), NotAfter: time.Unix(200, 0)}
+	root := &x509.Certificate{Raw: []byte("root"), SerialNumber: big.NewInt(3), NotAfter: time.Unix(100, 0)}
+	crossSigned := &x509.Certificate{Raw: []byte("cross-signed"), SerialNumber: big.NewInt(4), NotAfter: time.Unix(400, 0)}
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf, intermediate, crossSigned},
+			VerifiedChains: [][]*x509.Certificate{
+				{leaf, intermediate, root},
+				{leaf, intermediate, crossSigned},
+				{leaf, intermediate, root},
+			},
+		},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+
+	fromStore := map[string]string{}
+	for _, m := range mfs["ssl_cert_not_after"].GetMetric() {
+		fromStore[labelValue(m, "serial_no")] = labelValue(m, "from_store")
+	}
+	want := map[string]string{"1": "", "2": "", "3": "true", "4": ""}
+	if !reflect.DeepEqual(fromStore, want) {
+		t.Errorf("expected ssl_cert_not_after with from_store %v, got %v", want, fromStore)
+	}
+	if n := len(mfs["ssl_cert_ev"].GetMetric()); n != 1 {
+		t.Errorf("expected ssl_cert_ev for the leaf only, got %d", n)
+	}
+}
+
+// Test that the dates of the certificates of each verified chain are sent
+// with the number of the chain and their position in it
+func TestCollectVerifiedChains(t *testing.T) {
+	leaf := &x509.Certificate{Raw: []byte("leaf"), SerialNumber: big.NewInt(1), NotAfter: time.Unix(300, 0)}
+	intermediate := &x509.Certificate{Raw: []byte("intermediate"), SerialNumber: big.NewInt(2), NotAfter: time.Unix(200, 0)}
+	root := &x509.Certificate{Raw: []byte("root"), SerialNumber: big.NewInt(3), NotAfter: time.Unix(100, 0)}
+	crossSigned := &x509.Certificate{Raw: []byte("cross-signed"), SerialNumber: big.NewInt(4), NotAfter: time.Unix(400, 0)}
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf, intermediate},
+			VerifiedChains: [][]*x509.Certificate{
+				{leaf, intermediate, root},
+				{leaf, crossSigned},
+			},
+		},
+	}
+
+	mfs := collect(t, result, nil, Options{})
+
+	got := map[string]float64{}
+	for _, m := range mfs["ssl_verified_cert_not_after"].GetMetric() {
+		got[labelValue(m, "chain_no")+"/"+labelValue(m, "position")+"/"+labelValue(m, "serial_no")] = m.GetGauge().GetValue()
+	}
+	want := map[string]float64{"0/0/1": 300, "0/1/2": 200, "0/2/3": 100, "1/0/1": 300, "1/1/4": 400}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected ssl_verified_cert_not_after %v, got %v", want, got)
+	}
+	if n := len(mfs["ssl_verified_cert_not_before"].GetMetric()); n != 5 {
+		t.Errorf("expected 5 ssl_verified_cert_not_before series, got %d", n)
+	}
+
+	result.State.VerifiedChains = nil
+	mfs = collect(t, result, nil, Options{})
+	if _, ok := mfs["ssl_verified_cert_not_after"]; ok {
+		t.Errorf("expected no ssl_verified_cert_not_after without verified chains")
+	}
+}
+
+// Test that only the metrics of the leaf are sent with LeafOnly
+func TestCollectLeafOnly(t *testing.T) {
+	leaf := &x509.Certificate{Raw: []byte("leaf"), SerialNumber: big.NewInt(1), NotAfter: time.Unix(300, 0)}
+	intermediate := &x509.Certificate{Raw: []byte("intermediate"), SerialNumber: big.NewInt(2), NotAfter: time.Unix(200, 0)}
+	root := &x509.Certificate{Raw: []byte("root"), SerialNumber: big.NewInt(3), NotAfter: time.Unix(100, 0)}
+	result := &prober.Result{
+		Protocol: "https",
+		State: &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf, intermediate},
+			VerifiedChains:   [][]*x509.Certificate{{leaf, intermediate, root}},
+		},
+	}
+
+	mfs := collect(t, result, nil, Options{LeafOnly: true})
+	metrics := mfs["ssl_cert_not_after"].GetMetric()
+	if len(metrics) != 1 || labelValue(metrics[0], "serial_no") != "1" {
+		t.Errorf("expected ssl_cert_not_after for the leaf only, got %v", metrics)
+	}
+	if metrics := mfs["ssl_verified_cert_not_after"].GetMetric(); len(metrics) != 1 || labelValue(metrics[0], "position") != "0" {
+		t.Errorf("expected ssl_verified_cert_not_after for the leaf only, got %v", metrics)
+	}
+	if _, ok := mfs["ssl_chain_issuers"]; !ok {
+		t.Errorf("expected ssl_chain_issuers")
+	}
+}
+
+// Test that the result of each address is sent with an address label, even
+// when the probe of the target failed
+func TestCollectAddresses(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "tcp",
+		Addresses: []prober.AddressResult{
+			{Address: "192.0.2.1", State: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{SerialNumber: big.NewInt(1), NotAfter: time.Unix(100, 0)},
+			}}},
+			{Address: "2001:db8::1", Err: errors.New("connection refused")},
+		},
+	}
+
+	mfs := collect(t, result, errors.New("connection refused"), Options{})
+
+	notAfter := map[string]float64{}
+	for _, m := range mfs["ssl_cert_not_after"].GetMetric() {
+		notAfter[labelValue(m, "address")] = m.GetGauge().GetValue()
+	}
+	if len(notAfter) != 1 || notAfter["192.0.2.1"] != 100 {
+		t.Errorf("unexpected ssl_cert_not_after %v", notAfter)
+	}
+
+	success := map[string]float64{}
+	for _, m := range mfs["ssl_tls_connect_success"].GetMetric() {
+		success[labelValue(m, "address")] = m.GetGauge().GetValue()
+	}
+	if len(success) != 3 || success[""] != 0 || success["192.0.2.1"] != 1 || success["2001:db8::1"] != 0 {
+		t.Errorf("unexpected ssl_tls_connect_success %v", success)
+	}
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// Test that serial numbers can be formatted as hex
+func TestSerial(t *testing.T) {
+	for serial, want := range map[int64][2]string{
+		0:      {"0", "00"},
+		10:     {"10", "0A"},
+		703710: {"703710", "0A:BC:DE"},
+	} {
+		cert := &x509.Certificate{SerialNumber: big.NewInt(serial)}
+		if v := (Options{}).serial(cert); v != want[0] {
+			t.Errorf("expected the decimal serial %s, got %s", want[0], v)
+		}
+		if v := (Options{SerialFormat: SerialHex}).serial(cert); v != want[1] {
+			t.Errorf("expected the hex serial %s, got %s", want[1], v)
+		}
+	}
+}
+
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {
+	Describe(ch)
+}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+func gather(t *testing.T, g prometheus.Gatherer) map[string]*dto.MetricFamily {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		result[mf.GetName()] = mf
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"crypto/tls"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+	"golang.org/x/crypto/ocsp"
+)
+
+// The metrics below are for probes of OCSP responders, rather than of TLS
+// servers, and for the responses that TLS servers staple
+var (
+	ocspResponderUp = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_responder_up"),
+		"If the OCSP responder gave a response for the certificate",
+		nil, nil,
+	)
+	ocspResponderDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_responder_duration_seconds"),
+		"How long the OCSP responder took to respond",
+		nil, nil,
+	)
+	ocspResponseStapled = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_response_stapled"),
+		"If the target stapled an OCSP response to the handshake",
+		nil, nil,
+	)
+	ocspResponseValid = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_response_valid"),
+		"If the OCSP response is signed by the issuer and within its validity period",
+		nil, nil,
+	)
+	ocspResponseStatus = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_response_status"),
+		"The status of the certificate in the OCSP response",
+		[]string{"status"}, nil,
+	)
+	ocspResponseThisUpdate = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_response_this_update"),
+		"ThisUpdate of the OCSP response expressed as a Unix Epoch Time",
+		nil, nil,
+	)
+	ocspResponseNextUpdate = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_response_next_update"),
+		"NextUpdate of the OCSP response expressed as a Unix Epoch Time",
+		nil, nil,
+	)
+	ocspResponseRevokedAt = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ocsp_response_revoked_at"),
+		"When the certificate was revoked, according to the OCSP response, expressed as a Unix Epoch Time",
+		nil, nil,
+	)
+)
+
+var ocspStatuses = map[int]string{
+	ocsp.Good:    "good",
+	ocsp.Revoked: "revoked",
+	ocsp.Unknown: "unknown",
+}
+
+func describeOCSP(ch chan<- *prometheus.Desc) {
+	ch <- ocspResponderUp
+	ch <- ocspResponderDuration
+	ch <- ocspResponseStapled
+	ch <- ocspResponseValid
+	ch <- ocspResponseStatus
+	ch <- ocspResponseThisUpdate
+	ch <- ocspResponseNextUpdate
+	ch <- ocspResponseRevokedAt
+}
+
+// CollectOCSP sends the metrics for the result of a probe of an OCSP
+// responder and the error that prober.ProbeOCSP returned with it
+func CollectOCSP(ch chan<- prometheus.Metric, result *prober.OCSPResult, err error) {
+	up := 1.0
+	if err != nil || result == nil || result.Response == nil {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(ocspResponderUp, prometheus.GaugeValue, up)
+
+	if result == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(ocspResponderDuration, prometheus.GaugeValue, result.Duration.Seconds())
+
+	if err != nil {
+		return
+	}
+	CollectOCSPResponse(ch, result)
+}
+
+// collectStapledOCSP sends whether the server stapled an OCSP response to
+// the handshake and, if it could be parsed, the status of the leaf in it
+func collectStapledOCSP(ch chan<- prometheus.Metric, state *tls.ConnectionState) {
+	if len(state.OCSPResponse) == 0 || len(state.PeerCertificates) == 0 {
+		ch <- prometheus.MustNewConstMetric(ocspResponseStapled, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(ocspResponseStapled, prometheus.GaugeValue, 1)
+
+	result, err := prober.ParseOCSPResponse(state.OCSPResponse, state.PeerCertificates[0], prober.LeafIssuer(state))
+	if err != nil {
+		return
+	}
+	CollectOCSPResponse(ch, result)
+}
+
+// CollectOCSPResponse sends the validity of an OCSP response and the status
+// of the certificate in it, like one that the leaf's responder gave when the
+// server didn't staple one
+func CollectOCSPResponse(ch chan<- prometheus.Metric, result *prober.OCSPResult) {
+	resp := result.Response
+	if resp == nil {
+		return
+	}
+
+	valid := 1.0
+	if result.ResponseErr != nil {
+		valid = 0
+	}
+	ch <- prometheus.MustNewConstMetric(ocspResponseValid, prometheus.GaugeValue, valid)
+
+	for status, name := range ocspStatuses {
+		value := 0.0
+		if status == resp.Status {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(ocspResponseStatus, prometheus.GaugeValue, value, name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(ocspResponseThisUpdate, prometheus.GaugeValue, float64(resp.ThisUpdate.Unix()))
+	if !resp.NextUpdate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(ocspResponseNextUpdate, prometheus.GaugeValue, float64(resp.NextUpdate.Unix()))
+	}
+	if resp.Status == ocsp.Revoked {
+		ch <- prometheus.MustNewConstMetric(ocspResponseRevokedAt, prometheus.GaugeValue, float64(resp.RevokedAt.Unix()))
+	}
+}
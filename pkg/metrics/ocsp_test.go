@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Test that the status and validity of an OCSP response are sent, and only
+// the availability of a responder that failed
+func TestCollectOCSP(t *testing.T) {
+	thisUpdate := time.Now().Add(-time.Hour).Truncate(time.Second)
+	result := &prober.OCSPResult{
+		Duration: 250 * time.Millisecond,
+		Response: &ocsp.Response{
+			Status:     ocsp.Revoked,
+			RevokedAt:  thisUpdate.Add(-time.Hour),
+			ThisUpdate: thisUpdate,
+			NextUpdate: thisUpdate.Add(2 * time.Hour),
+		},
+	}
+
+	mfs := collectOCSP(t, result, nil)
+	for name, want := range map[string]float64{
+		"ssl_ocsp_responder_up":               1,
+		"ssl_ocsp_responder_duration_seconds": 0.25,
+		"ssl_ocsp_response_valid":             1,
+		"ssl_ocsp_response_this_update":       float64(thisUpdate.Unix()),
+		"ssl_ocsp_response_next_update":       float64(thisUpdate.Add(2 * time.Hour).Unix()),
+		"ssl_ocsp_response_revoked_at":        float64(thisUpdate.Add(-time.Hour).Unix()),
+	} {
+		if v := mfs[name].GetMetric()[0].GetGauge().GetValue(); v != want {
+			t.Errorf("expected %s %v, got %v", name, want, v)
+		}
+	}
+	for _, m := range mfs["ssl_ocsp_response_status"].GetMetric() {
+		want := 0.0
+		if labelValue(m, "status") == "revoked" {
+			want = 1
+		}
+		if v := m.GetGauge().GetValue(); v != want {
+			t.Errorf("expected ssl_ocsp_response_status{status=%q} %v, got %v", labelValue(m, "status"), want, v)
+		}
+	}
+
+	result.ResponseErr = errors.New("expired")
+	mfs = collectOCSP(t, result, nil)
+	if v := mfs["ssl_ocsp_response_valid"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_ocsp_response_valid 0, got %v", v)
+	}
+
+	mfs = collectOCSP(t, &prober.OCSPResult{Duration: time.Second}, errors.New("503 Service Unavailable"))
+	if v := mfs["ssl_ocsp_responder_up"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_ocsp_responder_up 0, got %v", v)
+	}
+	if _, ok := mfs["ssl_ocsp_responder_duration_seconds"]; !ok {
+		t.Errorf("expected the duration of a responder that responded with an error")
+	}
+	if _, ok := mfs["ssl_ocsp_response_status"]; ok {
+		t.Errorf("expected no ssl_ocsp_response_status without a response")
+	}
+}
+
+func collectOCSP(t *testing.T, result *prober.OCSPResult, err error) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectOCSP(ch, result, err)
+	}))
+
+	return gather(t, registry)
+}
+
+// Test that whether the server stapled a response is sent, and the status of
+// the leaf only when the response can be parsed
+func TestCollectStapledOCSP(t *testing.T) {
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	for _, test := range []struct {
+		staple  []byte
+		stapled float64
+	}{
+		{staple: nil, stapled: 0},
+		{staple: []byte("not a response"), stapled: 1},
+	} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+			collectStapledOCSP(ch, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}, OCSPResponse: test.staple})
+		}))
+		mfs := gather(t, registry)
+
+		if v := mfs["ssl_ocsp_response_stapled"].GetMetric()[0].GetGauge().GetValue(); v != test.stapled {
+			t.Errorf("%q: expected ssl_ocsp_response_stapled %v, got %v", test.staple, test.stapled, v)
+		}
+		if _, ok := mfs["ssl_ocsp_response_status"]; ok {
+			t.Errorf("%q: expected no ssl_ocsp_response_status", test.staple)
+		}
+	}
+}
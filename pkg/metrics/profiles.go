@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"crypto/tls"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// The metrics below are for the handshakes of the client profiles, which
+// mimic old clients
+var (
+	clientProfileSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "client_profile_success"),
+		"If a handshake with the versions and cipher suites of the client profile was successful",
+		[]string{"profile"}, nil,
+	)
+	clientProfileCipher = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "client_profile_cipher_info"),
+		"The version and cipher suite that the target chose for the client profile",
+		[]string{"profile", "version", "cipher_suite"}, nil,
+	)
+)
+
+func describeClientProfiles(ch chan<- *prometheus.Desc) {
+	ch <- clientProfileSuccess
+	ch <- clientProfileCipher
+}
+
+// collectClientProfiles sends the results of the handshakes of each of the
+// client profiles. They're sent even if the probe failed, as it's the old
+// clients that may still connect.
+func collectClientProfiles(ch chan<- prometheus.Metric, profiles []prober.ClientProfileResult) {
+	for _, p := range profiles {
+		if p.Err != nil || p.State == nil {
+			ch <- prometheus.MustNewConstMetric(clientProfileSuccess, prometheus.GaugeValue, 0, p.Profile)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(clientProfileSuccess, prometheus.GaugeValue, 1, p.Profile)
+		ch <- prometheus.MustNewConstMetric(
+			clientProfileCipher, prometheus.GaugeValue, 1,
+			p.Profile, tls.VersionName(p.State.Version), tls.CipherSuiteName(p.State.CipherSuite),
+		)
+	}
+}
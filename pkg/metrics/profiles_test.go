@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the client profiles are reported, even when the probe failed, with
+// the version and cipher suite of those that connected
+func TestCollectClientProfiles(t *testing.T) {
+	result := &prober.Result{
+		Protocol: "tcp",
+		ClientProfiles: []prober.ClientProfileResult{
+			{Profile: "java8", State: &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+			{Profile: "no-ecc", Err: errors.New("handshake failure")},
+		},
+	}
+
+	for _, err := range []error{nil, errors.New("connection refused")} {
+		mfs := collect(t, result, err, Options{})
+		for _, m := range mfs["ssl_client_profile_success"].GetMetric() {
+			want := 0.0
+			if labelValue(m, "profile") == "java8" {
+				want = 1
+			}
+			if v := m.GetGauge().GetValue(); v != want {
+				t.Errorf("expected ssl_client_profile_success{profile=%q} %v, got %v", labelValue(m, "profile"), want, v)
+			}
+		}
+
+		metrics := mfs["ssl_client_profile_cipher_info"].GetMetric()
+		if len(metrics) != 1 {
+			t.Fatalf("expected ssl_client_profile_cipher_info for java8 only, got %d", len(metrics))
+		}
+		if v, c := labelValue(metrics[0], "version"), labelValue(metrics[0], "cipher_suite"); v != "TLS 1.2" || c != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+			t.Errorf("unexpected version %s and cipher suite %s", v, c)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// The metrics below are for probes of SPIFFE workloads, whose SVIDs are
+// verified against a trust bundle rather than the names of the targets
+var (
+	spiffeProbeSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_probe_success"),
+		"If the X.509-SVIDs of the workload could be fetched, from the Workload API or the TLS server",
+		nil, nil,
+	)
+	spiffeSVIDs = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_svids"),
+		"The number of X.509-SVIDs of the workload",
+		nil, nil,
+	)
+	spiffeSVIDValid = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_svid_valid"),
+		"If the X.509-SVID has a SPIFFE ID and can be verified against the trust bundle of its trust domain",
+		[]string{"spiffe_id", "trust_domain", "serial_no"}, nil,
+	)
+	spiffeSVIDNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_svid_not_before"),
+		"NotBefore of the leaf of the X.509-SVID expressed as a Unix Epoch Time",
+		[]string{"spiffe_id", "trust_domain", "serial_no"}, nil,
+	)
+	spiffeSVIDNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_svid_not_after"),
+		"NotAfter of the leaf of the X.509-SVID expressed as a Unix Epoch Time",
+		[]string{"spiffe_id", "trust_domain", "serial_no"}, nil,
+	)
+	spiffeBundleCerts = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_bundle_certs"),
+		"The number of X.509 authorities in the trust bundle",
+		[]string{"trust_domain", "source"}, nil,
+	)
+	spiffeBundleNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_bundle_not_after"),
+		"The earliest NotAfter of the X.509 authorities in the trust bundle expressed as a Unix Epoch Time",
+		[]string{"trust_domain", "source"}, nil,
+	)
+	spiffeBundleModified = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_bundle_modified"),
+		"When the file of the trust bundle was last changed expressed as a Unix Epoch Time",
+		[]string{"trust_domain", "source"}, nil,
+	)
+	spiffeBundleSequence = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_bundle_sequence"),
+		"The spiffe_sequence of the trust bundle, which increases with each update of the bundle",
+		[]string{"trust_domain", "source"}, nil,
+	)
+	spiffeBundleRefreshHint = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "spiffe_bundle_refresh_hint_seconds"),
+		"The spiffe_refresh_hint of the trust bundle, how often it should be refreshed",
+		[]string{"trust_domain", "source"}, nil,
+	)
+)
+
+func describeSPIFFE(ch chan<- *prometheus.Desc) {
+	ch <- spiffeProbeSuccess
+	ch <- spiffeSVIDs
+	ch <- spiffeSVIDValid
+	ch <- spiffeSVIDNotBefore
+	ch <- spiffeSVIDNotAfter
+	ch <- spiffeBundleCerts
+	ch <- spiffeBundleNotAfter
+	ch <- spiffeBundleModified
+	ch <- spiffeBundleSequence
+	ch <- spiffeBundleRefreshHint
+}
+
+// CollectSPIFFE sends the metrics for the result of prober.ProbeSPIFFE and
+// the error that it returned with it. The bundle is the trust bundle of the
+// configuration, if there is one, which is reported with the file source and
+// those of the Workload API with the workload_api source.
+func CollectSPIFFE(ch chan<- prometheus.Metric, result *prober.SPIFFEResult, bundle *prober.SPIFFEBundle, err error, opts Options) {
+	// The bundle of the configuration is read before the probe, so it's
+	// reported even when the probe fails
+	if bundle != nil {
+		collectSPIFFEBundle(ch, bundle, "file")
+	}
+
+	if err != nil || result == nil {
+		ch <- prometheus.MustNewConstMetric(spiffeProbeSuccess, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(spiffeProbeSuccess, prometheus.GaugeValue, 1)
+
+	ch <- prometheus.MustNewConstMetric(spiffeSVIDs, prometheus.GaugeValue, float64(len(result.SVIDs)))
+	for _, svid := range result.SVIDs {
+		leaf := svid.Certificates[0]
+		labels := []string{svid.ID, svid.TrustDomain(), opts.serial(leaf)}
+
+		var valid float64
+		if svid.VerifyErr == nil {
+			valid = 1
+		}
+		ch <- prometheus.MustNewConstMetric(spiffeSVIDValid, prometheus.GaugeValue, valid, labels...)
+		ch <- prometheus.MustNewConstMetric(spiffeSVIDNotBefore, prometheus.GaugeValue, float64(leaf.NotBefore.Unix()), labels...)
+		ch <- prometheus.MustNewConstMetric(spiffeSVIDNotAfter, prometheus.GaugeValue, float64(leaf.NotAfter.Unix()), labels...)
+	}
+
+	for _, b := range result.Bundles {
+		collectSPIFFEBundle(ch, b, "workload_api")
+	}
+}
+
+// collectSPIFFEBundle sends the metrics for a trust bundle. The sequence and
+// the refresh hint are left out for bundles that don't have them.
+func collectSPIFFEBundle(ch chan<- prometheus.Metric, bundle *prober.SPIFFEBundle, source string) {
+	labels := []string{bundle.TrustDomain, source}
+
+	ch <- prometheus.MustNewConstMetric(spiffeBundleCerts, prometheus.GaugeValue, float64(len(bundle.Roots)), labels...)
+
+	var notAfter time.Time
+	for _, root := range bundle.Roots {
+		if notAfter.IsZero() || root.NotAfter.Before(notAfter) {
+			notAfter = root.NotAfter
+		}
+	}
+	if !notAfter.IsZero() {
+		ch <- prometheus.MustNewConstMetric(spiffeBundleNotAfter, prometheus.GaugeValue, float64(notAfter.Unix()), labels...)
+	}
+
+	if !bundle.Modified.IsZero() {
+		ch <- prometheus.MustNewConstMetric(spiffeBundleModified, prometheus.GaugeValue, float64(bundle.Modified.Unix()), labels...)
+	}
+	if bundle.Sequence != nil {
+		ch <- prometheus.MustNewConstMetric(spiffeBundleSequence, prometheus.GaugeValue, float64(*bundle.Sequence), labels...)
+	}
+	if bundle.RefreshHint > 0 {
+		ch <- prometheus.MustNewConstMetric(spiffeBundleRefreshHint, prometheus.GaugeValue, bundle.RefreshHint.Seconds(), labels...)
+	}
+}
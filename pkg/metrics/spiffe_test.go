@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that the SVIDs and the bundles are sent, with the sequence, refresh
+// hint and modification time only for the bundles that have them
+func TestCollectSPIFFE(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	id, _ := url.Parse("spiffe://example.org/web")
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		URIs:         []*url.URL{id},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+	}
+	roots := []*x509.Certificate{
+		{SerialNumber: big.NewInt(1), NotAfter: now.Add(48 * time.Hour)},
+		{SerialNumber: big.NewInt(2), NotAfter: now.Add(24 * time.Hour)},
+	}
+	sequence := uint64(3)
+
+	result := &prober.SPIFFEResult{
+		SVIDs: []*prober.SVID{
+			{ID: id.String(), Certificates: []*x509.Certificate{leaf}},
+			{Certificates: []*x509.Certificate{{SerialNumber: big.NewInt(8)}}, VerifyErr: errors.New("the leaf has no SPIFFE ID")},
+		},
+		Bundles: []*prober.SPIFFEBundle{{TrustDomain: "example.org", Roots: roots[:1]}},
+	}
+	bundle := &prober.SPIFFEBundle{TrustDomain: "example.org", Roots: roots, Sequence: &sequence, RefreshHint: 5 * time.Minute, Modified: now}
+
+	mfs := collectSPIFFE(t, result, bundle, nil)
+	for name, want := range map[string]float64{
+		"ssl_spiffe_probe_success":               1,
+		"ssl_spiffe_svids":                       2,
+		"ssl_spiffe_bundle_modified":             float64(now.Unix()),
+		"ssl_spiffe_bundle_sequence":             3,
+		"ssl_spiffe_bundle_refresh_hint_seconds": 300,
+	} {
+		if v := mfs[name].GetMetric()[0].GetGauge().GetValue(); v != want {
+			t.Errorf("expected %s %v, got %v", name, want, v)
+		}
+	}
+
+	for _, m := range mfs["ssl_spiffe_svid_valid"].GetMetric() {
+		want := 0.0
+		if labelValue(m, "spiffe_id") == "spiffe://example.org/web" {
+			want = 1
+			if labelValue(m, "trust_domain") != "example.org" || labelValue(m, "serial_no") != "7" {
+				t.Errorf("unexpected labels %v", m.GetLabel())
+			}
+		}
+		if v := m.GetGauge().GetValue(); v != want {
+			t.Errorf("expected ssl_spiffe_svid_valid{spiffe_id=%q} %v, got %v", labelValue(m, "spiffe_id"), want, v)
+		}
+	}
+
+	for _, m := range mfs["ssl_spiffe_bundle_not_after"].GetMetric() {
+		want := now.Add(24 * time.Hour)
+		if labelValue(m, "source") == "workload_api" {
+			want = now.Add(48 * time.Hour)
+		}
+		if v := m.GetGauge().GetValue(); v != float64(want.Unix()) {
+			t.Errorf("expected ssl_spiffe_bundle_not_after{source=%q} %v, got %v", labelValue(m, "source"), want.Unix(), v)
+		}
+	}
+	for _, name := range []string{"ssl_spiffe_bundle_modified", "ssl_spiffe_bundle_sequence", "ssl_spiffe_bundle_refresh_hint_seconds"} {
+		if metrics := mfs[name].GetMetric(); len(metrics) != 1 || labelValue(metrics[0], "source") != "file" {
+			t.Errorf("expected %s for the bundle of the file only", name)
+		}
+	}
+
+	mfs = collectSPIFFE(t, nil, bundle, errors.New("connection refused"))
+	if v := mfs["ssl_spiffe_probe_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_spiffe_probe_success 0, got %v", v)
+	}
+	if _, ok := mfs["ssl_spiffe_bundle_certs"]; !ok {
+		t.Errorf("expected the bundle of the file for a failed probe")
+	}
+	if _, ok := mfs["ssl_spiffe_svids"]; ok {
+		t.Errorf("expected no ssl_spiffe_svids for a failed probe")
+	}
+}
+
+func collectSPIFFE(t *testing.T, result *prober.SPIFFEResult, bundle *prober.SPIFFEBundle, err error) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectSPIFFE(ch, result, bundle, err, Options{})
+	}))
+
+	return gather(t, registry)
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+	"golang.org/x/crypto/ssh"
+)
+
+// The metrics below are for the OpenSSH certificates of SSH servers and of
+// files, rather than for X.509 certificates
+var (
+	sshProbeSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ssh_probe_success"),
+		"If the host key of the SSH server, or the certificates in the file, could be read",
+		nil, nil,
+	)
+	sshCerts = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ssh_certs"),
+		"The number of OpenSSH certificates, which is 0 for a SSH server without a host certificate",
+		nil, nil,
+	)
+	sshCertValidAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ssh_cert_valid_after"),
+		"ValidAfter of the OpenSSH certificate expressed as a Unix Epoch Time",
+		[]string{"type", "key_id", "serial_no", "key_fingerprint"}, nil,
+	)
+	sshCertValidBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ssh_cert_valid_before"),
+		"ValidBefore of the OpenSSH certificate expressed as a Unix Epoch Time",
+		[]string{"type", "key_id", "serial_no", "key_fingerprint"}, nil,
+	)
+	sshCertInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "ssh_cert_info"),
+		"The principals and the fingerprint of the CA key of the OpenSSH certificate",
+		[]string{"type", "key_id", "serial_no", "key_fingerprint", "principals", "ca_fingerprint"}, nil,
+	)
+)
+
+var sshCertTypes = map[uint32]string{
+	ssh.HostCert: "host",
+	ssh.UserCert: "user",
+}
+
+func describeSSH(ch chan<- *prometheus.Desc) {
+	ch <- sshProbeSuccess
+	ch <- sshCerts
+	ch <- sshCertValidAfter
+	ch <- sshCertValidBefore
+	ch <- sshCertInfo
+}
+
+// CollectSSH sends the metrics for the result of prober.ProbeSSH or
+// prober.ReadSSHCertificates and the error that it returned with it
+func CollectSSH(ch chan<- prometheus.Metric, result *prober.SSHResult, err error) {
+	if err != nil || result == nil {
+		ch <- prometheus.MustNewConstMetric(sshProbeSuccess, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(sshProbeSuccess, prometheus.GaugeValue, 1)
+
+	// The same certificate can be in a file more than once
+	var certs []*ssh.Certificate
+	seen := map[string]bool{}
+	for _, cert := range result.Certificates {
+		if raw := string(cert.Marshal()); !seen[raw] {
+			seen[raw] = true
+			certs = append(certs, cert)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(sshCerts, prometheus.GaugeValue, float64(len(certs)))
+
+	for _, cert := range certs {
+		labels := []string{
+			sshCertTypes[cert.CertType],
+			cert.KeyId,
+			strconv.FormatUint(cert.Serial, 10),
+			ssh.FingerprintSHA256(cert.Key),
+		}
+
+		ch <- prometheus.MustNewConstMetric(sshCertValidAfter, prometheus.GaugeValue, float64(cert.ValidAfter), labels...)
+		// Certificates that are valid forever don't have a ValidBefore
+		if cert.ValidBefore != ssh.CertTimeInfinity {
+			ch <- prometheus.MustNewConstMetric(sshCertValidBefore, prometheus.GaugeValue, float64(cert.ValidBefore), labels...)
+		}
+
+		principals := ","
+		if len(cert.ValidPrincipals) > 0 {
+			principals = "," + strings.Join(cert.ValidPrincipals, ",") + ","
+		}
+		ch <- prometheus.MustNewConstMetric(
+			sshCertInfo, prometheus.GaugeValue, 1, append(labels, principals, ssh.FingerprintSHA256(cert.SignatureKey))...,
+		)
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+	"golang.org/x/crypto/ssh"
+)
+
+// Test that the validity windows and CA keys of the certificates are sent,
+// without a ValidBefore for a certificate that's valid forever
+func TestCollectSSH(t *testing.T) {
+	ca := testSSHSigner(t)
+	host := testSSHSigner(t)
+	user := testSSHSigner(t)
+
+	certs := []*ssh.Certificate{
+		{Key: host.PublicKey(), CertType: ssh.HostCert, KeyId: "host", Serial: 1, ValidPrincipals: []string{"a.example.com", "b.example.com"}, ValidAfter: 100, ValidBefore: 200},
+		{Key: user.PublicKey(), CertType: ssh.UserCert, KeyId: "user", Serial: 2, ValidAfter: 300, ValidBefore: ssh.CertTimeInfinity},
+	}
+	for _, cert := range certs {
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfs := collectSSH(t, &prober.SSHResult{Certificates: append(certs, certs[0])}, nil)
+	if v := mfs["ssl_ssh_probe_success"].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("expected ssl_ssh_probe_success 1, got %v", v)
+	}
+	if v := mfs["ssl_ssh_certs"].GetMetric()[0].GetGauge().GetValue(); v != 2 {
+		t.Errorf("expected ssl_ssh_certs 2, got %v", v)
+	}
+
+	validAfter := map[string]float64{}
+	for _, m := range mfs["ssl_ssh_cert_valid_after"].GetMetric() {
+		validAfter[labelValue(m, "type")+"/"+labelValue(m, "key_id")] = m.GetGauge().GetValue()
+	}
+	if len(validAfter) != 2 || validAfter["host/host"] != 100 || validAfter["user/user"] != 300 {
+		t.Errorf("unexpected ssl_ssh_cert_valid_after %v", validAfter)
+	}
+	if metrics := mfs["ssl_ssh_cert_valid_before"].GetMetric(); len(metrics) != 1 || metrics[0].GetGauge().GetValue() != 200 {
+		t.Errorf("expected ssl_ssh_cert_valid_before 200 for the host certificate only, got %v", metrics)
+	}
+
+	for _, m := range mfs["ssl_ssh_cert_info"].GetMetric() {
+		if v := labelValue(m, "ca_fingerprint"); v != ssh.FingerprintSHA256(ca.PublicKey()) {
+			t.Errorf("unexpected ca_fingerprint %s", v)
+		}
+		if labelValue(m, "key_id") == "host" && labelValue(m, "principals") != ",a.example.com,b.example.com," {
+			t.Errorf("unexpected principals %s", labelValue(m, "principals"))
+		}
+	}
+
+	mfs = collectSSH(t, nil, errors.New("connection refused"))
+	if v := mfs["ssl_ssh_probe_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_ssh_probe_success 0, got %v", v)
+	}
+	if _, ok := mfs["ssl_ssh_certs"]; ok {
+		t.Errorf("expected no ssl_ssh_certs for a failed probe")
+	}
+}
+
+func collectSSH(t *testing.T, result *prober.SSHResult, err error) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectSSH(ch, result, err)
+	}))
+
+	return gather(t, registry)
+}
+
+func testSSHSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics below time the probe, like the blackbox exporter's
+// probe_duration_seconds
+var (
+	probeDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "probe", "duration_seconds"),
+		"How long the probe took to complete, in seconds",
+		nil, nil,
+	)
+	probePhase = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "probe", "phase_seconds"),
+		"How long each phase of the probe took, in seconds: resolve, dial, starttls, handshake and verify",
+		[]string{"phase"}, nil,
+	)
+)
+
+func describeTimings(ch chan<- *prometheus.Desc) {
+	ch <- probeDuration
+	ch <- probePhase
+}
+
+// CollectTimings sends how long the probe took, and how long each of the
+// phases that it went through took
+func CollectTimings(ch chan<- prometheus.Metric, duration time.Duration, phases map[string]time.Duration) {
+	ch <- prometheus.MustNewConstMetric(probeDuration, prometheus.GaugeValue, duration.Seconds())
+	for phase, d := range phases {
+		ch <- prometheus.MustNewConstMetric(probePhase, prometheus.GaugeValue, d.Seconds(), phase)
+	}
+}
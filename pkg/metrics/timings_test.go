@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Test that the duration of the probe and of each phase are sent in seconds
+func TestCollectTimings(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectTimings(ch, 1500*time.Millisecond, map[string]time.Duration{
+			"dial":      100 * time.Millisecond,
+			"handshake": 250 * time.Millisecond,
+		})
+	}))
+	mfs := gather(t, registry)
+
+	if v := mfs["ssl_probe_duration_seconds"].GetMetric()[0].GetGauge().GetValue(); v != 1.5 {
+		t.Errorf("expected ssl_probe_duration_seconds 1.5, got %v", v)
+	}
+	phases := map[string]float64{}
+	for _, m := range mfs["ssl_probe_phase_seconds"].GetMetric() {
+		phases[labelValue(m, "phase")] = m.GetGauge().GetValue()
+	}
+	if phases["dial"] != 0.1 || phases["handshake"] != 0.25 || len(phases) != 2 {
+		t.Errorf("unexpected ssl_probe_phase_seconds %v", phases)
+	}
+}
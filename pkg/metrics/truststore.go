@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TrustStoreCert is a certificate in a trust store, with the alias of the
+// entry of a keystore that it's in, which PKCS#12 stores call its friendly
+// name. The certificates of PEM bundles don't have one.
+type TrustStoreCert struct {
+	Alias string
+	Cert  *x509.Certificate
+}
+
+// The metrics below are for the certificates in trust store files, which are
+// read rather than probed
+var (
+	trustStoreReadSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "truststore_read_success"),
+		"If the certificates of the trust store could be read",
+		nil, nil,
+	)
+	trustStoreCerts = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "truststore_certs"),
+		"The number of certificates in the trust store",
+		nil, nil,
+	)
+	trustStoreNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "truststore_cert_not_before"),
+		"NotBefore of a certificate in the trust store expressed as a Unix Epoch Time",
+		[]string{"alias", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	trustStoreNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "truststore_cert_not_after"),
+		"NotAfter of a certificate in the trust store expressed as a Unix Epoch Time",
+		[]string{"alias", "serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+)
+
+func describeTrustStore(ch chan<- *prometheus.Desc) {
+	ch <- trustStoreReadSuccess
+	ch <- trustStoreCerts
+	ch <- trustStoreNotBefore
+	ch <- trustStoreNotAfter
+}
+
+// CollectTrustStore sends the metrics for the certificates of a trust store
+// and the error from reading it
+func CollectTrustStore(ch chan<- prometheus.Metric, certs []TrustStoreCert, err error, opts Options) {
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(trustStoreReadSuccess, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(trustStoreReadSuccess, prometheus.GaugeValue, 1)
+
+	ch <- prometheus.MustNewConstMetric(trustStoreCerts, prometheus.GaugeValue, float64(len(certs)))
+
+	// Stores can have more than one copy of a certificate, as in the chains
+	// of the private key entries of a JKS, which are sent once for each alias
+	// that they're in
+	var aliases []string
+	byAlias := map[string][]*x509.Certificate{}
+	for _, c := range certs {
+		if _, ok := byAlias[c.Alias]; !ok {
+			aliases = append(aliases, c.Alias)
+		}
+		byAlias[c.Alias] = append(byAlias[c.Alias], c.Cert)
+	}
+	for _, alias := range aliases {
+		for _, cert := range uniq(byAlias[alias]) {
+			serialNum := opts.serial(cert)
+			issuerCN := cert.Issuer.CommonName
+			subjectCN := cert.Subject.CommonName
+
+			ch <- prometheus.MustNewConstMetric(trustStoreNotBefore, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), alias, serialNum, issuerCN, subjectCN)
+			ch <- prometheus.MustNewConstMetric(trustStoreNotAfter, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), alias, serialNum, issuerCN, subjectCN)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Test that each certificate of a trust store is sent once for each of its
+// aliases, and only whether it could be read when it couldn't
+func TestCollectTrustStore(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	root := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Root CA"},
+		Issuer:       pkix.Name{CommonName: "Root CA"},
+		NotAfter:     notAfter,
+	}
+	intermediate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Intermediate CA"},
+		Issuer:       pkix.Name{CommonName: "Root CA"},
+		NotAfter:     notAfter.Add(-time.Minute),
+	}
+
+	mfs := collectTrustStore(t, []TrustStoreCert{{Cert: root}, {Cert: intermediate}, {Cert: root}}, nil)
+	if v := mfs["ssl_truststore_read_success"].GetMetric()[0].GetGauge().GetValue(); v != 1 {
+		t.Errorf("expected ssl_truststore_read_success 1, got %v", v)
+	}
+	if v := mfs["ssl_truststore_certs"].GetMetric()[0].GetGauge().GetValue(); v != 3 {
+		t.Errorf("expected ssl_truststore_certs 3, got %v", v)
+	}
+	series := mfs["ssl_truststore_cert_not_after"].GetMetric()
+	if len(series) != 2 {
+		t.Fatalf("expected 2 ssl_truststore_cert_not_after series, got %d", len(series))
+	}
+	for _, m := range series {
+		want := notAfter
+		if labelValue(m, "subject_cn") == "Intermediate CA" {
+			want = intermediate.NotAfter
+		}
+		if v := m.GetGauge().GetValue(); v != float64(want.Unix()) {
+			t.Errorf("%s: expected ssl_truststore_cert_not_after %d, got %v", labelValue(m, "subject_cn"), want.Unix(), v)
+		}
+	}
+
+	mfs = collectTrustStore(t, []TrustStoreCert{
+		{Alias: "server", Cert: intermediate},
+		{Alias: "server", Cert: root},
+		{Alias: "rootca", Cert: root},
+		{Alias: "server", Cert: root},
+	}, nil)
+	if v := mfs["ssl_truststore_certs"].GetMetric()[0].GetGauge().GetValue(); v != 4 {
+		t.Errorf("expected ssl_truststore_certs 4, got %v", v)
+	}
+	aliases := map[string]int{}
+	for _, m := range mfs["ssl_truststore_cert_not_after"].GetMetric() {
+		aliases[labelValue(m, "alias")+"/"+labelValue(m, "subject_cn")]++
+	}
+	if len(aliases) != 3 || aliases["server/Intermediate CA"] != 1 || aliases["server/Root CA"] != 1 || aliases["rootca/Root CA"] != 1 {
+		t.Errorf("expected the root under both of its aliases, got %v", aliases)
+	}
+
+	mfs = collectTrustStore(t, nil, errors.New("no such file or directory"))
+	if v := mfs["ssl_truststore_read_success"].GetMetric()[0].GetGauge().GetValue(); v != 0 {
+		t.Errorf("expected ssl_truststore_read_success 0, got %v", v)
+	}
+	if _, ok := mfs["ssl_truststore_certs"]; ok {
+		t.Errorf("expected no ssl_truststore_certs for a store that couldn't be read")
+	}
+}
+
+func collectTrustStore(t *testing.T, certs []TrustStoreCert, err error) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		CollectTrustStore(ch, certs, err, Options{})
+	}))
+
+	return gather(t, registry)
+}
@@ -0,0 +1,110 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// AddressResult is the outcome of the probe of one of the addresses of a
+// target, when Options.AllAddresses is set
+type AddressResult struct {
+	// Address is the IP address that was probed
+	Address string
+
+	// State is the state of the TLS connection. It's nil if the probe
+	// failed, with the reason in Err.
+	State *tls.ConnectionState
+	Err   error
+}
+
+// pinnedResolver resolves one host to a single address, and any other host,
+// like that of a proxy, with the resolver it wraps
+type pinnedResolver struct {
+	host string
+	addr net.IPAddr
+	next Resolver
+}
+
+func (r pinnedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host == r.host {
+		return []net.IPAddr{r.addr}, nil
+	}
+	return r.next.LookupIPAddr(ctx, host)
+}
+
+// probeAddresses probes each of the addresses that the host of the target
+// resolves to, at the same time. Targets whose host is an IP address only
+// have the one address, so they aren't probed again.
+func probeAddresses(ctx context.Context, target, proto string, opts Options) []AddressResult {
+	var host string
+	switch proto {
+	case "https":
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil
+		}
+		host = u.Hostname()
+	default:
+		if proto != "tcp" && proto != "grpc" && proto != "kafka" && !isStartTLS(proto) {
+			return nil
+		}
+		h, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil
+		}
+		host = h
+	}
+	// Onion services don't have addresses of their own
+	if net.ParseIP(host) != nil || isOnion(host) {
+		return nil
+	}
+
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+
+	request := opts.HTTPRequest
+	request.FollowRedirects = 0
+	grpcRequest := GRPCRequest{Authority: opts.GRPC.Authority}
+
+	results := make([]AddressResult, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr net.IPAddr) {
+			defer wg.Done()
+
+			pinned := pinnedResolver{host: host, addr: addr, next: resolver}
+			trace := newPhaseTrace(ctx, target, nil)
+			var verifyErr *error
+			if opts.RecordVerifyErrors {
+				verifyErr = new(error)
+			}
+
+			var state *tls.ConnectionState
+			var err error
+			switch {
+			case proto == "https":
+				state, _, err = probeHTTPS(ctx, target, opts.TLSConfig, pinned, nil, request, trace, verifyErr)
+			case proto == "tcp", proto == "kafka":
+				state, err = probeTCP(ctx, target, opts.TLSConfig, pinned, trace, verifyErr)
+			case proto == "grpc":
+				state, _, err = probeGRPC(ctx, target, opts.TLSConfig, pinned, grpcRequest, trace, verifyErr)
+			default:
+				state, err = probeStartTLS(ctx, target, proto, opts.TLSConfig, pinned, trace, verifyErr)
+			}
+			results[i] = AddressResult{Address: addr.String(), State: state, Err: err}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	return results
+}
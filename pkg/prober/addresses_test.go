@@ -0,0 +1,59 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Test that each of the addresses of the target is probed, and that one that
+// can't be reached is reported without failing the others
+func TestProbeAllAddresses(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server only listens on 127.0.0.1
+	resolver := staticResolver{"example.com": {{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("127.0.0.2")}}}
+
+	for _, target := range []string{"https://example.com:" + port, "example.com:" + port} {
+		result, err := Probe(context.Background(), target, Options{
+			TLSConfig:    &tls.Config{RootCAs: roots},
+			Resolver:     resolver,
+			AllAddresses: true,
+		})
+		if err != nil {
+			t.Errorf("%s: %s", target, err)
+			continue
+		}
+		if len(result.Addresses) != 2 {
+			t.Errorf("%s: expected a result for each address, got %+v", target, result.Addresses)
+			continue
+		}
+
+		if a := result.Addresses[0]; a.Address != "127.0.0.1" || a.Err != nil || a.State == nil || len(a.State.PeerCertificates) == 0 {
+			t.Errorf("%s: expected the certificates of 127.0.0.1, got %+v", target, a)
+		}
+		if a := result.Addresses[1]; a.Address != "127.0.0.2" || a.Err == nil || a.State != nil {
+			t.Errorf("%s: expected an error for 127.0.0.2, got %+v", target, a)
+		}
+	}
+
+	// A target with an IP address only has the one
+	result, err := Probe(context.Background(), server.URL, Options{
+		TLSConfig:    &tls.Config{RootCAs: roots, ServerName: "example.com"},
+		AllAddresses: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Addresses) != 0 {
+		t.Errorf("expected no results for the addresses of an IP address, got %+v", result.Addresses)
+	}
+}
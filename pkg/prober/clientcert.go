@@ -0,0 +1,162 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"sync"
+)
+
+// ClientCertRequest is what a probe found out about the server's request for
+// a client certificate
+type ClientCertRequest string
+
+const (
+	// ClientCertUnknown means the handshake couldn't be observed, because a
+	// kept connection was reused or a registered prober made it
+	ClientCertUnknown ClientCertRequest = ""
+	// ClientCertNotRequested means the server didn't ask for a certificate
+	ClientCertNotRequested ClientCertRequest = "not_requested"
+	// ClientCertRequested means the server asked for a certificate and one
+	// was sent, so it can't be told whether the server requires one
+	ClientCertRequested ClientCertRequest = "requested"
+	// ClientCertOptional means the server asked for a certificate but
+	// accepted the connection without one
+	ClientCertOptional ClientCertRequest = "optional"
+	// ClientCertRequired means the server asked for a certificate and
+	// rejected the connection without one
+	ClientCertRequired ClientCertRequest = "required"
+)
+
+// clientCertKey is the context key of the clientCertRecord of a probe
+type clientCertKey struct{}
+
+// clientCertRecord records whether the server asked for a client certificate
+// during the handshake of a probe, and whether one was sent
+type clientCertRecord struct {
+	mtx       sync.Mutex
+	handshook bool
+	requested bool
+	sent      bool
+	accepted  bool
+}
+
+func withClientCertRecord(ctx context.Context) (context.Context, *clientCertRecord) {
+	rec := &clientCertRecord{}
+	return context.WithValue(ctx, clientCertKey{}, rec), rec
+}
+
+func clientCertRecordFrom(ctx context.Context) *clientCertRecord {
+	rec, _ := ctx.Value(clientCertKey{}).(*clientCertRecord)
+	return rec
+}
+
+// handshake records that a handshake was made, so that the absence of a
+// request means something. It's safe to call on a nil record, like the other
+// methods.
+func (r *clientCertRecord) handshake() {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.handshook = true
+}
+
+// request records a certificate request and whether a certificate was sent
+// in answer to it
+func (r *clientCertRecord) request(sent bool) {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.requested, r.sent = true, sent
+}
+
+// accept records that the server went on with the connection after the
+// handshake
+func (r *clientCertRecord) accept() {
+	if r == nil {
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.accepted = true
+}
+
+// withoutCert reports whether the server asked for a certificate and didn't
+// get one
+func (r *clientCertRecord) withoutCert() bool {
+	if r == nil {
+		return false
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.requested && !r.sent
+}
+
+// result works out what the server asked for from the record and the error
+// of the probe, if it failed
+func (r *clientCertRecord) result(err error) ClientCertRequest {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	switch {
+	case !r.requested && r.handshook:
+		return ClientCertNotRequested
+	case !r.requested:
+		return ClientCertUnknown
+	case r.sent:
+		return ClientCertRequested
+	case err != nil && rejectedClientCert(err):
+		return ClientCertRequired
+	case err == nil && r.accepted:
+		return ClientCertOptional
+	}
+	return ClientCertUnknown
+}
+
+// rejectedClientCert reports whether err is the alert a server sends when it
+// requires a client certificate and didn't get one. TLS 1.3 has an alert
+// of its own for it, but servers may also send bad_certificate or, with TLS
+// 1.2, handshake_failure. As the latter can only be sent after the
+// certificate request, the parameters of the handshake have already been
+// agreed on, so it's down to the certificate.
+func rejectedClientCert(err error) bool {
+	s := err.Error()
+	for _, alert := range []string{"certificate required", "bad certificate", "handshake failure"} {
+		if strings.Contains(s, "remote error: tls: "+alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordClientCert makes the config record certificate requests in the
+// clientCertRecord of the handshake's context. It picks the client
+// certificate in the same way crypto/tls does.
+func recordClientCert(c *tls.Config) {
+	getCert, certs := c.GetClientCertificate, c.Certificates
+
+	c.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		var (
+			cert = &tls.Certificate{}
+			err  error
+		)
+		if getCert != nil {
+			cert, err = getCert(cri)
+		} else {
+			for i := range certs {
+				if cri.SupportsCertificate(&certs[i]) == nil {
+					cert = &certs[i]
+					break
+				}
+			}
+		}
+		if err == nil {
+			clientCertRecordFrom(cri.Context()).request(cert != nil && len(cert.Certificate) > 0)
+		}
+		return cert, err
+	}
+}
@@ -0,0 +1,45 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that the server's request for a client certificate is detected by
+// both probers, with TLS 1.2 and 1.3
+func TestProbeClientCert(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		for auth, expected := range map[tls.ClientAuthType]ClientCertRequest{
+			tls.NoClientCert:            ClientCertNotRequested,
+			tls.RequestClientCert:       ClientCertOptional,
+			tls.RequireAnyClientCert:    ClientCertRequired,
+			tls.VerifyClientCertIfGiven: ClientCertOptional,
+		} {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.TLS = &tls.Config{ClientAuth: auth, MaxVersion: version}
+			server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			server.StartTLS()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(server.Certificate())
+
+			for _, target := range []string{server.URL, strings.TrimPrefix(server.URL, "https://")} {
+				result, _ := Probe(context.Background(), target, Options{
+					TLSConfig: &tls.Config{RootCAs: roots},
+				})
+				if result.ClientCert != expected {
+					t.Errorf("%x %s %s: expected %q, got %q", version, auth, target, expected, result.ClientCert)
+				}
+			}
+
+			server.Close()
+		}
+	}
+}
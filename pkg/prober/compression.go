@@ -0,0 +1,495 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// CertCompression is what the server did with the compress_certificate
+// extension of RFC 8879, which crypto/tls doesn't offer, so it's offered in a
+// handshake of its own
+type CertCompression struct {
+	// Algorithm is the algorithm that the Certificate message was
+	// compressed with: zlib, brotli or zstd. It's empty if the server sent
+	// it uncompressed.
+	Algorithm string
+
+	// Length is the length of the Certificate message as the server sent
+	// it, and UncompressedLength the length of the message once it's
+	// uncompressed. They're the same for an uncompressed message.
+	Length             int
+	UncompressedLength int
+}
+
+// certCompressionAlgorithms are the algorithms of RFC 8879, which are all
+// offered. The messages are never uncompressed, so none of them has to be
+// implemented.
+var certCompressionAlgorithms = map[uint16]string{
+	1: "zlib",
+	2: "brotli",
+	3: "zstd",
+}
+
+// The handshake messages and extensions of the handshake that offers
+// certificate compression
+const (
+	msgServerHello           = 2
+	msgEncryptedExtensions   = 8
+	msgCertificate           = 11
+	msgCertificateRequest    = 13
+	msgCompressedCertificate = 25
+
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extSignatureAlgorithms = 13
+	extCompressCertificate = 27
+	extKeyShare            = 51
+)
+
+// helloRetryRandom is the random of a ServerHello that's a HelloRetryRequest
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// probeCertCompression makes a TLS 1.3 handshake with the target that offers
+// certificate compression, as far as the Certificate message of the server.
+// The handshake is never completed, so nothing is verified. Only https and
+// tcp targets can be, and nil is returned for the others.
+func probeCertCompression(ctx context.Context, target, proto string, opts Options) (*CertCompression, error) {
+	var address string
+	switch proto {
+	case "https":
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		address = u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		}
+	case "tcp":
+		address = target
+	default:
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	name := host
+	if opts.TLSConfig != nil && opts.TLSConfig.ServerName != "" {
+		name = opts.TLSConfig.ServerName
+	}
+
+	var conn net.Conn
+	if isOnion(host) {
+		conn, err = dialOnion(ctx, address)
+	} else {
+		conn, err = dialTCP(ctx, address, opts.Resolver, newPhaseTrace(ctx, target, nil))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	return readCertCompression(conn, name)
+}
+
+// readCertCompression sends the ClientHello on the connection and reads the
+// handshake of the server up to its Certificate message
+func readCertCompression(conn io.ReadWriter, serverName string) (*CertCompression, error) {
+	x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	p256, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err := compressionClientHello(serverName, x25519, p256)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte{22, 3, 1}, appendLen16(nil, hello)...)); err != nil {
+		return nil, err
+	}
+
+	r := &recordReader{r: conn}
+	msg, err := r.handshake()
+	if err != nil {
+		return nil, err
+	}
+	if msg[0] != msgServerHello {
+		return nil, errors.New("expected a ServerHello, got handshake message " + strconv.Itoa(int(msg[0])))
+	}
+	suite, group, share, err := parseKeyShare(msg[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	var priv *ecdh.PrivateKey
+	switch group {
+	case 0x001d:
+		priv = x25519
+	case 0x0017:
+		priv = p256
+	default:
+		return nil, errors.New("the server chose the group " + strconv.Itoa(group) + ", which wasn't offered")
+	}
+	peer, err := priv.Curve().NewPublicKey(share)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		h      func() hash.Hash
+		keyLen int
+	)
+	switch uint16(suite) {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	default:
+		return nil, errors.New("the server chose the cipher suite " + tls.CipherSuiteName(uint16(suite)) + ", which wasn't offered")
+	}
+	transcript := h()
+	transcript.Write(hello)
+	transcript.Write(msg)
+
+	if r.aead, r.iv, err = handshakeKeys(h, shared, transcript.Sum(nil), keyLen); err != nil {
+		return nil, err
+	}
+
+	// The Certificate follows the EncryptedExtensions and, if the server
+	// wants a client certificate, the CertificateRequest
+	for {
+		msg, err := r.handshake()
+		if err != nil {
+			return nil, err
+		}
+		switch msg[0] {
+		case msgEncryptedExtensions, msgCertificateRequest:
+			continue
+		case msgCertificate:
+			return &CertCompression{Length: len(msg) - 4, UncompressedLength: len(msg) - 4}, nil
+		case msgCompressedCertificate:
+			return parseCompressedCertificate(msg[4:])
+		default:
+			return nil, errors.New("expected a Certificate, got handshake message " + strconv.Itoa(int(msg[0])))
+		}
+	}
+}
+
+// compressionClientHello returns a TLS 1.3 ClientHello message that offers
+// certificate compression, with key shares for X25519 and P-256 so that the
+// server doesn't have to ask for another one
+func compressionClientHello(serverName string, x25519, p256 *ecdh.PrivateKey) ([]byte, error) {
+	var exts []byte
+	ext := func(typ int, data []byte) {
+		exts = appendUint16(exts, typ)
+		exts = appendLen16(exts, data)
+	}
+	if serverName != "" && net.ParseIP(serverName) == nil && !strings.Contains(serverName, "%") {
+		ext(extServerName, appendLen16(nil, append([]byte{0}, appendLen16(nil, []byte(serverName))...)))
+	}
+	ext(extSupportedGroups, appendLen16(nil, appendUint16s(nil, 0x001d, 0x0017)))
+	ext(extSignatureAlgorithms, appendLen16(nil, appendUint16s(nil,
+		0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601, 0x0807,
+	)))
+	ext(extSupportedVersions, appendLen8(nil, appendUint16s(nil, tls.VersionTLS13)))
+
+	var shares []byte
+	shares = appendUint16(shares, 0x001d)
+	shares = appendLen16(shares, x25519.PublicKey().Bytes())
+	shares = appendUint16(shares, 0x0017)
+	shares = appendLen16(shares, p256.PublicKey().Bytes())
+	ext(extKeyShare, appendLen16(nil, shares))
+
+	ext(extCompressCertificate, appendLen8(nil, appendUint16s(nil, 1, 2, 3)))
+
+	// A random and a session ID, which TLS 1.3 sends for the sake of
+	// middleboxes
+	random := make([]byte, 64)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	body := appendUint16(nil, tls.VersionTLS12)
+	body = append(body, random[:32]...)
+	body = appendLen8(body, random[32:])
+	body = appendLen16(body, appendUint16s(nil, tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384))
+	body = append(body, 1, 0)
+	body = appendLen16(body, exts)
+
+	return append([]byte{1}, appendLen24(nil, body)...), nil
+}
+
+// parseKeyShare returns the cipher suite and the key share of the body of a
+// ServerHello, which has to be for TLS 1.3
+func parseKeyShare(body []byte) (suite, group int, share []byte, err error) {
+	r := helloReader(body)
+	if _, ok := r.uint16(); !ok {
+		return 0, 0, nil, errMalformedHello
+	}
+	random, ok := r.bytes(32)
+	if !ok {
+		return 0, 0, nil, errMalformedHello
+	}
+	if bytes.Equal(random, helloRetryRandom) {
+		return 0, 0, nil, errors.New("the server asked for another key share with a HelloRetryRequest")
+	}
+	sid, ok := r.uint8()
+	if !ok {
+		return 0, 0, nil, errMalformedHello
+	}
+	if _, ok := r.bytes(sid); !ok {
+		return 0, 0, nil, errMalformedHello
+	}
+	if suite, ok = r.uint16(); !ok {
+		return 0, 0, nil, errMalformedHello
+	}
+	if _, ok := r.uint8(); !ok {
+		return 0, 0, nil, errMalformedHello
+	}
+
+	var version int
+	if !r.extensions(func(typ uint16, data helloReader) {
+		switch typ {
+		case extSupportedVersions:
+			version, _ = data.uint16()
+		case extKeyShare:
+			group, _ = data.uint16()
+			if n, ok := data.uint16(); ok {
+				share, _ = data.bytes(n)
+			}
+		}
+	}) {
+		return 0, 0, nil, errMalformedHello
+	}
+	if version != tls.VersionTLS13 {
+		return 0, 0, nil, errors.New("the server didn't choose TLS 1.3, the only version with certificate compression")
+	}
+	if share == nil {
+		return 0, 0, nil, errors.New("the ServerHello has no key share")
+	}
+
+	return suite, group, share, nil
+}
+
+// parseCompressedCertificate parses the body of a CompressedCertificate
+// message
+func parseCompressedCertificate(body []byte) (*CertCompression, error) {
+	r := helloReader(body)
+	algorithm, ok := r.uint16()
+	if !ok {
+		return nil, errors.New("malformed CompressedCertificate")
+	}
+	length, ok := r.bytes(3)
+	if !ok {
+		return nil, errors.New("malformed CompressedCertificate")
+	}
+
+	name, ok := certCompressionAlgorithms[uint16(algorithm)]
+	if !ok {
+		return nil, errors.New("the server compressed the certificate with the algorithm " + strconv.Itoa(algorithm) + ", which wasn't offered")
+	}
+	return &CertCompression{
+		Algorithm:          name,
+		Length:             len(body),
+		UncompressedLength: int(length[0])<<16 | int(length[1])<<8 | int(length[2]),
+	}, nil
+}
+
+// handshakeKeys returns the AEAD and the IV of the handshake traffic of the
+// server, from the shared secret and the hash of the ClientHello and the
+// ServerHello, as in section 7.1 of RFC 8446
+func handshakeKeys(h func() hash.Hash, shared, transcript []byte, keyLen int) (cipher.AEAD, []byte, error) {
+	early := hkdfExtract(h, make([]byte, h().Size()), nil)
+	derived := expandLabel(h, early, "derived", h().Sum(nil), h().Size())
+	handshake := hkdfExtract(h, shared, derived)
+	secret := expandLabel(h, handshake, "s hs traffic", transcript, h().Size())
+
+	key := expandLabel(h, secret, "key", nil, keyLen)
+	iv := expandLabel(h, secret, "iv", nil, 12)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, iv, nil
+}
+
+// hkdfExtract is HKDF-Extract of RFC 5869
+func hkdfExtract(h func() hash.Hash, secret, salt []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, h().Size())
+	}
+	mac := hmac.New(h, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// expandLabel is HKDF-Expand-Label of RFC 8446, which is HKDF-Expand with
+// the label and the context in the info
+func expandLabel(h func() hash.Hash, secret []byte, label string, context []byte, length int) []byte {
+	info := appendUint16(nil, length)
+	info = appendLen8(info, []byte("tls13 "+label))
+	info = appendLen8(info, context)
+
+	var out, block []byte
+	mac := hmac.New(h, secret)
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// recordReader reads the handshake messages of the server from its records,
+// which are decrypted once the aead is set
+type recordReader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+	// buf is what's been read of the handshake messages and not returned
+	buf []byte
+}
+
+// maxHandshakeMessage is the longest handshake message that's read, which is
+// plenty for a chain of certificates
+const maxHandshakeMessage = 1 << 18
+
+// handshake returns the next handshake message, with its header
+func (r *recordReader) handshake() ([]byte, error) {
+	for {
+		if len(r.buf) >= 4 {
+			n := int(r.buf[1])<<16 | int(r.buf[2])<<8 | int(r.buf[3])
+			if n > maxHandshakeMessage {
+				return nil, errors.New("handshake message too long")
+			}
+			if len(r.buf) >= 4+n {
+				msg := r.buf[:4+n]
+				r.buf = r.buf[4+n:]
+				return msg, nil
+			}
+		}
+
+		b, err := r.record()
+		if err != nil {
+			return nil, err
+		}
+		r.buf = append(r.buf, b...)
+	}
+}
+
+// record returns the content of the next handshake record. The
+// ChangeCipherSpec that TLS 1.3 sends for middleboxes is skipped.
+func (r *recordReader) record() ([]byte, error) {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r.r, header); err != nil {
+			return nil, err
+		}
+		n := int(header[3])<<8 | int(header[4])
+		if n > 16<<10+256 {
+			return nil, errors.New("record too long")
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			return nil, err
+		}
+
+		typ := header[0]
+		if r.aead != nil && typ == 23 {
+			nonce := make([]byte, len(r.iv))
+			copy(nonce, r.iv)
+			for i := 0; i < 8; i++ {
+				nonce[len(nonce)-1-i] ^= byte(r.seq >> (8 * i))
+			}
+			r.seq++
+
+			plain, err := r.aead.Open(nil, nonce, body, header)
+			if err != nil {
+				return nil, err
+			}
+			// The content is followed by its type and any padding
+			plain = bytes.TrimRight(plain, "\x00")
+			if len(plain) == 0 {
+				return nil, errors.New("record without a content type")
+			}
+			typ, body = plain[len(plain)-1], plain[:len(plain)-1]
+		}
+
+		switch typ {
+		case 20:
+			continue
+		case 21:
+			if len(body) < 2 {
+				return nil, errors.New("malformed alert")
+			}
+			return nil, tls.AlertError(body[1])
+		case 22:
+			return body, nil
+		default:
+			return nil, errors.New("unexpected record of type " + strconv.Itoa(int(typ)))
+		}
+	}
+}
+
+func appendUint16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint16s(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = appendUint16(b, int(v))
+	}
+	return b
+}
+
+func appendLen8(b, data []byte) []byte {
+	return append(append(b, byte(len(data))), data...)
+}
+
+func appendLen16(b, data []byte) []byte {
+	return append(appendUint16(b, len(data)), data...)
+}
+
+func appendLen24(b, data []byte) []byte {
+	return append(append(b, byte(len(data)>>16)), appendLen16(nil, data)...)
+}
@@ -0,0 +1,81 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that the handshake that offers certificate compression reads the
+// Certificate of a server that doesn't compress it, for both suites and with
+// a request for a client certificate, and fails against TLS 1.2
+func TestProbeCertCompression(t *testing.T) {
+	for _, config := range []*tls.Config{
+		{},
+		{CipherSuites: []uint16{tls.TLS_AES_256_GCM_SHA384}, CurvePreferences: []tls.CurveID{tls.CurveP256}},
+		{ClientAuth: tls.RequestClientCert},
+	} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = config
+		server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		server.StartTLS()
+
+		for _, target := range []string{server.URL, strings.TrimPrefix(server.URL, "https://")} {
+			result, err := Probe(context.Background(), target, Options{
+				TLSConfig:       &tls.Config{InsecureSkipVerify: true},
+				CertCompression: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := result.CertCompression
+			if c == nil {
+				t.Fatalf("%s: expected the result of certificate compression", target)
+			}
+			if c.Algorithm != "" || c.Length < len(server.Certificate().Raw) || c.Length != c.UncompressedLength {
+				t.Errorf("%s: expected an uncompressed Certificate, got %+v", target, c)
+			}
+		}
+
+		server.Close()
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	result, err := Probe(context.Background(), server.URL, Options{
+		TLSConfig:       &tls.Config{InsecureSkipVerify: true},
+		CertCompression: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CertCompression != nil {
+		t.Errorf("expected no result for TLS 1.2, got %+v", result.CertCompression)
+	}
+}
+
+// Test that the algorithm and the lengths are read from a CompressedCertificate
+func TestParseCompressedCertificate(t *testing.T) {
+	c, err := parseCompressedCertificate([]byte{0, 2, 0, 0x12, 0x34, 0, 0, 3, 1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Algorithm != "brotli" || c.Length != 11 || c.UncompressedLength != 0x1234 {
+		t.Errorf("unexpected %+v", c)
+	}
+
+	for _, b := range [][]byte{{0, 9, 0, 0, 1}, {0, 1}} {
+		if _, err := parseCompressedCertificate(b); err == nil {
+			t.Errorf("expected an error for %v", b)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package prober
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Connections keeps the connections of https probes open between the probes
+// of each target, so that frequent probes don't each need a new TCP
+// connection and TLS handshake. A probe that reuses a connection reports the
+// state of the handshake that was made when the connection was opened.
+//
+// The connections of a target are bound to the first Resolver they're
+// dialled with, so a Connections shouldn't be shared by probes that use
+// different resolvers.
+type Connections struct {
+	// MaxAge is how long the connections to a target are reused for before
+	// new ones are opened, so that changes to its certificate are noticed
+	MaxAge time.Duration
+
+	mtx        sync.Mutex
+	transports map[string]*pooledTransport
+}
+
+type pooledTransport struct {
+	transport *http.Transport
+	config    *tls.Config
+	created   time.Time
+}
+
+// NewConnections returns a Connections that reuses connections for up to
+// maxAge
+func NewConnections(maxAge time.Duration) *Connections {
+	return &Connections{
+		MaxAge:     maxAge,
+		transports: map[string]*pooledTransport{},
+	}
+}
+
+// transport returns the transport for the host, creating it with newTransport
+// if there isn't one yet. It's replaced when it's older than MaxAge or the
+// TLS config has changed, after a reload for instance.
+func (c *Connections) transport(host string, config *tls.Config, newTransport func() *http.Transport) *http.Transport {
+	now := time.Now()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if t, ok := c.transports[host]; ok {
+		if t.config == config && now.Sub(t.created) < c.MaxAge {
+			return t.transport
+		}
+		// Requests in progress keep their connections until they're done
+		t.transport.CloseIdleConnections()
+	}
+
+	t := &pooledTransport{
+		transport: newTransport(),
+		config:    config,
+		created:   now,
+	}
+	t.transport.IdleConnTimeout = c.MaxAge
+	c.transports[host] = t
+
+	return t.transport
+}
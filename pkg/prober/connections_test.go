@@ -0,0 +1,69 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that probes of the same target reuse its connection until it's older
+// than the maximum age
+func TestProbeConnections(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		conns int
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mtx.Lock()
+			conns++
+			mtx.Unlock()
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	opts := Options{
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		Connections: NewConnections(time.Hour),
+	}
+
+	probe := func() {
+		result, err := Probe(context.Background(), server.URL, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.State.PeerCertificates) == 0 {
+			t.Fatalf("expected the state of the reused connection to have the certificates")
+		}
+	}
+	count := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return conns
+	}
+
+	probe()
+	probe()
+	if n := count(); n != 1 {
+		t.Errorf("expected the connection to be reused, got %d connections", n)
+	}
+
+	opts.Connections.MaxAge = time.Nanosecond
+	probe()
+	if n := count(); n != 2 {
+		t.Errorf("expected a new connection after the maximum age, got %d connections", n)
+	}
+}
@@ -0,0 +1,183 @@
+package prober
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// maxCRL is the largest CRL that's downloaded. The CRLs of public CAs can be
+// tens of megabytes.
+const maxCRL = 64 << 20
+
+// CRLResult is the outcome of a download of a CRL
+type CRLResult struct {
+	// URL is the distribution point that the CRL was downloaded from
+	URL string
+
+	// Duration is how long the download took, until the whole CRL was read
+	Duration time.Duration
+
+	// List is the CRL. It's nil if the CRL couldn't be downloaded.
+	List *x509.RevocationList
+
+	// Raw is the DER of the CRL
+	Raw []byte
+
+	// ListErr is why the CRL isn't valid: its signature can't be verified
+	// with the issuer, or it's outside of its validity period. It's nil for
+	// a valid CRL.
+	ListErr error
+
+	// LastModified and ETag are the validators that the distribution point
+	// returned with the CRL, if any, for conditional requests on refresh
+	LastModified string
+	ETag         string
+
+	// NotModified is whether the distribution point answered a conditional
+	// request with 304 Not Modified, so the CRL is the cached one
+	NotModified bool
+}
+
+// ProbeCRL downloads the CRL from the distribution point at the URL and
+// checks it against the issuer. The error is about the CRL not being
+// downloaded at all, while an invalid CRL is reported in CRLResult.ListErr.
+//
+// cached, if it isn't nil, is the CRL that was downloaded from the
+// distribution point before. Its validators are sent with the request, and
+// when the distribution point answers 304 Not Modified, the returned
+// CRLResult has NotModified set and the CRL and the validators of cached,
+// which saves downloading a large CRL again.
+//
+// The TLSConfig, Resolver and Tracer of the options are used for the request.
+// If the distribution point responds, the returned CRLResult isn't nil, even
+// if err isn't, so that the duration can be reported.
+func ProbeCRL(ctx context.Context, u string, issuer *x509.Certificate, cached *CRLResult, opts Options) (*CRLResult, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Base()
+	}
+
+	logger.Debugln("Downloading the CRL from " + u)
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+	}
+
+	trace := newPhaseTrace(ctx, u, opts.Tracer)
+	ctx = context.WithValue(ctx, phaseTraceKey{}, trace)
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	req = req.WithContext(ctx)
+
+	transport := newTransport(opts.TLSConfig, opts.Resolver)
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCRL+1))
+	result := &CRLResult{URL: u, Duration: time.Since(start)}
+	if err != nil {
+		return result, err
+	}
+	if len(b) > maxCRL {
+		return result, fmt.Errorf("the CRL is too large, it's more than %d bytes", maxCRL)
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		result.Raw, result.List, result.ListErr = cached.Raw, cached.List, cached.ListErr
+		result.LastModified, result.ETag = cached.LastModified, cached.ETag
+		result.NotModified = true
+		logger.Debugln("The CRL from " + u + " hasn't changed")
+		return result, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return result, errors.New("the CRL distribution point returned " + resp.Status)
+	}
+
+	parsed, err := ParseCRL(b, issuer)
+	if err != nil {
+		return result, err
+	}
+	result.Raw, result.List, result.ListErr = parsed.Raw, parsed.List, parsed.ListErr
+	result.LastModified, result.ETag = resp.Header.Get("Last-Modified"), resp.Header.Get("ETag")
+
+	if result.ListErr != nil {
+		logger.Debugln("The CRL from " + u + " isn't valid: " + result.ListErr.Error())
+	}
+	logger.Debugln("The CRL from " + u + " was downloaded in " + result.Duration.String())
+
+	return result, nil
+}
+
+// ParseCRL parses a CRL, in DER or PEM, and checks it. A CRL whose signature
+// can't be verified with the issuer, or that's outside of its validity
+// period, is still returned, with the reason in CRLResult.ListErr. Without
+// an issuer, the signature isn't checked.
+func ParseCRL(b []byte, issuer *x509.Certificate) (*CRLResult, error) {
+	if block, _ := pem.Decode(b); block != nil && block.Type == "X509 CRL" {
+		b = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return nil, err
+	}
+	result := &CRLResult{Raw: b, List: list}
+
+	if issuer != nil {
+		result.ListErr = list.CheckSignatureFrom(issuer)
+	}
+	if result.ListErr == nil {
+		result.ListErr = CheckCRLTimes(list, time.Now())
+	}
+
+	return result, nil
+}
+
+// Revoked returns the entry of the certificate in the CRL, or nil if it
+// isn't revoked
+func (r *CRLResult) Revoked(cert *x509.Certificate) *x509.RevocationListEntry {
+	if r.List == nil || cert.SerialNumber == nil {
+		return nil
+	}
+	for i, e := range r.List.RevokedCertificateEntries {
+		if e.SerialNumber != nil && e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return &r.List.RevokedCertificateEntries[i]
+		}
+	}
+	return nil
+}
+
+// CheckCRLTimes checks that the CRL is within its validity period at now
+func CheckCRLTimes(list *x509.RevocationList, now time.Time) error {
+	if now.Before(list.ThisUpdate) {
+		return errors.New("the CRL isn't valid until " + list.ThisUpdate.String())
+	}
+	if !list.NextUpdate.IsZero() && now.After(list.NextUpdate) {
+		return errors.New("the CRL expired at " + list.NextUpdate.String())
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package prober
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that CRLs are downloaded in DER or PEM and checked against the issuer,
+// and that the revoked certificates are found in them
+func TestProbeCRL(t *testing.T) {
+	issuer, key := testOCSPIssuer(t)
+	other, otherKey := testOCSPIssuer(t)
+	revoked := &x509.Certificate{SerialNumber: big.NewInt(42)}
+	good := &x509.Certificate{SerialNumber: big.NewInt(43)}
+
+	now := time.Now()
+	for name, test := range map[string]struct {
+		next  time.Time
+		other bool
+		pem   bool
+		valid bool
+	}{
+		"der":          {next: now.Add(time.Hour), valid: true},
+		"pem":          {next: now.Add(time.Hour), pem: true, valid: true},
+		"expired":      {next: now.Add(-time.Minute)},
+		"wrong issuer": {next: now.Add(time.Hour), other: true},
+	} {
+		signer, signerKey := issuer, key
+		if test.other {
+			signer, signerKey = other, otherKey
+		}
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: now.Add(-2 * time.Hour),
+			NextUpdate: test.next,
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: revoked.SerialNumber, RevocationTime: now.Add(-time.Hour)},
+			},
+		}, signer, signerKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.pem {
+			crl = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(crl)
+		}))
+		result, err := ProbeCRL(context.Background(), server.URL, issuer, nil, Options{})
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if valid := result.ListErr == nil; valid != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", name, test.valid, result.ListErr)
+		}
+		if result.Revoked(revoked) == nil || result.Revoked(good) != nil {
+			t.Errorf("%s: expected only serial 42 to be revoked", name)
+		}
+	}
+}
+
+// Test that distribution points that fail or don't serve a CRL are errors
+func TestProbeCRLFailure(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		},
+		"garbage": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("not a crl"))
+		},
+		"too large": func(w http.ResponseWriter, r *http.Request) {
+			io.CopyN(w, zeros{}, maxCRL+1)
+		},
+	} {
+		server := httptest.NewServer(handler)
+		result, err := ProbeCRL(context.Background(), server.URL, nil, nil, Options{})
+		server.Close()
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if name == "too large" && !strings.Contains(err.Error(), "too large") {
+			t.Errorf("%s: expected the CRL to be too large, got %s", name, err)
+		}
+		if result == nil {
+			t.Errorf("%s: expected a result with the duration", name)
+		}
+	}
+}
+
+// Test that the validators of a cached CRL are sent with the request, and
+// that a 304 Not Modified returns the cached CRL
+func TestProbeCRLNotModified(t *testing.T) {
+	issuer, key := testOCSPIssuer(t)
+	now := time.Now()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.Add(-time.Hour),
+		NextUpdate: now.Add(time.Hour),
+	}, issuer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastModified := now.UTC().Format(http.TimeFormat)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"1"` && r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write(crl)
+	}))
+	defer server.Close()
+
+	cached, err := ProbeCRL(context.Background(), server.URL, issuer, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.NotModified || cached.ETag != `"1"` || cached.LastModified != lastModified {
+		t.Fatalf("expected a downloaded CRL with its validators, got %+v", cached)
+	}
+
+	result, err := ProbeCRL(context.Background(), server.URL, issuer, cached, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.NotModified || result.List != cached.List || result.ETag != cached.ETag {
+		t.Errorf("expected the cached CRL to not be modified, got %+v", result)
+	}
+}
+
+// zeros is an io.Reader of endless zeros
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,59 @@
+package prober
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dateKey is the context key of the dateRecord of a probe
+type dateKey struct{}
+
+// dateRecord records the Date header of the response to a https probe, and
+// when the response arrived, to tell how far the clock of the server is off
+type dateRecord struct {
+	mtx      sync.Mutex
+	date     time.Time
+	received time.Time
+}
+
+func withDateRecord(ctx context.Context) (context.Context, *dateRecord) {
+	rec := &dateRecord{}
+	return context.WithValue(ctx, dateKey{}, rec), rec
+}
+
+// recordDate records the Date of the response in the record of the context,
+// if there is one. Only the first response is recorded, so that those of the
+// redirects that are followed from it don't replace it.
+func recordDate(ctx context.Context, resp *http.Response, received time.Time) {
+	rec, _ := ctx.Value(dateKey{}).(*dateRecord)
+	if rec == nil {
+		return
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	rec.mtx.Lock()
+	defer rec.mtx.Unlock()
+	if rec.date.IsZero() {
+		rec.date, rec.received = date, received
+	}
+}
+
+// skew returns the Date of the response and how far it's ahead of the
+// exporter's clock, or a zero time if there wasn't one. It's safe to call on
+// a nil record.
+func (r *dateRecord) skew() (time.Time, time.Duration) {
+	if r == nil {
+		return time.Time{}, 0
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.date.IsZero() {
+		return time.Time{}, 0
+	}
+	return r.date, r.date.Sub(r.received)
+}
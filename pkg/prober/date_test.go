@@ -0,0 +1,52 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the skew of the clock of a https target is told from the Date of
+// its response, and that there's none without one or for a tcp target
+func TestProbeClockSkew(t *testing.T) {
+	var date []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Date"] = date
+	}))
+	defer server.Close()
+	opts := Options{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	date = []string{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}
+	result, err := Probe(context.Background(), server.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ServerDate.IsZero() {
+		t.Fatalf("expected the Date of the response")
+	}
+	if skew := result.ClockSkew; skew > -time.Hour+time.Second || skew < -time.Hour-2*time.Second {
+		t.Errorf("expected a skew of about -1h, got %s", skew)
+	}
+
+	date = nil
+	result, err = Probe(context.Background(), server.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.ServerDate.IsZero() || result.ClockSkew != 0 {
+		t.Errorf("expected no skew without a Date, got %s", result.ClockSkew)
+	}
+
+	date = []string{time.Now().UTC().Format(http.TimeFormat)}
+	result, err = Probe(context.Background(), strings.TrimPrefix(server.URL, "https://"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.ServerDate.IsZero() {
+		t.Errorf("expected no Date for a tcp target")
+	}
+}
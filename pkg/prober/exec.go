@@ -0,0 +1,82 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ExecProber runs an external command to retrieve the chain presented by a
+// target, for protocols the exporter doesn't support itself. The target is
+// passed as the last argument and in the SSL_EXPORTER_TARGET environment
+// variable. The command must write the PEM encoded chain, leaf first, to
+// stdout and exit 0.
+type ExecProber struct {
+	Command []string
+
+	// Port is the default port for targets that don't have one
+	Port string
+}
+
+// DefaultPort implements DefaultPorter
+func (e *ExecProber) DefaultPort() string {
+	return e.Port
+}
+
+// Probe runs the command and verifies the chain it returns
+func (e *ExecProber) Probe(ctx context.Context, target string, config *tls.Config) (*tls.ConnectionState, error) {
+	if len(e.Command) == 0 {
+		return nil, errors.New("no command configured")
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, e.Command[0], append(e.Command[1:], target)...)
+	cmd.Env = append(os.Environ(), "SSL_EXPORTER_TARGET="+target)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", e.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	var certs []*x509.Certificate
+	b := stdout.Bytes()
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates returned by " + e.Command[0])
+	}
+
+	state := &tls.ConnectionState{
+		ServerName:       config.ServerName,
+		PeerCertificates: certs,
+	}
+	if config.VerifyConnection != nil {
+		if err := config.VerifyConnection(*state); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
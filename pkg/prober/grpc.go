@@ -0,0 +1,268 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+)
+
+// GRPCRequest configures the probes of grpc targets
+type GRPCRequest struct {
+	// Authority replaces the host of the target in the :authority of the
+	// health check, and in the server name of the handshake unless the
+	// TLSConfig has one, like the authority of a gRPC client's channel. It
+	// may have a port.
+	Authority string
+
+	// HealthCheck calls the Check method of the gRPC health checking
+	// protocol, grpc.health.v1.Health, for the Service, with the response in
+	// Result.GRPCHealth. The empty Service is the server as a whole.
+	HealthCheck bool
+	Service     string
+}
+
+// GRPCHealth is the response to a gRPC health check
+type GRPCHealth struct {
+	// Code is the grpc-status of the call, which is 0 when it succeeded and
+	// 12, UNIMPLEMENTED, when the server doesn't have health checks
+	Code int
+
+	// Status is the serving status in the response: UNKNOWN, SERVING,
+	// NOT_SERVING or SERVICE_UNKNOWN. It's empty when the call failed.
+	Status string
+
+	// Err is the reason the call didn't get a grpc-status, like a HTTP
+	// error. The TLS connection was still made.
+	Err error
+}
+
+// GRPCServingStatuses are the serving statuses of the health checking
+// protocol, by their number in its HealthCheckResponse
+var GRPCServingStatuses = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+// grpcHealthCheck is the path of the Check method of the health checking
+// protocol
+const grpcHealthCheck = "/grpc.health.v1.Health/Check"
+
+// maxGRPCMessage is the largest response to a health check that's read
+const maxGRPCMessage = 4 << 10
+
+// probeGRPC performs a TLS handshake with the target that offers h2 with
+// ALPN, as gRPC clients do, and returns the state of the connection. The
+// server must choose h2. With a health check, the call is made over the
+// connection once it's made, and its failure doesn't fail the probe.
+func probeGRPC(ctx context.Context, target string, config *tls.Config, resolver Resolver, request GRPCRequest, trace *phaseTrace, verifyErr *error) (*tls.ConnectionState, *GRPCHealth, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	config = grpcConfig(config, request.Authority)
+
+	if !request.HealthCheck {
+		var conn net.Conn
+		if isOnion(host) {
+			trace.start("dial", target)
+			conn, err = dialOnion(ctx, target)
+			trace.end("dial", target, err)
+		} else {
+			conn, err = dialTCP(ctx, target, resolver, trace)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		defer conn.Close()
+
+		state, err := handshake(ctx, conn, target, config, trace, verifyErr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkH2(target, state); err != nil {
+			return nil, nil, err
+		}
+		return state, nil, nil
+	}
+
+	transport := newTransport(verifyConfig(config, host, trace, verifyErr), resolver)
+	transport.ForceAttemptHTTP2 = true
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	// The state is taken from the handshake, as the call may fail after it
+	var (
+		mtx   sync.Mutex
+		state *tls.ConnectionState
+	)
+	ctx = context.WithValue(ctx, phaseTraceKey{}, trace)
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: clientCertRecordFrom(ctx).handshake,
+		TLSHandshakeDone: func(s tls.ConnectionState, err error) {
+			if err == nil {
+				mtx.Lock()
+				state = &s
+				mtx.Unlock()
+			}
+		},
+	})
+
+	body := grpcMessage(healthCheckRequest(request.Service))
+	req, err := http.NewRequest("POST", "https://"+escapeZone(target)+grpcHealthCheck, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if request.Authority != "" {
+		req.Host = request.Authority
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, callErr := client.Do(req.WithContext(ctx))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if state == nil {
+		if callErr == nil {
+			callErr = errors.New("The response from " + target + " is unencrypted")
+		}
+		return nil, nil, callErr
+	}
+	if err := checkH2(target, state); err != nil {
+		return nil, nil, err
+	}
+	if len(state.PeerCertificates) < 1 {
+		return nil, nil, errors.New("No certificates found in connection state for " + target)
+	}
+	if callErr != nil {
+		return state, &GRPCHealth{Err: callErr}, nil
+	}
+
+	return state, readHealthCheck(resp), nil
+}
+
+// grpcConfig returns a copy of config that offers h2 with ALPN, with the
+// host of the authority as its server name if it doesn't have one
+func grpcConfig(config *tls.Config, authority string) *tls.Config {
+	c := &tls.Config{}
+	if config != nil {
+		c = config.Clone()
+	}
+	c.NextProtos = []string{"h2"}
+	if c.ServerName == "" && authority != "" {
+		host := authority
+		if h, _, err := net.SplitHostPort(authority); err == nil {
+			host = h
+		}
+		c.ServerName = host
+	}
+	return c
+}
+
+// checkH2 returns an error if the server didn't choose h2, without which a
+// gRPC client can't use the connection
+func checkH2(target string, state *tls.ConnectionState) error {
+	if state.NegotiatedProtocol != "h2" {
+		return errors.New(target + " didn't choose h2 with ALPN, which gRPC needs")
+	}
+	return nil
+}
+
+// readHealthCheck reads the grpc-status and the serving status of the
+// response to a health check
+func readHealthCheck(resp *http.Response) *GRPCHealth {
+	if resp.StatusCode != http.StatusOK {
+		return &GRPCHealth{Err: errors.New("unexpected HTTP status " + resp.Status)}
+	}
+
+	// The trailers are only there once the body has been read
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxGRPCMessage))
+	if err != nil {
+		return &GRPCHealth{Err: err}
+	}
+
+	// A response without a message has the status in its headers
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status == "" {
+		return &GRPCHealth{Err: errors.New("the response has no grpc-status")}
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return &GRPCHealth{Err: fmt.Errorf("invalid grpc-status %s", status)}
+	}
+	health := &GRPCHealth{Code: code}
+	if code != 0 {
+		return health
+	}
+
+	serving, err := parseHealthCheckResponse(b)
+	if err != nil {
+		return &GRPCHealth{Err: err}
+	}
+	health.Status = "UNKNOWN"
+	if serving < uint64(len(GRPCServingStatuses)) {
+		health.Status = GRPCServingStatuses[serving]
+	}
+
+	return health
+}
+
+// grpcMessage frames the message for a gRPC stream, uncompressed
+func grpcMessage(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// healthCheckRequest encodes a HealthCheckRequest for the service, whose
+// only field is the service, 1
+func healthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	b := make([]byte, 1+binary.MaxVarintLen64)
+	b[0] = 1<<3 | 2
+	n := binary.PutUvarint(b[1:], uint64(len(service)))
+	return append(b[:1+n], service...)
+}
+
+// parseHealthCheckResponse returns the status of the HealthCheckResponse in
+// the framed message:
+//
+//	message HealthCheckResponse {
+//	    ServingStatus status = 1;
+//	}
+func parseHealthCheckResponse(b []byte) (uint64, error) {
+	if len(b) < 5 {
+		return 0, errors.New("the response to the health check has no message")
+	}
+	if b[0] != 0 {
+		return 0, errors.New("the response to the health check is compressed")
+	}
+	length := binary.BigEndian.Uint32(b[1:5])
+	if uint64(len(b)-5) < uint64(length) {
+		return 0, errors.New("the response to the health check is truncated")
+	}
+
+	var status uint64
+	err := walkProto(b[5:5+length], func(field int, wireType, varint uint64, _ []byte) {
+		if field == 1 && wireType == 0 {
+			status = varint
+		}
+	})
+	return status, err
+}
@@ -0,0 +1,165 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that grpc targets are probed with a handshake that offers h2, and
+// that a server that doesn't choose it fails the probe
+func TestProbeGRPC(t *testing.T) {
+	server, roots := testGRPCServer(t)
+	defer server.Close()
+	target := "grpc://" + strings.TrimPrefix(server.URL, "https://")
+
+	result, err := Probe(context.Background(), target, Options{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Protocol != "grpc" {
+		t.Errorf("expected the grpc protocol, got %s", result.Protocol)
+	}
+	if result.State.NegotiatedProtocol != "h2" {
+		t.Errorf("expected h2 to be negotiated, got %q", result.State.NegotiatedProtocol)
+	}
+	if result.GRPCHealth != nil {
+		t.Errorf("expected no health check without one in the options")
+	}
+
+	// A server without ALPN carries on with the handshake regardless
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: server.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	_, err = Probe(context.Background(), "grpc://"+l.Addr().String(), Options{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err == nil || !strings.Contains(err.Error(), "didn't choose h2") {
+		t.Errorf("expected an error for a server that doesn't choose h2, got %v", err)
+	}
+}
+
+// Test that the health check reports the serving status of the service, or
+// the grpc-status when the call fails, and that the authority replaces the
+// host of the target in the call and in the server name
+func TestProbeGRPCHealthCheck(t *testing.T) {
+	server, roots := testGRPCServer(t)
+	defer server.Close()
+	target := strings.TrimPrefix(server.URL, "https://")
+
+	for _, test := range []struct {
+		request GRPCRequest
+		code    int
+		status  string
+	}{
+		{request: GRPCRequest{HealthCheck: true}, status: "SERVING"},
+		{request: GRPCRequest{HealthCheck: true, Service: "backup"}, status: "NOT_SERVING"},
+		{request: GRPCRequest{HealthCheck: true, Service: "missing"}, code: 5},
+		{request: GRPCRequest{HealthCheck: true, Authority: "example.com:443"}, status: "SERVING"},
+	} {
+		result, err := Probe(context.Background(), target, Options{
+			TLSConfig: &tls.Config{RootCAs: roots},
+			Prober:    "grpc",
+			GRPC:      test.request,
+		})
+		if err != nil {
+			t.Errorf("%+v: %s", test.request, err)
+			continue
+		}
+		health := result.GRPCHealth
+		if health == nil || health.Err != nil || health.Code != test.code || health.Status != test.status {
+			t.Errorf("%+v: expected code %d and status %q, got %+v", test.request, test.code, test.status, health)
+		}
+	}
+
+	// The certificate of the test server isn't for the authority
+	_, err := Probe(context.Background(), target, Options{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Prober:    "grpc",
+		GRPC:      GRPCRequest{Authority: "api.internal"},
+	})
+	if err == nil {
+		t.Errorf("expected the certificate to be verified against the authority")
+	}
+}
+
+// testGRPCServer is a HTTP/2 server that implements the Check method of the
+// health checking protocol, for the server, the backup service, which isn't
+// serving, and the example.com authority
+func testGRPCServer(t *testing.T) (*httptest.Server, *x509.CertPool) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != grpcHealthCheck || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "not a gRPC health check", http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if len(b) < 5 {
+			http.Error(w, "not a gRPC message", http.StatusBadRequest)
+			return
+		}
+
+		var service string
+		walkProto(b[5:], func(field int, wireType, _ uint64, value []byte) {
+			if field == 1 && wireType == 2 {
+				service = string(value)
+			}
+		})
+
+		w.Header().Set("Content-Type", "application/grpc")
+		var status byte
+		switch {
+		case service == "" && (r.Host == "example.com:443" || strings.HasPrefix(r.Host, "127.0.0.1")):
+			status = 1
+		case service == "backup":
+			status = 2
+		default:
+			// A response without a message has the status in its headers
+			w.Header().Set("Grpc-Status", "5")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpcMessage([]byte{1 << 3, status}))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	return server, roots
+}
+
+// Test that the status is read from a HealthCheckResponse, skipping the
+// fields that it doesn't know
+func TestParseHealthCheckResponse(t *testing.T) {
+	status, err := parseHealthCheckResponse(grpcMessage([]byte{2<<3 | 2, 1, 'x', 1 << 3, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 3 {
+		t.Errorf("expected the status 3, got %d", status)
+	}
+
+	for _, b := range [][]byte{nil, {1, 0, 0, 0, 0}, {0, 0, 0, 0, 9, 1 << 3}} {
+		if _, err := parseHealthCheckResponse(b); err == nil {
+			t.Errorf("expected an error for %v", b)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package prober
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// ServerHello is what the server chose in its ServerHello message
+type ServerHello struct {
+	// Version is the legacy_version field, which is always TLS 1.2 for TLS
+	// 1.3, where the version is in the supported_versions extension
+	Version uint16
+	// SelectedVersion is the version that was agreed on, from the
+	// supported_versions extension if there is one
+	SelectedVersion uint16
+	CipherSuite     uint16
+	// Extensions are the types of the extensions, in the order the server
+	// sent them
+	Extensions []uint16
+}
+
+// JA3S returns the JA3S fingerprint of the ServerHello: the MD5 of its
+// version, cipher suite and extensions, which identifies the TLS stack of
+// the server, or of whatever terminates TLS in front of it
+func (h *ServerHello) JA3S() string {
+	sum := md5.Sum([]byte(h.JA3SString()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA3SString returns the string that the JA3S fingerprint is the hash of,
+// like 771,4865,43-51
+func (h *ServerHello) JA3SString() string {
+	var exts []string
+	for _, e := range h.Extensions {
+		exts = append(exts, strconv.Itoa(int(e)))
+	}
+	return strconv.Itoa(int(h.Version)) + "," + strconv.Itoa(int(h.CipherSuite)) + "," + strings.Join(exts, "-")
+}
+
+// ClientHello is what the exporter offered in its ClientHello message
+type ClientHello struct {
+	// Versions are those of the supported_versions extension, or the
+	// legacy_version field if there isn't one
+	Versions     []uint16
+	CipherSuites []uint16
+	Extensions   []uint16
+}
+
+// maxHelloRecords is the most that's kept of a connection in search of a
+// hello message: a full record, plus headers
+const maxHelloRecords = 16<<10 + 64
+
+// helloKey is the context key of the helloRecord of a probe
+type helloKey struct{}
+
+// helloRecord keeps the records written to and read from the connection of
+// a probe until the ClientHello and ServerHello can be parsed from them
+type helloRecord struct {
+	mtx    sync.Mutex
+	client helloBuffer
+	server helloBuffer
+}
+
+// helloBuffer keeps the records sent one way until the hello message can be
+// parsed from them
+type helloBuffer struct {
+	buf  []byte
+	body []byte
+	done bool
+}
+
+func (h *helloBuffer) add(b []byte, msgType byte) {
+	if h.done {
+		return
+	}
+
+	h.buf = append(h.buf, b...)
+	body, err := parseHandshake(h.buf, msgType)
+	if err == errShortHello && len(h.buf) < maxHelloRecords {
+		return
+	}
+	h.body, h.done, h.buf = body, true, nil
+}
+
+func withHelloRecord(ctx context.Context) (context.Context, *helloRecord) {
+	rec := &helloRecord{}
+	return context.WithValue(ctx, helloKey{}, rec), rec
+}
+
+// recordHello returns a conn that records the hello messages it writes and
+// reads in the helloRecord of ctx, if there is one
+func recordHello(ctx context.Context, conn net.Conn) net.Conn {
+	rec, _ := ctx.Value(helloKey{}).(*helloRecord)
+	if rec == nil {
+		return conn
+	}
+	return &helloConn{Conn: conn, rec: rec}
+}
+
+// serverHello returns the ServerHello, if it was read
+func (r *helloRecord) serverHello() *ServerHello {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.server.body == nil {
+		return nil
+	}
+	hello, _ := parseServerHello(r.server.body)
+	return hello
+}
+
+// clientHello returns the ClientHello, if it was written
+func (r *helloRecord) clientHello() *ClientHello {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.client.body == nil {
+		return nil
+	}
+	hello, _ := parseClientHello(r.client.body)
+	return hello
+}
+
+// helloConn passes what's written to and read from the connection to a
+// helloRecord
+type helloConn struct {
+	net.Conn
+	rec *helloRecord
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.rec.mtx.Lock()
+		c.rec.server.add(b[:n], 2)
+		c.rec.mtx.Unlock()
+	}
+	return n, err
+}
+
+func (c *helloConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.rec.mtx.Lock()
+		c.rec.client.add(b[:n], 1)
+		c.rec.mtx.Unlock()
+	}
+	return n, err
+}
+
+// errShortHello means more records are needed to parse a hello message
+var errShortHello = errors.New("incomplete hello")
+
+// parseHandshake returns the body of the first handshake message in the
+// TLS records, which has to be of the type. It may be split over several
+// records.
+func parseHandshake(b []byte, msgType byte) ([]byte, error) {
+	var (
+		msg   []byte
+		ended bool
+	)
+	for len(b) >= 5 {
+		n := int(b[3])<<8 | int(b[4])
+		if len(b) < 5+n {
+			break
+		}
+		// The handshake records end with anything else, like the
+		// ChangeCipherSpec that follows the ServerHello of TLS 1.3, or an
+		// alert
+		if b[0] != 22 {
+			ended = true
+			break
+		}
+		msg = append(msg, b[5:5+n]...)
+		b = b[5+n:]
+	}
+
+	short := errShortHello
+	if ended {
+		short = errors.New("no hello in the handshake records")
+	}
+	if len(msg) < 4 {
+		return nil, short
+	}
+	if msg[0] != msgType {
+		return nil, errors.New("not a hello")
+	}
+	n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+n {
+		return nil, short
+	}
+
+	return msg[4 : 4+n], nil
+}
+
+var errMalformedHello = errors.New("malformed hello")
+
+// helloReader reads the fields of a hello message
+type helloReader []byte
+
+func (r *helloReader) uint8() (int, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := int((*r)[0])
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) uint16() (int, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := int((*r)[0])<<8 | int((*r)[1])
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) bytes(n int) (helloReader, bool) {
+	if n < 0 || len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+// uint16s reads a list of 16-bit values with a length of lenBytes bytes
+func (r *helloReader) uint16s(lenBytes int) ([]uint16, bool) {
+	var (
+		n  int
+		ok bool
+	)
+	if lenBytes == 1 {
+		n, ok = r.uint8()
+	} else {
+		n, ok = r.uint16()
+	}
+	if !ok {
+		return nil, false
+	}
+	list, ok := r.bytes(n)
+	if !ok || n%2 != 0 {
+		return nil, false
+	}
+
+	var values []uint16
+	for len(list) > 0 {
+		v, _ := list.uint16()
+		values = append(values, uint16(v))
+	}
+	return values, true
+}
+
+// extensions reads the extensions at the end of a hello message and calls
+// fn with the type and data of each
+func (r *helloReader) extensions(fn func(typ uint16, data helloReader)) bool {
+	if len(*r) == 0 {
+		return true
+	}
+	n, ok := r.uint16()
+	if !ok {
+		return false
+	}
+	exts, ok := r.bytes(n)
+	if !ok {
+		return false
+	}
+	for len(exts) > 0 {
+		typ, ok := exts.uint16()
+		if !ok {
+			return false
+		}
+		n, ok := exts.uint16()
+		if !ok {
+			return false
+		}
+		data, ok := exts.bytes(n)
+		if !ok {
+			return false
+		}
+		fn(uint16(typ), data)
+	}
+	return true
+}
+
+// extSupportedVersions is the type of the supported_versions extension
+const extSupportedVersions = 43
+
+// parseServerHello parses the body of a ServerHello message
+func parseServerHello(body []byte) (*ServerHello, error) {
+	r := helloReader(body)
+
+	version, ok := r.uint16()
+	if !ok {
+		return nil, errMalformedHello
+	}
+	hello := &ServerHello{Version: uint16(version)}
+
+	// The random and the session ID
+	if _, ok := r.bytes(32); !ok {
+		return nil, errMalformedHello
+	}
+	sid, ok := r.uint8()
+	if !ok {
+		return nil, errMalformedHello
+	}
+	if _, ok := r.bytes(sid); !ok {
+		return nil, errMalformedHello
+	}
+
+	// The cipher suite and the compression method
+	suite, ok := r.uint16()
+	if !ok {
+		return nil, errMalformedHello
+	}
+	hello.CipherSuite = uint16(suite)
+	if _, ok := r.uint8(); !ok {
+		return nil, errMalformedHello
+	}
+
+	if !r.extensions(func(typ uint16, data helloReader) {
+		hello.Extensions = append(hello.Extensions, typ)
+		if typ == extSupportedVersions {
+			if v, ok := data.uint16(); ok {
+				hello.SelectedVersion = uint16(v)
+			}
+		}
+	}) {
+		return nil, errMalformedHello
+	}
+	if hello.SelectedVersion == 0 {
+		hello.SelectedVersion = hello.Version
+	}
+
+	return hello, nil
+}
+
+// parseClientHello parses the body of a ClientHello message
+func parseClientHello(body []byte) (*ClientHello, error) {
+	r := helloReader(body)
+
+	version, ok := r.uint16()
+	if !ok {
+		return nil, errMalformedHello
+	}
+
+	// The random and the session ID
+	if _, ok := r.bytes(32); !ok {
+		return nil, errMalformedHello
+	}
+	sid, ok := r.uint8()
+	if !ok {
+		return nil, errMalformedHello
+	}
+	if _, ok := r.bytes(sid); !ok {
+		return nil, errMalformedHello
+	}
+
+	hello := &ClientHello{}
+	if hello.CipherSuites, ok = r.uint16s(2); !ok {
+		return nil, errMalformedHello
+	}
+
+	// The compression methods
+	n, ok := r.uint8()
+	if !ok {
+		return nil, errMalformedHello
+	}
+	if _, ok := r.bytes(n); !ok {
+		return nil, errMalformedHello
+	}
+
+	if !r.extensions(func(typ uint16, data helloReader) {
+		hello.Extensions = append(hello.Extensions, typ)
+		if typ == extSupportedVersions {
+			hello.Versions, _ = data.uint16s(1)
+		}
+	}) {
+		return nil, errMalformedHello
+	}
+	if len(hello.Versions) == 0 {
+		hello.Versions = []uint16{uint16(version)}
+	}
+
+	return hello, nil
+}
+
+// extensionNames are the names of the common extensions, for the debug logs
+var extensionNames = map[uint16]string{
+	0:     "server_name",
+	5:     "status_request",
+	10:    "supported_groups",
+	11:    "ec_point_formats",
+	13:    "signature_algorithms",
+	16:    "application_layer_protocol_negotiation",
+	18:    "signed_certificate_timestamp",
+	23:    "extended_master_secret",
+	35:    "session_ticket",
+	41:    "pre_shared_key",
+	43:    "supported_versions",
+	45:    "psk_key_exchange_modes",
+	51:    "key_share",
+	65281: "renegotiation_info",
+}
+
+// logHellos logs the parameters of the hello messages at debug level, which
+// says more about a failed handshake than the error does
+func logHellos(logger log.Logger, client *ClientHello, server *ServerHello) {
+	if client == nil {
+		return
+	}
+
+	var versions, suites []string
+	for _, v := range client.Versions {
+		versions = append(versions, tls.VersionName(v))
+	}
+	for _, c := range client.CipherSuites {
+		suites = append(suites, tls.CipherSuiteName(c))
+	}
+	logger.Debugln("ClientHello offered versions " + strings.Join(versions, ", ") +
+		"; cipher suites " + strings.Join(suites, ", ") +
+		"; extensions " + extensionList(client.Extensions))
+
+	if server == nil {
+		logger.Debugln("No ServerHello was received")
+		return
+	}
+	logger.Debugln("ServerHello chose version " + tls.VersionName(server.SelectedVersion) +
+		"; cipher suite " + tls.CipherSuiteName(server.CipherSuite) +
+		"; extensions " + extensionList(server.Extensions))
+}
+
+func extensionList(exts []uint16) string {
+	var names []string
+	for _, e := range exts {
+		name, ok := extensionNames[e]
+		if !ok {
+			name = strconv.Itoa(int(e))
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,72 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+// Test that the hello messages are recorded by both probers
+func TestProbeServerHello(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	for _, target := range []string{server.URL, strings.TrimPrefix(server.URL, "https://")} {
+		result, err := Probe(context.Background(), target, Options{
+			TLSConfig: &tls.Config{RootCAs: roots},
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+
+		hello := result.ServerHello
+		if hello == nil {
+			t.Fatalf("%s: expected the ServerHello to be read", target)
+		}
+		if hello.Version != tls.VersionTLS12 || hello.SelectedVersion != result.State.Version || hello.CipherSuite != result.State.CipherSuite || len(hello.Extensions) == 0 {
+			t.Errorf("%s: unexpected ServerHello %+v", target, hello)
+		}
+
+		client := result.ClientHello
+		if client == nil {
+			t.Fatalf("%s: expected the ClientHello to be recorded", target)
+		}
+		if len(client.Versions) == 0 || len(client.CipherSuites) == 0 || len(client.Extensions) == 0 {
+			t.Errorf("%s: unexpected ClientHello %+v", target, client)
+		}
+	}
+}
+
+// Test that a ServerHello split over two records is parsed
+func TestParseServerHello(t *testing.T) {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0, 0x13, 0x01, 0)
+	body = append(body, 0, 10, 0, 43, 0, 2, 3, 4, 0, 51, 0, 0)
+	msg := append([]byte{2, 0, 0, byte(len(body))}, body...)
+
+	records := append([]byte{22, 3, 3, 0, 10}, msg[:10]...)
+	if _, err := parseHandshake(records, 2); err != errShortHello {
+		t.Fatalf("expected the ServerHello to be incomplete, got %v", err)
+	}
+
+	records = append(records, append([]byte{22, 3, 3, 0, byte(len(msg) - 10)}, msg[10:]...)...)
+	body, err := parseHandshake(records, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := parseServerHello(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.SelectedVersion != tls.VersionTLS13 {
+		t.Errorf("expected the version from supported_versions, got %x", hello.SelectedVersion)
+	}
+	if s := hello.JA3SString(); s != "771,4865,43-51" {
+		t.Errorf("expected the JA3S string 771,4865,43-51, got %s", s)
+	}
+	if fp := hello.JA3S(); fp != "f4febc55ea12b31ae17cfb7e614afda8" {
+		t.Errorf("unexpected JA3S %s", fp)
+	}
+}
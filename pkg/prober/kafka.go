@@ -0,0 +1,475 @@
+package prober
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The SASL mechanisms that kafka targets can be authenticated to with
+const (
+	SASLPlain       = "PLAIN"
+	SASLSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// KafkaRequest configures the probes of kafka targets
+type KafkaRequest struct {
+	// SASL, if set, authenticates to the broker after the handshake, as
+	// the clients of a SASL_SSL listener do, with the outcome in
+	// Result.Kafka
+	SASL *SASL
+
+	// DiscoverBrokers asks the broker for the brokers of its cluster, and
+	// makes a handshake with each of them, with the results in
+	// Result.Kafka. With SASL, they're only asked for once the
+	// authentication succeeded.
+	DiscoverBrokers bool
+}
+
+// SASL is the mechanism and the credentials of SASL authentication
+type SASL struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// KafkaResult is what was done with a kafka target after the handshake
+type KafkaResult struct {
+	// SASL is whether SASL authentication was made, and SASLErr why it
+	// failed if it did
+	SASL    bool
+	SASLErr error
+
+	// Brokers are the handshakes with each of the brokers of the cluster,
+	// in the order of their ids, when they were discovered. BrokersErr is
+	// why the brokers couldn't be asked for.
+	Brokers    []KafkaBroker
+	BrokersErr error
+}
+
+// KafkaBroker is the outcome of the handshake with one of the brokers of a
+// cluster
+type KafkaBroker struct {
+	// ID is the node id of the broker, and Address the host and port that
+	// it advertises
+	ID      int32
+	Address string
+
+	// State is the state of the TLS connection. It's nil if the handshake
+	// failed, with the reason in Err.
+	State *tls.ConnectionState
+	Err   error
+}
+
+// The keys and versions of the requests of the Kafka protocol that are made
+// to a broker. They're the lowest versions that the brokers of Kafka 4 still
+// accept, and the last that aren't encoded in the flexible format.
+const (
+	kafkaMetadata         = 3
+	kafkaMetadataVersion  = 4
+	kafkaSASLHandshake    = 17
+	kafkaSASLHandshakeV   = 1
+	kafkaSASLAuthenticate = 36
+	kafkaSASLAuthV        = 1
+)
+
+// kafkaClientID is the client.id of the requests, which shows up in the logs
+// of the broker
+const kafkaClientID = "ssl_exporter"
+
+// maxKafkaResponse is the largest response from a broker that's read. The
+// metadata of a cluster with many brokers is the largest of them.
+const maxKafkaResponse = 1 << 20
+
+// probeKafka performs a TLS handshake with the broker in the target, and
+// then authenticates with SASL and asks for the brokers of the cluster if the
+// request says to. Neither fails the probe, as the handshake succeeded. The
+// brokers are returned without having been probed.
+func probeKafka(ctx context.Context, target string, config *tls.Config, resolver Resolver, request KafkaRequest, trace *phaseTrace, verifyErr *error) (*tls.ConnectionState, *KafkaResult, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conn net.Conn
+	if isOnion(host) {
+		trace.start("dial", target)
+		conn, err = dialOnion(ctx, target)
+		trace.end("dial", target, err)
+	} else {
+		conn, err = dialTCP(ctx, target, resolver, trace)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	tlsConn, state, err := handshakeConn(ctx, conn, target, config, trace, verifyErr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if request.SASL == nil && !request.DiscoverBrokers {
+		return state, nil, nil
+	}
+
+	// The requests after the handshake are bound by the context too
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	} else {
+		tlsConn.SetDeadline(time.Time{})
+	}
+	c := &kafkaConn{rw: tlsConn}
+
+	result := &KafkaResult{}
+	if request.SASL != nil {
+		result.SASL = true
+		trace.start("sasl", "")
+		result.SASLErr = c.authenticate(request.SASL)
+		trace.end("sasl", "", result.SASLErr)
+		if result.SASLErr != nil {
+			return state, result, nil
+		}
+	}
+
+	if request.DiscoverBrokers {
+		result.Brokers, result.BrokersErr = c.brokers()
+	}
+
+	return state, result, nil
+}
+
+// probeBrokers makes a handshake with each of the brokers, at the same time,
+// which are verified against the names that they advertise rather than the
+// server name of the TLSConfig
+func probeBrokers(ctx context.Context, brokers []KafkaBroker, opts Options) {
+	config := opts.TLSConfig
+	if config != nil && config.ServerName != "" {
+		config = config.Clone()
+		config.ServerName = ""
+	}
+
+	var wg sync.WaitGroup
+	for i := range brokers {
+		wg.Add(1)
+		go func(b *KafkaBroker) {
+			defer wg.Done()
+
+			trace := newPhaseTrace(ctx, b.Address, nil)
+			var verifyErr *error
+			if opts.RecordVerifyErrors {
+				verifyErr = new(error)
+			}
+			b.State, b.Err = probeTCP(ctx, b.Address, config, opts.Resolver, trace, verifyErr)
+		}(&brokers[i])
+	}
+	wg.Wait()
+}
+
+// kafkaConn makes requests of the Kafka protocol to a broker, one at a time
+type kafkaConn struct {
+	rw            io.ReadWriter
+	correlationID int32
+}
+
+// request sends the request and returns the body of its response
+func (c *kafkaConn) request(key, version int16, body []byte) (*kafkaReader, error) {
+	c.correlationID++
+
+	// The header of the request, version 1: the key, the version, the
+	// correlation id and the client id
+	w := &kafkaWriter{}
+	w.int16(key)
+	w.int16(version)
+	w.int32(c.correlationID)
+	w.string(kafkaClientID)
+	w.b = append(w.b, body...)
+
+	msg := make([]byte, 4, 4+len(w.b))
+	binary.BigEndian.PutUint32(msg, uint32(len(w.b)))
+	if _, err := c.rw.Write(append(msg, w.b...)); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.rw, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxKafkaResponse {
+		return nil, fmt.Errorf("invalid length of a Kafka response, %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, b); err != nil {
+		return nil, err
+	}
+
+	r := &kafkaReader{b: b}
+	if id := r.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("unexpected correlation id %d in a Kafka response, expected %d", id, c.correlationID)
+	}
+	return r, nil
+}
+
+// authenticate authenticates to the broker with the SASL mechanism, over
+// the SaslHandshake and SaslAuthenticate requests
+func (c *kafkaConn) authenticate(sasl *SASL) error {
+	w := &kafkaWriter{}
+	w.string(sasl.Mechanism)
+	r, err := c.request(kafkaSASLHandshake, kafkaSASLHandshakeV, w.b)
+	if err != nil {
+		return err
+	}
+	code := r.int16()
+	var mechanisms []string
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		mechanisms = append(mechanisms, r.string())
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if code != 0 {
+		return fmt.Errorf("the broker doesn't support SASL %s, only %s (error code %d)", sasl.Mechanism, strings.Join(mechanisms, ", "), code)
+	}
+
+	switch sasl.Mechanism {
+	case SASLPlain:
+		_, err := c.saslAuthenticate([]byte("\x00" + sasl.Username + "\x00" + sasl.Password))
+		return err
+	case SASLSCRAMSHA256:
+		return c.scram(sha256.New, sasl)
+	case SASLSCRAMSHA512:
+		return c.scram(sha512.New, sasl)
+	}
+	return errors.New("unsupported SASL mechanism " + sasl.Mechanism)
+}
+
+// saslAuthenticate sends the bytes of the mechanism in a SaslAuthenticate
+// request and returns those of the response
+func (c *kafkaConn) saslAuthenticate(b []byte) ([]byte, error) {
+	w := &kafkaWriter{}
+	w.bytes(b)
+	r, err := c.request(kafkaSASLAuthenticate, kafkaSASLAuthV, w.b)
+	if err != nil {
+		return nil, err
+	}
+	code := r.int16()
+	message := r.nullableString()
+	auth := r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if code != 0 {
+		if message == "" {
+			message = "authentication failed"
+		}
+		return nil, fmt.Errorf("SASL authentication failed with error code %d: %s", code, message)
+	}
+	return auth, nil
+}
+
+// scram authenticates with SCRAM, RFC 5802, and verifies the signature of
+// the broker, so that it's known to have the credentials too
+func (c *kafkaConn) scram(h func() hash.Hash, sasl *SASL) error {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	clientNonce := base64.RawStdEncoding.EncodeToString(nonce)
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(sasl.Username)
+	clientFirstBare := "n=" + user + ",r=" + clientNonce
+
+	b, err := c.saslAuthenticate([]byte("n,," + clientFirstBare))
+	if err != nil {
+		return err
+	}
+	serverFirst := string(b)
+	attrs := scramAttributes(serverFirst)
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return errors.New("invalid salt in the SCRAM server-first-message")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return errors.New("invalid iteration count in the SCRAM server-first-message")
+	}
+	if !strings.HasPrefix(attrs["r"], clientNonce) || len(attrs["r"]) == len(clientNonce) {
+		return errors.New("invalid nonce in the SCRAM server-first-message")
+	}
+
+	clientFinalWithoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	saltedPassword := pbkdf2.Key([]byte(sasl.Password), salt, iterations, h().Size(), h)
+	clientKey := scramHMAC(h, saltedPassword, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	clientSignature := scramHMAC(h, storedKey.Sum(nil), authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	b, err = c.saslAuthenticate([]byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	final := scramAttributes(string(b))
+	if e, ok := final["e"]; ok {
+		return errors.New("SCRAM authentication failed: " + e)
+	}
+	serverSignature := scramHMAC(h, scramHMAC(h, saltedPassword, "Server Key"), authMessage)
+	if v, err := base64.StdEncoding.DecodeString(final["v"]); err != nil || !hmac.Equal(v, serverSignature) {
+		return errors.New("the SCRAM signature of the broker is invalid")
+	}
+
+	return nil
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramAttributes returns the attributes of a SCRAM message, by name
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 1 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+// brokers asks the broker for the metadata of the cluster, without any
+// topics, and returns its brokers in the order of their ids
+func (c *kafkaConn) brokers() ([]KafkaBroker, error) {
+	// No topics, and they aren't created
+	w := &kafkaWriter{}
+	w.int32(0)
+	w.b = append(w.b, 0)
+	r, err := c.request(kafkaMetadata, kafkaMetadataVersion, w.b)
+	if err != nil {
+		return nil, err
+	}
+
+	r.int32() // throttle_time_ms
+	var brokers []KafkaBroker
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.nullableString() // rack
+		brokers = append(brokers, KafkaBroker{ID: id, Address: net.JoinHostPort(host, strconv.Itoa(int(port)))})
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("the metadata of the cluster has no brokers")
+	}
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i].ID < brokers[j].ID })
+
+	return brokers, nil
+}
+
+// kafkaWriter encodes the fields of a Kafka request
+type kafkaWriter struct {
+	b []byte
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	w.b = append(w.b, byte(uint16(v)>>8), byte(v))
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	w.b = append(w.b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(w.b[len(w.b)-4:], uint32(v))
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.b = append(w.b, b...)
+}
+
+// kafkaReader decodes the fields of a Kafka response. Once a field can't be
+// read, err is set and the rest are zero.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errors.New("truncated Kafka response")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int16() int16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (r *kafkaReader) int32() int32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+// nullableString returns "" for a null string, whose length is -1
+func (r *kafkaReader) nullableString() string {
+	n := r.int16()
+	if n == -1 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n == -1 {
+		return nil
+	}
+	return r.next(int(n))
+}
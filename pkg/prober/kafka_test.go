@@ -0,0 +1,284 @@
+package prober
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Test that kafka targets are probed with a handshake, and that SASL
+// authentication over it reports whether the credentials were accepted,
+// without failing the probe
+func TestProbeKafkaSASL(t *testing.T) {
+	broker, roots := testKafkaBroker(t, nil)
+	defer broker.Close()
+	target := "kafka://" + broker.Addr().String()
+
+	result, err := Probe(context.Background(), target, Options{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Protocol != "kafka" {
+		t.Errorf("expected the kafka protocol, got %s", result.Protocol)
+	}
+	if result.Kafka != nil {
+		t.Errorf("expected no kafka result without SASL or discovery")
+	}
+
+	for _, test := range []struct {
+		sasl SASL
+		err  string
+	}{
+		{sasl: SASL{Mechanism: SASLPlain, Username: "alice", Password: "secret"}},
+		{sasl: SASL{Mechanism: SASLPlain, Username: "alice", Password: "wrong"}, err: "Authentication failed"},
+		{sasl: SASL{Mechanism: SASLSCRAMSHA256, Username: "alice", Password: "secret"}},
+		{sasl: SASL{Mechanism: SASLSCRAMSHA256, Username: "alice", Password: "wrong"}, err: "Authentication failed"},
+		{sasl: SASL{Mechanism: SASLSCRAMSHA512, Username: "alice", Password: "secret"}},
+		{sasl: SASL{Mechanism: SASLSCRAMSHA512, Username: "bob", Password: "secret"}, err: "Authentication failed"},
+	} {
+		sasl := test.sasl
+		result, err := Probe(context.Background(), target, Options{
+			TLSConfig: &tls.Config{RootCAs: roots},
+			Kafka:     KafkaRequest{SASL: &sasl},
+		})
+		if err != nil {
+			t.Errorf("%+v: %s", sasl, err)
+			continue
+		}
+		if result.Kafka == nil || !result.Kafka.SASL {
+			t.Errorf("%+v: expected SASL authentication", sasl)
+			continue
+		}
+		switch {
+		case test.err == "" && result.Kafka.SASLErr != nil:
+			t.Errorf("%+v: %s", sasl, result.Kafka.SASLErr)
+		case test.err != "" && (result.Kafka.SASLErr == nil || !strings.Contains(result.Kafka.SASLErr.Error(), test.err)):
+			t.Errorf("%+v: expected an error containing %q, got %v", sasl, test.err, result.Kafka.SASLErr)
+		}
+	}
+
+	// The broker only has the mechanisms that it's configured with
+	only, roots := testKafkaBroker(t, nil)
+	defer only.Close()
+	result, err = Probe(context.Background(), only.Addr().String(), Options{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Prober:    "kafka",
+		Kafka:     KafkaRequest{SASL: &SASL{Mechanism: "GSSAPI", Username: "alice"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Kafka.SASLErr == nil || !strings.Contains(result.Kafka.SASLErr.Error(), "doesn't support SASL GSSAPI") {
+		t.Errorf("expected an error for an unsupported mechanism, got %v", result.Kafka.SASLErr)
+	}
+}
+
+// Test that the brokers of the cluster are discovered from its metadata and
+// each probed, in the order of their ids, and that a broker that can't be
+// reached doesn't fail the others
+func TestProbeKafkaBrokers(t *testing.T) {
+	other, roots := testKafkaBroker(t, nil)
+	defer other.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	brokers := []KafkaBroker{
+		{ID: 3, Address: closed.Addr().String()},
+		{ID: 1, Address: other.Addr().String()},
+	}
+	broker, _ := testKafkaBroker(t, brokers)
+	defer broker.Close()
+
+	for _, sasl := range []*SASL{nil, {Mechanism: SASLSCRAMSHA256, Username: "alice", Password: "secret"}} {
+		result, err := Probe(context.Background(), broker.Addr().String(), Options{
+			TLSConfig: &tls.Config{RootCAs: roots},
+			Prober:    "kafka",
+			Kafka:     KafkaRequest{SASL: sasl, DiscoverBrokers: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Kafka == nil || result.Kafka.BrokersErr != nil || len(result.Kafka.Brokers) != 2 {
+			t.Fatalf("expected 2 brokers, got %+v", result.Kafka)
+		}
+		first, second := result.Kafka.Brokers[0], result.Kafka.Brokers[1]
+		if first.ID != 1 || first.Address != other.Addr().String() || first.Err != nil || first.State == nil {
+			t.Errorf("expected a handshake with broker 1, got %+v", first)
+		}
+		if second.ID != 3 || second.Err == nil || second.State != nil {
+			t.Errorf("expected broker 3 to fail, got %+v", second)
+		}
+	}
+
+	// The brokers aren't asked for once the authentication failed
+	result, err := Probe(context.Background(), broker.Addr().String(), Options{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Prober:    "kafka",
+		Kafka:     KafkaRequest{SASL: &SASL{Mechanism: SASLPlain, Username: "alice"}, DiscoverBrokers: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Kafka.SASLErr == nil || len(result.Kafka.Brokers) != 0 {
+		t.Errorf("expected no brokers after a failed authentication, got %+v", result.Kafka)
+	}
+}
+
+// Test that the attributes of a SCRAM message are read by name
+func TestScramAttributes(t *testing.T) {
+	attrs := scramAttributes("r=abc,s=c2FsdA==,i=4096,x")
+	if attrs["r"] != "abc" || attrs["s"] != "c2FsdA==" || attrs["i"] != "4096" || len(attrs) != 3 {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
+
+// testKafkaBroker returns a broker on a SASL_SSL listener that accepts the
+// user alice with the password secret over PLAIN and SCRAM, and whose
+// metadata has the brokers. The roots have its certificate.
+func testKafkaBroker(t *testing.T, brokers []KafkaBroker) (net.Listener, *x509.CertPool) {
+	server, roots := testServer()
+	config := &tls.Config{Certificates: server.TLS.Certificates}
+	server.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serveKafka(conn, brokers)
+			}()
+		}
+	}()
+
+	return l, roots
+}
+
+// serveKafka answers the SASL and metadata requests on the connection
+func serveKafka(conn net.Conn, brokers []KafkaBroker) {
+	var (
+		mechanism, firstBare, serverFirst string
+		salt                              = []byte("salt")
+	)
+	hashes := map[string]func() hash.Hash{SASLSCRAMSHA256: sha256.New, SASLSCRAMSHA512: sha512.New}
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		r := &kafkaReader{b: b}
+		key := r.int16()
+		r.int16()
+		correlationID := r.int32()
+		r.string()
+
+		w := &kafkaWriter{}
+		w.int32(correlationID)
+		switch key {
+		case kafkaSASLHandshake:
+			mechanism = r.string()
+			if mechanism == SASLPlain || hashes[mechanism] != nil {
+				w.int16(0)
+			} else {
+				w.int16(33)
+			}
+			w.int32(3)
+			w.string(SASLPlain)
+			w.string(SASLSCRAMSHA256)
+			w.string(SASLSCRAMSHA512)
+		case kafkaSASLAuthenticate:
+			auth := string(r.bytes())
+			var reply string
+			ok := true
+			switch {
+			case mechanism == SASLPlain:
+				ok = auth == "\x00alice\x00secret"
+			case strings.HasPrefix(auth, "n,,"):
+				firstBare = strings.TrimPrefix(auth, "n,,")
+				attrs := scramAttributes(firstBare)
+				serverFirst = "r=" + attrs["r"] + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+				reply = serverFirst
+				ok = attrs["n"] == "alice"
+			default:
+				h := hashes[mechanism]
+				i := strings.LastIndex(auth, ",p=")
+				authMessage := firstBare + "," + serverFirst + "," + auth[:i]
+				proof, _ := base64.StdEncoding.DecodeString(auth[i+3:])
+
+				saltedPassword := pbkdf2.Key([]byte("secret"), salt, 4096, h().Size(), h)
+				storedKey := h()
+				storedKey.Write(scramHMAC(h, saltedPassword, "Client Key"))
+				signature := scramHMAC(h, storedKey.Sum(nil), authMessage)
+				if len(proof) != len(signature) {
+					ok = false
+					break
+				}
+				for i := range proof {
+					proof[i] ^= signature[i]
+				}
+				given := h()
+				given.Write(proof)
+				ok = hmac.Equal(given.Sum(nil), storedKey.Sum(nil))
+				reply = "v=" + base64.StdEncoding.EncodeToString(scramHMAC(h, scramHMAC(h, saltedPassword, "Server Key"), authMessage))
+			}
+			if ok {
+				w.int16(0)
+				w.int16(-1)
+				w.bytes([]byte(reply))
+			} else {
+				w.int16(58)
+				w.string("Authentication failed: Invalid username or password")
+				w.bytes(nil)
+			}
+			w.int32(0)
+			w.int32(0)
+		case kafkaMetadata:
+			w.int32(0)
+			w.int32(int32(len(brokers)))
+			for _, b := range brokers {
+				host, port, _ := net.SplitHostPort(b.Address)
+				p, _ := net.LookupPort("tcp", port)
+				w.int32(b.ID)
+				w.string(host)
+				w.int32(int32(p))
+				w.int16(-1)
+			}
+			w.string("cluster")
+			w.int32(1)
+			w.int32(0)
+		default:
+			return
+		}
+
+		msg := make([]byte, 4)
+		binary.BigEndian.PutUint32(msg, uint32(len(w.b)))
+		conn.Write(append(msg, w.b...))
+	}
+}
@@ -0,0 +1,164 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxOCSPResponse is the most that's read of a response from an OCSP
+// responder
+const maxOCSPResponse = 1 << 20
+
+// OCSPResult is the outcome of a probe of an OCSP responder
+type OCSPResult struct {
+	// Duration is how long the responder took to respond, until the whole
+	// response was read
+	Duration time.Duration
+
+	// Response is the status of the certificate that the responder gave.
+	// It's nil if it didn't give one.
+	Response *ocsp.Response
+
+	// Raw is the response, as the responder sent it
+	Raw []byte
+
+	// ResponseErr is why the response isn't valid: its signature can't be
+	// verified with the issuer, or it's outside of its validity period. It's
+	// nil for a valid response.
+	ResponseErr error
+}
+
+// ProbeOCSP requests the status of the certificate from the OCSP responder at
+// the URL and checks the response. The error is about the responder not
+// giving a response at all, while an invalid response is reported in
+// OCSPResult.ResponseErr.
+//
+// The TLSConfig, Resolver and Tracer of the options are used for the request.
+// If the responder responds, the returned OCSPResult isn't nil, even if err
+// isn't, so that the duration can be reported.
+func ProbeOCSP(ctx context.Context, responder string, cert, issuer *x509.Certificate, opts Options) (*OCSPResult, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Base()
+	}
+
+	logger.Debugln("Requesting the status of certificate " + cert.SerialNumber.String() + " from " + responder)
+
+	body, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", responder, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	trace := newPhaseTrace(ctx, responder, opts.Tracer)
+	ctx = context.WithValue(ctx, phaseTraceKey{}, trace)
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+	req = req.WithContext(ctx)
+
+	transport := newTransport(opts.TLSConfig, opts.Resolver)
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	result := &OCSPResult{Duration: time.Since(start)}
+	if err != nil {
+		return result, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return result, errors.New("the OCSP responder returned " + resp.Status)
+	}
+
+	parsed, err := ParseOCSPResponse(b, cert, issuer)
+	if err != nil {
+		return result, err
+	}
+	result.Raw, result.Response, result.ResponseErr = parsed.Raw, parsed.Response, parsed.ResponseErr
+
+	if result.ResponseErr != nil {
+		logger.Debugln("The OCSP response isn't valid: " + result.ResponseErr.Error())
+	}
+	logger.Debugln("The OCSP responder responded in " + result.Duration.String())
+
+	return result, nil
+}
+
+// ParseOCSPResponse parses the OCSP response for the certificate, like one
+// that a TLS server stapled, and checks it. A response whose signature can't
+// be verified with the issuer, or that's outside of its validity period, is
+// still returned, with the reason in OCSPResult.ResponseErr. Without an
+// issuer, the signature isn't checked.
+func ParseOCSPResponse(b []byte, cert, issuer *x509.Certificate) (*OCSPResult, error) {
+	result := &OCSPResult{Raw: b}
+
+	var err error
+	result.Response, err = ocsp.ParseResponseForCert(b, cert, issuer)
+	if err != nil {
+		if _, ok := err.(ocsp.ResponseError); ok {
+			return nil, err
+		}
+		// A response that can be parsed without checking the signature is
+		// a response, only not a valid one
+		unverified, uerr := ocsp.ParseResponseForCert(b, cert, nil)
+		if uerr != nil {
+			return nil, err
+		}
+		result.Response, result.ResponseErr = unverified, err
+	} else {
+		result.ResponseErr = checkOCSPTimes(result.Response, time.Now())
+	}
+
+	return result, nil
+}
+
+// LeafIssuer returns the issuer of the leaf of the connection: the next
+// certificate that the server presented, if it signed the leaf, or the next
+// one in the verified chain. It's nil if neither is known.
+func LeafIssuer(state *tls.ConnectionState) *x509.Certificate {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	if len(state.PeerCertificates) > 1 && leaf.CheckSignatureFrom(state.PeerCertificates[1]) == nil {
+		return state.PeerCertificates[1]
+	}
+	for _, chain := range state.VerifiedChains {
+		if len(chain) > 1 {
+			return chain[1]
+		}
+	}
+	return nil
+}
+
+// checkOCSPTimes checks that the response is within its validity period
+func checkOCSPTimes(resp *ocsp.Response, now time.Time) error {
+	if now.Before(resp.ThisUpdate) {
+		return errors.New("the OCSP response isn't valid until " + resp.ThisUpdate.String())
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return errors.New("the OCSP response expired at " + resp.NextUpdate.String())
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package prober
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Test that the status from a responder is returned, and that invalid
+// responses are told apart from responders that don't respond
+func TestProbeOCSP(t *testing.T) {
+	issuer, key := testOCSPIssuer(t)
+	cert := &x509.Certificate{SerialNumber: big.NewInt(42)}
+
+	now := time.Now()
+	for name, test := range map[string]struct {
+		template ocsp.Response
+		signer   crypto.Signer
+		valid    bool
+	}{
+		"good": {
+			template: ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)},
+			signer:   key,
+			valid:    true,
+		},
+		"revoked": {
+			template: ocsp.Response{Status: ocsp.Revoked, RevokedAt: now.Add(-time.Hour), ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)},
+			signer:   key,
+			valid:    true,
+		},
+		"expired": {
+			template: ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-2 * time.Hour), NextUpdate: now.Add(-time.Hour)},
+			signer:   key,
+		},
+		"wrong signer": {
+			template: ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(time.Hour)},
+			signer:   testKey(t),
+		},
+	} {
+		test.template.SerialNumber = cert.SerialNumber
+		resp, err := ocsp.CreateResponse(issuer, issuer, test.template, test.signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.Header.Get("Content-Type") != "application/ocsp-request" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if req, err := ocsp.ParseRequest(body); err != nil || req.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write(resp)
+		}))
+
+		result, err := ProbeOCSP(context.Background(), server.URL, cert, issuer, Options{})
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if result.Response == nil || result.Response.Status != test.template.Status {
+			t.Errorf("%s: expected status %d, got %+v", name, test.template.Status, result.Response)
+		}
+		if valid := result.ResponseErr == nil; valid != test.valid {
+			t.Errorf("%s: expected valid %t, got error %v", name, test.valid, result.ResponseErr)
+		}
+	}
+}
+
+// Test that responders that fail or answer with an error are errors
+func TestProbeOCSPFailure(t *testing.T) {
+	issuer, _ := testOCSPIssuer(t)
+	cert := &x509.Certificate{SerialNumber: big.NewInt(42)}
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+		"try later": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(ocsp.TryLaterErrorResponse)
+		},
+		"garbage": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("not ocsp"))
+		},
+	} {
+		server := httptest.NewServer(handler)
+		result, err := ProbeOCSP(context.Background(), server.URL, cert, issuer, Options{})
+		server.Close()
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if result == nil {
+			t.Errorf("%s: expected a result with the duration", name)
+		}
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if _, err := ProbeOCSP(context.Background(), closed.URL, cert, issuer, Options{}); err == nil {
+		t.Errorf("expected an error for a responder that isn't listening")
+	}
+}
+
+// testOCSPIssuer returns a self-signed CA and its key
+func testOCSPIssuer(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	key := testKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testKey(t *testing.T) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
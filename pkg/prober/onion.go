@@ -0,0 +1,90 @@
+package prober
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+	"golang.org/x/net/proxy"
+)
+
+// onionAddressLen is the length of the label of a v3 onion service: the
+// base32 of its 32 byte key, a 2 byte checksum and the version
+const onionAddressLen = 56
+
+// torProxyKey is the context key of the address of the SOCKS proxy of Tor
+// that the .onion targets of a probe are dialed through
+type torProxyKey struct{}
+
+// withTorProxy returns a context whose .onion targets are dialed through the
+// SOCKS proxy at the address
+func withTorProxy(ctx context.Context, address string) context.Context {
+	if address == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, torProxyKey{}, address)
+}
+
+// isOnion reports whether the host is a .onion name, of a Tor onion service
+func isOnion(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".onion")
+}
+
+// checkOnion returns an error if the .onion name isn't that of a v3 onion
+// service, with a valid checksum, so that a mistyped address is told apart
+// from a service that's down. Subdomains of the service, like
+// www.<address>.onion, are allowed.
+func checkOnion(host string) error {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(host, ".")), ".")
+	address := labels[len(labels)-2]
+	if len(address) != onionAddressLen {
+		return errors.New(host + " isn't the address of a v3 onion service, which has 56 characters before .onion")
+	}
+
+	b, err := base32.StdEncoding.DecodeString(strings.ToUpper(address))
+	if err != nil {
+		return errors.New(host + " isn't the address of an onion service: " + err.Error())
+	}
+	key, checksum, version := b[:32], b[32:34], b[34]
+	if version != 3 {
+		return errors.New(host + " isn't the address of a v3 onion service")
+	}
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(key)
+	h.Write([]byte{version})
+	if sum := h.Sum(nil); sum[0] != checksum[0] || sum[1] != checksum[1] {
+		return errors.New("the checksum of the onion address " + host + " doesn't match, it may be mistyped")
+	}
+
+	return nil
+}
+
+// dialOnion dials the address of an onion service through the SOCKS proxy
+// of Tor in the context, which resolves the name itself. Onion names are
+// never looked up in DNS, as RFC 7686 requires.
+func dialOnion(ctx context.Context, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOnion(host); err != nil {
+		return nil, err
+	}
+
+	torProxy, _ := ctx.Value(torProxyKey{}).(string)
+	if torProxy == "" {
+		return nil, errors.New(host + " is an onion service, which can only be probed through the SOCKS proxy of Tor")
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", torProxy, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}).DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,147 @@
+package prober
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base32"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Test that the names of v3 onion services are checked, so that mistyped
+// ones aren't reported as down
+func TestCheckOnion(t *testing.T) {
+	address := testOnionAddress(t)
+
+	for _, host := range []string{address, "www." + address, strings.ToUpper(address), address + "."} {
+		if err := checkOnion(host); err != nil {
+			t.Errorf("%s: %s", host, err)
+		}
+	}
+
+	mistyped := []byte(address)
+	if mistyped[0] == 'a' {
+		mistyped[0] = 'b'
+	} else {
+		mistyped[0] = 'a'
+	}
+	for _, host := range []string{
+		string(mistyped),
+		"expyuzz4wqqyqhjn.onion",
+		strings.Repeat("1", onionAddressLen) + ".onion",
+		".onion",
+	} {
+		if err := checkOnion(host); err == nil {
+			t.Errorf("expected an error for %s", host)
+		}
+	}
+}
+
+// Test that onion services are dialed through the SOCKS proxy, with their
+// name rather than an address, and can't be probed without it
+func TestProbeOnion(t *testing.T) {
+	server, _ := testServer()
+	defer server.Close()
+
+	proxy, requested := testSOCKSProxy(t, server.Listener.Addr().String())
+	defer proxy.Close()
+
+	address := testOnionAddress(t)
+	for _, target := range []string{"https://" + address, address + ":443"} {
+		_, err := Probe(context.Background(), target, Options{
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			TorProxy:  proxy.Addr().String(),
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+		if host := <-requested; host != address+":443" {
+			t.Errorf("%s: expected the proxy to be asked for %s:443, got %s", target, address, host)
+		}
+
+		if _, err := Probe(context.Background(), target, Options{TLSConfig: &tls.Config{InsecureSkipVerify: true}}); err == nil {
+			t.Errorf("%s: expected an error without a proxy", target)
+		}
+	}
+}
+
+// testOnionAddress returns the name of a v3 onion service with a new key
+func testOnionAddress(t *testing.T) string {
+	key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(key)
+	h.Write([]byte{3})
+	b := append(append([]byte(key), h.Sum(nil)[:2]...), 3)
+
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b)) + ".onion"
+}
+
+// testSOCKSProxy returns a SOCKS5 proxy that connects every request to the
+// address, and sends the host and port that were requested on the channel
+func testSOCKSProxy(t *testing.T, address string) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requested := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				// The greeting, to which no authentication is chosen
+				b := make([]byte, 2)
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, b[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+
+				// The CONNECT request, with a domain name
+				b = make([]byte, 5)
+				if _, err := io.ReadFull(conn, b); err != nil || b[3] != 3 {
+					return
+				}
+				b = make([]byte, int(b[4])+2)
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				port := binary.BigEndian.Uint16(b[len(b)-2:])
+				requested <- net.JoinHostPort(string(b[:len(b)-2]), strconv.Itoa(int(port)))
+
+				upstream, err := net.Dial("tcp", address)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return l, requested
+}
@@ -0,0 +1,345 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test that targets are mapped to the right protocol
+func TestParseTarget(t *testing.T) {
+	for target, expected := range map[string][2]string{
+		"example.com:443":               {"example.com:443", "tcp"},
+		"example.com":                   {"https://example.com", "https"},
+		"https://example.com/foo":       {"https://example.com/foo", "https"},
+		"https://example.com:8443/ok":   {"https://example.com:8443/ok", "https"},
+		"smtps://mail.example.com":      {"mail.example.com:465", "tcp"},
+		"ldaps://dc1":                   {"dc1:636", "tcp"},
+		"imaps://mail.example.com:10":   {"mail.example.com:10", "tcp"},
+		"tls://example.com:8443":        {"example.com:8443", "tcp"},
+		"example.com:443/path":          {"example.com:443", "tcp"},
+		"[2001:db8::1]:443":             {"[2001:db8::1]:443", "tcp"},
+		"[fe80::1%eth0]:443":            {"[fe80::1%eth0]:443", "tcp"},
+		"2001:db8::1":                   {"https://[2001:db8::1]", "https"},
+		"[2001:db8::1]":                 {"https://[2001:db8::1]", "https"},
+		"fe80::1%eth0":                  {"https://[fe80::1%25eth0]", "https"},
+		"https://[2001:db8::1]:8443":    {"https://[2001:db8::1]:8443", "https"},
+		"ldaps://[2001:db8::1]":         {"[2001:db8::1]:636", "tcp"},
+		"https://[fe80::1%25eth0]/":     {"https://[fe80::1%25eth0]/", "https"},
+		"münchen.example":               {"https://xn--mnchen-3ya.example", "https"},
+		"https://münchen.example/pfad":  {"https://xn--mnchen-3ya.example/pfad", "https"},
+		"MÜNCHEN.example:443":           {"xn--mnchen-3ya.example:443", "tcp"},
+		"ldaps://bücher.example":        {"xn--bcher-kva.example:636", "tcp"},
+		"syslog-tls://logs.example.com": {"logs.example.com:6514", "tcp"},
+		"smtp://mail.example.com":       {"mail.example.com:25", "smtp"},
+		"submission://mail.example.com": {"mail.example.com:587", "submission"},
+		"imap://mail.example.com:1143":  {"mail.example.com:1143", "imap"},
+		"pop3://[2001:db8::1]":          {"[2001:db8::1]:110", "pop3"},
+		"ftp://ftp.example.com":         {"ftp.example.com:21", "ftp"},
+		"grpc://api.example.com":        {"api.example.com:443", "grpc"},
+		"grpc://[2001:db8::1]:8443":     {"[2001:db8::1]:8443", "grpc"},
+		"kafka://broker-0.example.com":  {"broker-0.example.com:9093", "kafka"},
+		"quic://www.example.com":        {"www.example.com:443", "quic"},
+		"postgres://db.example.com":     {"db.example.com:5432", "postgres"},
+		"mysql://db.example.com:3307":   {"db.example.com:3307", "mysql"},
+		"ldap://dc1":                    {"dc1:389", "ldap"},
+		"xmpp://chat.example.com":       {"chat.example.com:5222", "xmpp"},
+	} {
+		addr, proto, err := ParseTarget(target)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", target, err)
+			continue
+		}
+		if addr != expected[0] || proto != expected[1] {
+			t.Errorf("%s: expected %s over %s, got %s over %s", target, expected[0], expected[1], addr, proto)
+		}
+	}
+
+	for _, target := range []string{"http://example.com", "tls://example.com", "redis://cache:6379"} {
+		if _, _, err := ParseTarget(target); err == nil {
+			t.Errorf("expected an error for %s", target)
+		}
+	}
+}
+
+// Test that targets without a scheme use the prober and its default port
+func TestParseTargetProber(t *testing.T) {
+	MustRegister("test-ldaps", &ExecProber{Command: []string{"true"}})
+	MustRegister("test-port", &ExecProber{Command: []string{"true"}, Port: "10636"})
+
+	for _, test := range []struct {
+		target, prober, addr, proto string
+	}{
+		{"example.com", "https", "https://example.com:443", "https"},
+		{"example.com:8443", "https", "https://example.com:8443", "https"},
+		{"example.com", "tcp", "example.com:443", "tcp"},
+		{"example.com:636", "test-ldaps", "test-ldaps://example.com:636", "test-ldaps"},
+		{"example.com", "test-port", "test-port://example.com:10636", "test-port"},
+		{"test-port://example.com", "", "test-port://example.com:10636", "test-port"},
+		{"https://example.com", "tcp", "https://example.com", "https"},
+		{"2001:db8::1", "tcp", "[2001:db8::1]:443", "tcp"},
+		{"[2001:db8::1]", "https", "https://[2001:db8::1]:443", "https"},
+		{"[2001:db8::1]:8443", "https", "https://[2001:db8::1]:8443", "https"},
+		{"münchen.example", "tcp", "xn--mnchen-3ya.example:443", "tcp"},
+		{"logs.example.com", "syslog-tls", "logs.example.com:6514", "tcp"},
+		{"logs.example.com:10514", "syslog-tls", "logs.example.com:10514", "tcp"},
+		{"mail.example.com", "smtp", "mail.example.com:25", "smtp"},
+		{"mail.example.com:2525", "smtp", "mail.example.com:2525", "smtp"},
+		{"mail.example.com", "imap", "mail.example.com:143", "imap"},
+		{"api.example.com", "grpc", "api.example.com:443", "grpc"},
+		{"api.example.com:8443", "grpc", "api.example.com:8443", "grpc"},
+		{"broker-0.example.com", "kafka", "broker-0.example.com:9093", "kafka"},
+		{"www.example.com", "quic", "www.example.com:443", "quic"},
+	} {
+		addr, proto, err := parseTarget(test.target, test.prober)
+		if err != nil {
+			t.Errorf("%s with %s: unexpected error: %s", test.target, test.prober, err)
+			continue
+		}
+		if addr != test.addr || proto != test.proto {
+			t.Errorf("%s with %s: expected %s over %s, got %s over %s", test.target, test.prober, test.addr, test.proto, addr, proto)
+		}
+	}
+
+	if _, _, err := parseTarget("example.com", "test-ldaps"); err == nil {
+		t.Errorf("expected an error for a prober without a default port")
+	}
+	if _, _, err := parseTarget("example.com:25", "unregistered"); err == nil {
+		t.Errorf("expected an error for an unregistered prober")
+	}
+}
+
+// Test that the server name for an IPv6 target doesn't include its zone, and
+// that a server name that's given is kept
+func TestVerifyConfigServerName(t *testing.T) {
+	if c := verifyConfig(nil, "fe80::1%eth0", nil, nil); c.ServerName != "fe80::1" {
+		t.Errorf("expected the server name fe80::1, got %s", c.ServerName)
+	}
+	if c := verifyConfig(&tls.Config{ServerName: "example.com"}, "2001:db8::1", nil, nil); c.ServerName != "example.com" {
+		t.Errorf("expected the server name example.com, got %s", c.ServerName)
+	}
+}
+
+// Test that both kinds of target can be probed
+func TestProbe(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	for _, target := range []string{server.URL, strings.TrimPrefix(server.URL, "https://")} {
+		result, err := Probe(context.Background(), target, Options{
+			TLSConfig: &tls.Config{RootCAs: roots},
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+		if len(result.State.PeerCertificates) == 0 {
+			t.Errorf("%s: expected the peer certificates", target)
+		}
+		if chains := result.State.VerifiedChains; len(chains) != 1 || !chains[0][len(chains[0])-1].Equal(server.Certificate()) {
+			t.Errorf("%s: expected a chain verified up to the test root, got %v", target, chains)
+		}
+	}
+
+	result, err := Probe(context.Background(), server.URL, Options{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.State.VerifiedChains) != 0 {
+		t.Errorf("expected no verified chains without verification")
+	}
+}
+
+// Test that IPv6 targets can be probed and are verified against the IP
+// addresses in the certificate
+func TestProbeIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 isn't available: ", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener.Close()
+	server.Listener = l
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for _, target := range []string{server.URL, strings.TrimPrefix(server.URL, "https://")} {
+		if _, err := Probe(context.Background(), target, Options{TLSConfig: &tls.Config{RootCAs: roots}}); err != nil {
+			t.Errorf("%s: %s", target, err)
+		}
+	}
+}
+
+// Test that verification errors fail the probe by default and are recorded
+// when asked
+func TestProbeVerifyErrors(t *testing.T) {
+	server, _ := testServer()
+	defer server.Close()
+
+	result, err := Probe(context.Background(), server.URL, Options{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}})
+	if err == nil {
+		t.Errorf("expected a verification error")
+	}
+	if result == nil || result.Protocol != "https" {
+		t.Errorf("expected the protocol to be returned with the error, got %+v", result)
+	}
+
+	result, err = Probe(context.Background(), server.URL, Options{
+		TLSConfig:          &tls.Config{RootCAs: x509.NewCertPool()},
+		RecordVerifyErrors: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.VerifyErr == nil {
+		t.Errorf("expected the verification error to be recorded")
+	}
+}
+
+// Test that the https prober makes the request in the options
+func TestProbeHTTPRequest(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	if _, err := Probe(context.Background(), server.URL, Options{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		HTTPRequest: HTTPRequest{
+			Method: "POST",
+			Header: http.Header{"Host": {"internal.example.com"}, "X-Api-Key": {"secret"}},
+			Body:   `{"query": "health"}`,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Method != "POST" || got.Host != "internal.example.com" || got.Header.Get("X-Api-Key") != "secret" {
+		t.Errorf("unexpected request %s %s with headers %v", got.Method, got.Host, got.Header)
+	}
+	if string(body) != `{"query": "health"}` {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+// Test that the path of the request replaces the root of the target, but not
+// a path of the target's own
+func TestProbeHTTPRequestPath(t *testing.T) {
+	var got string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for target, want := range map[string]string{
+		server.URL:                 "/healthz?full=1",
+		server.URL + "/":           "/healthz?full=1",
+		server.URL + "/status":     "/status",
+		server.URL + "/?verbose=1": "/?verbose=1",
+	} {
+		if _, err := Probe(context.Background(), target, Options{
+			TLSConfig:   &tls.Config{RootCAs: roots},
+			HTTPRequest: HTTPRequest{Method: "HEAD", Path: "/healthz?full=1"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: expected a request for %s, got %s", target, want, got)
+		}
+	}
+}
+
+// Test that the chain is verified against each of the trust stores, even
+// when it can't be verified against the roots of the TLS config
+func TestProbeTrustStores(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	stores := map[string]*x509.CertPool{"test": roots, "system": nil}
+	for _, target := range []string{server.URL, strings.TrimPrefix(server.URL, "https://")} {
+		result, err := Probe(context.Background(), target, Options{TrustStores: stores})
+		if err == nil {
+			t.Errorf("%s: expected the probe to fail without the test roots", target)
+		}
+		if result.State != nil {
+			t.Errorf("%s: expected no state for a failed probe", target)
+		}
+		if len(result.TrustStoreErrors) != 2 || result.TrustStoreErrors["test"] != nil || result.TrustStoreErrors["system"] == nil {
+			t.Errorf("%s: unexpected trust store errors %v", target, result.TrustStoreErrors)
+		}
+
+		result, err = Probe(context.Background(), target, Options{
+			TLSConfig:   &tls.Config{RootCAs: roots},
+			TrustStores: stores,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+		if result.TrustStoreErrors["test"] != nil || result.TrustStoreErrors["system"] == nil {
+			t.Errorf("%s: unexpected trust store errors %v", target, result.TrustStoreErrors)
+		}
+	}
+}
+
+// Test that each phase of the probe is passed to the tracer
+func TestProbeTracer(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	tracer := &testTracer{ended: map[string]bool{}}
+	if _, err := Probe(context.Background(), strings.TrimPrefix(server.URL, "https://"), Options{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Tracer:    tracer,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, phase := range []string{"resolve", "dial", "handshake", "verify"} {
+		if !tracer.ended[phase] {
+			t.Errorf("expected a %s phase", phase)
+		}
+	}
+}
+
+type testTracer struct {
+	mtx   sync.Mutex
+	ended map[string]bool
+}
+
+func (t *testTracer) StartPhase(ctx context.Context, phase string, attributes map[string]string) func(error) {
+	return func(error) {
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+		t.ended[phase] = true
+	}
+}
+
+func testServer() (*httptest.Server, *x509.CertPool) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	return server, roots
+}
@@ -0,0 +1,226 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"sync"
+)
+
+// ClientProfile is a handshake that mimics an old client, with only the
+// versions, cipher suites and curves that it offered, to tell whether such
+// clients can still connect to the target
+type ClientProfile struct {
+	Name string
+
+	// MinVersion and MaxVersion are the versions that are offered. A zero
+	// MinVersion is TLS 1.0, and a zero MaxVersion the latest version.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CipherSuites are the suites that are offered for TLS 1.2 and earlier,
+	// or the defaults if it's empty. The suites of TLS 1.3 can't be chosen.
+	CipherSuites []uint16
+
+	// CurvePreferences are the curves that are offered for ECDHE, or the
+	// defaults if it's empty
+	CurvePreferences []tls.CurveID
+}
+
+// config returns the TLS configuration of the profile, on top of that of the
+// probe
+func (p ClientProfile) config(config *tls.Config) *tls.Config {
+	c := &tls.Config{}
+	if config != nil {
+		c = config.Clone()
+	}
+
+	c.MinVersion, c.MaxVersion = p.MinVersion, p.MaxVersion
+	if c.MinVersion == 0 {
+		c.MinVersion = tls.VersionTLS10
+	}
+	c.CipherSuites = p.CipherSuites
+	c.CurvePreferences = p.CurvePreferences
+
+	return c
+}
+
+// ClientProfileResult is the outcome of the handshake of one of the
+// Options.ClientProfiles
+type ClientProfileResult struct {
+	Profile string
+
+	// State is the state of the TLS connection. It's nil if the profile
+	// couldn't connect, with the reason in Err.
+	State *tls.ConnectionState
+	Err   error
+}
+
+// The suites below are those that crypto/tls implements of what each client
+// offered. The clients also offered DHE suites, which it doesn't, so a target
+// that only accepts those is reported as unreachable by the profile.
+var (
+	ecdheGCM = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	ecdheCBC = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	}
+	rsaSuites = []uint16{
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	}
+	nistCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+)
+
+// clientProfiles are the profiles that can be chosen by name
+var clientProfiles = map[string]ClientProfile{
+	// Any client that hasn't got TLS 1.3 yet, with all of the suites of TLS
+	// 1.2
+	"tls12": {
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: concatSuites(ecdheGCM, []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		}, ecdheCBC, rsaSuites),
+	},
+	// Java 7, whose clients only enable TLS 1.0 by default and, without the
+	// unlimited strength policy, only have AES-128
+	"java7": {
+		MaxVersion: tls.VersionTLS10,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+		CurvePreferences: nistCurves,
+	},
+	// Java 8 before TLS 1.3 was backported to it, in 8u261
+	"java8": {
+		MaxVersion:       tls.VersionTLS12,
+		CipherSuites:     concatSuites(ecdheGCM, ecdheCBC, rsaSuites),
+		CurvePreferences: nistCurves,
+	},
+	// Android 4.4, which has TLS 1.2 but no ChaCha20 or X25519
+	"android4.4": {
+		MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		CurvePreferences: nistCurves,
+	},
+	// Internet Explorer 11 on Windows 7, whose SChannel has the GCM suites
+	// only for ECDSA certificates
+	"windows7": {
+		MaxVersion:       tls.VersionTLS12,
+		CipherSuites:     concatSuites(ecdheCBC, ecdheGCM[:2], rsaSuites),
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	},
+	// Clients without elliptic curves, which need an RSA certificate and
+	// the RSA key exchange
+	"no-ecc": {
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: rsaSuites,
+	},
+}
+
+func init() {
+	for name, p := range clientProfiles {
+		p.Name = name
+		clientProfiles[name] = p
+	}
+}
+
+// concatSuites returns the suites of each of the lists, in order
+func concatSuites(lists ...[]uint16) []uint16 {
+	var suites []uint16
+	for _, l := range lists {
+		suites = append(suites, l...)
+	}
+	return suites
+}
+
+// LookupClientProfile returns the profile with the name, like java8 or
+// no-ecc
+func LookupClientProfile(name string) (ClientProfile, bool) {
+	p, ok := clientProfiles[name]
+	return p, ok
+}
+
+// ClientProfileNames returns the names of the profiles, in order
+func ClientProfileNames() []string {
+	var names []string
+	for name := range clientProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// probeClientProfiles makes a handshake with each of the profiles, at the
+// same time. The chain isn't verified, as the profiles don't have the roots
+// of the clients they mimic, only whether they can agree on a version and a
+// cipher suite with the target.
+func probeClientProfiles(ctx context.Context, target, proto string, opts Options) []ClientProfileResult {
+	request := opts.HTTPRequest
+	request.FollowRedirects = 0
+	grpcRequest := GRPCRequest{Authority: opts.GRPC.Authority}
+
+	results := make([]ClientProfileResult, len(opts.ClientProfiles))
+	var wg sync.WaitGroup
+	for i, p := range opts.ClientProfiles {
+		wg.Add(1)
+		go func(i int, p ClientProfile) {
+			defer wg.Done()
+
+			config := p.config(opts.TLSConfig)
+			trace := newPhaseTrace(ctx, target, nil)
+			verifyErr := new(error)
+
+			var state *tls.ConnectionState
+			var err error
+			switch proto {
+			case "https":
+				state, _, err = probeHTTPS(ctx, target, config, opts.Resolver, nil, request, trace, verifyErr)
+			case "tcp", "kafka":
+				state, err = probeTCP(ctx, target, config, opts.Resolver, trace, verifyErr)
+			case "grpc":
+				state, _, err = probeGRPC(ctx, target, config, opts.Resolver, grpcRequest, trace, verifyErr)
+			case "quic":
+				state, err = probeQUIC(ctx, target, config, opts.Resolver, trace, verifyErr)
+			default:
+				if isStartTLS(proto) {
+					state, err = probeStartTLS(ctx, target, proto, config, opts.Resolver, trace, verifyErr)
+				} else {
+					state, err = probeRegistered(ctx, target, proto, config, trace, verifyErr)
+				}
+			}
+			results[i] = ClientProfileResult{Profile: p.Name, State: state, Err: err}
+		}(i, p)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,62 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that each profile only connects with the versions and cipher suites
+// that it offers, whether or not the chain can be verified
+func TestProbeClientProfiles(t *testing.T) {
+	var profiles []ClientProfile
+	for _, name := range []string{"java8", "windows7", "no-ecc", "tls12"} {
+		p, ok := LookupClientProfile(name)
+		if !ok {
+			t.Fatalf("expected the %s profile", name)
+		}
+		profiles = append(profiles, p)
+	}
+
+	for _, tc := range []struct {
+		config *tls.Config
+		want   map[string]bool
+	}{
+		{
+			config: &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+			want:   map[string]bool{"java8": true, "windows7": false, "no-ecc": false, "tls12": true},
+		},
+		{
+			config: &tls.Config{CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}},
+			want:   map[string]bool{"java8": true, "windows7": true, "no-ecc": true, "tls12": true},
+		},
+		{
+			config: &tls.Config{MinVersion: tls.VersionTLS13},
+			want:   map[string]bool{"java8": false, "windows7": false, "no-ecc": false, "tls12": false},
+		},
+	} {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = tc.config
+		server.StartTLS()
+
+		for _, target := range []string{server.URL, strings.TrimPrefix(server.URL, "https://")} {
+			result, err := Probe(context.Background(), target, Options{ClientProfiles: profiles})
+			if err == nil {
+				t.Errorf("%s: expected the chain of the test server not to be verified", target)
+			}
+			if len(result.ClientProfiles) != len(profiles) {
+				t.Fatalf("%s: expected a result for each profile, got %d", target, len(result.ClientProfiles))
+			}
+			for _, r := range result.ClientProfiles {
+				if connected := r.Err == nil; connected != tc.want[r.Profile] {
+					t.Errorf("%s: expected %s to connect: %t, got %t (%v)", target, r.Profile, tc.want[r.Profile], connected, r.Err)
+				}
+			}
+		}
+
+		server.Close()
+	}
+}
@@ -0,0 +1,154 @@
+package prober
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyKey is the context key of the proxy that the targets of a probe are
+// dialed through
+type proxyKey struct{}
+
+// withProxy returns a context whose targets are dialed through the proxy
+func withProxy(ctx context.Context, u *url.URL) context.Context {
+	if u == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyKey{}, u)
+}
+
+// proxyFrom returns the proxy in the context, or nil if there isn't one
+func proxyFrom(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(proxyKey{}).(*url.URL)
+	return u
+}
+
+// CheckProxyURL returns an error if the URL isn't that of a proxy the
+// targets can be dialed through: a HTTP proxy that supports CONNECT, over
+// http or https, or a SOCKS5 proxy
+func CheckProxyURL(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return errors.New("unsupported proxy scheme " + u.Scheme + ", must be one of http, https, socks5 or socks5h")
+	}
+	if u.Host == "" {
+		return errors.New("the proxy URL " + u.Redacted() + " has no host")
+	}
+	return nil
+}
+
+// dialProxy dials the address through the proxy, which resolves its host
+// itself. The credentials of the proxy are taken from the user info of its
+// URL.
+func dialProxy(ctx context.Context, u *url.URL, address string) (net.Conn, error) {
+	if u.Scheme == "socks5" || u.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", proxyAddress(u), auth, nil)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(interface {
+			DialContext(ctx context.Context, network, address string) (net.Conn, error)
+		}).DialContext(ctx, "tcp", address)
+	}
+
+	return dialConnect(ctx, u, address)
+}
+
+// dialConnect asks the HTTP proxy to connect to the address with a CONNECT
+// request
+func dialConnect(ctx context.Context, u *url.URL, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", proxyAddress(u))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// The request and response aren't bound by the context otherwise
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("the proxy " + u.Redacted() + " refused to connect to " + address + ": " + resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The server speaks first in some protocols, like SMTP, so what the proxy
+	// passed on along with its response mustn't be lost
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// proxyAddress returns the address of the proxy, with the default port of
+// its scheme if it doesn't have one
+func proxyAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1080"
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// bufferedConn reads what's left in r before the rest of the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
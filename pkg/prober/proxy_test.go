@@ -0,0 +1,124 @@
+package prober
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Test that https and tcp targets are dialed through a HTTP proxy with a
+// CONNECT request, which carries the credentials of the proxy
+func TestProbeConnectProxy(t *testing.T) {
+	server, _ := testServer()
+	defer server.Close()
+
+	proxy, requested := testConnectProxy(t, server.Listener.Addr().String())
+	defer proxy.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	u := &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: proxy.Addr().String()}
+	for _, target := range []string{"https://backend.internal:" + port, "backend.internal:" + port} {
+		_, err := Probe(context.Background(), target, Options{
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			ProxyURL:  u,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+		if r := <-requested; r.Host != "backend.internal:"+port || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			t.Errorf("%s: expected an authenticated CONNECT to backend.internal:%s, got %s with %v", target, port, r.Host, r.Header)
+		}
+	}
+}
+
+// Test that tcp targets are dialed through a SOCKS5 proxy, with their name
+// rather than an address
+func TestProbeSOCKSProxy(t *testing.T) {
+	server, _ := testServer()
+	defer server.Close()
+
+	proxy, requested := testSOCKSProxy(t, server.Listener.Addr().String())
+	defer proxy.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	_, err := Probe(context.Background(), "backend.internal:"+port, Options{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		ProxyURL:  &url.URL{Scheme: "socks5", Host: proxy.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host := <-requested; host != "backend.internal:"+port {
+		t.Errorf("expected the proxy to be asked for backend.internal:%s, got %s", port, host)
+	}
+}
+
+// Test that only the schemes of the proxies that are supported are accepted
+func TestCheckProxyURL(t *testing.T) {
+	for rawurl, valid := range map[string]bool{
+		"http://proxy:3128":     true,
+		"https://proxy":         true,
+		"socks5://proxy:1080":   true,
+		"socks5h://proxy":       true,
+		"ftp://proxy":           false,
+		"http:///no-host":       false,
+		"socks4://proxy:1080":   false,
+		"http://user:pw@proxy/": true,
+	} {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckProxyURL(u); (err == nil) != valid {
+			t.Errorf("%s: expected valid to be %t, got %v", rawurl, valid, err)
+		}
+	}
+}
+
+// testConnectProxy returns a HTTP proxy that connects every CONNECT request
+// to the address, and sends the requests on the channel
+func testConnectProxy(t *testing.T, address string) (net.Listener, chan *http.Request) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requested := make(chan *http.Request, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || !strings.EqualFold(req.Method, http.MethodConnect) {
+					return
+				}
+				requested <- req
+
+				upstream, err := net.Dial("tcp", address)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+				go io.Copy(upstream, br)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return l, requested
+}
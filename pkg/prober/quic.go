@@ -0,0 +1,862 @@
+package prober
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// quicVersion1 is the version of QUIC in RFC 9000
+const quicVersion1 = 0x00000001
+
+// quicInitialSalt is the salt of the secrets of the Initial packets of QUIC
+// version 1, from RFC 9001
+var quicInitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+const (
+	// quicMinDatagram is the size that the datagrams with Initial packets
+	// from the client are padded to
+	quicMinDatagram = 1200
+	// quicMaxCrypto is the most handshake data sent in one packet, which
+	// leaves room for the headers and an ACK in quicMinDatagram
+	quicMaxCrypto = 1000
+	// quicInitialTimeout is how long the packets are waited for before
+	// they're sent again, which is doubled each time
+	quicInitialTimeout = time.Second
+)
+
+// The types of the long header packets
+const (
+	quicPacketInitial   = 0
+	quicPacket0RTT      = 1
+	quicPacketHandshake = 2
+	quicPacketRetry     = 3
+)
+
+// probeQUIC performs the TLS 1.3 handshake of QUIC with the target over UDP,
+// offering h3 with ALPN unless the config has protocols of its own, and
+// returns the state of the connection. Only the Initial and Handshake
+// packets are exchanged, and the connection is closed once the handshake is
+// done.
+func probeQUIC(ctx context.Context, target string, config *tls.Config, resolver Resolver, trace *phaseTrace, verifyErr *error) (*tls.ConnectionState, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	if isOnion(host) || proxyFrom(ctx) != nil {
+		return nil, errors.New("quic targets can't be probed through a proxy, which only carries TCP")
+	}
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	trace.start("resolve", "")
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	trace.end("resolve", "", err)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+
+	// UDP has no handshake of its own, so the first address is as good as
+	// any
+	address := net.JoinHostPort(addrs[0].String(), port)
+	trace.start("dial", address)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", address)
+	trace.end("dial", address, err)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	c := verifyConfig(config, host, trace, verifyErr)
+	c.MinVersion = tls.VersionTLS13
+	if len(c.NextProtos) == 0 {
+		c.NextProtos = []string{"h3"}
+	}
+
+	q, err := newQUICEndpoint(true, c, conn.Write)
+	if err != nil {
+		return nil, err
+	}
+	defer q.tls.Close()
+
+	trace.start("handshake", "")
+	err = q.handshake(ctx, conn)
+	trace.end("handshake", "", err)
+	if err != nil {
+		return nil, err
+	}
+
+	state := q.tls.ConnectionState()
+	if len(state.PeerCertificates) < 1 {
+		return nil, errors.New("No certificates found in connection state for " + target)
+	}
+
+	return &state, nil
+}
+
+// quicEndpoint is one end of the handshake of a QUIC connection. It only
+// knows about the Initial and Handshake packets, which carry the TLS
+// handshake, and the frames that they can.
+type quicEndpoint struct {
+	client bool
+	tls    *tls.QUICConn
+	send   func([]byte) (int, error)
+
+	// dcid is the connection ID of the peer, which starts off as a random
+	// one from the client, and scid is our own
+	dcid, scid []byte
+	// token is the token of a Retry packet, which is sent back in the
+	// Initial packets
+	token []byte
+	// peerSeen is whether a packet has been received from the peer, after
+	// which its connection ID is used
+	peerSeen bool
+	retried  bool
+
+	initial, handshakeLevel *quicLevel
+	done                    bool
+	closed                  bool
+}
+
+// quicLevel is the state of one of the encryption levels of a connection
+type quicLevel struct {
+	packetType byte
+	tlsLevel   tls.QUICEncryptionLevel
+	read       *quicKeys
+	write      *quicKeys
+	// discarded is set once the level is no longer sent on
+	discarded bool
+
+	nextPN uint64
+	// out is the handshake data that's still to be sent, from outOffset,
+	// and sent is all of it, in case it has to be sent again
+	out       []byte
+	outOffset uint64
+	sent      []byte
+	close     bool
+
+	largest   int64
+	received  map[uint64]bool
+	ackNeeded bool
+	// in are the CRYPTO frames that arrived before the data preceding them,
+	// by their offset, and inOffset is how much has been passed on to TLS
+	in       map[uint64][]byte
+	inOffset uint64
+	// pending are the packets that arrived before their keys
+	pending [][]byte
+}
+
+func newQUICLevel(packetType byte, tlsLevel tls.QUICEncryptionLevel) *quicLevel {
+	return &quicLevel{
+		packetType: packetType,
+		tlsLevel:   tlsLevel,
+		largest:    -1,
+		received:   map[uint64]bool{},
+		in:         map[uint64][]byte{},
+	}
+}
+
+// newQUICEndpoint returns a client or a server endpoint that sends its
+// datagrams with send
+func newQUICEndpoint(client bool, config *tls.Config, send func([]byte) (int, error)) (*quicEndpoint, error) {
+	q := &quicEndpoint{
+		client:         client,
+		send:           send,
+		scid:           make([]byte, 8),
+		initial:        newQUICLevel(quicPacketInitial, tls.QUICEncryptionLevelInitial),
+		handshakeLevel: newQUICLevel(quicPacketHandshake, tls.QUICEncryptionLevelHandshake),
+	}
+	if _, err := rand.Read(q.scid); err != nil {
+		return nil, err
+	}
+
+	qc := &tls.QUICConfig{TLSConfig: config}
+	if client {
+		q.dcid = make([]byte, 8)
+		if _, err := rand.Read(q.dcid); err != nil {
+			return nil, err
+		}
+		q.initial.write, q.initial.read = quicInitialKeys(q.dcid)
+		q.tls = tls.QUICClient(qc)
+	} else {
+		q.tls = tls.QUICServer(qc)
+	}
+	q.tls.SetTransportParameters(q.transportParameters(nil))
+
+	return q, nil
+}
+
+// transportParameters returns our transport parameters: the connection ID
+// and, for a server, the connection ID that the client first sent to
+func (q *quicEndpoint) transportParameters(odcid []byte) []byte {
+	var b []byte
+	if odcid != nil {
+		b = appendQUICParameter(b, 0x00, odcid)
+	}
+	// max_idle_timeout, in milliseconds
+	b = appendQUICParameter(b, 0x01, appendVarint(nil, 30000))
+	// initial_source_connection_id
+	b = appendQUICParameter(b, 0x0f, q.scid)
+	return b
+}
+
+func appendQUICParameter(b []byte, id uint64, value []byte) []byte {
+	b = appendVarint(b, id)
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// handshake runs the client's side of the handshake over the connection,
+// until it's done or the context expires. The packets are sent again when
+// there's no reply.
+func (q *quicEndpoint) handshake(ctx context.Context, conn net.Conn) error {
+	if err := q.tls.Start(ctx); err != nil {
+		return err
+	}
+	if err := q.events(); err != nil {
+		return err
+	}
+	if err := q.flush(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 65536)
+	timeout := quicInitialTimeout
+	for !q.done {
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				q.resend()
+				if err := q.flush(); err != nil {
+					return err
+				}
+				timeout *= 2
+				continue
+			}
+			return err
+		}
+
+		if err := q.handleDatagram(buf[:n]); err != nil {
+			return err
+		}
+		if err := q.flush(); err != nil {
+			return err
+		}
+	}
+
+	// The Finished message goes out with the close, as nothing else is
+	// needed from the server
+	q.handshakeLevel.close = true
+	return q.flush()
+}
+
+// resend sends all of the handshake data again, on the levels that are
+// still in use
+func (q *quicEndpoint) resend() {
+	for _, l := range []*quicLevel{q.initial, q.handshakeLevel} {
+		if l.write != nil && !l.discarded && len(l.sent) > 0 {
+			l.out, l.outOffset = l.sent, 0
+		}
+	}
+}
+
+// events handles the events of the TLS connection, until there are none
+func (q *quicEndpoint) events() error {
+	for {
+		e := q.tls.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			l := q.level(e.Level)
+			if l == nil {
+				// The keys of the application data aren't needed
+				continue
+			}
+			keys, err := newQUICKeys(e.Suite, e.Data)
+			if err != nil {
+				return err
+			}
+			if e.Kind == tls.QUICSetReadSecret {
+				l.read = keys
+			} else {
+				l.write = keys
+			}
+		case tls.QUICWriteData:
+			if l := q.level(e.Level); l != nil {
+				l.out = append(l.out, e.Data...)
+				l.sent = append(l.sent, e.Data...)
+			}
+		case tls.QUICHandshakeDone:
+			q.done = true
+		}
+	}
+}
+
+// level returns the state of the encryption level, or nil for the levels
+// after the handshake
+func (q *quicEndpoint) level(level tls.QUICEncryptionLevel) *quicLevel {
+	switch level {
+	case tls.QUICEncryptionLevelInitial:
+		return q.initial
+	case tls.QUICEncryptionLevelHandshake:
+		return q.handshakeLevel
+	}
+	return nil
+}
+
+// handleDatagram handles each of the packets in the datagram. The packets
+// with a short header, which come after the handshake, are ignored.
+func (q *quicEndpoint) handleDatagram(b []byte) error {
+	for len(b) > 0 && b[0]&0x80 != 0 {
+		if len(b) < 7 {
+			return nil
+		}
+		version := binary.BigEndian.Uint32(b[1:5])
+		if version == 0 {
+			return errors.New("the server doesn't support version 1 of QUIC")
+		}
+		if version != quicVersion1 {
+			return nil
+		}
+
+		p := 5
+		dcid, p, ok := readLen8(b, p)
+		if !ok {
+			return nil
+		}
+		scid, p, ok := readLen8(b, p)
+		if !ok {
+			return nil
+		}
+
+		typ := (b[0] >> 4) & 0x03
+		if typ == quicPacketRetry {
+			// The token is followed by the integrity tag
+			if q.client && !q.peerSeen && !q.retried && len(b)-p > 16 {
+				q.retry(scid, b[p:len(b)-16])
+			}
+			return nil
+		}
+		if typ == quicPacketInitial {
+			tokenLen, n, err := readVarint(b[p:])
+			if err != nil || uint64(len(b)-p-n) < tokenLen {
+				return nil
+			}
+			p += n + int(tokenLen)
+		}
+		length, n, err := readVarint(b[p:])
+		if err != nil || uint64(len(b)-p-n) < length {
+			return nil
+		}
+		p += n
+		packet, pnOffset := b[:p+int(length)], p
+		b = b[p+int(length):]
+
+		var l *quicLevel
+		switch typ {
+		case quicPacketInitial:
+			l = q.initial
+			if !q.peerSeen {
+				q.peerSeen = true
+				q.dcid = append([]byte{}, scid...)
+				if !q.client {
+					// The server's keys are derived from the connection ID
+					// that the client chose for it
+					q.initial.read, q.initial.write = quicInitialKeys(dcid)
+					q.tls.SetTransportParameters(q.transportParameters(dcid))
+					if err := q.tls.Start(context.Background()); err != nil {
+						return err
+					}
+				}
+			}
+		case quicPacketHandshake:
+			l = q.handshakeLevel
+		default:
+			continue
+		}
+
+		if l.read == nil {
+			l.pending = append(l.pending, append([]byte{}, packet...))
+			continue
+		}
+		if err := q.handlePacket(l, packet, pnOffset); err != nil {
+			return err
+		}
+		if err := q.handlePending(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handlePending handles the packets that arrived before their keys, which
+// may now be there
+func (q *quicEndpoint) handlePending() error {
+	l := q.handshakeLevel
+	for l.read != nil && len(l.pending) > 0 {
+		packet := l.pending[0]
+		l.pending = l.pending[1:]
+		if err := q.handleDatagram(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry starts again with the connection ID and the token of a Retry packet
+func (q *quicEndpoint) retry(scid, token []byte) {
+	q.retried = true
+	q.dcid = append([]byte{}, scid...)
+	q.token = append([]byte{}, token...)
+	q.initial.write, q.initial.read = quicInitialKeys(q.dcid)
+	q.initial.out, q.initial.outOffset = q.initial.sent, 0
+}
+
+// handlePacket removes the protection of the packet and handles its frames.
+// Packets that can't be decrypted are dropped, as they may be forged.
+func (q *quicEndpoint) handlePacket(l *quicLevel, packet []byte, pnOffset int) error {
+	if len(packet) < pnOffset+4+16 {
+		return nil
+	}
+	mask := make([]byte, aes.BlockSize)
+	l.read.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+
+	header := append([]byte{}, packet[:pnOffset]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		b := packet[pnOffset+i] ^ mask[1+i]
+		header = append(header, b)
+		truncated = truncated<<8 | uint64(b)
+	}
+	pn := decodePacketNumber(l.largest, truncated, pnLen*8)
+
+	payload, err := l.read.aead.Open(nil, l.read.nonce(pn), packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil
+	}
+	if int64(pn) > l.largest {
+		l.largest = int64(pn)
+	}
+	l.received[pn] = true
+
+	return q.handleFrames(l, payload)
+}
+
+// handleFrames handles the frames of a packet of the level
+func (q *quicEndpoint) handleFrames(l *quicLevel, b []byte) error {
+	for len(b) > 0 {
+		typ, n, err := readVarint(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		switch typ {
+		case 0x00:
+			// PADDING
+		case 0x01:
+			// PING
+			l.ackNeeded = true
+		case 0x02, 0x03:
+			// ACK, which is only read past, as nothing is sent again
+			// until the peer goes quiet
+			if b, err = skipVarints(b, 2); err != nil {
+				return err
+			}
+			var ranges uint64
+			if ranges, n, err = readVarint(b); err != nil {
+				return err
+			}
+			b = b[n:]
+			// The first range, each of the others with its gap, and the
+			// ECN counts
+			fields := 1 + 2*int(ranges)
+			if typ == 0x03 {
+				fields += 3
+			}
+			if b, err = skipVarints(b, fields); err != nil {
+				return err
+			}
+		case 0x06:
+			// CRYPTO
+			var offset, length uint64
+			if offset, n, err = readVarint(b); err != nil {
+				return err
+			}
+			b = b[n:]
+			if length, n, err = readVarint(b); err != nil {
+				return err
+			}
+			b = b[n:]
+			if uint64(len(b)) < length {
+				return errors.New("truncated CRYPTO frame")
+			}
+			l.ackNeeded = true
+			if err := q.crypto(l, offset, b[:length]); err != nil {
+				return err
+			}
+			b = b[length:]
+		case 0x1c, 0x1d:
+			// CONNECTION_CLOSE
+			var code uint64
+			if code, n, err = readVarint(b); err != nil {
+				return err
+			}
+			b = b[n:]
+			if typ == 0x1c {
+				if b, err = skipVarints(b, 1); err != nil {
+					return err
+				}
+			}
+			reason, _, _ := readLenVarint(b)
+			q.closed = true
+			return quicCloseError(code, string(reason))
+		default:
+			return fmt.Errorf("unexpected frame 0x%x in a handshake packet", typ)
+		}
+	}
+
+	return nil
+}
+
+// quicCloseError describes the error of a CONNECTION_CLOSE frame. The codes
+// from 0x100 are the alerts of TLS.
+func quicCloseError(code uint64, reason string) error {
+	msg := fmt.Sprintf("the peer closed the connection with error 0x%x", code)
+	if code >= 0x100 && code < 0x200 {
+		msg = fmt.Sprintf("the peer closed the connection with the TLS alert %d", code-0x100)
+	}
+	if reason != "" {
+		msg += ": " + reason
+	}
+	return errors.New(msg)
+}
+
+// crypto passes the handshake data on to TLS in order
+func (q *quicEndpoint) crypto(l *quicLevel, offset uint64, data []byte) error {
+	end := offset + uint64(len(data))
+	if end <= l.inOffset {
+		return nil
+	}
+	if offset < l.inOffset {
+		data = data[l.inOffset-offset:]
+		offset = l.inOffset
+	}
+	if _, ok := l.in[offset]; !ok || len(l.in[offset]) < len(data) {
+		l.in[offset] = append([]byte{}, data...)
+	}
+
+	for {
+		data, ok := l.in[l.inOffset]
+		if !ok {
+			return nil
+		}
+		delete(l.in, l.inOffset)
+		l.inOffset += uint64(len(data))
+		if err := q.tls.HandleData(l.tlsLevel, data); err != nil {
+			return err
+		}
+		if err := q.events(); err != nil {
+			return err
+		}
+	}
+}
+
+// flush sends the handshake data, the acknowledgements and the close of
+// each level. Each packet is sent in a datagram of its own, and those with
+// Initial packets from the client are padded.
+func (q *quicEndpoint) flush() error {
+	for _, l := range []*quicLevel{q.initial, q.handshakeLevel} {
+		if l.write == nil || l.discarded {
+			continue
+		}
+		for l.ackNeeded || len(l.out) > 0 || l.close {
+			var frames []byte
+			if l.ackNeeded && l.largest >= 0 {
+				frames = appendACK(frames, l)
+			}
+			l.ackNeeded = false
+
+			if n := len(l.out); n > 0 {
+				if n > quicMaxCrypto {
+					n = quicMaxCrypto
+				}
+				frames = append(frames, 0x06)
+				frames = appendVarint(frames, l.outOffset)
+				frames = appendVarint(frames, uint64(n))
+				frames = append(frames, l.out[:n]...)
+				l.out, l.outOffset = l.out[n:], l.outOffset+uint64(n)
+			}
+			if l.close && len(l.out) == 0 {
+				// CONNECTION_CLOSE with NO_ERROR, for no frame in particular
+				frames = append(frames, 0x1c, 0x00, 0x00, 0x00)
+				l.close = false
+			}
+			if len(frames) == 0 {
+				break
+			}
+
+			if _, err := q.send(q.packet(l, frames)); err != nil {
+				return err
+			}
+		}
+
+		// A client stops sending Initial packets once it sends Handshake
+		// packets
+		if q.client && l == q.handshakeLevel && l.nextPN > 0 {
+			q.initial.discarded = true
+		}
+	}
+
+	return nil
+}
+
+// packet returns a protected long header packet of the level with the
+// frames
+func (q *quicEndpoint) packet(l *quicLevel, frames []byte) []byte {
+	pn := l.nextPN
+	l.nextPN++
+
+	// The packet number is always written with 4 bytes
+	b := []byte{0xc0 | l.packetType<<4 | 0x03}
+	b = binary.BigEndian.AppendUint32(b, quicVersion1)
+	b = append(b, byte(len(q.dcid)))
+	b = append(b, q.dcid...)
+	b = append(b, byte(len(q.scid)))
+	b = append(b, q.scid...)
+	if l.packetType == quicPacketInitial {
+		b = appendVarint(b, uint64(len(q.token)))
+		b = append(b, q.token...)
+	}
+
+	overhead := 4 + l.write.aead.Overhead()
+	if l.packetType == quicPacketInitial && q.client {
+		// The length is always written with 2 bytes
+		if pad := quicMinDatagram - len(b) - 2 - overhead - len(frames); pad > 0 {
+			frames = append(frames, make([]byte, pad)...)
+		}
+	}
+	length := overhead + len(frames)
+	b = append(b, 0x40|byte(length>>8), byte(length))
+
+	pnOffset := len(b)
+	b = binary.BigEndian.AppendUint32(b, uint32(pn))
+	header := b
+	b = l.write.aead.Seal(b, l.write.nonce(pn), frames, header)
+
+	mask := make([]byte, aes.BlockSize)
+	l.write.hp.Encrypt(mask, b[pnOffset+4:pnOffset+4+16])
+	b[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		b[pnOffset+i] ^= mask[1+i]
+	}
+
+	return b
+}
+
+// appendACK appends an ACK frame for the largest packet received on the
+// level, and those just before it
+func appendACK(b []byte, l *quicLevel) []byte {
+	largest := uint64(l.largest)
+	var first uint64
+	for first < largest && l.received[largest-first-1] {
+		first++
+	}
+
+	b = append(b, 0x02)
+	b = appendVarint(b, largest)
+	// No ACK delay and no more ranges
+	b = appendVarint(b, 0)
+	b = appendVarint(b, 0)
+	return appendVarint(b, first)
+}
+
+// quicKeys protect the packets of one direction of an encryption level
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQUICKeys derives the keys of the cipher suite from the secret. Only the
+// suites with AES are supported, as ChaCha20 isn't in the standard library.
+func newQUICKeys(suite uint16, secret []byte) (*quicKeys, error) {
+	var (
+		h      func() hash.Hash
+		keyLen int
+	)
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	default:
+		return nil, errors.New("the server chose " + tls.CipherSuiteName(suite) + ", which the quic prober doesn't support")
+	}
+
+	block, err := aes.NewCipher(hkdfExpandLabel(h, secret, "quic key", keyLen))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(h, secret, "quic hp", keyLen))
+	if err != nil {
+		return nil, err
+	}
+
+	return &quicKeys{aead: aead, iv: hkdfExpandLabel(h, secret, "quic iv", 12), hp: hp}, nil
+}
+
+// nonce returns the nonce of the packet number
+func (k *quicKeys) nonce(pn uint64) []byte {
+	nonce := append([]byte{}, k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// quicInitialKeys returns the keys of the client's and the server's Initial
+// packets, which are derived from the connection ID that the client first
+// sends to
+func quicInitialKeys(dcid []byte) (client, server *quicKeys) {
+	initial := hkdf.Extract(sha256.New, dcid, quicInitialSalt)
+	client, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, hkdfExpandLabel(sha256.New, initial, "client in", 32))
+	server, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, hkdfExpandLabel(sha256.New, initial, "server in", 32))
+	return client, server
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from TLS 1.3, without a context
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	var info []byte
+	info = appendUint16(info, length)
+	info = appendLen8(info, []byte("tls13 "+label))
+	info = append(info, 0)
+	b := make([]byte, length)
+	io.ReadFull(hkdf.Expand(h, secret, info), b)
+	return b
+}
+
+// decodePacketNumber recovers the full packet number from the bits that
+// were sent, as in appendix A.3 of RFC 9000
+func decodePacketNumber(largest int64, truncated uint64, bits int) uint64 {
+	expected := uint64(largest + 1)
+	win := uint64(1) << bits
+	hwin := win / 2
+	candidate := (expected &^ (win - 1)) | truncated
+	if candidate+hwin <= expected && candidate < (1<<62)-win {
+		return candidate + win
+	}
+	if candidate > expected+hwin && candidate >= win {
+		return candidate - win
+	}
+	return candidate
+}
+
+// appendVarint appends the variable length integer of QUIC
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return binary.BigEndian.AppendUint64(b, v|0xc0<<56)
+}
+
+var errShortVarint = errors.New("truncated variable length integer")
+
+// readVarint reads a variable length integer of QUIC, and returns it with
+// its length
+func readVarint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errShortVarint
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, errShortVarint
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, nil
+}
+
+// skipVarints returns what's after the next n variable length integers
+func skipVarints(b []byte, n int) ([]byte, error) {
+	for i := 0; i < n; i++ {
+		_, l, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[l:]
+	}
+	return b, nil
+}
+
+// readLenVarint reads bytes preceded by their length as a variable length
+// integer
+func readLenVarint(b []byte) ([]byte, []byte, error) {
+	length, n, err := readVarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	b = b[n:]
+	if uint64(len(b)) < length {
+		return nil, nil, errShortVarint
+	}
+	return b[:length], b[length:], nil
+}
+
+// readLen8 reads bytes preceded by their length in a byte, from the offset
+// p, and returns them with the offset after them
+func readLen8(b []byte, p int) ([]byte, int, bool) {
+	if len(b) <= p {
+		return nil, p, false
+	}
+	n := int(b[p])
+	p++
+	if len(b) < p+n {
+		return nil, p, false
+	}
+	return b[p : p+n], p + n, true
+}
@@ -0,0 +1,159 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Test that quic targets are probed with the handshake of QUIC, which offers
+// h3, and that it gets through a Retry from the server
+func TestProbeQUIC(t *testing.T) {
+	for _, retry := range []bool{false, true} {
+		conn, roots := testQUICServer(t, retry)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		result, err := Probe(ctx, "quic://"+conn.LocalAddr().String(), Options{TLSConfig: &tls.Config{RootCAs: roots}})
+		if err != nil {
+			t.Fatalf("retry %t: %s", retry, err)
+		}
+		if result.Protocol != "quic" {
+			t.Errorf("expected the quic protocol, got %s", result.Protocol)
+		}
+		if result.State.Version != tls.VersionTLS13 || result.State.NegotiatedProtocol != "h3" {
+			t.Errorf("expected TLS 1.3 with h3, got %x with %q", result.State.Version, result.State.NegotiatedProtocol)
+		}
+		if len(result.State.PeerCertificates) == 0 || len(result.State.VerifiedChains) == 0 {
+			t.Errorf("expected a verified chain")
+		}
+	}
+}
+
+// Test that quic targets can't be probed through a proxy
+func TestProbeQUICProxy(t *testing.T) {
+	_, err := Probe(context.Background(), "quic://www.example.com", Options{
+		ProxyURL: &url.URL{Scheme: "http", Host: "proxy:3128"},
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// Test the variable length integers of QUIC and the decoding of packet
+// numbers, with the examples of RFC 9000
+func TestQUICVarint(t *testing.T) {
+	for v, n := range map[uint64]int{37: 1, 15293: 2, 494878333: 4, 151288809941952652: 8} {
+		b := appendVarint(nil, v)
+		if len(b) != n {
+			t.Errorf("%d: expected %d bytes, got %d", v, n, len(b))
+		}
+		if got, l, err := readVarint(b); err != nil || got != v || l != n {
+			t.Errorf("%d: read %d in %d bytes: %v", v, got, l, err)
+		}
+	}
+
+	if pn := decodePacketNumber(0xa82f30ea, 0x9b32, 16); pn != 0xa82f9b32 {
+		t.Errorf("expected the packet number 0xa82f9b32, got 0x%x", pn)
+	}
+}
+
+// testQUICServer returns a UDP socket that answers the handshake of one
+// QUIC connection at a time, after a Retry if retry is set, and the roots of
+// its certificate
+func testQUICServer(t *testing.T, retry bool) (net.PacketConn, *x509.CertPool) {
+	server, roots := testServer()
+	config := &tls.Config{Certificates: server.TLS.Certificates, NextProtos: []string{"h3"}, MinVersion: tls.VersionTLS13}
+	server.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var (
+			q    *quicEndpoint
+			peer net.Addr
+			cid  []byte
+		)
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			b := buf[:n]
+
+			if q == nil || addr.String() != peer.String() {
+				if retry {
+					// The rest of the first flight of the client is
+					// dropped until it comes back with the new connection
+					// ID
+					dcid, _, _ := readLen8(b, 5)
+					if cid == nil {
+						var r []byte
+						if r, cid = testQUICRetry(b); r != nil {
+							conn.WriteTo(r, addr)
+						}
+						continue
+					}
+					if !bytes.Equal(dcid, cid) {
+						continue
+					}
+				}
+				peer = addr
+				q, _ = newQUICEndpoint(false, config, func(b []byte) (int, error) {
+					return conn.WriteTo(b, addr)
+				})
+			}
+
+			if err := q.handleDatagram(b); err != nil {
+				q = nil
+				continue
+			}
+			q.flush()
+		}
+	}()
+
+	return conn, roots
+}
+
+// testQUICRetry returns a Retry packet for the Initial packet, which has a
+// token and an integrity tag that the prober doesn't check, and the new
+// connection ID in it
+func testQUICRetry(b []byte) ([]byte, []byte) {
+	if len(b) < 6 || b[0]&0xf0 != 0xc0 {
+		return nil, nil
+	}
+	dcid, p, ok := readLen8(b, 5)
+	if !ok {
+		return nil, nil
+	}
+	scid, _, ok := readLen8(b, p)
+	if !ok {
+		return nil, nil
+	}
+
+	// The new connection ID must differ from the one the client chose
+	cid := make([]byte, len(dcid)+1)
+	rand.Read(cid)
+
+	r := []byte{0xf0}
+	r = binary.BigEndian.AppendUint32(r, quicVersion1)
+	r = append(r, byte(len(scid)))
+	r = append(r, scid...)
+	r = append(r, byte(len(cid)))
+	r = append(r, cid...)
+	r = append(r, "token"...)
+	return append(r, make([]byte, 16)...), cid
+}
@@ -0,0 +1,123 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Redirect is a hop of the redirects that were followed from a https target
+type Redirect struct {
+	URL string
+
+	// State is the state of the TLS connection to the hop. It's nil if the
+	// hop isn't https, or it failed.
+	State *tls.ConnectionState
+
+	// Err is why the hop failed. The certificate of each hop is verified,
+	// even when the verification error of the target is only recorded.
+	Err error
+}
+
+// followRedirects follows the redirects from the response, up to the limit
+// of the request. It stops at the first response that isn't a redirect, or
+// the first hop that fails.
+func followRedirects(ctx context.Context, req *http.Request, resp *http.Response, config *tls.Config, resolver Resolver, request HTTPRequest) []Redirect {
+	// The handshakes of the hops aren't those of the target
+	ctx = context.WithValue(ctx, clientCertKey{}, (*clientCertRecord)(nil))
+	ctx = context.WithValue(ctx, helloKey{}, (*helloRecord)(nil))
+
+	// The server name of the target doesn't apply to the other hosts
+	if config != nil {
+		config = config.Clone()
+		config.ServerName = ""
+	}
+
+	var redirects []Redirect
+	for len(redirects) < request.FollowRedirects {
+		next := redirectRequest(ctx, req, resp, request)
+		if next == nil {
+			break
+		}
+
+		hop := Redirect{URL: next.URL.String()}
+		resp, hop.Err = redirectHop(ctx, next, config, resolver)
+		if hop.Err == nil {
+			hop.State = resp.TLS
+		}
+		redirects = append(redirects, hop)
+		if hop.Err != nil {
+			break
+		}
+		req = next
+	}
+
+	return redirects
+}
+
+// redirectRequest returns the request that the response redirects to, or nil
+// if it isn't a redirect. Like net/http, it keeps the method and body for 307
+// and 308 and drops the credentials when the redirect leaves the host.
+func redirectRequest(ctx context.Context, req *http.Request, resp *http.Response, request HTTPRequest) *http.Request {
+	method := req.Method
+	var body io.Reader
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != "HEAD" {
+			method = "GET"
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		if request.Body != "" {
+			body = strings.NewReader(request.Body)
+		}
+	default:
+		return nil
+	}
+
+	loc, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	next, err := http.NewRequestWithContext(ctx, method, loc.String(), body)
+	if err != nil {
+		return nil
+	}
+
+	next.Header = req.Header.Clone()
+	if body == nil {
+		next.Header.Del("Content-Type")
+	}
+	if next.URL.Hostname() != req.URL.Hostname() {
+		for _, name := range []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"} {
+			next.Header.Del(name)
+		}
+	}
+
+	return next
+}
+
+// redirectHop makes the request for a hop with a transport of its own, which
+// verifies the certificate against the host of the hop
+func redirectHop(ctx context.Context, req *http.Request, config *tls.Config, resolver Resolver) (*http.Response, error) {
+	transport := newTransport(verifyConfig(config, req.URL.Hostname(), newPhaseTrace(ctx, req.URL.String(), nil), nil), resolver)
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: transport,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrain))
+	resp.Body.Close()
+
+	return resp, nil
+}
@@ -0,0 +1,110 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test that redirects are followed through plain http hops, up to the limit
+func TestProbeFollowRedirects(t *testing.T) {
+	final := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer final.Close()
+
+	plain := httptest.NewServer(http.RedirectHandler(final.URL+"/final", http.StatusMovedPermanently))
+	defer plain.Close()
+
+	target := httptest.NewTLSServer(http.RedirectHandler(plain.URL+"/plain", http.StatusFound))
+	defer target.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+	roots.AddCert(final.Certificate())
+
+	result, err := Probe(context.Background(), target.URL, Options{
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		HTTPRequest: HTTPRequest{FollowRedirects: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Redirects) != 2 {
+		t.Fatalf("expected 2 redirects, got %d", len(result.Redirects))
+	}
+	if r := result.Redirects[0]; r.URL != plain.URL+"/plain" || r.State != nil || r.Err != nil {
+		t.Errorf("unexpected first hop %+v", r)
+	}
+	if r := result.Redirects[1]; r.URL != final.URL+"/final" || r.State == nil || r.Err != nil {
+		t.Errorf("unexpected second hop %+v", r)
+	}
+
+	result, err = Probe(context.Background(), target.URL, Options{
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		HTTPRequest: HTTPRequest{FollowRedirects: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Redirects) != 1 {
+		t.Errorf("expected 1 redirect, got %d", len(result.Redirects))
+	}
+}
+
+// Test that a failed hop is reported without failing the probe of the target
+func TestProbeFollowRedirectsFailure(t *testing.T) {
+	// Nothing listens on the address of the next hop
+	closed := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	target := httptest.NewTLSServer(http.RedirectHandler(closed.URL, http.StatusFound))
+	defer target.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+
+	result, err := Probe(context.Background(), target.URL, Options{
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		HTTPRequest: HTTPRequest{FollowRedirects: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Redirects) != 1 || result.Redirects[0].Err == nil || result.Redirects[0].State != nil {
+		t.Errorf("expected a failed hop, got %+v", result.Redirects)
+	}
+}
+
+// Test that credentials aren't sent to other hosts
+func TestRedirectRequestCredentials(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://example.com/login", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Api-Key", "secret")
+
+	for location, auth := range map[string]string{
+		"/next":                    "Bearer secret",
+		"https://cdn.example.net/": "",
+	} {
+		resp := &http.Response{
+			StatusCode: http.StatusFound,
+			Header:     http.Header{"Location": {location}},
+			Request:    req,
+		}
+		next := redirectRequest(context.Background(), req, resp, HTTPRequest{})
+		if next == nil {
+			t.Fatalf("expected a request for %s", location)
+		}
+		if next.Method != "GET" {
+			t.Errorf("%s: expected a GET, got %s", location, next.Method)
+		}
+		if a := next.Header.Get("Authorization"); a != auth {
+			t.Errorf("%s: expected Authorization %q, got %q", location, auth, a)
+		}
+		if next.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("%s: expected the other headers to be kept", location)
+		}
+	}
+}
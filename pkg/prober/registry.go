@@ -0,0 +1,128 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Prober connects to a target over a protocol of its own and returns the
+// state of the TLS connection. Probers are registered for a URL scheme and
+// are used for targets of the form <scheme>://<host>:<port>.
+//
+// The config has already been prepared for the target: its ServerName is set
+// and verification of the chain happens in its VerifyConnection. Probers that
+// don't perform the handshake with the config themselves, like ones that get
+// the chain from elsewhere, must call VerifyConnection with the state.
+type Prober interface {
+	Probe(ctx context.Context, target string, config *tls.Config) (*tls.ConnectionState, error)
+}
+
+// ProberFunc adapts a function to a Prober
+type ProberFunc func(ctx context.Context, target string, config *tls.Config) (*tls.ConnectionState, error)
+
+// Probe calls f
+func (f ProberFunc) Probe(ctx context.Context, target string, config *tls.Config) (*tls.ConnectionState, error) {
+	return f(ctx, target, config)
+}
+
+// DefaultPorter can be implemented by a Prober to give the port to use for
+// targets that don't have one
+type DefaultPorter interface {
+	DefaultPort() string
+}
+
+// defaultPorts are the well known ports of the protocols that probers may be
+// registered for. gRPC doesn't have one, so it's that of https, and Kafka's is
+// that of its SSL listeners.
+var defaultPorts = map[string]string{
+	"https":      "443",
+	"tcp":        "443",
+	"grpc":       "443",
+	"ftp":        "21",
+	"smtp":       "25",
+	"submission": "587",
+	"smtps":      "465",
+	"pop3":       "110",
+	"pop3s":      "995",
+	"imap":       "143",
+	"imaps":      "993",
+	"ldap":       "389",
+	"ldaps":      "636",
+	"postgres":   "5432",
+	"mysql":      "3306",
+	"xmpp":       "5222",
+	"nntps":      "563",
+	"ftps":       "990",
+	"ircs":       "6697",
+	"syslog":     "6514",
+	"syslog-tls": "6514",
+	"kafka":      "9093",
+	"quic":       "443",
+}
+
+// DefaultPort returns the port probed for targets of the prober that don't
+// have one, or "" if it doesn't have a default
+func DefaultPort(prober string) string {
+	if p, ok := registered(prober); ok {
+		if dp, ok := p.(DefaultPorter); ok && dp.DefaultPort() != "" {
+			return dp.DefaultPort()
+		}
+	}
+	return defaultPorts[prober]
+}
+
+var (
+	registryMtx sync.RWMutex
+	registry    = map[string]Prober{}
+)
+
+// Register makes a prober available for targets with the scheme. It's
+// intended to be called from an init function. Registering a scheme twice,
+// or one of the built in "https", "tcp", "grpc", "kafka" and "quic"
+// protocols, returns an error.
+func Register(scheme string, p Prober) error {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	if scheme == "https" || scheme == "tcp" || scheme == "grpc" || scheme == "kafka" || scheme == "quic" {
+		return fmt.Errorf("the %s prober is built in", scheme)
+	}
+	if _, ok := registry[scheme]; ok {
+		return fmt.Errorf("a prober is already registered for %s", scheme)
+	}
+	registry[scheme] = p
+
+	return nil
+}
+
+// MustRegister is like Register but panics if the prober can't be registered
+func MustRegister(scheme string, p Prober) {
+	if err := Register(scheme, p); err != nil {
+		panic(err)
+	}
+}
+
+// Registered returns the schemes that probers have been registered for
+func Registered() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	var schemes []string
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+func registered(scheme string) (Prober, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	p, ok := registry[scheme]
+	return p, ok
+}
@@ -0,0 +1,122 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test that targets with a registered scheme are probed with its prober
+func TestProbeRegistered(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	var probed string
+	MustRegister("test-handshake", ProberFunc(func(ctx context.Context, target string, config *tls.Config) (*tls.ConnectionState, error) {
+		probed = target
+
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		state := tlsConn.ConnectionState()
+		return &state, nil
+	}))
+
+	target := "test-handshake://" + strings.TrimPrefix(server.URL, "https://")
+	result, err := Probe(context.Background(), target, Options{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if probed != target {
+		t.Errorf("expected the prober to be given %s, got %s", target, probed)
+	}
+	if result.Protocol != "test-handshake" {
+		t.Errorf("expected the protocol test-handshake, got %s", result.Protocol)
+	}
+
+	// The config given to the prober still verifies the chain
+	if _, err := Probe(context.Background(), target, Options{}); err == nil {
+		t.Errorf("expected a verification error")
+	}
+}
+
+// Test that the built in protocols and duplicates can't be registered
+func TestRegisterInvalid(t *testing.T) {
+	p := ProberFunc(func(ctx context.Context, target string, config *tls.Config) (*tls.ConnectionState, error) {
+		return nil, nil
+	})
+
+	for _, scheme := range []string{"https", "tcp"} {
+		if err := Register(scheme, p); err == nil {
+			t.Errorf("expected an error registering %s", scheme)
+		}
+	}
+
+	if err := Register("test-duplicate", p); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("test-duplicate", p); err == nil {
+		t.Errorf("expected an error registering a scheme twice")
+	}
+}
+
+// Test that the chain printed by an external command is verified
+func TestExecProber(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	chainFile := filepath.Join(dir, "chain.pem")
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(chainFile, chain, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	MustRegister("test-exec", &ExecProber{Command: []string{"sh", "-c", `test "$SSL_EXPORTER_TARGET" = "$1" && cat ` + chainFile, "sh"}})
+
+	result, err := Probe(context.Background(), "test-exec://example.com:389", Options{TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.State.PeerCertificates) != 1 {
+		t.Errorf("expected 1 certificate, got %d", len(result.State.PeerCertificates))
+	}
+
+	if _, err := Probe(context.Background(), "test-exec://example.org:389", Options{TLSConfig: &tls.Config{RootCAs: roots}}); err == nil {
+		t.Errorf("expected a verification error for the wrong host")
+	}
+}
+
+// Test that a failing command fails the probe
+func TestExecProberError(t *testing.T) {
+	p := &ExecProber{Command: []string{"sh", "-c", "echo unreachable >&2; exit 1"}}
+
+	_, err := p.Probe(context.Background(), "test://example.com:389", &tls.Config{})
+	if err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("expected an error with the command's stderr, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package prober
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver looks up the addresses of the host of a target. *net.Resolver
+// implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewClientSubnetResolver returns a Resolver that sends the EDNS Client
+// Subnet option with its queries, so that geo-routed names resolve to the
+// addresses that clients in the subnet would get. Like NewCachingResolver,
+// it always uses Go's own resolver.
+func NewClientSubnetResolver(subnet *net.IPNet) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialDNS(ctx, network, address, subnet)
+		},
+	}
+}
+
+// CachingResolver is a Resolver that remembers the addresses it looks up for
+// as long as the TTL of the DNS records allows, up to MaxTTL. Answers that
+// don't come with a TTL, like those from /etc/hosts or over TCP, aren't
+// cached.
+type CachingResolver struct {
+	MaxTTL time.Duration
+
+	// ClientSubnet, if set, is sent with the queries in the EDNS Client
+	// Subnet option
+	ClientSubnet *net.IPNet
+
+	resolver *net.Resolver
+
+	mtx   sync.Mutex
+	cache map[string]cachedAddrs
+}
+
+type cachedAddrs struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// NewCachingResolver returns a CachingResolver that caches addresses for at
+// most maxTTL. It always uses Go's own resolver, which reads the system's
+// DNS configuration from /etc/resolv.conf.
+func NewCachingResolver(maxTTL time.Duration) *CachingResolver {
+	r := &CachingResolver{
+		MaxTTL: maxTTL,
+		cache:  map[string]cachedAddrs{},
+	}
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialDNS(ctx, network, address, r.ClientSubnet)
+		},
+	}
+
+	return r
+}
+
+// LookupIPAddr returns the cached addresses of the host, or looks them up if
+// they aren't cached or have expired
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+
+	r.mtx.Lock()
+	c, ok := r.cache[host]
+	r.mtx.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.addrs, nil
+	}
+
+	rec := &ttlRecorder{}
+	addrs, err := r.resolver.LookupIPAddr(context.WithValue(ctx, ttlRecorderKey{}, rec), host)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, ok := rec.min()
+	if !ok || ttl <= 0 {
+		return addrs, nil
+	}
+	if ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for h, c := range r.cache {
+		if !now.Before(c.expires) {
+			delete(r.cache, h)
+		}
+	}
+	r.cache[host] = cachedAddrs{addrs: addrs, expires: now.Add(ttl)}
+
+	return addrs, nil
+}
+
+// ttlRecorderKey is the context key of the ttlRecorder for a lookup
+type ttlRecorderKey struct{}
+
+// ttlRecorder keeps the lowest TTL of the answers to the queries of a
+// lookup, which may be made concurrently for A and AAAA records
+type ttlRecorder struct {
+	mtx  sync.Mutex
+	ttl  uint32
+	seen bool
+}
+
+// record parses a DNS response and keeps the TTLs of its answers
+func (r *ttlRecorder) record(b []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(b); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		if !r.seen || h.TTL < r.ttl {
+			r.ttl = h.TTL
+			r.seen = true
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// min returns the lowest TTL that was recorded, if any were
+func (r *ttlRecorder) min() (time.Duration, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return time.Duration(r.ttl) * time.Second, r.seen
+}
+
+// dialDNS dials a DNS server. For lookups made by a CachingResolver, it
+// records the TTLs of the responses read over UDP. If subnet isn't nil, it's
+// added to the queries in the EDNS Client Subnet option.
+func dialDNS(ctx context.Context, network, address string, subnet *net.IPNet) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, _ := ctx.Value(ttlRecorderKey{}).(*ttlRecorder)
+	if udpConn, ok := conn.(*net.UDPConn); ok && (rec != nil || subnet != nil) {
+		return &dnsPacketConn{UDPConn: udpConn, rec: rec, subnet: subnet}, nil
+	}
+	if subnet != nil {
+		return &dnsStreamConn{Conn: conn, subnet: subnet}, nil
+	}
+
+	return conn, nil
+}
+
+// dnsPacketConn adds the client subnet to the DNS queries it writes and
+// passes each response it reads to a ttlRecorder. It embeds *net.UDPConn so
+// that it's still treated as a net.PacketConn.
+type dnsPacketConn struct {
+	*net.UDPConn
+	rec    *ttlRecorder
+	subnet *net.IPNet
+}
+
+func (c *dnsPacketConn) Write(b []byte) (int, error) {
+	if c.subnet == nil {
+		return c.UDPConn.Write(b)
+	}
+
+	msg, err := withClientSubnet(b, c.subnet)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *dnsPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil && c.rec != nil {
+		c.rec.record(b[:n])
+	}
+	return n, err
+}
+
+// dnsStreamConn adds the client subnet to the DNS queries it writes over
+// TCP, which are prefixed with their length
+type dnsStreamConn struct {
+	net.Conn
+	subnet *net.IPNet
+}
+
+func (c *dnsStreamConn) Write(b []byte) (int, error) {
+	if len(b) < 2 {
+		return c.Conn.Write(b)
+	}
+
+	msg, err := withClientSubnet(b[2:], c.subnet)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ednsClientSubnet is the code of the EDNS Client Subnet option, from
+// RFC 7871
+const ednsClientSubnet = 8
+
+// withClientSubnet adds the EDNS Client Subnet option for the subnet to a
+// DNS query, adding an OPT record if the query doesn't have one
+func withClientSubnet(query []byte, subnet *net.IPNet) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+
+	family, ip := uint16(1), subnet.IP.To4()
+	if ip == nil {
+		family, ip = 2, subnet.IP.To16()
+	}
+	prefix, _ := subnet.Mask.Size()
+
+	masked := ip.Mask(subnet.Mask)
+	if masked == nil {
+		return nil, errors.New("invalid client subnet " + subnet.String())
+	}
+
+	// The address is truncated to the bytes covered by the prefix
+	data := []byte{byte(family >> 8), byte(family), byte(prefix), 0}
+	data = append(data, masked[:(prefix+7)/8]...)
+	option := dnsmessage.Option{Code: ednsClientSubnet, Data: data}
+
+	for i, r := range msg.Additionals {
+		if opt, ok := r.Body.(*dnsmessage.OPTResource); ok {
+			opt.Options = append(opt.Options, option)
+			msg.Additionals[i].Body = opt
+			return msg.Pack()
+		}
+	}
+
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+		Header: h,
+		Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{option}},
+	})
+
+	return msg.Pack()
+}
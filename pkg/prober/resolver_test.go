@@ -0,0 +1,248 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Test that both kinds of target are looked up with the resolver in the
+// options
+func TestProbeResolver(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate of the test server is valid for example.com
+	resolver := staticResolver{"example.com": {{IP: net.ParseIP("127.0.0.1")}}}
+
+	for _, target := range []string{"https://example.com:" + port, "example.com:" + port} {
+		if _, err := Probe(context.Background(), target, Options{
+			TLSConfig: &tls.Config{RootCAs: roots},
+			Resolver:  resolver,
+		}); err != nil {
+			t.Errorf("%s: %s", target, err)
+		}
+	}
+}
+
+// Test that addresses are cached for the TTL of their records, up to the
+// maximum
+func TestCachingResolver(t *testing.T) {
+	dns, err := newTestDNSServer(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+
+	r := NewCachingResolver(time.Hour)
+	r.resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialDNS(ctx, "udp", dns.Addr(), nil)
+	}
+
+	for i := 0; i < 2; i++ {
+		addrs, err := r.LookupIPAddr(context.Background(), "cached.example.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("unexpected addresses %v", addrs)
+		}
+	}
+	if n := dns.Queries(); n != 2 {
+		t.Errorf("expected one A and one AAAA query, got %d", n)
+	}
+
+	r.MaxTTL = time.Nanosecond
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupIPAddr(context.Background(), "capped.example."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := dns.Queries(); n != 6 {
+		t.Errorf("expected the addresses to expire at the maximum TTL, got %d queries", n)
+	}
+}
+
+// Test that the client subnet is sent with the queries
+func TestClientSubnetResolver(t *testing.T) {
+	dns, err := newTestDNSServer(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+
+	_, subnet, err := net.ParseCIDR("203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewClientSubnetResolver(subnet)
+	r.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialDNS(ctx, "udp", dns.Addr(), subnet)
+	}
+
+	addrs, err := r.LookupIPAddr(context.Background(), "geo.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+
+	// IPv4, a /24 prefix, a scope of 0 and the first 3 bytes of the address
+	if want := []byte{0, 1, 24, 0, 203, 0, 113}; !bytes.Equal(dns.ClientSubnet(), want) {
+		t.Errorf("expected the client subnet option %v, got %v", want, dns.ClientSubnet())
+	}
+}
+
+// Test that the client subnet is added to queries with and without an OPT
+// record
+func TestWithClientSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("2001:db8::/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, edns := range []bool{false, true} {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("geo.example."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET})
+		if edns {
+			var h dnsmessage.ResourceHeader
+			h.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+			b.StartAdditionals()
+			b.OPTResource(h, dnsmessage.OPTResource{})
+		}
+		query, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		modified, err := withClientSubnet(query, subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(modified); err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Additionals) != 1 {
+			t.Fatalf("edns %t: expected a single OPT record, got %d", edns, len(msg.Additionals))
+		}
+		opt := msg.Additionals[0].Body.(*dnsmessage.OPTResource)
+		want := []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0}
+		if len(opt.Options) != 1 || opt.Options[0].Code != 8 || !bytes.Equal(opt.Options[0].Data, want) {
+			t.Errorf("edns %t: expected the client subnet option %v, got %v", edns, want, opt.Options)
+		}
+	}
+}
+
+type staticResolver map[string][]net.IPAddr
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r[host], nil
+}
+
+// testDNSServer answers A queries with 192.0.2.1 and AAAA queries with no
+// records
+type testDNSServer struct {
+	conn net.PacketConn
+	ttl  uint32
+
+	mtx          sync.Mutex
+	queries      int
+	clientSubnet []byte
+}
+
+func newTestDNSServer(ttl uint32) (*testDNSServer, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &testDNSServer{conn: conn, ttl: ttl}
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *testDNSServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testDNSServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *testDNSServer) Queries() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.queries
+}
+
+// ClientSubnet returns the data of the client subnet option of the last
+// query that had one
+func (s *testDNSServer) ClientSubnet() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.clientSubnet
+}
+
+func (s *testDNSServer) serve() {
+	b := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		var query dnsmessage.Message
+		if err := query.Unpack(b[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		h, q := query.Header, query.Questions[0]
+
+		s.mtx.Lock()
+		s.queries++
+		for _, r := range query.Additionals {
+			if opt, ok := r.Body.(*dnsmessage.OPTResource); ok {
+				for _, o := range opt.Options {
+					if o.Code == 8 {
+						s.clientSubnet = o.Data
+					}
+				}
+			}
+		}
+		s.mtx.Unlock()
+
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true})
+		builder.StartQuestions()
+		builder.Question(q)
+		builder.StartAnswers()
+		if q.Type == dnsmessage.TypeA {
+			builder.AResource(
+				dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl},
+				dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			)
+		}
+		msg, err := builder.Finish()
+		if err != nil {
+			continue
+		}
+
+		s.conn.WriteTo(msg, addr)
+	}
+}
@@ -0,0 +1,507 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/http2"
+)
+
+// maxSVIDResponse is the most that's read of a response of the Workload API
+const maxSVIDResponse = 4 << 20
+
+// workloadAPIMethod is the gRPC method of the Workload API that streams the
+// X.509-SVIDs of the workload
+const workloadAPIMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// SVID is a X.509 SPIFFE Verifiable Identity Document
+type SVID struct {
+	// ID is the SPIFFE ID in the URI SAN of the leaf, like
+	// spiffe://example.org/web. It's empty if the leaf doesn't have one.
+	ID string
+
+	// Certificates are the leaf, followed by its intermediates
+	Certificates []*x509.Certificate
+
+	// VerifyErr is why the SVID isn't valid: it has no SPIFFE ID, there's
+	// no trust bundle for its trust domain or its chain can't be verified
+	// against it. It's nil for a valid SVID.
+	VerifyErr error
+}
+
+// TrustDomain returns the trust domain of the SPIFFE ID of the SVID
+func (s *SVID) TrustDomain() string {
+	return spiffeTrustDomain(s.ID)
+}
+
+// SPIFFEBundle is the trust bundle of a SPIFFE trust domain
+type SPIFFEBundle struct {
+	// TrustDomain is the trust domain, like example.org. A bundle without
+	// one is used for the SVIDs of any trust domain.
+	TrustDomain string
+
+	// Roots are the X.509 authorities of the trust domain
+	Roots []*x509.Certificate
+
+	// Sequence and RefreshHint are the spiffe_sequence and
+	// spiffe_refresh_hint of a bundle in the JSON format of the bundle
+	// endpoints. Sequence is nil and RefreshHint 0 if it didn't have them.
+	Sequence    *uint64
+	RefreshHint time.Duration
+
+	// Modified is when the file of the bundle was last changed. It's zero
+	// for the bundles of the Workload API.
+	Modified time.Time
+}
+
+// SPIFFEResult is the outcome of a probe of a SPIFFE workload
+type SPIFFEResult struct {
+	// SVIDs are the X.509-SVIDs of the workload
+	SVIDs []*SVID
+
+	// Bundles are the trust bundles that the Workload API returned with the
+	// SVIDs, for their trust domain and the federated ones. There are none
+	// for TLS servers.
+	Bundles []*SPIFFEBundle
+}
+
+// ProbeSPIFFE fetches the X.509-SVIDs of the SPIFFE workload at the target
+// and verifies them against the trust bundle.
+//
+// A target like unix:///run/spire/sockets/agent.sock is the socket of the
+// Workload API, whose SVIDs are verified against the bundle of their trust
+// domain that it returns with them, unless the bundle is for that trust
+// domain. Any other target is probed with a TLS handshake, like Probe does,
+// and the chain the server presents is its SVID, which is verified against
+// the bundle.
+func ProbeSPIFFE(ctx context.Context, target string, bundle *SPIFFEBundle, opts Options) (*SPIFFEResult, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Base()
+	}
+
+	trace := newPhaseTrace(ctx, target, opts.Tracer)
+
+	var (
+		result *SPIFFEResult
+		err    error
+	)
+	if strings.HasPrefix(target, "unix:") {
+		logger.Debugln("Fetching the X.509-SVIDs from the Workload API at " + target)
+		result, err = fetchX509SVIDs(ctx, target, trace)
+	} else {
+		result, err = probeSVID(ctx, target, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	trace.start("verify", "")
+	for _, svid := range result.SVIDs {
+		b := bundle
+		if b == nil || (b.TrustDomain != "" && b.TrustDomain != svid.TrustDomain()) {
+			b = nil
+			for _, wb := range result.Bundles {
+				if wb.TrustDomain == svid.TrustDomain() {
+					b = wb
+				}
+			}
+		}
+		svid.VerifyErr = verifySVID(svid, b, now)
+		if svid.VerifyErr != nil {
+			logger.Debugln("The SVID " + svid.ID + " isn't valid: " + svid.VerifyErr.Error())
+		}
+	}
+	trace.end("verify", "", nil)
+
+	return result, nil
+}
+
+// probeSVID returns the chain that the TLS server at the target presents as
+// its SVID. SVIDs don't have the names of the servers, so the chain isn't
+// verified by the handshake.
+func probeSVID(ctx context.Context, target string, opts Options) (*SPIFFEResult, error) {
+	config := &tls.Config{}
+	if opts.TLSConfig != nil {
+		config = opts.TLSConfig.Clone()
+	}
+	config.InsecureSkipVerify = true
+
+	opts.TLSConfig = config
+	opts.RecordVerifyErrors = false
+	opts.TrustStores = nil
+	opts.AllAddresses = false
+	if opts.Prober == "" {
+		opts.Prober = "tcp"
+	}
+
+	r, err := Probe(ctx, target, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.State.PeerCertificates) == 0 {
+		return nil, errors.New("no certificates presented by " + target)
+	}
+
+	return &SPIFFEResult{SVIDs: []*SVID{newSVID(r.State.PeerCertificates)}}, nil
+}
+
+// fetchX509SVIDs returns the first response of the FetchX509SVID stream of
+// the Workload API at the socket. gRPC runs over HTTP/2 without TLS on the
+// socket, and the messages are decoded with readProto, so that the exporter
+// doesn't need the gRPC and protobuf libraries for the one call.
+func fetchX509SVIDs(ctx context.Context, target string, trace *phaseTrace) (*SPIFFEResult, error) {
+	socket := strings.TrimPrefix(strings.TrimPrefix(target, "unix:"), "//")
+	if !filepath.IsAbs(socket) {
+		return nil, errors.New("the socket of the Workload API must be an absolute path, in " + target)
+	}
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			trace.start("dial", socket)
+			conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			trace.end("dial", socket, err)
+			return conn, err
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	// The stream doesn't end, so the request is cancelled once the first
+	// response has been read
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// An empty X509SVIDRequest, in the framing of gRPC: uncompressed and 0
+	// bytes long
+	req, err := http.NewRequest("POST", "http://localhost"+workloadAPIMethod, bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("workload.spiffe.io", "true")
+	req = req.WithContext(ctx)
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status from the Workload API: " + resp.Status)
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(resp.Body, header[:]); err != nil {
+		// The status of a call that failed is in the trailers, or in the
+		// headers of a response without a body
+		status := resp.Trailer
+		if status.Get("Grpc-Status") == "" {
+			status = resp.Header
+		}
+		if code := status.Get("Grpc-Status"); code != "" && code != "0" {
+			message, _ := url.PathUnescape(status.Get("Grpc-Message"))
+			return nil, fmt.Errorf("the Workload API returned gRPC status %s: %s", code, message)
+		}
+		return nil, fmt.Errorf("reading the response of the Workload API: %s", err)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("the response of the Workload API is compressed")
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxSVIDResponse {
+		return nil, fmt.Errorf("the response of the Workload API is too large, at %d bytes", length)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, message); err != nil {
+		return nil, fmt.Errorf("reading the response of the Workload API: %s", err)
+	}
+
+	return parseX509SVIDResponse(message)
+}
+
+// parseX509SVIDResponse decodes a X509SVIDResponse of the Workload API:
+//
+//	message X509SVIDResponse {
+//	    repeated X509SVID svids = 1;
+//	    repeated bytes crl = 2;
+//	    map<string, bytes> federated_bundles = 3;
+//	}
+//
+//	message X509SVID {
+//	    string spiffe_id = 1;
+//	    bytes x509_svid = 2;
+//	    bytes x509_svid_key = 3;
+//	    bytes bundle = 4;
+//	}
+//
+// The certificates and bundles are concatenated DER. The private keys are
+// never kept.
+func parseX509SVIDResponse(b []byte) (*SPIFFEResult, error) {
+	fields, err := readProto(b)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SPIFFEResult{}
+	seen := map[string]bool{}
+	for _, raw := range fields[1] {
+		svidFields, err := readProto(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := x509.ParseCertificates(lastField(svidFields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("parsing the X.509-SVID: %s", err)
+		}
+		if len(certs) == 0 {
+			return nil, errors.New("the Workload API returned a X.509-SVID without certificates")
+		}
+		svid := newSVID(certs)
+		if id := string(lastField(svidFields[1])); id != "" {
+			svid.ID = id
+		}
+		result.SVIDs = append(result.SVIDs, svid)
+
+		// The SVIDs of a trust domain all come with its bundle
+		if td, raw := svid.TrustDomain(), lastField(svidFields[4]); td != "" && len(raw) > 0 && !seen[td] {
+			roots, err := x509.ParseCertificates(raw)
+			if err != nil {
+				return nil, fmt.Errorf("parsing the bundle of %s: %s", td, err)
+			}
+			seen[td] = true
+			result.Bundles = append(result.Bundles, &SPIFFEBundle{TrustDomain: td, Roots: roots})
+		}
+	}
+	if len(result.SVIDs) == 0 {
+		return nil, errors.New("the Workload API returned no X.509-SVIDs")
+	}
+
+	for _, raw := range fields[3] {
+		entry, err := readProto(raw)
+		if err != nil {
+			return nil, err
+		}
+		td := spiffeTrustDomain(string(lastField(entry[1])))
+		if td == "" || seen[td] {
+			continue
+		}
+		roots, err := x509.ParseCertificates(lastField(entry[2]))
+		if err != nil {
+			return nil, fmt.Errorf("parsing the federated bundle of %s: %s", td, err)
+		}
+		seen[td] = true
+		result.Bundles = append(result.Bundles, &SPIFFEBundle{TrustDomain: td, Roots: roots})
+	}
+
+	return result, nil
+}
+
+// readProto returns the length delimited fields of a protobuf message, by
+// field number, in order. The fields of the other wire types are skipped.
+func readProto(b []byte) (map[int][][]byte, error) {
+	fields := map[int][][]byte{}
+	err := walkProto(b, func(field int, wireType, _ uint64, value []byte) {
+		if wireType == 2 {
+			fields[field] = append(fields[field], value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// walkProto calls f with each field of a protobuf message, in order, with
+// the value of a varint or the bytes of a length delimited field. The values
+// of the fixed wire types are skipped.
+func walkProto(b []byte, f func(field int, wireType, varint uint64, value []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid protobuf message")
+		}
+		b = b[n:]
+
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			f(int(key>>3), 0, v, nil)
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("invalid protobuf fixed64")
+			}
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errors.New("invalid protobuf length")
+			}
+			b = b[n:]
+			f(int(key>>3), 2, 0, b[:length])
+			b = b[length:]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("invalid protobuf fixed32")
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+	}
+	return nil
+}
+
+// lastField returns the last value of a field, which is the one that counts
+// for fields that aren't repeated
+func lastField(values [][]byte) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[len(values)-1]
+}
+
+// newSVID returns the SVID of a chain, with the SPIFFE ID of the leaf
+func newSVID(certs []*x509.Certificate) *SVID {
+	svid := &SVID{Certificates: certs}
+	for _, uri := range certs[0].URIs {
+		if uri.Scheme == "spiffe" {
+			svid.ID = uri.String()
+			break
+		}
+	}
+	return svid
+}
+
+// verifySVID checks the SVID against the bundle of its trust domain, with
+// the rules of the X.509-SVID specification: the leaf has a single SPIFFE
+// ID, isn't a CA and chains up to one of the roots of the bundle
+func verifySVID(svid *SVID, bundle *SPIFFEBundle, now time.Time) error {
+	leaf := svid.Certificates[0]
+	if svid.ID == "" || svid.TrustDomain() == "" {
+		return errors.New("the leaf has no SPIFFE ID")
+	}
+	if len(leaf.URIs) != 1 {
+		return fmt.Errorf("the leaf has %d URI SANs, rather than one SPIFFE ID", len(leaf.URIs))
+	}
+	if leaf.URIs[0].String() != svid.ID {
+		return errors.New("the SPIFFE ID " + svid.ID + " isn't the one in the leaf, " + leaf.URIs[0].String())
+	}
+	if leaf.IsCA {
+		return errors.New("the leaf is a CA")
+	}
+	if bundle == nil || len(bundle.Roots) == 0 {
+		return errors.New("no trust bundle for the trust domain " + svid.TrustDomain())
+	}
+
+	roots := x509.NewCertPool()
+	for _, root := range bundle.Roots {
+		roots.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range svid.Certificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// spiffeTrustDomain returns the trust domain of a SPIFFE ID, or of the ID of
+// a trust domain, like spiffe://example.org
+func spiffeTrustDomain(id string) string {
+	u, err := url.Parse(id)
+	if err != nil || u.Scheme != "spiffe" {
+		return ""
+	}
+	return u.Host
+}
+
+// spiffeBundleJSON is a bundle in the JWK Set format of the SPIFFE bundle
+// endpoints
+type spiffeBundleJSON struct {
+	Keys []struct {
+		Use string   `json:"use"`
+		X5C []string `json:"x5c"`
+	} `json:"keys"`
+	Sequence    *uint64 `json:"spiffe_sequence"`
+	RefreshHint *int64  `json:"spiffe_refresh_hint"`
+}
+
+// ParseSPIFFEBundle parses a trust bundle in PEM, or in the JSON format of
+// the SPIFFE bundle endpoints, whose x509-svid keys are the roots
+func ParseSPIFFEBundle(b []byte) (*SPIFFEBundle, error) {
+	bundle := &SPIFFEBundle{}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		var j spiffeBundleJSON
+		if err := json.Unmarshal(b, &j); err != nil {
+			return nil, err
+		}
+		for _, key := range j.Keys {
+			if key.Use != "x509-svid" || len(key.X5C) == 0 {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(key.X5C[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid x5c: %s", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			bundle.Roots = append(bundle.Roots, cert)
+		}
+		bundle.Sequence = j.Sequence
+		if j.RefreshHint != nil {
+			bundle.RefreshHint = time.Duration(*j.RefreshHint) * time.Second
+		}
+	} else {
+		for {
+			var block *pem.Block
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			bundle.Roots = append(bundle.Roots, cert)
+		}
+	}
+	if len(bundle.Roots) == 0 {
+		return nil, errors.New("no X.509 authorities found in the bundle")
+	}
+
+	return bundle, nil
+}
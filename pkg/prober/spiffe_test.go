@@ -0,0 +1,231 @@
+package prober
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Test that the SVIDs of the Workload API are verified against the bundles
+// that it returns for their trust domains, or the bundle that's given
+func TestProbeSPIFFEWorkloadAPI(t *testing.T) {
+	ca, caKey := testOCSPIssuer(t)
+	otherCA, otherKey := testOCSPIssuer(t)
+	web := testSVIDCert(t, ca, caKey, "spiffe://example.org/web")
+	db := testSVIDCert(t, otherCA, otherKey, "spiffe://other.org/db")
+
+	response := append(
+		protoField(1, append(protoField(1, []byte("spiffe://example.org/web")), append(protoField(2, web.Raw), append(protoField(3, []byte("key")), protoField(4, ca.Raw)...)...)...)),
+		protoField(1, append(protoField(1, []byte("spiffe://other.org/db")), protoField(2, db.Raw)...))...,
+	)
+	response = append(response, protoField(3, append(protoField(1, []byte("spiffe://other.org")), protoField(2, otherCA.Raw)...))...)
+	target, stop := testWorkloadAPI(t, response)
+	defer stop()
+
+	result, err := ProbeSPIFFE(context.Background(), target, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.SVIDs) != 2 || result.SVIDs[0].ID != "spiffe://example.org/web" || result.SVIDs[1].ID != "spiffe://other.org/db" {
+		t.Fatalf("expected the SVIDs of web and db, got %d", len(result.SVIDs))
+	}
+	for _, svid := range result.SVIDs {
+		if svid.VerifyErr != nil {
+			t.Errorf("%s: %s", svid.ID, svid.VerifyErr)
+		}
+	}
+	if len(result.Bundles) != 2 || result.Bundles[0].TrustDomain != "example.org" || result.Bundles[1].TrustDomain != "other.org" {
+		t.Errorf("expected the bundles of example.org and other.org, got %d", len(result.Bundles))
+	}
+
+	// A bundle for the trust domain replaces the Workload API's, which is
+	// still used for the others
+	stale, _ := testOCSPIssuer(t)
+	result, err = ProbeSPIFFE(context.Background(), target, &SPIFFEBundle{TrustDomain: "example.org", Roots: []*x509.Certificate{stale}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SVIDs[0].VerifyErr == nil {
+		t.Errorf("expected the SVID of example.org not to be verified against the stale bundle")
+	}
+	if result.SVIDs[1].VerifyErr != nil {
+		t.Errorf("expected the SVID of other.org to be verified against the federated bundle, got %s", result.SVIDs[1].VerifyErr)
+	}
+}
+
+// Test that the errors of the Workload API are returned
+func TestProbeSPIFFEWorkloadAPIFailure(t *testing.T) {
+	empty, stop := testWorkloadAPI(t, nil)
+	defer stop()
+
+	for name, target := range map[string]string{
+		"empty":    empty,
+		"missing":  "unix:///nonexistent/agent.sock",
+		"relative": "unix:agent.sock",
+	} {
+		if _, err := ProbeSPIFFE(context.Background(), target, nil, Options{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// Test that the chain of a TLS server is its SVID, which is verified against
+// the bundle
+func TestProbeSPIFFETLS(t *testing.T) {
+	ca, caKey := testOCSPIssuer(t)
+	key := testKey(t)
+	leaf := testSVIDCertWithKey(t, ca, caKey, "spiffe://example.org/api", key)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Raw}, PrivateKey: key}}}
+	server.StartTLS()
+	defer server.Close()
+	target := server.Listener.Addr().String()
+
+	result, err := ProbeSPIFFE(context.Background(), target, &SPIFFEBundle{Roots: []*x509.Certificate{ca}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.SVIDs) != 1 || result.SVIDs[0].ID != "spiffe://example.org/api" {
+		t.Fatalf("expected the SVID of the server, got %d SVIDs", len(result.SVIDs))
+	}
+	if err := result.SVIDs[0].VerifyErr; err != nil {
+		t.Errorf("expected a valid SVID, got %s", err)
+	}
+	if len(result.Bundles) != 0 {
+		t.Errorf("expected no bundles for a TLS server, got %d", len(result.Bundles))
+	}
+
+	result, err = ProbeSPIFFE(context.Background(), target, &SPIFFEBundle{TrustDomain: "other.org", Roots: []*x509.Certificate{ca}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SVIDs[0].VerifyErr == nil {
+		t.Errorf("expected an error without a bundle for example.org")
+	}
+}
+
+// Test that bundles are parsed from PEM and from the JSON of the bundle
+// endpoints
+func TestParseSPIFFEBundle(t *testing.T) {
+	ca, _ := testOCSPIssuer(t)
+
+	bundle, err := ParseSPIFFEBundle(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Roots) != 1 || bundle.Sequence != nil || bundle.RefreshHint != 0 {
+		t.Errorf("expected the root of the PEM bundle, got %d roots", len(bundle.Roots))
+	}
+
+	bundle, err = ParseSPIFFEBundle([]byte(`{
+  "keys": [
+    {"use": "x509-svid", "kty": "EC", "x5c": ["` + base64.StdEncoding.EncodeToString(ca.Raw) + `"]},
+    {"use": "jwt-svid", "kty": "EC", "kid": "jwt"}
+  ],
+  "spiffe_sequence": 12,
+  "spiffe_refresh_hint": 300
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Roots) != 1 || bundle.Sequence == nil || *bundle.Sequence != 12 || bundle.RefreshHint != 5*time.Minute {
+		t.Errorf("expected the root, sequence and refresh hint of the JSON bundle, got %d roots, %v and %s", len(bundle.Roots), bundle.Sequence, bundle.RefreshHint)
+	}
+
+	for _, b := range []string{"", `{"keys": [{"use": "jwt-svid"}]}`, `{"keys": [`} {
+		if _, err := ParseSPIFFEBundle([]byte(b)); err == nil {
+			t.Errorf("expected an error for %q", b)
+		}
+	}
+}
+
+func testSVIDCert(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, id string) *x509.Certificate {
+	return testSVIDCertWithKey(t, ca, caKey, id, testKey(t))
+}
+
+func testSVIDCertWithKey(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, id string, key crypto.Signer) *x509.Certificate {
+	u, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		URIs:         []*url.URL{u},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// protoField encodes a length delimited protobuf field
+func protoField(field int, b []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(field<<3|2))
+	out = binary.AppendUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+// testWorkloadAPI returns the target of a Workload API on a socket, which
+// streams the X509SVIDResponse, or fails the calls when it's nil, and a
+// function that stops it
+func testWorkloadAPI(t *testing.T, response []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "spiffe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != workloadAPIMethod || r.Header.Get("workload.spiffe.io") != "true" || response == nil {
+				w.Header().Set("Grpc-Status", "3")
+				w.Header().Set("Grpc-Message", "security header missing from request")
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			frame := make([]byte, 5)
+			binary.BigEndian.PutUint32(frame[1:], uint32(len(response)))
+			w.Write(append(frame, response...))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}), &http2.Server{}),
+	}
+	go server.Serve(l)
+
+	return "unix://" + socket, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,173 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshHostKeyAlgorithms are the host key algorithms offered to SSH servers,
+// with the certificates first so that servers that have a host certificate
+// present it rather than their plain key
+var sshHostKeyAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSAv01,
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA,
+}
+
+// errSSHHostKey ends the handshake with a SSH server once its host key has
+// been seen, so that the exporter never tries to authenticate
+var errSSHHostKey = errors.New("host key received")
+
+// SSHResult is the outcome of a probe of a SSH server, or of the reading of
+// a file of OpenSSH certificates
+type SSHResult struct {
+	// HostKey is the host key that the server presented, which is a
+	// certificate if it has one. It's nil for files.
+	HostKey ssh.PublicKey
+
+	// Certificates are the host certificate of the server, or the
+	// certificates in the file
+	Certificates []*ssh.Certificate
+}
+
+// ProbeSSH returns the host key that the SSH server at the target, a
+// <host>:<port>, presents in the key exchange. The connection is closed
+// before authentication, which isn't attempted.
+//
+// The Resolver and Tracer of the options are used for the connection. The
+// host key isn't verified.
+func ProbeSSH(ctx context.Context, target string, opts Options) (*SSHResult, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Base()
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "22")
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugln("Reading the host key of SSH server " + target)
+
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	trace := newPhaseTrace(ctx, target, opts.Tracer)
+
+	trace.start("resolve", "")
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	trace.end("resolve", "", err)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses found for " + host)
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	for _, addr := range addrs {
+		address := net.JoinHostPort(addr.String(), port)
+
+		trace.start("dial", address)
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		trace.end("dial", address, err)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	result := &SSHResult{}
+	config := &ssh.ClientConfig{
+		User:              "ssl_exporter",
+		ClientVersion:     "SSH-2.0-ssl_exporter",
+		HostKeyAlgorithms: sshHostKeyAlgorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			result.HostKey = key
+			return errSSHHostKey
+		},
+	}
+
+	trace.start("handshake", "")
+	_, _, _, err = ssh.NewClientConn(conn, target, config)
+	if result.HostKey == nil {
+		if err == nil {
+			err = errors.New("no host key received from " + target)
+		}
+		trace.end("handshake", "", err)
+		return nil, err
+	}
+	trace.end("handshake", "", nil)
+
+	if cert, ok := result.HostKey.(*ssh.Certificate); ok {
+		result.Certificates = []*ssh.Certificate{cert}
+	} else {
+		logger.Debugln("The SSH server presented a " + result.HostKey.Type() + " host key without a certificate")
+	}
+
+	return result, nil
+}
+
+// ReadSSHCertificates returns the OpenSSH certificates in a file in the
+// authorized_keys format, like the ssh_host_ed25519_key-cert.pub of a host
+// or the id_ed25519-cert.pub of a user. A private key, like id_ed25519,
+// stands for the certificate next to it, as it does for ssh.
+func ReadSSHCertificates(file string) (*SSHResult, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(b, []byte("PRIVATE KEY-----")) {
+		file += "-cert.pub"
+		if b, err = ioutil.ReadFile(file); err != nil {
+			if os.IsNotExist(err) {
+				return nil, errors.New("no certificate next to the private key, in " + file)
+			}
+			return nil, err
+		}
+	}
+
+	// The lines that aren't keys are skipped, and an error only means that
+	// there are no more keys
+	result := &SSHResult{}
+	for len(b) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		if cert, ok := key.(*ssh.Certificate); ok {
+			result.Certificates = append(result.Certificates, cert)
+		}
+		b = rest
+	}
+	if len(result.Certificates) == 0 {
+		return nil, errors.New("no OpenSSH certificates found in " + file)
+	}
+
+	return result, nil
+}
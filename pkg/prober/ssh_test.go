@@ -0,0 +1,150 @@
+package prober
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Test that the host certificate of a SSH server is returned, and the plain
+// host key of one without a certificate
+func TestProbeSSH(t *testing.T) {
+	ca := testSSHSigner(t)
+	hostKey := testSSHSigner(t)
+	cert := testSSHCert(t, ca, hostKey.PublicKey(), ssh.HostCert, time.Now().Add(time.Hour))
+	certSigner, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, signer := range map[string]ssh.Signer{"certificate": certSigner, "plain": hostKey} {
+		target := testSSHServer(t, signer)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		result, err := ProbeSSH(ctx, target, Options{})
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if result.HostKey == nil {
+			t.Fatalf("%s: expected the host key", name)
+		}
+
+		if name == "plain" {
+			if len(result.Certificates) != 0 {
+				t.Errorf("%s: expected no certificates, got %d", name, len(result.Certificates))
+			}
+			continue
+		}
+		if len(result.Certificates) != 1 || result.Certificates[0].KeyId != cert.KeyId {
+			t.Fatalf("%s: expected the host certificate, got %v", name, result.Certificates)
+		}
+		if got := ssh.FingerprintSHA256(result.Certificates[0].SignatureKey); got != ssh.FingerprintSHA256(ca.PublicKey()) {
+			t.Errorf("%s: expected the CA key %s, got %s", name, ssh.FingerprintSHA256(ca.PublicKey()), got)
+		}
+	}
+}
+
+// Test that the certificates of a file are read, and the certificate next to
+// a private key
+func TestReadSSHCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := testSSHSigner(t)
+	user := testSSHCert(t, ca, testSSHSigner(t).PublicKey(), ssh.UserCert, time.Now().Add(time.Hour))
+	host := testSSHCert(t, ca, testSSHSigner(t).PublicKey(), ssh.HostCert, time.Now().Add(time.Hour))
+
+	files := map[string][]byte{
+		"certs.pub":         append(append([]byte("# comment\n"), ssh.MarshalAuthorizedKey(user)...), ssh.MarshalAuthorizedKey(host)...),
+		"id_ecdsa":          pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("not a key")}),
+		"id_ecdsa-cert.pub": ssh.MarshalAuthorizedKey(user),
+		"id_ecdsa.pub":      ssh.MarshalAuthorizedKey(user.Key),
+		"lonely":            pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: []byte("not a key")}),
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]int{"certs.pub": 2, "id_ecdsa": 1} {
+		result, err := ReadSSHCertificates(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(result.Certificates) != want {
+			t.Errorf("%s: expected %d certificates, got %d", name, want, len(result.Certificates))
+		}
+	}
+	for _, name := range []string{"id_ecdsa.pub", "lonely", "missing"} {
+		if _, err := ReadSSHCertificates(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func testSSHSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func testSSHCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          42,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: []string{"test.example.com"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testSSHServer returns the address of a SSH server with the host key,
+// which only does the key exchange of its first connection
+func testSSHServer(t *testing.T, hostKey ssh.Signer) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ssh.NewServerConn(conn, config)
+	}()
+
+	return l.Addr().String()
+}
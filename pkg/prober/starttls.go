@@ -0,0 +1,493 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// startTLS are the upgrades to TLS of the protocols that start in plain text
+// and switch to TLS with a command of their own, by scheme. They're given the
+// host of the target, for the protocols that name the server they're for.
+var startTLS = map[string]func(c *textproto.Conn, host string) error{
+	"smtp":       startTLSSMTP,
+	"submission": startTLSSMTP,
+	"imap":       startTLSIMAP,
+	"pop3":       startTLSPOP3,
+	"ftp":        startTLSFTP,
+	"postgres":   startTLSPostgres,
+	"mysql":      startTLSMySQL,
+	"ldap":       startTLSLDAP,
+	"xmpp":       startTLSXMPP,
+}
+
+// StartTLS reports whether the scheme is that of a protocol that starts in
+// plain text and is upgraded to TLS with STARTTLS, or its equivalent, before
+// the handshake: smtp, submission, imap, pop3, ftp, postgres, mysql, ldap and
+// xmpp
+func StartTLS(scheme string) bool {
+	return startTLS[scheme] != nil
+}
+
+// isStartTLS reports whether targets of the protocol are probed with STARTTLS.
+// A prober that's registered for the scheme takes its place.
+func isStartTLS(proto string) bool {
+	if _, ok := registered(proto); ok {
+		return false
+	}
+	return StartTLS(proto)
+}
+
+// probeStartTLS connects to the target in plain text, upgrades the connection
+// to TLS in the way of the protocol and performs the TLS handshake
+func probeStartTLS(ctx context.Context, target, proto string, config *tls.Config, resolver Resolver, trace *phaseTrace, verifyErr *error) (*tls.ConnectionState, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if isOnion(host) {
+		trace.start("dial", target)
+		conn, err = dialOnion(ctx, target)
+		trace.end("dial", target, err)
+	} else {
+		conn, err = dialTCP(ctx, target, resolver, trace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The handshake is bound by the context, but the commands before it
+	// aren't
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	trace.start("starttls", "")
+	err = startTLS[proto](textproto.NewConn(conn), host)
+	trace.end("starttls", "", err)
+	if err != nil {
+		return nil, fmt.Errorf("error upgrading the %s connection to %s to TLS: %s", proto, target, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return handshake(ctx, conn, target, config, trace, verifyErr)
+}
+
+// startTLSSMTP upgrades a SMTP connection with STARTTLS, RFC 3207, once the
+// server has said that it supports it in its reply to EHLO
+func startTLSSMTP(c *textproto.Conn, _ string) error {
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return err
+	}
+
+	if err := c.PrintfLine("EHLO localhost"); err != nil {
+		return err
+	}
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		return err
+	}
+	// The first line of the reply is the greeting, and the rest are the
+	// extensions that the server supports
+	supported := false
+	for _, ext := range strings.Split(msg, "\n")[1:] {
+		if fields := strings.Fields(ext); len(fields) > 0 && strings.EqualFold(fields[0], "STARTTLS") {
+			supported = true
+		}
+	}
+	if !supported {
+		return errors.New("the server doesn't support STARTTLS")
+	}
+
+	if err := c.PrintfLine("STARTTLS"); err != nil {
+		return err
+	}
+	_, _, err = c.ReadResponse(220)
+	return err
+}
+
+// startTLSIMAP upgrades an IMAP connection with STARTTLS, RFC 3501
+func startTLSIMAP(c *textproto.Conn, _ string) error {
+	greeting, err := c.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(strings.ToUpper(greeting), "* OK") {
+		return errors.New("unexpected greeting: " + greeting)
+	}
+
+	if err := c.PrintfLine("a1 STARTTLS"); err != nil {
+		return err
+	}
+	// Untagged responses may come before the one to the command
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "a1 ") {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToUpper(line), "A1 OK") {
+			return errors.New("the server refused STARTTLS: " + line)
+		}
+		return nil
+	}
+}
+
+// startTLSPOP3 upgrades a POP3 connection with STLS, RFC 2595
+func startTLSPOP3(c *textproto.Conn, _ string) error {
+	greeting, err := c.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "+OK") {
+		return errors.New("unexpected greeting: " + greeting)
+	}
+
+	if err := c.PrintfLine("STLS"); err != nil {
+		return err
+	}
+	line, err := c.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return errors.New("the server refused STLS: " + line)
+	}
+	return nil
+}
+
+// startTLSFTP upgrades a FTP control connection with AUTH TLS, RFC 4217
+func startTLSFTP(c *textproto.Conn, _ string) error {
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return err
+	}
+
+	if err := c.PrintfLine("AUTH TLS"); err != nil {
+		return err
+	}
+	_, _, err := c.ReadResponse(234)
+	return err
+}
+
+// postgresSSLRequest is the code of the SSLRequest message of PostgreSQL
+const postgresSSLRequest = 80877103
+
+// startTLSPostgres upgrades a PostgreSQL connection with an SSLRequest, which
+// the server answers with a single byte: S to go ahead with the handshake
+// or N if it doesn't have TLS
+func startTLSPostgres(c *textproto.Conn, _ string) error {
+	var msg []byte
+	msg = binary.BigEndian.AppendUint32(msg, 8)
+	msg = binary.BigEndian.AppendUint32(msg, postgresSSLRequest)
+	if _, err := c.W.Write(msg); err != nil {
+		return err
+	}
+	if err := c.W.Flush(); err != nil {
+		return err
+	}
+
+	b, err := c.R.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 'S':
+		return nil
+	case 'N':
+		return errors.New("the server doesn't support TLS")
+	}
+	return fmt.Errorf("unexpected response to the SSLRequest: %q", b)
+}
+
+// The capabilities of MySQL clients and servers that the upgrade needs
+const (
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+)
+
+// startTLSMySQL upgrades a MySQL connection with an SSLRequest packet, once
+// the server has said in its handshake packet that it supports TLS
+func startTLSMySQL(c *textproto.Conn, _ string) error {
+	payload, err := readMySQLPacket(c)
+	if err != nil {
+		return err
+	}
+	if len(payload) > 0 && payload[0] == 0xff {
+		// An error packet, like for a host that's blocked, has a code and
+		// then the message
+		if len(payload) > 3 {
+			return errors.New("the server refused the connection: " + strings.TrimPrefix(string(payload[3:]), "#"))
+		}
+		return errors.New("the server refused the connection")
+	}
+	if len(payload) == 0 || payload[0] != 10 {
+		return errors.New("unexpected handshake packet from the server")
+	}
+
+	// The lower half of the capabilities comes after the version, the
+	// connection ID, the first part of the auth data and a filler byte
+	i := strings.IndexByte(string(payload[1:]), 0)
+	if i < 0 || len(payload) < 1+i+1+4+8+1+2 {
+		return errors.New("truncated handshake packet from the server")
+	}
+	p := 1 + i + 1 + 4 + 8 + 1
+	capabilities := uint32(binary.LittleEndian.Uint16(payload[p:]))
+	if capabilities&mysqlClientSSL == 0 {
+		return errors.New("the server doesn't support TLS")
+	}
+
+	// The SSLRequest is the start of the handshake response, with the
+	// capabilities of the client, the largest packet, the character set,
+	// utf8mb4, and a filler
+	var req []byte
+	req = binary.LittleEndian.AppendUint32(req, mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConnection)
+	req = binary.LittleEndian.AppendUint32(req, 1<<24-1)
+	req = append(req, 45)
+	req = append(req, make([]byte, 23)...)
+
+	return writeMySQLPacket(c, 1, req)
+}
+
+// readMySQLPacket reads the payload of a MySQL packet, which has a 3 byte
+// length and a sequence number in front of it
+func readMySQLPacket(c *textproto.Conn) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.R, header[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(c.R, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// writeMySQLPacket writes the payload as a MySQL packet with the sequence
+// number
+func writeMySQLPacket(c *textproto.Conn, seq byte, payload []byte) error {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	if _, err := c.W.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return c.W.Flush()
+}
+
+// ldapStartTLSRequest is the LDAPMessage of an ExtendedRequest for StartTLS,
+// with the message ID 1
+var ldapStartTLSRequest = append([]byte{
+	0x30, 0x1d, // LDAPMessage
+	0x02, 0x01, 0x01, // messageID
+	0x77, 0x18, // [APPLICATION 23] ExtendedRequest
+	0x80, 0x16, // [0] requestName
+}, "1.3.6.1.4.1.1466.20037"...)
+
+// maxLDAPResponse is the most that's read of the response to StartTLS, which
+// only has a result code and a message
+const maxLDAPResponse = 64 << 10
+
+// startTLSLDAP upgrades an LDAP connection with the StartTLS extended
+// operation, RFC 4511, which the server answers with an ExtendedResponse
+func startTLSLDAP(c *textproto.Conn, _ string) error {
+	if _, err := c.W.Write(ldapStartTLSRequest); err != nil {
+		return err
+	}
+	if err := c.W.Flush(); err != nil {
+		return err
+	}
+
+	tag, msg, err := readBER(c.R)
+	if err != nil {
+		return err
+	}
+	if tag != 0x30 {
+		return errors.New("unexpected response to StartTLS")
+	}
+	// The message ID, which is 0 for a notice of disconnection, and then
+	// the ExtendedResponse
+	_, _, msg, err = parseBER(msg)
+	if err != nil {
+		return err
+	}
+	tag, resp, _, err := parseBER(msg)
+	if err != nil {
+		return err
+	}
+	if tag != 0x78 {
+		return errors.New("unexpected response to StartTLS")
+	}
+
+	// The result code, the matched DN and the diagnostic message
+	tag, code, resp, err := parseBER(resp)
+	if err != nil || tag != 0x0a || len(code) != 1 {
+		return errors.New("unexpected result code in the response to StartTLS")
+	}
+	if code[0] == 0 {
+		return nil
+	}
+	_, _, resp, _ = parseBER(resp)
+	if _, diag, _, err := parseBER(resp); err == nil && len(diag) > 0 {
+		return fmt.Errorf("the server refused StartTLS with result code %d: %s", code[0], diag)
+	}
+	return fmt.Errorf("the server refused StartTLS with result code %d", code[0])
+}
+
+// readBER reads a BER element from the reader, up to maxLDAPResponse, and
+// returns its tag and its contents
+func readBER(r io.ByteReader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(n)
+	// The long form has the number of bytes of the length, which servers
+	// like Active Directory always use, even for short lengths
+	if n&0x80 != 0 {
+		if n&0x7f == 0 || n&0x7f > 4 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < int(n&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxLDAPResponse {
+		return 0, nil, errors.New("the response to StartTLS is too large")
+	}
+
+	contents := make([]byte, length)
+	for i := range contents {
+		if contents[i], err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+	return tag, contents, nil
+}
+
+// parseBER parses the BER element at the start of b, and returns its tag, its
+// contents and the rest of b
+func parseBER(b []byte) (byte, []byte, []byte, error) {
+	tag, contents, err := readBER(bytes.NewReader(b))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	header := 2
+	if b[1]&0x80 != 0 {
+		header += int(b[1] & 0x7f)
+	}
+	return tag, contents, b[header+len(contents):], nil
+}
+
+// The namespaces of XMPP streams and of their STARTTLS negotiation
+const (
+	xmppStreamsNS = "http://etherx.jabber.org/streams"
+	xmppTLSNS     = "urn:ietf:params:xml:ns:xmpp-tls"
+)
+
+// startTLSXMPP upgrades an XMPP client connection with STARTTLS, RFC 6120,
+// once the server has offered it in the features of the stream. The stream
+// is opened to the host of the target, which is the domain of the service.
+func startTLSXMPP(c *textproto.Conn, host string) error {
+	var header bytes.Buffer
+	header.WriteString("<?xml version='1.0'?><stream:stream to='")
+	xml.EscapeText(&header, []byte(host))
+	header.WriteString("' version='1.0' xmlns='jabber:client' xmlns:stream='" + xmppStreamsNS + "'>")
+	if _, err := c.W.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if err := c.W.Flush(); err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(c.R)
+	start, err := nextXMPPElement(d)
+	if err != nil {
+		return err
+	}
+	if start.Name.Space != xmppStreamsNS || start.Name.Local != "stream" {
+		return errors.New("unexpected start of the stream: " + start.Name.Local)
+	}
+
+	start, err = nextXMPPElement(d)
+	if err != nil {
+		return err
+	}
+	if start.Name.Space != xmppStreamsNS || start.Name.Local != "features" {
+		return errors.New("unexpected element instead of the stream features: " + start.Name.Local)
+	}
+	var features struct {
+		StartTLS *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	}
+	if err := d.DecodeElement(&features, &start); err != nil {
+		return err
+	}
+	if features.StartTLS == nil {
+		return errors.New("the server doesn't support STARTTLS")
+	}
+
+	if _, err := c.W.WriteString("<starttls xmlns='" + xmppTLSNS + "'/>"); err != nil {
+		return err
+	}
+	if err := c.W.Flush(); err != nil {
+		return err
+	}
+
+	start, err = nextXMPPElement(d)
+	if err != nil {
+		return err
+	}
+	if start.Name.Space == xmppTLSNS && start.Name.Local == "proceed" {
+		return nil
+	}
+	return errors.New("the server refused STARTTLS with " + start.Name.Local)
+}
+
+// nextXMPPElement returns the next element that the server starts, or the
+// error of the stream if it sends one instead
+func nextXMPPElement(d *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Space == xmppStreamsNS && start.Name.Local == "error" {
+			var streamErr struct {
+				Conditions []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			}
+			d.DecodeElement(&streamErr, &start)
+			if len(streamErr.Conditions) > 0 {
+				return start, errors.New("stream error: " + streamErr.Conditions[0].XMLName.Local)
+			}
+			return start, errors.New("stream error")
+		}
+		return start, nil
+	}
+}
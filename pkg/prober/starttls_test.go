@@ -0,0 +1,308 @@
+package prober
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startTLSExchange is a command that a test server expects from the client,
+// and the reply that it sends. The greeting is sent without a command.
+type startTLSExchange struct {
+	command, reply string
+}
+
+// Test that targets of each of the protocols are upgraded to TLS, and that
+// the chain presented after the upgrade is verified
+func TestProbeStartTLS(t *testing.T) {
+	for proto, script := range map[string][]startTLSExchange{
+		"smtp": {
+			{"", "220-mail.example.com ESMTP\r\n220 ready\r\n"},
+			{"EHLO localhost", "250-mail.example.com\r\n250-PIPELINING\r\n250 STARTTLS\r\n"},
+			{"STARTTLS", "220 2.0.0 Ready to start TLS\r\n"},
+		},
+		"submission": {
+			{"", "220 mail.example.com ESMTP\r\n"},
+			{"EHLO localhost", "250-mail.example.com\r\n250-starttls\r\n250 AUTH PLAIN\r\n"},
+			{"STARTTLS", "220 Go ahead\r\n"},
+		},
+		"imap": {
+			{"", "* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n"},
+			{"a1 STARTTLS", "* BYE not really\r\na1 OK Begin TLS negotiation now\r\n"},
+		},
+		"pop3": {
+			{"", "+OK POP3 ready\r\n"},
+			{"STLS", "+OK Begin TLS negotiation\r\n"},
+		},
+		"ftp": {
+			{"", "220-Welcome\r\n220 FTP ready\r\n"},
+			{"AUTH TLS", "234 AUTH TLS OK\r\n"},
+		},
+	} {
+		server, roots := testServer()
+		l := testStartTLSServer(t, server.TLS, script)
+
+		result, err := Probe(context.Background(), proto+"://"+l.Addr().String(), Options{TLSConfig: &tls.Config{RootCAs: roots}})
+		if err != nil {
+			t.Errorf("%s: %s", proto, err)
+		} else if result.Protocol != proto || len(result.State.VerifiedChains) == 0 {
+			t.Errorf("%s: expected a verified chain over %s, got %+v", proto, proto, result)
+		}
+		if result != nil && result.ServerHello == nil {
+			t.Errorf("%s: expected the ServerHello after the upgrade", proto)
+		}
+
+		l.Close()
+		server.Close()
+	}
+}
+
+// Test that a server that doesn't offer STARTTLS, or refuses it, fails the
+// probe before the handshake
+func TestProbeStartTLSRefused(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	for proto, script := range map[string][]startTLSExchange{
+		"smtp": {
+			{"", "220 mail.example.com ESMTP\r\n"},
+			{"EHLO localhost", "250-mail.example.com\r\n250 PIPELINING\r\n"},
+		},
+		"imap": {
+			{"", "* OK ready\r\n"},
+			{"a1 STARTTLS", "a1 BAD unknown command\r\n"},
+		},
+		"pop3": {
+			{"", "+OK POP3 ready\r\n"},
+			{"STLS", "-ERR not supported\r\n"},
+		},
+		"ftp": {
+			{"", "220 FTP ready\r\n"},
+			{"AUTH TLS", "502 not implemented\r\n"},
+		},
+	} {
+		l := testStartTLSServer(t, server.TLS, script)
+		_, err := Probe(context.Background(), proto+"://"+l.Addr().String(), Options{TLSConfig: &tls.Config{RootCAs: roots}})
+		if err == nil || !strings.Contains(err.Error(), "upgrading the "+proto+" connection") {
+			t.Errorf("%s: expected the upgrade to fail, got %v", proto, err)
+		}
+		l.Close()
+	}
+}
+
+// Test that PostgreSQL and MySQL connections are upgraded with their
+// SSLRequests, and that servers without TLS fail the probe before the
+// handshake
+func TestProbeStartTLSDatabases(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	postgres := func(reply byte) func(net.Conn) bool {
+		return func(conn net.Conn) bool {
+			var req [8]byte
+			if _, err := io.ReadFull(conn, req[:]); err != nil || binary.BigEndian.Uint32(req[4:]) != postgresSSLRequest {
+				return false
+			}
+			conn.Write([]byte{reply})
+			return reply == 'S'
+		}
+	}
+	mysql := func(handshake []byte) func(net.Conn) bool {
+		return func(conn net.Conn) bool {
+			conn.Write(append([]byte{byte(len(handshake)), 0, 0, 0}, handshake...))
+			var req [36]byte
+			if _, err := io.ReadFull(conn, req[:]); err != nil || req[0] != 32 || req[3] != 1 {
+				return false
+			}
+			return binary.LittleEndian.Uint32(req[4:])&mysqlClientSSL != 0
+		}
+	}
+	mysqlHandshake := func(capabilities uint16) []byte {
+		b := append([]byte{10}, "8.0.36\x00"...)
+		b = append(b, 1, 0, 0, 0)
+		b = append(b, "abcdefgh\x00"...)
+		b = binary.LittleEndian.AppendUint16(b, capabilities)
+		return append(b, 45, 2, 0, 0xff, 0xff)
+	}
+
+	for _, test := range []struct {
+		proto   string
+		upgrade func(net.Conn) bool
+		err     string
+	}{
+		{proto: "postgres", upgrade: postgres('S')},
+		{proto: "postgres", upgrade: postgres('N'), err: "doesn't support TLS"},
+		{proto: "mysql", upgrade: mysql(mysqlHandshake(0xffff))},
+		{proto: "mysql", upgrade: mysql(mysqlHandshake(0xffff &^ mysqlClientSSL)), err: "doesn't support TLS"},
+		{proto: "mysql", upgrade: mysql(append([]byte{0xff, 0x69, 0x04}, "#HY000Host is blocked"...)), err: "Host is blocked"},
+	} {
+		l := testUpgradeServer(t, server.TLS, test.upgrade)
+		result, err := Probe(context.Background(), test.proto+"://"+l.Addr().String(), Options{TLSConfig: &tls.Config{RootCAs: roots}})
+		l.Close()
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error with %q, got %v", test.proto, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.proto, err)
+		} else if result.Protocol != test.proto || len(result.State.VerifiedChains) == 0 {
+			t.Errorf("%s: expected a verified chain, got %+v", test.proto, result)
+		}
+	}
+}
+
+// Test that LDAP connections are upgraded with the StartTLS extended
+// operation and XMPP streams with STARTTLS, and that refusals fail the probe
+// before the handshake
+func TestProbeStartTLSLDAPAndXMPP(t *testing.T) {
+	server, roots := testServer()
+	defer server.Close()
+
+	ldap := func(reply []byte, success bool) func(net.Conn) bool {
+		return func(conn net.Conn) bool {
+			req := make([]byte, len(ldapStartTLSRequest))
+			if _, err := io.ReadFull(conn, req); err != nil || string(req) != string(ldapStartTLSRequest) {
+				return false
+			}
+			conn.Write(reply)
+			return success
+		}
+	}
+	// A successful response with the long form lengths of Active Directory,
+	// and a refusal with protocolError
+	ldapSuccess := []byte{0x30, 0x84, 0, 0, 0, 0x10, 0x02, 0x01, 0x01, 0x78, 0x84, 0, 0, 0, 0x07, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00}
+	ldapRefused := append([]byte{0x30, 0x17, 0x02, 0x01, 0x01, 0x78, 0x12, 0x0a, 0x01, 0x02, 0x04, 0x00, 0x04, 0x0b}, "unsupported"...)
+
+	xmpp := func(features string, proceed bool) func(net.Conn) bool {
+		return func(conn net.Conn) bool {
+			r := bufio.NewReader(conn)
+			r.ReadString('>')
+			header, err := r.ReadString('>')
+			if err != nil || !strings.Contains(header, "to='127.0.0.1'") {
+				return false
+			}
+			conn.Write([]byte("<?xml version='1.0'?><stream:stream from='127.0.0.1' id='1' version='1.0' xmlns='jabber:client' xmlns:stream='" + xmppStreamsNS + "'>" + features))
+			if line, err := r.ReadString('>'); err != nil || !strings.Contains(line, "starttls") {
+				return false
+			}
+			if !proceed {
+				conn.Write([]byte("<failure xmlns='" + xmppTLSNS + "'/></stream:stream>"))
+				return false
+			}
+			conn.Write([]byte("<proceed xmlns='" + xmppTLSNS + "'/>"))
+			return true
+		}
+	}
+	starttls := "<stream:features><starttls xmlns='" + xmppTLSNS + "'><required/></starttls></stream:features>"
+
+	for _, test := range []struct {
+		proto   string
+		upgrade func(net.Conn) bool
+		err     string
+	}{
+		{proto: "ldap", upgrade: ldap(ldapSuccess, true)},
+		{proto: "ldap", upgrade: ldap(ldapRefused, false), err: "result code 2: unsupported"},
+		{proto: "xmpp", upgrade: xmpp(starttls, true)},
+		{proto: "xmpp", upgrade: xmpp(starttls, false), err: "refused STARTTLS with failure"},
+		{proto: "xmpp", upgrade: xmpp("<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/></stream:features>", true), err: "doesn't support STARTTLS"},
+		{proto: "xmpp", upgrade: xmpp("<stream:error><host-unknown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>", true), err: "stream error: host-unknown"},
+	} {
+		l := testUpgradeServer(t, server.TLS, test.upgrade)
+		result, err := Probe(context.Background(), test.proto+"://"+l.Addr().String(), Options{TLSConfig: &tls.Config{RootCAs: roots}})
+		l.Close()
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error with %q, got %v", test.proto, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.proto, err)
+		} else if result.Protocol != test.proto || len(result.State.VerifiedChains) == 0 {
+			t.Errorf("%s: expected a verified chain, got %+v", test.proto, result)
+		}
+	}
+}
+
+// Test that a prober that's registered for one of the schemes takes the place
+// of STARTTLS, so that external probers configured for them keep working
+func TestProbeStartTLSRegistered(t *testing.T) {
+	if isStartTLS("test-ldaps") || !isStartTLS("pop3") {
+		t.Fatalf("expected only pop3 to be probed with STARTTLS")
+	}
+
+	registryMtx.Lock()
+	registry["ftp"] = ProberFunc(func(ctx context.Context, target string, config *tls.Config) (*tls.ConnectionState, error) {
+		return nil, nil
+	})
+	registryMtx.Unlock()
+	defer func() {
+		registryMtx.Lock()
+		delete(registry, "ftp")
+		registryMtx.Unlock()
+	}()
+
+	if isStartTLS("ftp") {
+		t.Errorf("expected the registered ftp prober to be used")
+	}
+}
+
+// testStartTLSServer returns a server that follows the script for each
+// connection, and then performs the TLS handshake with the config
+func testStartTLSServer(t *testing.T, config *tls.Config, script []startTLSExchange) net.Listener {
+	return testUpgradeServer(t, config, func(conn net.Conn) bool {
+		r := bufio.NewReader(conn)
+		for _, e := range script {
+			if e.command != "" {
+				line, err := r.ReadString('\n')
+				if err != nil || strings.TrimRight(line, "\r\n") != e.command {
+					return false
+				}
+			}
+			conn.Write([]byte(e.reply))
+		}
+		return true
+	})
+}
+
+// testUpgradeServer returns a server that upgrades each connection, and then
+// performs the TLS handshake with the config if the upgrade succeeded
+func testUpgradeServer(t *testing.T, config *tls.Config, upgrade func(conn net.Conn) bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				if !upgrade(conn) {
+					return
+				}
+
+				tlsConn := tls.Server(conn, config)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				tlsConn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	return l
+}
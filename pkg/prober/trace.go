@@ -0,0 +1,93 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+)
+
+// Tracer records the phases of a probe: resolve, dial, handshake and verify
+type Tracer interface {
+	// StartPhase begins a span for the phase, as a child of the span in ctx,
+	// and returns a function that ends it
+	StartPhase(ctx context.Context, phase string, attributes map[string]string) (end func(err error))
+}
+
+// phaseTrace tracks the phases of a single probe that are in progress. All of
+// its methods are safe to call without a Tracer.
+type phaseTrace struct {
+	ctx    context.Context
+	target string
+	tracer Tracer
+
+	mtx  sync.Mutex
+	ends map[string]func(error)
+}
+
+func newPhaseTrace(ctx context.Context, target string, tracer Tracer) *phaseTrace {
+	return &phaseTrace{
+		ctx:    ctx,
+		target: target,
+		tracer: tracer,
+		ends:   map[string]func(error){},
+	}
+}
+
+// start begins a span for the named phase. The address distinguishes
+// phases that may run concurrently, like dials to several addresses.
+func (p *phaseTrace) start(phase, address string) {
+	if p.tracer == nil {
+		return
+	}
+
+	attributes := map[string]string{"target": p.target}
+	if address != "" {
+		attributes["address"] = address
+	}
+	end := p.tracer.StartPhase(p.ctx, phase, attributes)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.ends[phase+address] = end
+}
+
+// end completes the span for the named phase
+func (p *phaseTrace) end(phase, address string, err error) {
+	if p.tracer == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	end := p.ends[phase+address]
+	delete(p.ends, phase+address)
+	p.mtx.Unlock()
+
+	if end != nil {
+		end(err)
+	}
+}
+
+// clientTrace returns hooks that trace the phases of a HTTP request
+func (p *phaseTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			p.start("resolve", "")
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			p.end("resolve", "", info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			p.start("dial", addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			p.end("dial", addr, err)
+		},
+		TLSHandshakeStart: func() {
+			p.start("handshake", "")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			p.end("handshake", "", err)
+		},
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultWorkers is how many of the items of a batch prober, like the files
+// that the pattern of a file target matches, are read at the same time when
+// the module doesn't say
+const defaultWorkers = 10
+
+// forEachItem calls fn for each of the n items that a batch prober expanded
+// its target into, with at most workers of them at the same time, so that
+// thousands of items don't start thousands of goroutines. The context of
+// each call is done after itemTimeout, if it's set, so that one slow item
+// can't hold up the others.
+func forEachItem(ctx context.Context, n, workers int, itemTimeout time.Duration, fn func(ctx context.Context, i int)) {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if workers > n {
+		workers = n
+	}
+
+	items := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				itemCtx, cancel := ctx, context.CancelFunc(func() {})
+				if itemTimeout > 0 {
+					itemCtx, cancel = context.WithTimeout(ctx, itemTimeout)
+				}
+				fn(itemCtx, i)
+				cancel()
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		items <- i
+	}
+	close(items)
+	wg.Wait()
+}
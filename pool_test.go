@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that each item is called once, with no more than the workers at the
+// same time, and that the context of each is done after the item timeout
+func TestForEachItem(t *testing.T) {
+	var mtx sync.Mutex
+	running, most := 0, 0
+	called := make([]int, 50)
+
+	forEachItem(context.Background(), len(called), 4, 0, func(ctx context.Context, i int) {
+		mtx.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		called[i]++
+		mtx.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+	})
+
+	if most > 4 {
+		t.Errorf("expected at most 4 items at the same time, got %d", most)
+	}
+	for i, n := range called {
+		if n != 1 {
+			t.Errorf("expected item %d to be called once, got %d", i, n)
+		}
+	}
+
+	var timedOut bool
+	forEachItem(context.Background(), 1, 0, time.Millisecond, func(ctx context.Context, i int) {
+		select {
+		case <-ctx.Done():
+			timedOut = true
+		case <-time.After(time.Second):
+		}
+	})
+	if !timedOut {
+		t.Errorf("expected the context of the item to be done after its timeout")
+	}
+}
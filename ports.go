@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/metrics"
+)
+
+// portTarget is the target for one of the ports of a target that has several
+type portTarget struct {
+	port   string
+	target string
+}
+
+// portTargets returns the targets for each of the ports of a target with a
+// list of them, like host:443,8443,9443 or https://host:443,8443/path, or for
+// each of the module's ports when the target doesn't have a port of its own.
+// It returns nil for a target that's probed as it is.
+func portTargets(target string, ports []int) ([]portTarget, error) {
+	var scheme, rest string
+	if i := strings.Index(target, "://"); i >= 0 {
+		scheme, rest = target[:i+3], target[i+3:]
+	} else {
+		rest = target
+	}
+	hostport, path := rest, ""
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		hostport, path = rest[:i], rest[i:]
+	}
+
+	// The colons of an IPv6 address are inside the brackets
+	host, list := hostport, ""
+	if i := strings.LastIndex(hostport, ":"); i >= 0 && i > strings.LastIndex(hostport, "]") {
+		host, list = hostport[:i], hostport[i+1:]
+	}
+
+	var names []string
+	switch {
+	case strings.Contains(list, ","):
+		names = strings.Split(list, ",")
+	case list == "" && len(ports) > 0:
+		for _, p := range ports {
+			names = append(names, strconv.Itoa(p))
+		}
+	default:
+		return nil, nil
+	}
+
+	var targets []portTarget
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if p, err := strconv.Atoi(name); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q in %s", name, target)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("port %s is listed more than once in %s", name, target)
+		}
+		seen[name] = true
+		targets = append(targets, portTarget{port: name, target: scheme + host + ":" + name + path})
+	}
+
+	return targets, nil
+}
+
+// splitPorts returns the targets for each of the ports of the exporter's
+// target, or nil when it's probed as it is. Only the probers that make a
+// TLS handshake with the target probe several ports.
+func (e *Exporter) splitPorts() ([]portTarget, error) {
+	switch {
+	case e.ocspCerts != nil:
+		return nil, nil
+	case e.proberName == sshProber, e.proberName == spiffeProber, e.proberName == fileProber,
+		e.proberName == kubernetesProber, e.proberName == trustStoreProber:
+		return nil, nil
+	}
+	return portTargets(e.target, e.ports)
+}
+
+// forPort returns a copy of the exporter that probes one of the ports of its
+// target
+func (e *Exporter) forPort(t portTarget) *Exporter {
+	exporter := *e
+	exporter.target = t.target
+	if e.phases != nil {
+		exporter.phases = &phaseObserver{owner: e.phases.owner, target: t.target, durations: e.phases.durations}
+	}
+	return &exporter
+}
+
+// collectPorts probes each of the ports of the target at the same time, and
+// sends their metrics with a port label
+func (e *Exporter) collectPorts(ch chan<- prometheus.Metric, targets []portTarget) {
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t portTarget) {
+			defer wg.Done()
+			metrics.WithLabel(ch, "port", t.port, e.forPort(t).collectTLS)
+		}(t)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test that the ports of a list, or of the module, each get a target of their
+// own, and that targets with a single port are left as they are
+func TestPortTargets(t *testing.T) {
+	for target, want := range map[string][]portTarget{
+		"example.com:443,8443": {{"443", "example.com:443"}, {"8443", "example.com:8443"}},
+		"https://example.com:443,8443/health?full=1": {
+			{"443", "https://example.com:443/health?full=1"},
+			{"8443", "https://example.com:8443/health?full=1"},
+		},
+		"[2001:db8::1]:443,9443":   {{"443", "[2001:db8::1]:443"}, {"9443", "[2001:db8::1]:9443"}},
+		"example.com":              {{"8443", "example.com:8443"}, {"9443", "example.com:9443"}},
+		"ldaps://dc1":              {{"8443", "ldaps://dc1:8443"}, {"9443", "ldaps://dc1:9443"}},
+		"example.com:443":          nil,
+		"https://example.com:443/": nil,
+		"[2001:db8::1]:443":        nil,
+	} {
+		targets, err := portTargets(target, []int{8443, 9443})
+		if err != nil {
+			t.Errorf("%s: %s", target, err)
+			continue
+		}
+		if !reflect.DeepEqual(targets, want) {
+			t.Errorf("%s: expected %v, got %v", target, want, targets)
+		}
+	}
+
+	if targets, _ := portTargets("example.com", nil); targets != nil {
+		t.Errorf("expected no targets without a list or the module's ports, got %v", targets)
+	}
+	for _, target := range []string{"example.com:443,", "example.com:443,https", "example.com:443,70000", "example.com:443,443"} {
+		if _, err := portTargets(target, nil); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
+
+// Test that the bare ports after a comma stay with the target before them,
+// rather than being targets of their own
+func TestRequestTargetsPorts(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/probe?target=appliance:443,8443,9443,example.com:443&target=8443", nil)
+	want := []string{"appliance:443,8443,9443", "example.com:443", "8443"}
+	if targets := requestTargets(req); !reflect.DeepEqual(targets, want) {
+		t.Errorf("expected %v, got %v", want, targets)
+	}
+}
+
+// Test that each of the ports of a target is probed, with a port label on its
+// metrics
+func TestProbeHandlerPorts(t *testing.T) {
+	var ports []string
+	for i := 0; i < 2; i++ {
+		server, err := server()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		u, _ := url.Parse(server.URL)
+		ports = append(ports, u.Port())
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closed, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	rr, err := probe("localhost:" + strings.Join(append(ports, closed), ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`ssl_tls_connect_success{port="` + ports[0] + `"} 1`,
+		`ssl_tls_connect_success{port="` + ports[1] + `"} 1`,
+		`ssl_tls_connect_success{port="` + closed + `"} 0`,
+		`ssl_cert_not_after{issuer_cn=`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected `%s`", want)
+		}
+	}
+	if strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1") {
+		t.Errorf("expected no metrics without a port label")
+	}
+}
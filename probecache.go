@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// errProbeLimit is returned when a probe request gave up waiting for one of
+// the --probe.max-concurrency slots
+var errProbeLimit = errors.New("too many probes are running, try again later")
+
+// probeSlots, when it's set, holds a slot for each request to the probe
+// endpoints that's probing, and for each target of a batch request or of a
+// request with several targets or ports, so that at most its capacity of
+// them probe at the same time
+var probeSlots chan struct{}
+
+// probeResults, when it's set, caches the results of /probe requests
+var probeResults *resultCache
+
+// acquireProbeSlot waits for a slot to probe in, until the context is done.
+// The returned function releases the slot.
+func acquireProbeSlot(ctx context.Context) (func(), error) {
+	if probeSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case probeSlots <- struct{}{}:
+		return func() { <-probeSlots }, nil
+	case <-ctx.Done():
+		return nil, errProbeLimit
+	}
+}
+
+// slotCollector collects the metrics of the collector in one of the probe
+// slots. When it can't get one before the context is done, it collects
+// nothing and sets limited instead.
+type slotCollector struct {
+	ctx       context.Context
+	collector prometheus.Collector
+	limited   *int32
+}
+
+// Describe implements prometheus.Collector
+func (c *slotCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *slotCollector) Collect(ch chan<- prometheus.Metric) {
+	release, err := acquireProbeSlot(c.ctx)
+	if err != nil {
+		atomic.StoreInt32(c.limited, 1)
+		return
+	}
+	defer release()
+	c.collector.Collect(ch)
+}
+
+// resultCache keeps the metrics gathered for a probe request for the TTL,
+// by the query of the request, so that several Prometheus servers scraping
+// the same target within the TTL share a single handshake. A request that
+// arrives while the same probe is running waits for its result, rather than
+// starting another one.
+type resultCache struct {
+	ttl time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]*resultEntry
+}
+
+type resultEntry struct {
+	// done is closed once mfs and err are set
+	done    chan struct{}
+	mfs     []*dto.MetricFamily
+	err     error
+	expires time.Time
+	// abandoned is whether gather failed after the request that called it
+	// went away, which the requests that waited for it shouldn't fail with
+	abandoned bool
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:     ttl,
+		entries: map[string]*resultEntry{},
+	}
+}
+
+// gather returns the metrics for the key from the cache, or from gather,
+// which is only called by one request for the key at a time. The requests
+// that wait for it give up when their context is done, and gather again when
+// it failed because the context of the request that called it was. Errors
+// aren't cached. A nil cache always calls gather.
+func (c *resultCache) gather(ctx context.Context, key string, gather func() ([]*dto.MetricFamily, error)) ([]*dto.MetricFamily, error) {
+	if c == nil {
+		return gather()
+	}
+
+	now := time.Now()
+	c.mtx.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		select {
+		case <-e.done:
+			if now.Before(e.expires) {
+				c.mtx.Unlock()
+				return e.mfs, e.err
+			}
+		default:
+			c.mtx.Unlock()
+			select {
+			case <-e.done:
+				if e.abandoned {
+					return c.gather(ctx, key, gather)
+				}
+				return e.mfs, e.err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	for k, e := range c.entries {
+		select {
+		case <-e.done:
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		default:
+		}
+	}
+	e = &resultEntry{done: make(chan struct{})}
+	c.entries[key] = e
+	c.mtx.Unlock()
+
+	mfs, err := gather()
+
+	c.mtx.Lock()
+	e.mfs, e.err = mfs, err
+	e.abandoned = err != nil && ctx.Err() != nil
+	if err == nil {
+		e.expires = time.Now().Add(c.ttl)
+	}
+	close(e.done)
+	c.mtx.Unlock()
+
+	return mfs, err
+}
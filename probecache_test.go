@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Test that the requests for a key share the result of one gather, while
+// it's running and for the TTL after it
+func TestResultCache(t *testing.T) {
+	c := newResultCache(time.Hour)
+
+	var calls int32
+	release := make(chan struct{})
+	gather := func() ([]*dto.MetricFamily, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []*dto.MetricFamily{{}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if mfs, err := c.gather(context.Background(), "target=a", gather); err != nil || len(mfs) != 1 {
+				t.Errorf("expected the shared result, got %v, %v", mfs, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	c.gather(context.Background(), "target=a", gather)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected one gather for the key, got %d", n)
+	}
+
+	c.gather(context.Background(), "target=b", gather)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected another gather for another key, got %d", n)
+	}
+
+	c.ttl = 0
+	c.gather(context.Background(), "target=c", gather)
+	c.gather(context.Background(), "target=c", gather)
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("expected expired results to be gathered again, got %d gathers", n)
+	}
+}
+
+// Test that the requests that wait for a gather whose request went away
+// gather again, rather than failing with it
+func TestResultCacheAbandoned(t *testing.T) {
+	c := newResultCache(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go c.gather(ctx, "target=a", func() ([]*dto.MetricFamily, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mfs, err := c.gather(context.Background(), "target=a", func() ([]*dto.MetricFamily, error) {
+			return []*dto.MetricFamily{{}}, nil
+		})
+		if err != nil || len(mfs) != 1 {
+			t.Errorf("expected the waiting request to gather again, got %v, %v", mfs, err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+}
+
+// Test that the probe handler reuses the result of a probe for the same
+// query and timeout, and that it gives up on requests that can't get a slot
+// to probe in
+func TestProbeHandlerCacheAndLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	probeResults = newResultCache(time.Hour)
+	probeSlots = make(chan struct{}, 1)
+	defer func() {
+		probeResults, probeSlots = nil, nil
+	}()
+
+	modules := testModules(&tls.Config{})
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/probe?target="+ln.Addr().String(), nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rr.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("expected one connection for the repeated requests, got %d", n)
+	}
+
+	req, _ := http.NewRequest("GET", "/probe?target="+ln.Addr().String(), nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "5")
+	probeHandler(httptest.NewRecorder(), req, modules)
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Errorf("expected another connection for a request with another timeout, got %d", n)
+	}
+
+	// Hold the only slot, so that a request for another query has to wait
+	// until its context is done
+	probeSlots <- struct{}{}
+	defer func() { <-probeSlots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequest("GET", "/probe?target="+ln.Addr().String()+"&servername=other", nil)
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req.WithContext(ctx), modules)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a free slot, got %d", rr.Code)
+	}
+}
+
+// Test that each of the ports of a target takes one of the probe slots
+func TestProbeHandlerLimitPorts(t *testing.T) {
+	accepted := make(chan struct{}, 2)
+	var ports []string
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				accepted <- struct{}{}
+			}
+		}()
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		ports = append(ports, port)
+	}
+
+	probeResults = newResultCache(time.Hour)
+	probeSlots = make(chan struct{}, 1)
+	defer func() {
+		probeResults, probeSlots = nil, nil
+	}()
+
+	// The handshake with the port that got the slot hangs until the
+	// timeout, as cached probes outlive their request, while the other
+	// port waits for the slot until the request goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-accepted
+		cancel()
+	}()
+	req, _ := http.NewRequest("GET", "/probe?target=127.0.0.1:"+strings.Join(ports, ","), nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "1")
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req.WithContext(ctx), testModules(&tls.Config{}))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for the port without a free slot, got %d", rr.Code)
+	}
+}
+
+// Test that the other probing handlers take probe slots too, one for each
+// target of a batch request
+func TestProbeSlotsOtherHandlers(t *testing.T) {
+	probeSlots = make(chan struct{}, 1)
+	defer func() { probeSlots = nil }()
+	probeSlots <- struct{}{}
+	defer func() { <-probeSlots }()
+
+	// The requests give up at once, as the only slot is taken
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	modules := testModules(&tls.Config{})
+	request := func(method, path, body string) *http.Request {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		return req.WithContext(ctx)
+	}
+
+	for path, handler := range map[string]func(http.ResponseWriter, *http.Request, map[string]*module){
+		"/api/v1/probe": apiProbeHandler,
+		"/chain":        chainHandler,
+		"/report":       reportHandler,
+	} {
+		rr := httptest.NewRecorder()
+		handler(rr, request("GET", path+"?target=127.0.0.1:1", ""), modules)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503 without a free slot, got %d", path, rr.Code)
+		}
+	}
+
+	body := `{"targets": [{"target": "127.0.0.1:1"}, {"target": "127.0.0.1:2"}]}`
+	rr := httptest.NewRecorder()
+	batchProbeHandler(rr, request("POST", "/probe", body), modules)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for a batch without free slots, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	apiBatchProbeHandler(rr, request("POST", "/api/v1/probes", body), modules)
+	var results []*apiProbeResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%s: %s", err, rr.Body.String())
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for _, result := range results {
+		if result.Success || result.Error != errProbeLimit.Error() {
+			t.Errorf("expected %s to fail without a free slot, got %+v", result.Target, result)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var pushgatewayFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: "exporter",
+	Name:      "pushgateway_push_failures_total",
+	Help:      "Number of times the results of a background probe couldn't be pushed to the Pushgateway",
+})
+
+func init() {
+	prometheus.MustRegister(pushgatewayFailures)
+}
+
+var pushgatewayClient = &http.Client{Timeout: 10 * time.Second}
+
+// pushgatewayPublisher publishes the results of background probes to a
+// Pushgateway
+type pushgatewayPublisher struct {
+	config *PushgatewayConfig
+}
+
+// Publish pushes the results to the Pushgateway
+func (p *pushgatewayPublisher) Publish(target string, mfs []*dto.MetricFamily, ts time.Time) error {
+	if err := pushResults(p.config, target, mfs); err != nil {
+		pushgatewayFailures.Inc()
+		return fmt.Errorf("error pushing to the Pushgateway: %s", err)
+	}
+	return nil
+}
+
+// pushResults pushes the results of a probe to the Pushgateway. Each target
+// has a group of its own, identified by the target label, so that its
+// results replace those of its previous probe without affecting others.
+func pushResults(c *PushgatewayConfig, target string, mfs []*dto.MetricFamily) error {
+	grouping := map[string]string{"target": target}
+	for name, value := range c.Grouping {
+		grouping[name] = value
+	}
+
+	buf := &bytes.Buffer{}
+	enc := expfmt.NewEncoder(buf, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("PUT", pushURL(c.URL, c.Job, grouping), buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+
+	resp, err := pushgatewayClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d while pushing to %s: %s", resp.StatusCode, c.URL, body)
+	}
+
+	return nil
+}
+
+// pushURL returns the URL for a group on the Pushgateway. The label values
+// are base64 encoded because targets often contain a '/'.
+func pushURL(base, job string, grouping map[string]string) string {
+	var names []string
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	components := []string{"job@base64", encodeGroupingValue(job)}
+	for _, name := range names {
+		components = append(components, name+"@base64", encodeGroupingValue(grouping[name]))
+	}
+
+	return strings.TrimSuffix(base, "/") + "/metrics/" + strings.Join(components, "/")
+}
+
+func encodeGroupingValue(value string) string {
+	if value == "" {
+		// An empty value has to be represented by a single '='
+		return "="
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Test that the results of a background probe are pushed to the Pushgateway
+func TestSchedulerPushgateway(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var (
+		path    string
+		method  string
+		metrics = map[string]*dto.MetricFamily{}
+	)
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.EscapedPath()
+
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err != nil {
+				break
+			}
+			metrics[mf.GetName()] = mf
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer pushgateway.Close()
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), []publisher{&pushgatewayPublisher{config: &PushgatewayConfig{
+		URL:      pushgateway.URL,
+		Job:      "ssl",
+		Grouping: map[string]string{"site": "dmz"},
+	}}})
+	s.probe(Target{
+		Target:   "https://localhost:443/",
+		Module:   defaultModule,
+		Interval: time.Minute,
+	})
+
+	if method != "PUT" {
+		t.Errorf("expected a PUT request, got %s", method)
+	}
+
+	expectedPath := "/metrics/job@base64/c3Ns/site@base64/ZG16/target@base64/aHR0cHM6Ly9sb2NhbGhvc3Q6NDQzLw"
+	if path != expectedPath {
+		t.Errorf("expected path %s, got %s", expectedPath, path)
+	}
+
+	mf, ok := metrics["ssl_tls_connect_success"]
+	if !ok {
+		t.Fatalf("expected ssl_tls_connect_success to be pushed")
+	}
+	if len(mf.GetMetric()[0].GetLabel()) != 0 {
+		t.Errorf("expected the pushed metrics not to have a target label")
+	}
+}
+
+// Test that an error is returned when the Pushgateway rejects the push
+func TestPushResultsError(t *testing.T) {
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer pushgateway.Close()
+
+	err := pushResults(&PushgatewayConfig{URL: pushgateway.URL, Job: "ssl"}, "example.com:443", nil)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+var (
+	tlsReloadSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "tls_config_last_reload_successful",
+		Help:      "Whether the last reload of the CA bundle and client certificate of each TLS configuration was successful",
+	}, []string{"tls_config"})
+	tlsReloadSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "tls_config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful reload of the CA bundle and client certificate of each TLS configuration",
+	}, []string{"tls_config"})
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last reload of the configuration was successful",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful reload of the configuration",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(tlsReloadSuccess)
+	prometheus.MustRegister(tlsReloadSeconds)
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadSeconds)
+}
+
+// tlsConfigLoader builds a tls.Config from the files in a TLSConfig and
+// rebuilds it when they change, so that certificates can be rotated without
+// restarting the exporter
+type tlsConfigLoader struct {
+	// name is where the TLSConfig is from, like modules/default, which
+	// labels the metrics of its reloads
+	name       string
+	insecure   bool
+	serverName string
+	clientAuth bool
+	trustStore TrustStore
+	caFile     string
+	javaFile   string
+	javaPass   KeystorePassword
+	certFile   string
+	keyFile    string
+	pkcs11     *PKCS11Config
+
+	// signer is the key on the PKCS#11 token. It's opened once and kept
+	// across reloads of the certificate.
+	signer crypto.Signer
+
+	mtx      sync.RWMutex
+	config   *tls.Config
+	modTimes map[string]time.Time
+	// secretVersion is the resourceVersion of the secret that the client
+	// certificate was loaded from, when certFile refers to one
+	secretVersion string
+}
+
+func newTLSConfigLoader(name string, c TLSConfig) (*tlsConfigLoader, error) {
+	l := &tlsConfigLoader{
+		name:       name,
+		insecure:   c.InsecureSkipVerify,
+		serverName: c.ServerName,
+		clientAuth: c.CertFile != "",
+		trustStore: c.trustStore(),
+		caFile:     c.CAFile,
+		javaFile:   c.JavaCACerts,
+		javaPass:   c.JavaCACertsPassword,
+		certFile:   c.CertFile,
+		keyFile:    c.KeyFile,
+		pkcs11:     c.PKCS11,
+	}
+
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Config returns the current TLS configuration
+func (l *tlsConfigLoader) Config() *tls.Config {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.config
+}
+
+// deleteMetrics deletes the series of the reload metrics of the loader, once
+// its TLSConfig has been removed from the configuration
+func (l *tlsConfigLoader) deleteMetrics() {
+	tlsReloadSuccess.DeleteLabelValues(l.name)
+	tlsReloadSeconds.DeleteLabelValues(l.name)
+}
+
+// Reload reads the files from disk and replaces the current configuration.
+// The previous configuration is kept if any of the files can't be loaded.
+func (l *tlsConfigLoader) Reload() error {
+	var (
+		certificates []tls.Certificate
+		rootCAs      *x509.CertPool
+	)
+
+	modTimes, err := l.stat()
+	if err != nil {
+		tlsReloadSuccess.WithLabelValues(l.name).Set(0)
+		return err
+	}
+
+	switch l.trustStore {
+	case TrustStoreFile:
+		caCert, err := ioutil.ReadFile(l.caFile)
+		if err != nil {
+			tlsReloadSuccess.WithLabelValues(l.name).Set(0)
+			return err
+		}
+
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caCert) {
+			tlsReloadSuccess.WithLabelValues(l.name).Set(0)
+			return errors.New("no certificates found in " + l.caFile)
+		}
+	case TrustStoreMozilla:
+		rootCAs = mozillaRoots()
+	case TrustStoreJava:
+		if rootCAs, err = javaRoots(l.javaFile, l.javaPass); err != nil {
+			tlsReloadSuccess.WithLabelValues(l.name).Set(0)
+			return err
+		}
+	}
+
+	var secretVersion string
+	if l.clientAuth {
+		var (
+			cert tls.Certificate
+			err  error
+		)
+		if l.fromSecret() {
+			cert, secretVersion, err = secretKeyPair(l.certFile)
+		} else {
+			cert, err = l.loadClientCert()
+		}
+		if err != nil {
+			tlsReloadSuccess.WithLabelValues(l.name).Set(0)
+			return err
+		}
+		certificates = append(certificates, cert)
+	}
+
+	l.mtx.Lock()
+	l.config = &tls.Config{
+		InsecureSkipVerify: l.insecure,
+		ServerName:         l.serverName,
+		Certificates:       certificates,
+		RootCAs:            rootCAs,
+		KeyLogWriter:       keyLogWriter,
+	}
+	l.modTimes = modTimes
+	l.secretVersion = secretVersion
+	l.mtx.Unlock()
+
+	tlsReloadSuccess.WithLabelValues(l.name).Set(1)
+	tlsReloadSeconds.WithLabelValues(l.name).SetToCurrentTime()
+
+	return nil
+}
+
+// fromSecret reports whether the client certificate is loaded from a
+// Kubernetes secret, rather than files
+func (l *tlsConfigLoader) fromSecret() bool {
+	return strings.HasPrefix(l.certFile, kubernetesScheme)
+}
+
+// loadClientCert loads the client certificate, with its key from key_file or
+// the PKCS#11 token
+func (l *tlsConfigLoader) loadClientCert() (tls.Certificate, error) {
+	if l.pkcs11 == nil {
+		return tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	}
+
+	b, err := ioutil.ReadFile(l.certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("no certificates found in " + l.certFile)
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if l.signer == nil {
+		if l.signer, err = newPKCS11Signer(l.pkcs11, cert.Leaf.PublicKey); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	cert.PrivateKey = l.signer
+
+	return cert, nil
+}
+
+// Watch checks the files for changes every interval and reloads the
+// configuration when one of them has been modified, until stop is closed
+func (l *tlsConfigLoader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if !l.changed() {
+			continue
+		}
+
+		log.Infoln("Detected a change to the TLS files, reloading")
+		if err := l.Reload(); err != nil {
+			log.Errorln("Error reloading the TLS files: ", err)
+		}
+	}
+}
+
+// changed reports whether the modification time of any of the files differs
+// from when they were last loaded
+func (l *tlsConfigLoader) changed() bool {
+	modTimes, err := l.stat()
+	if err != nil {
+		// The file may be in the middle of being replaced; try again on the
+		// next tick
+		return false
+	}
+
+	var version string
+	if l.clientAuth && l.fromSecret() {
+		if version, err = secretVersion(l.certFile); err != nil {
+			return false
+		}
+	}
+
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if version != l.secretVersion {
+		return true
+	}
+	for file, modTime := range modTimes {
+		if !modTime.Equal(l.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *tlsConfigLoader) stat() (map[string]time.Time, error) {
+	var files []string
+	switch l.trustStore {
+	case TrustStoreFile:
+		files = append(files, l.caFile)
+	case TrustStoreJava:
+		files = append(files, l.javaFile)
+	}
+	if l.clientAuth && !l.fromSecret() {
+		files = append(files, l.certFile)
+		if l.pkcs11 == nil {
+			files = append(files, l.keyFile)
+		}
+	}
+
+	modTimes := map[string]time.Time{}
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = fi.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+// watch watches the TLS files of the module and its trust stores for
+// changes, until the module is closed
+func (m *module) watch(interval time.Duration) {
+	go m.tls.Watch(interval, m.done)
+	for _, l := range m.stores {
+		go l.Watch(interval, m.done)
+	}
+}
+
+// loaders returns the tlsConfigLoaders of the module and its trust stores
+func (m *module) loaders() []*tlsConfigLoader {
+	loaders := []*tlsConfigLoader{m.tls}
+	for _, l := range m.stores {
+		loaders = append(loaders, l)
+	}
+	return loaders
+}
+
+// close stops watching the files of the module. The probes that are still
+// using it can carry on.
+func (m *module) close() {
+	if m.done != nil {
+		close(m.done)
+	}
+}
+
+// reloadFiles reloads the TLS files of the module and its trust stores
+func (m *module) reloadFiles() error {
+	if err := m.tls.Reload(); err != nil {
+		return fmt.Errorf("failed to reload TLS files: %s", err)
+	}
+	for store, l := range m.stores {
+		if err := l.Reload(); err != nil {
+			return fmt.Errorf("failed to reload trust store %s: %s", store, err)
+		}
+	}
+	return nil
+}
+
+// configReloader holds the current modules and replaces them when the
+// configuration is reloaded, on SIGHUP or a request to /-/reload. Without a
+// configuration file, reloading reloads the TLS files of the default module.
+type configReloader struct {
+	file       string
+	defaultTLS TLSConfig
+	// watchInterval is how often the files of the modules are checked for
+	// changes, or 0 if they aren't
+	watchInterval time.Duration
+	// scheduler, if set, probes the targets of the configuration
+	scheduler *scheduler
+	// state, if set, saves the caches of the modules
+	state *stateFile
+	// targets are the targets of the scheduler, from the configuration and
+	// its target files
+	targets []Target
+	// targetFilesStop stops watching the target files of the current
+	// configuration
+	targetFilesStop chan struct{}
+	// probers are the exec probers that have been registered, which can't
+	// be replaced without a restart
+	probers map[string]ExecProberConfig
+
+	// reloadMtx stops reloads from running at the same time
+	reloadMtx sync.Mutex
+	mtx       sync.RWMutex
+	modules   map[string]*module
+}
+
+func newConfigReloader(file string, defaultTLS TLSConfig, conf *Config, modules map[string]*module) *configReloader {
+	probers := map[string]ExecProberConfig{}
+	for scheme, p := range conf.Probers {
+		probers[scheme] = p
+	}
+	return &configReloader{
+		file:       file,
+		defaultTLS: defaultTLS,
+		probers:    probers,
+		modules:    modules,
+	}
+}
+
+// Modules returns the current modules
+func (c *configReloader) Modules() map[string]*module {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.modules
+}
+
+// Watch starts watching the files of the current modules for changes
+func (c *configReloader) Watch(interval time.Duration) {
+	c.watchInterval = interval
+	for _, m := range c.Modules() {
+		m.watch(interval)
+	}
+}
+
+// Reload reads the configuration file again and replaces the modules and
+// the targets of the scheduler. The modules that are configured the same as
+// before are kept, with their TLS files reloaded. The previous configuration
+// is kept if the new one can't be loaded. The probes in progress carry on
+// with the modules they started with.
+func (c *configReloader) Reload() error {
+	c.reloadMtx.Lock()
+	defer c.reloadMtx.Unlock()
+
+	err := c.reload()
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+
+	return nil
+}
+
+func (c *configReloader) reload() error {
+	previous := c.Modules()
+
+	conf := &Config{}
+	if c.file != "" {
+		var err error
+		if conf, err = loadConfig(c.file); err != nil {
+			return err
+		}
+	}
+
+	targets, err := loadTargets(conf)
+	if err != nil {
+		return err
+	}
+
+	modules, err := reloadModules(conf, c.defaultTLS, previous)
+	if err != nil {
+		return err
+	}
+	for name, m := range modules {
+		if previous[name] != m {
+			continue
+		}
+		if err := m.reloadFiles(); err != nil {
+			return fmt.Errorf("module %s: %s", name, err)
+		}
+	}
+
+	// Probers can't be unregistered, so the new ones are only registered
+	// once nothing else can fail
+	registered := map[string]bool{}
+	for _, scheme := range prober.Registered() {
+		registered[scheme] = true
+	}
+	var added []string
+	for scheme := range conf.Probers {
+		if _, ok := c.probers[scheme]; ok {
+			continue
+		}
+		if registered[scheme] {
+			return fmt.Errorf("a prober is already registered for %s", scheme)
+		}
+		added = append(added, scheme)
+	}
+	for scheme, p := range conf.Probers {
+		if previous, ok := c.probers[scheme]; ok && !reflect.DeepEqual(previous, p) {
+			log.Warnln("The prober for " + scheme + " has changed, restart the exporter for the change to take effect")
+		}
+	}
+	for _, scheme := range added {
+		p := conf.Probers[scheme]
+		if err := prober.Register(scheme, &prober.ExecProber{Command: p.Command, Port: p.DefaultPort}); err != nil {
+			log.Errorln("Error registering the prober for " + scheme + ": " + err.Error())
+			continue
+		}
+		c.probers[scheme] = p
+	}
+
+	c.mtx.Lock()
+	c.modules = modules
+	c.mtx.Unlock()
+
+	loaders := map[string]bool{}
+	for _, m := range modules {
+		for _, l := range m.loaders() {
+			loaders[l.name] = true
+		}
+	}
+	for name, m := range previous {
+		if modules[name] != m {
+			m.close()
+			for _, l := range m.loaders() {
+				if !loaders[l.name] {
+					l.deleteMetrics()
+				}
+			}
+		}
+	}
+	if c.watchInterval > 0 {
+		for name, m := range modules {
+			if previous[name] != m {
+				m.watch(c.watchInterval)
+			}
+		}
+	}
+	if c.state != nil {
+		c.state.setModules(modules)
+	}
+	if c.scheduler != nil {
+		c.targets = targets
+		c.scheduler.Reload(modules, targets)
+	}
+	c.watchTargetFiles(conf)
+
+	return nil
+}
+
+// notifyReload reloads the configuration when the exporter receives SIGHUP
+func notifyReload(c *configReloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Infoln("Received SIGHUP, reloading the configuration")
+			if err := c.Reload(); err != nil {
+				log.Errorln("Error reloading the configuration: ", err)
+				continue
+			}
+			log.Infoln("Reloaded the configuration")
+		}
+	}()
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request, c *configReloader) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("This endpoint requires a POST or PUT request.\n"))
+		return
+	}
+
+	if err := c.Reload(); err != nil {
+		log.Errorln("Error reloading the configuration: ", err)
+		http.Error(w, "failed to reload config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infoln("Reloaded the configuration")
+}
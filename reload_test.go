@@ -0,0 +1,323 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// Test that a rotated CA bundle is picked up by Reload
+func TestTLSConfigLoaderReloadCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte(clientCertWrong), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loader, err := newTLSConfigLoader("test", TLSConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rr := probeWithLoader(server.URL, loader)
+	if !strings.Contains(rr.Body.String(), "ssl_tls_connect_success 0") {
+		t.Errorf("expected `ssl_tls_connect_success 0` before reload")
+	}
+
+	if err := ioutil.WriteFile(caFile, []byte(caCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = probeWithLoader(server.URL, loader)
+	if !strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1") {
+		t.Errorf("expected `ssl_tls_connect_success 1` after reload")
+	}
+}
+
+// Test that a failed reload keeps the previous configuration
+func TestTLSConfigLoaderReloadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte(caCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loader, err := newTLSConfigLoader("test", TLSConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := loader.Config()
+
+	if err := ioutil.WriteFile(caFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loader.Reload(); err == nil {
+		t.Fatalf("expected an error reloading an invalid CA bundle")
+	}
+
+	if loader.Config() != config {
+		t.Errorf("expected the previous configuration to be kept")
+	}
+}
+
+// Test that changes to the client certificate are detected
+func TestTLSConfigLoaderChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, []byte(clientCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(clientKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loader, err := newTLSConfigLoader("test", TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loader.changed() {
+		t.Errorf("expected no change to be detected")
+	}
+
+	if err := ioutil.WriteFile(certFile, []byte(clientCertWrong), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(clientKeyWrong), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if !loader.changed() {
+		t.Errorf("expected a change to be detected")
+	}
+}
+
+// Test that the reload endpoint only accepts POST and PUT requests
+func TestReloadHandlerMethod(t *testing.T) {
+	loader, err := newTLSConfigLoader("test", TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for method, code := range map[string]int{
+		"GET":  http.StatusMethodNotAllowed,
+		"POST": http.StatusOK,
+		"PUT":  http.StatusOK,
+	} {
+		req, err := http.NewRequest(method, "/-/reload", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		reloadHandler(rr, req, newConfigReloader("", TLSConfig{}, &Config{}, map[string]*module{defaultModule: {tls: loader}}))
+
+		if rr.Code != code {
+			t.Errorf("expected %d for %s, got %d", code, method, rr.Code)
+		}
+	}
+}
+
+// Test that reloading the configuration keeps the modules that haven't
+// changed and replaces those that have
+func TestConfigReloaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ssl_exporter.yml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  same:\n    prober: tcp\n  changed:\n    prober: tcp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(conf, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newConfigReloader(file, TLSConfig{}, conf, modules)
+
+	if err := ioutil.WriteFile(file, []byte("modules:\n  same:\n    prober: tcp\n  changed:\n    prober: https\n  added:\n    prober: tcp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := reloader.Modules()
+	if reloaded["same"] != modules["same"] || reloaded[defaultModule] != modules[defaultModule] {
+		t.Errorf("expected the modules that haven't changed to be kept")
+	}
+	if reloaded["changed"] == modules["changed"] || reloaded["changed"].Prober != "https" {
+		t.Errorf("expected the changed module to be replaced")
+	}
+	if reloaded["added"] == nil {
+		t.Errorf("expected the added module")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("modules: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("expected an error reloading an invalid configuration")
+	}
+	if reloader.Modules()["added"] != reloaded["added"] {
+		t.Errorf("expected the previous modules to be kept after a failed reload")
+	}
+}
+
+// Test that the reload metrics of the modules that a reload removes are
+// deleted
+func TestConfigReloaderReloadMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ssl_exporter.yml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  metrics-kept:\n    prober: tcp\n  metrics-changed:\n    prober: tcp\n  metrics-removed:\n    prober: tcp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(conf, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newConfigReloader(file, TLSConfig{}, conf, modules)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(tlsReloadSuccess)
+	tlsConfigs := func() map[string]bool {
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfigs := map[string]bool{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "tls_config" {
+						tlsConfigs[l.GetValue()] = true
+					}
+				}
+			}
+		}
+		return tlsConfigs
+	}
+	if !tlsConfigs()["modules/metrics-removed"] {
+		t.Fatalf("expected the reload metrics of each module")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("modules:\n  metrics-kept:\n    prober: tcp\n  metrics-changed:\n    prober: https\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := tlsConfigs()
+	for _, name := range []string{"modules/metrics-kept", "modules/metrics-changed"} {
+		if !reloaded[name] {
+			t.Errorf("expected the reload metrics of %s to be kept", name)
+		}
+	}
+	if reloaded["modules/metrics-removed"] {
+		t.Errorf("expected the reload metrics of the removed module to be deleted")
+	}
+}
+
+// Test that the probers of a configuration that fails to reload aren't
+// registered
+func TestConfigReloaderReloadProbers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Registered already when the test runs more than once
+	prober.Register("test-reload-taken", &prober.ExecProber{Command: []string{"true"}})
+
+	file := filepath.Join(dir, "ssl_exporter.yml")
+	if err := ioutil.WriteFile(file, []byte("modules: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(conf, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newConfigReloader(file, TLSConfig{}, conf, modules)
+
+	probers := "probers:\n  test-reload-new:\n    command: [\"true\"]\n  test-reload-taken:\n    command: [\"true\"]\n"
+	if err := ioutil.WriteFile(file, []byte(probers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil || !strings.Contains(err.Error(), "test-reload-taken") {
+		t.Fatalf("expected an error for the prober that's already registered, got %v", err)
+	}
+	for _, scheme := range prober.Registered() {
+		if scheme == "test-reload-new" {
+			t.Errorf("expected the new prober not to be registered by the failed reload")
+		}
+	}
+}
+
+func probeWithLoader(url string, loader *tlsConfigLoader) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/probe?target="+url, nil)
+
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, map[string]*module{defaultModule: {tls: loader}})
+
+	return rr
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+var remoteWriteFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "remote_write_failures_total",
+		Help:      "Number of times the results of a background probe couldn't be sent to a remote write endpoint",
+	},
+	[]string{"url"},
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteFailures)
+}
+
+// remoteWriter sends the results of background probes to a Prometheus remote
+// write endpoint, like the ones provided by Cortex, Mimir and Thanos
+type remoteWriter struct {
+	config *RemoteWriteConfig
+	tls    *tlsConfigLoader
+	client *http.Client
+}
+
+func newRemoteWriter(c *RemoteWriteConfig) (*remoteWriter, error) {
+	l, err := newTLSConfigLoader("remote_write/"+c.URL, c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &remoteWriter{
+		config: c,
+		tls:    l,
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: newRemoteWriteTLSConfig(c, l),
+				Proxy:           http.ProxyFromEnvironment,
+			},
+			Timeout: c.RemoteTimeout,
+		},
+	}, nil
+}
+
+// newRemoteWriteTLSConfig returns the TLS configuration of the connections to
+// the endpoint. The client certificate and the CAs are taken from the loader
+// for each connection, so that the ones that Watch reloads are used by the
+// connections after it.
+func newRemoteWriteTLSConfig(c *RemoteWriteConfig, l *tlsConfigLoader) *tls.Config {
+	serverName := c.TLSConfig.ServerName
+	if serverName == "" {
+		if u, err := url.Parse(c.URL); err == nil {
+			serverName = u.Hostname()
+		}
+	}
+
+	return &tls.Config{
+		ServerName: c.TLSConfig.ServerName,
+		// The chain is verified by VerifyConnection instead, against the
+		// CAs that are loaded at the time
+		InsecureSkipVerify: true,
+		KeyLogWriter:       keyLogWriter,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			config := l.Config()
+			if len(config.Certificates) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &config.Certificates[0], nil
+		},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			config := l.Config()
+			if config.InsecureSkipVerify {
+				return nil
+			}
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("no certificates presented by " + c.URL)
+			}
+			opts := x509.VerifyOptions{
+				Roots:         config.RootCAs,
+				DNSName:       serverName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+// Publish sends the results to the endpoint, labelled with the target
+func (rw *remoteWriter) Publish(target string, mfs []*dto.MetricFamily, ts time.Time) error {
+	labels := map[string]string{"target": target}
+	for name, value := range rw.config.Labels {
+		labels[name] = value
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(toTimeSeries(mfs, labels, ts)))
+
+	req, err := http.NewRequest("POST", rw.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range rw.config.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", namespace+"_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if err := rw.config.authorize(req); err != nil {
+		remoteWriteFailures.WithLabelValues(rw.config.URL).Inc()
+		return err
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		remoteWriteFailures.WithLabelValues(rw.config.URL).Inc()
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		remoteWriteFailures.WithLabelValues(rw.config.URL).Inc()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d while sending to %s: %s", resp.StatusCode, rw.config.URL, b)
+	}
+
+	return nil
+}
+
+// authorize adds the configured credentials to the request. Secrets are read
+// from their files on every request so that they can be rotated.
+func (c *RemoteWriteConfig) authorize(req *http.Request) error {
+	if c.BasicAuth != nil {
+		password, err := c.BasicAuth.password()
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(c.BasicAuth.Username, password)
+	}
+
+	token := c.BearerToken
+	if c.BearerTokenFile != "" {
+		b, err := ioutil.ReadFile(c.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return nil
+}
+
+type timeSeries struct {
+	labels    []labelPair
+	value     float64
+	timestamp int64
+}
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+// toTimeSeries converts metric families into a sample per series, in the way
+// Prometheus would store them after a scrape
+func toTimeSeries(mfs []*dto.MetricFamily, labels map[string]string, ts time.Time) []timeSeries {
+	var series []timeSeries
+
+	timestamp := ts.UnixNano() / int64(time.Millisecond)
+	add := func(name string, m *dto.Metric, value float64, extra ...labelPair) {
+		lps := []labelPair{{name: "__name__", value: name}}
+		for _, lp := range m.GetLabel() {
+			lps = append(lps, labelPair{name: lp.GetName(), value: lp.GetValue()})
+		}
+		for n, v := range labels {
+			lps = append(lps, labelPair{name: n, value: v})
+		}
+		lps = append(lps, extra...)
+		sort.Slice(lps, func(i, j int) bool { return lps[i].name < lps[j].name })
+
+		series = append(series, timeSeries{labels: lps, value: value, timestamp: timestamp})
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(name, m, q.GetValue(), labelPair{name: "quantile", value: formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", m, m.GetSummary().GetSampleSum())
+				add(name+"_count", m, float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				for _, b := range m.GetHistogram().GetBucket() {
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), labelPair{name: "le", value: formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", m, float64(m.GetHistogram().GetSampleCount()), labelPair{name: "le", value: "+Inf"})
+				add(name+"_sum", m, m.GetHistogram().GetSampleSum())
+				add(name+"_count", m, float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest protobuf:
+//
+//	https://github.com/prometheus/prometheus/blob/master/prompb/remote.proto
+func encodeWriteRequest(series []timeSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = appendBytesField(lb, 1, []byte(l.name))
+			lb = appendBytesField(lb, 2, []byte(l.value))
+			ts = appendBytesField(ts, 1, lb)
+		}
+
+		var sample []byte
+		sample = binary.AppendUvarint(sample, 1<<3|1)
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(s.value))
+		sample = binary.AppendUvarint(sample, 2<<3|0)
+		sample = binary.AppendUvarint(sample, uint64(s.timestamp))
+		ts = appendBytesField(ts, 2, sample)
+
+		req = appendBytesField(req, 1, ts)
+	}
+
+	return req
+}
+
+// appendBytesField appends a length-delimited protobuf field
+func appendBytesField(b []byte, field uint64, value []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
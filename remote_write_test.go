@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Test that the results of a background probe are sent to a remote write
+// endpoint
+func TestSchedulerRemoteWrite(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var (
+		req    *http.Request
+		series []timeSeries
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b, err = snappy.Decode(nil, b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		series = decodeWriteRequest(t, b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	rw, err := newRemoteWriter(&RemoteWriteConfig{
+		URL:           receiver.URL + "/api/v1/push",
+		RemoteTimeout: time.Second,
+		Headers:       map[string]string{"X-Scope-OrgID": "edge"},
+		Labels:        map[string]string{"site": "dmz"},
+		BearerToken:   "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), []publisher{rw})
+	s.probe(Target{
+		Target:   server.URL,
+		Module:   defaultModule,
+		Interval: time.Minute,
+	})
+
+	if req == nil {
+		t.Fatalf("expected a request to the remote write endpoint")
+	}
+	if req.Method != "POST" || req.URL.Path != "/api/v1/push" {
+		t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+	}
+	for name, value := range map[string]string{
+		"Authorization":                     "Bearer secret",
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"X-Scope-OrgID":                     "edge",
+	} {
+		if req.Header.Get(name) != value {
+			t.Errorf("expected header %s to be %s, got %s", name, value, req.Header.Get(name))
+		}
+	}
+
+	var found bool
+	for _, s := range series {
+		labels := map[string]string{}
+		for _, l := range s.labels {
+			labels[l.name] = l.value
+		}
+		if labels["__name__"] != "ssl_tls_connect_success" {
+			continue
+		}
+		found = true
+
+		if labels["target"] != server.URL || labels["site"] != "dmz" {
+			t.Errorf("unexpected labels %v", labels)
+		}
+		if s.value != 1 {
+			t.Errorf("expected ssl_tls_connect_success 1, got %v", s.value)
+		}
+	}
+	if !found {
+		t.Errorf("expected ssl_tls_connect_success to be sent")
+	}
+}
+
+// Test that the basic auth password is read from its file on each request
+func TestRemoteWriteBasicAuthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var password string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, _ = r.BasicAuth()
+	}))
+	defer receiver.Close()
+
+	rw, err := newRemoteWriter(&RemoteWriteConfig{
+		URL:       receiver.URL,
+		BasicAuth: &BasicAuth{Username: "ssl", PasswordFile: passwordFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Publish("example.com:443", nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if password != "first" {
+		t.Errorf("expected password first, got %s", password)
+	}
+
+	if err := ioutil.WriteFile(passwordFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Publish("example.com:443", nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if password != "second" {
+		t.Errorf("expected password second, got %s", password)
+	}
+}
+
+// Test that the connections to the endpoint use the CA bundle that was last
+// reloaded
+func TestRemoteWriteReloadCA(t *testing.T) {
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	// Each request is made on a new connection
+	receiver.Config.SetKeepAlivesEnabled(false)
+
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte(clientCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rw, err := newRemoteWriter(&RemoteWriteConfig{URL: receiver.URL, TLSConfig: TLSConfig{CAFile: caFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Publish("example.com:443", nil, time.Now()); err == nil {
+		t.Fatalf("expected an error verifying the endpoint against the wrong CA")
+	}
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: receiver.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.tls.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Publish("example.com:443", nil, time.Now()); err != nil {
+		t.Errorf("expected the reloaded CA to verify the endpoint: %s", err)
+	}
+}
+
+// Test that an error is returned when the endpoint rejects the samples
+func TestRemoteWriteError(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	rw, err := newRemoteWriter(&RemoteWriteConfig{URL: receiver.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Publish("example.com:443", nil, time.Now()); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// Test that histograms are expanded into their bucket, sum and count series
+func TestToTimeSeriesHistogram(t *testing.T) {
+	name := "ssl_probe_duration_seconds"
+	typ := dto.MetricType_HISTOGRAM
+	count := uint64(3)
+	sum := 1.5
+	bound := 0.5
+	cumulative := uint64(2)
+
+	series := toTimeSeries([]*dto.MetricFamily{{
+		Name: &name,
+		Type: &typ,
+		Metric: []*dto.Metric{{
+			Histogram: &dto.Histogram{
+				SampleCount: &count,
+				SampleSum:   &sum,
+				Bucket:      []*dto.Bucket{{UpperBound: &bound, CumulativeCount: &cumulative}},
+			},
+		}},
+	}}, map[string]string{"target": "example.com:443"}, time.Unix(1, 0))
+
+	expected := []struct {
+		name  string
+		le    string
+		value float64
+	}{
+		{name + "_bucket", "0.5", 2},
+		{name + "_bucket", "+Inf", 3},
+		{name + "_sum", "", 1.5},
+		{name + "_count", "", 3},
+	}
+	if len(series) != len(expected) {
+		t.Fatalf("expected %d series, got %d", len(expected), len(series))
+	}
+	for i, e := range expected {
+		labels := map[string]string{}
+		for _, l := range series[i].labels {
+			labels[l.name] = l.value
+		}
+		if labels["__name__"] != e.name || labels["le"] != e.le || series[i].value != e.value {
+			t.Errorf("expected %s{le=%q} %v, got %v %v", e.name, e.le, e.value, labels, series[i].value)
+		}
+		if series[i].timestamp != 1000 {
+			t.Errorf("expected timestamp 1000, got %d", series[i].timestamp)
+		}
+	}
+}
+
+// decodeWriteRequest decodes the subset of a WriteRequest protobuf that
+// encodeWriteRequest produces
+func decodeWriteRequest(t *testing.T, b []byte) []timeSeries {
+	var series []timeSeries
+	for _, ts := range decodeFields(t, b)[1] {
+		var s timeSeries
+		fields := decodeFields(t, ts)
+		for _, l := range fields[1] {
+			lf := decodeFields(t, l)
+			s.labels = append(s.labels, labelPair{name: string(lf[1][0]), value: string(lf[2][0])})
+		}
+		sample := fields[2][0]
+		s.value = math.Float64frombits(binary.LittleEndian.Uint64(sample[1:9]))
+		timestamp, _ := binary.Uvarint(sample[10:])
+		s.timestamp = int64(timestamp)
+		series = append(series, s)
+	}
+	return series
+}
+
+// decodeFields returns the length-delimited fields of a protobuf message
+func decodeFields(t *testing.T, b []byte) map[uint64][][]byte {
+	fields := map[uint64][][]byte{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		if key&7 != 2 {
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		l, n := binary.Uvarint(b)
+		b = b[n:]
+		fields[key>>3] = append(fields[key>>3], b[:l])
+		b = b[l:]
+	}
+	return fields
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// reportExpiryWarning is how close to expiry a certificate has to be before
+// the report warns about it
+const reportExpiryWarning = 30 * 24 * time.Hour
+
+// report is what the report templates are rendered from
+type report struct {
+	*apiProbeResult
+	Now      time.Time
+	Warnings []string
+}
+
+var reportFuncs = map[string]interface{}{
+	"daysLeft": func(now, notAfter time.Time) int {
+		return int(notAfter.Sub(now).Hours() / 24)
+	},
+	"join": strings.Join,
+}
+
+var reportHTMLTemplate = htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(`<html>
+<head><title>SSL Exporter report for {{.Target}}</title></head>
+<body>
+<h1>{{.Target}}</h1>
+<p>Probe {{.ProbeID}} with module {{.Module}} at {{.Now.Format "2006-01-02 15:04:05 MST"}}</p>
+{{if not .Success}}<p><strong>Probe failed:</strong> {{.Error}}</p>{{else}}
+{{if .Warnings}}<h2>Warnings</h2>
+<ul>{{range .Warnings}}
+<li>{{.}}</li>{{end}}
+</ul>{{end}}
+<h2>Connection</h2>
+<table>
+<tr><th align="left">Protocol</th><td>{{.Protocol}}</td></tr>
+<tr><th align="left">TLS version</th><td>{{.TLS.Version}}</td></tr>
+<tr><th align="left">Cipher suite</th><td>{{.TLS.CipherSuite}}</td></tr>
+<tr><th align="left">Verified</th><td>{{if .Verification.Skipped}}skipped{{else}}{{.Verification.Verified}}{{end}}</td></tr>
+</table>
+<h2>Chain</h2>
+{{range $i, $cert := .Certificates}}<h3>{{$i}}: {{$cert.Subject}}</h3>
+<table>
+<tr><th align="left">Issuer</th><td>{{$cert.Issuer}}</td></tr>
+<tr><th align="left">Serial</th><td>{{$cert.SerialNo}}</td></tr>
+<tr><th align="left">Not before</th><td>{{$cert.NotBefore}}</td></tr>
+<tr><th align="left">Not after</th><td>{{$cert.NotAfter}} ({{daysLeft $.Now $cert.NotAfter}} days left)</td></tr>
+{{if $cert.DNSNames}}<tr><th align="left">DNS names</th><td>{{join $cert.DNSNames ", "}}</td></tr>
+{{end}}{{if $cert.IPs}}<tr><th align="left">IPs</th><td>{{join $cert.IPs ", "}}</td></tr>
+{{end}}<tr><th align="left">Signature</th><td>{{$cert.SignatureAlgorithm}}</td></tr>
+<tr><th align="left">SHA-256</th><td>{{$cert.FingerprintSHA256}}</td></tr>
+</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+var reportTextTemplate = texttemplate.Must(texttemplate.New("report").Funcs(reportFuncs).Parse(`Target:       {{.Target}}
+Module:       {{.Module}}
+Probe ID:     {{.ProbeID}}
+Time:         {{.Now.Format "2006-01-02 15:04:05 MST"}}
+{{if not .Success}}
+Probe failed: {{.Error}}
+{{else}}Protocol:     {{.Protocol}}
+TLS version:  {{.TLS.Version}}
+Cipher suite: {{.TLS.CipherSuite}}
+Verified:     {{if .Verification.Skipped}}skipped{{else}}{{.Verification.Verified}}{{end}}
+{{if .Warnings}}
+Warnings:
+{{range .Warnings}}  - {{.}}
+{{end}}{{end}}
+Chain:
+{{range $i, $cert := .Certificates}}  {{$i}}: {{$cert.Subject}}
+     Issuer:     {{$cert.Issuer}}
+     Serial:     {{$cert.SerialNo}}
+     Not before: {{$cert.NotBefore}}
+     Not after:  {{$cert.NotAfter}} ({{daysLeft $.Now $cert.NotAfter}} days left)
+{{if $cert.DNSNames}}     DNS names:  {{join $cert.DNSNames ", "}}
+{{end}}{{if $cert.IPs}}     IPs:        {{join $cert.IPs ", "}}
+{{end}}     Signature:  {{$cert.SignatureAlgorithm}}
+     SHA-256:    {{$cert.FingerprintSHA256}}
+{{end}}{{end}}`))
+
+// reportHandler probes the target and renders a summary of the results that
+// can be read without writing any PromQL. It's HTML unless format=text is
+// given or the client prefers plain text.
+func reportHandler(w http.ResponseWriter, r *http.Request, modules map[string]*module) {
+	exporter := newRequestExporter(w, r, modules, false)
+	if exporter == nil {
+		return
+	}
+	release, err := acquireProbeSlot(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	rep := &report{
+		apiProbeResult: newAPIProbeResult(r.URL.Query().Get("module"), exporter),
+		Now:            time.Now(),
+	}
+	rep.Warnings = reportWarnings(rep.apiProbeResult, rep.Now)
+
+	if r.URL.Query().Get("format") == "text" || strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = reportTextTemplate.Execute(w, rep)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = reportHTMLTemplate.Execute(w, rep)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// reportWarnings returns the problems with the result that someone looking at
+// the report should know about
+func reportWarnings(result *apiProbeResult, now time.Time) []string {
+	var warnings []string
+	if !result.Success {
+		return warnings
+	}
+
+	if result.Verification.Skipped {
+		warnings = append(warnings, "Certificate verification was skipped")
+	} else if !result.Verification.Verified {
+		warnings = append(warnings, "The chain couldn't be verified: "+result.Verification.Error)
+	}
+
+	switch result.TLS.Version {
+	case "SSLv3", "TLS 1.0", "TLS 1.1":
+		warnings = append(warnings, result.TLS.Version+" is deprecated")
+	}
+
+	for _, cert := range result.Certificates {
+		switch {
+		case now.After(cert.NotAfter):
+			warnings = append(warnings, cert.Subject+" expired on "+cert.NotAfter.Format("2006-01-02"))
+		case now.Before(cert.NotBefore):
+			warnings = append(warnings, cert.Subject+" isn't valid until "+cert.NotBefore.Format("2006-01-02"))
+		case cert.NotAfter.Sub(now) < reportExpiryWarning:
+			warnings = append(warnings, cert.Subject+" expires on "+cert.NotAfter.Format("2006-01-02"))
+		}
+
+		if strings.Contains(cert.SignatureAlgorithm, "SHA1") || strings.Contains(cert.SignatureAlgorithm, "MD5") {
+			warnings = append(warnings, cert.Subject+" is signed with "+cert.SignatureAlgorithm)
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the report includes the connection and chain
+func TestReportHandler(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rr := reportRequest(t, "/report?target="+server.URL, &tls.Config{RootCAs: certPool()})
+
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("expected HTML, got %s", rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	for _, s := range []string{"<h1>" + server.URL + "</h1>", "Cipher suite", "days left", "SHA-256"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected the report to contain %q", s)
+		}
+	}
+}
+
+// Test that the report can be rendered as plain text
+func TestReportHandlerText(t *testing.T) {
+	server, err := serverExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rr := reportRequest(t, "/report?format=text&target="+server.URL, &tls.Config{RootCAs: certPool()})
+
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("expected plain text, got %s", rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	for _, s := range []string{"Target:       " + server.URL, "Warnings:", "The chain couldn't be verified", "expired on"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected the report to contain %q, got:\n%s", s, body)
+		}
+	}
+}
+
+// Test that a failed probe is reported
+func TestReportHandlerError(t *testing.T) {
+	server, err := serverHTTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rr := reportRequest(t, "/report?format=text&target="+server.URL, &tls.Config{})
+
+	if !strings.Contains(rr.Body.String(), "Probe failed:") {
+		t.Errorf("expected the failure to be reported, got:\n%s", rr.Body.String())
+	}
+}
+
+// Test the warnings for a connection and chain
+func TestReportWarnings(t *testing.T) {
+	now := time.Now()
+	warnings := reportWarnings(&apiProbeResult{
+		Success:      true,
+		TLS:          &apiTLS{Version: "TLS 1.0"},
+		Verification: &apiVerification{Verified: true},
+		Certificates: []apiCertificate{
+			{Subject: "CN=soon", NotBefore: now.Add(-time.Hour), NotAfter: now.Add(24 * time.Hour), SignatureAlgorithm: "SHA256-RSA"},
+			{Subject: "CN=later", NotBefore: now.Add(-time.Hour), NotAfter: now.Add(365 * 24 * time.Hour), SignatureAlgorithm: "SHA1-RSA"},
+		},
+	}, now)
+
+	expected := []string{
+		"TLS 1.0 is deprecated",
+		"CN=soon expires on " + now.Add(24*time.Hour).Format("2006-01-02"),
+		"CN=later is signed with SHA1-RSA",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected warnings %q, got %q", expected, warnings)
+	}
+}
+
+func reportRequest(t *testing.T, uri string, tlsConfig *tls.Config) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	reportHandler(rr, req, testModules(tlsConfig))
+
+	return rr
+}
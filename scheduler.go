@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// scheduler probes the targets from the configuration file on their own
+// intervals and keeps the results of the latest probe of each, so they can be
+// served alongside the exporter's own metrics
+type scheduler struct {
+	modules    map[string]*module
+	publishers []publisher
+
+	// timestamps exposes the results with the time they were probed
+	timestamps bool
+	// moduleLabel adds a module label to the results, alongside the target
+	moduleLabel bool
+	// resolvers are shared by the probes of each module so that they can
+	// cache the addresses of the targets, for up to dnsCacheTTL
+	resolvers   map[string]prober.Resolver
+	dnsCacheTTL time.Duration
+	// connections keeps the connections of the https targets of the modules
+	// with keep_alive open between probes
+	connections map[string]*prober.Connections
+	// durations, if set, records how long each phase of the probes took
+	durations *phaseDurations
+	// changes tracks the leaf of each target between probes, and webhooks
+	// are sent the events about them
+	changes  *changeTracker
+	webhooks webhooks
+
+	mtx     sync.RWMutex
+	results map[string][]*dto.MetricFamily
+	probed  map[string]time.Time
+	// loops has the loop of each target that's probed, so that a reload
+	// only stops those of the targets that are gone or have changed.
+	// generations is how many times the loop of each target has been
+	// stopped, so that the probes that were in progress then don't leave
+	// results behind.
+	loops       map[string]targetLoop
+	generations map[string]int
+}
+
+// targetLoop is the loop that probes a target on its interval until stop is
+// closed
+type targetLoop struct {
+	target Target
+	stop   chan struct{}
+}
+
+// publisher sends the results of a background probe somewhere outside of the
+// exporter
+type publisher interface {
+	Publish(target string, mfs []*dto.MetricFamily, ts time.Time) error
+}
+
+func newScheduler(modules map[string]*module, publishers []publisher) *scheduler {
+	s := &scheduler{
+		modules:     modules,
+		publishers:  publishers,
+		resolvers:   map[string]prober.Resolver{},
+		connections: map[string]*prober.Connections{},
+		changes:     newChangeTracker(),
+		results:     map[string][]*dto.MetricFamily{},
+		probed:      map[string]time.Time{},
+		loops:       map[string]targetLoop{},
+		generations: map[string]int{},
+	}
+	for name, m := range modules {
+		s.addModule(name, m)
+	}
+
+	return s
+}
+
+// addModule makes the resolver and the kept connections of the module
+func (s *scheduler) addModule(name string, m *module) {
+	delete(s.resolvers, name)
+	delete(s.connections, name)
+	if s.dnsCacheTTL > 0 {
+		r := prober.NewCachingResolver(s.dnsCacheTTL)
+		r.ClientSubnet = m.clientSubnet()
+		s.resolvers[name] = r
+	} else if r := m.resolver(); r != nil {
+		s.resolvers[name] = r
+	}
+	if m.KeepAlive > 0 {
+		s.connections[name] = prober.NewConnections(m.KeepAlive)
+	}
+}
+
+// cacheAddresses caches the addresses of the targets of each module for up
+// to the ttl, if the TTLs of their DNS records allow
+func (s *scheduler) cacheAddresses(ttl time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.dnsCacheTTL = ttl
+	for name, m := range s.modules {
+		s.addModule(name, m)
+	}
+}
+
+// Run starts probing each of the targets in the background
+func (s *scheduler) Run(targets []Target) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, t := range targets {
+		s.start(t)
+	}
+}
+
+// start starts the loop of the target. The caller must hold mtx.
+func (s *scheduler) start(t Target) {
+	l := targetLoop{target: t, stop: make(chan struct{})}
+	s.loops[t.Target] = l
+	go s.run(t, l.stop)
+}
+
+// Reload replaces the modules and the targets with those of a reloaded
+// configuration. The modules that are the same as before keep their cached
+// addresses and connections. Only the loops of the targets that are gone, or
+// whose interval or module has changed, are stopped, and only those of the
+// new or changed targets are started, so the others stay on their tickers.
+// The probes in progress are left to finish, but the results of the targets
+// that are gone are dropped.
+func (s *scheduler) Reload(modules map[string]*module, targets []Target) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	changed := map[string]bool{}
+	for name, m := range modules {
+		if s.modules[name] != m {
+			s.addModule(name, m)
+			changed[name] = true
+		}
+	}
+	for name := range s.modules {
+		if _, ok := modules[name]; !ok {
+			delete(s.resolvers, name)
+			delete(s.connections, name)
+		}
+	}
+	s.modules = modules
+
+	wanted := map[string]Target{}
+	for _, t := range targets {
+		wanted[t.Target] = t
+	}
+	for target, l := range s.loops {
+		if t, ok := wanted[target]; ok && t == l.target && !changed[t.Module] {
+			continue
+		}
+		close(l.stop)
+		delete(s.loops, target)
+		s.generations[target]++
+	}
+	for target := range s.results {
+		if _, ok := wanted[target]; !ok {
+			delete(s.results, target)
+			delete(s.probed, target)
+		}
+	}
+	if s.durations != nil {
+		s.durations.deleteExcept(wanted)
+	}
+
+	for _, t := range targets {
+		if _, ok := s.loops[t.Target]; !ok {
+			s.start(t)
+		}
+	}
+}
+
+func (s *scheduler) run(t Target, stop <-chan struct{}) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+
+	for {
+		// The ticker and stop can both be ready, so check stop first to
+		// not probe with the modules of a reloaded configuration
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		s.probe(t)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probe probes the target once and replaces its previous results. Targets
+// whose module is gone after a reload aren't probed.
+func (s *scheduler) probe(t Target) {
+	s.mtx.RLock()
+	m := s.modules[t.Module]
+	resolver, connections := s.resolvers[t.Module], s.connections[t.Module]
+	generation := s.generations[t.Target]
+	s.mtx.RUnlock()
+	if m == nil {
+		return
+	}
+
+	timeout := defaultTimeout
+	if m.Timeout > 0 {
+		timeout = m.Timeout
+	}
+	if timeout > t.Interval {
+		timeout = t.Interval
+	}
+
+	probeID := newProbeID()
+	logger := newProbeLogger(probeID, false)
+
+	exporter := &Exporter{
+		ctx:       context.Background(),
+		probeID:   probeID,
+		logger:    logger,
+		target:    t.Target,
+		timeout:   timeout,
+		tlsConfig: m.tls.Config(),
+
+		proberName:        m.Prober,
+		keystorePasswords: m.KeystorePasswords,
+		spiffe:            m.SPIFFE,
+		kubernetes:        m.Kubernetes,
+
+		metricsOptions:  m.metricsOptions(),
+		resolver:        resolver,
+		connections:     connections,
+		httpRequest:     m.httpRequest,
+		grpcRequest:     m.grpcRequest(),
+		kafkaRequest:    m.kafkaRequest,
+		trustStores:     m.trustStores(),
+		ctLog:           m.ct,
+		ocspCheck:       m.ocsp,
+		crlCheck:        m.crl,
+		allAddresses:    m.AllAddresses,
+		torProxy:        m.TorSOCKSAddress,
+		proxyURL:        m.proxyURL(),
+		clientProfiles:  m.clientProfiles(),
+		certCompression: m.CertCompression,
+		ports:           m.Ports,
+		workers:         m.Workers,
+		itemTimeout:     m.ItemTimeout,
+		changes:         s.changes,
+		webhooks:        s.webhooks,
+	}
+	if m.Prober == ocspProber {
+		exporter.ocspCerts = m.ocspCerts
+	}
+	if !m.Expected.empty() {
+		exporter.expected = m.expectation
+	}
+	if s.durations != nil {
+		exporter.phases = &phaseObserver{owner: t.Target, target: t.Target, durations: s.durations}
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+
+	ts := time.Now()
+	mfs, err := registry.Gather()
+	if err != nil {
+		logger.Errorln("Error gathering the metrics for " + t.Target + ": " + err.Error())
+		return
+	}
+	if s.moduleLabel {
+		mfs = withLabels(mfs, map[string]string{"module": t.Module})
+	}
+
+	s.mtx.Lock()
+	if s.generations[t.Target] != generation {
+		s.mtx.Unlock()
+		return
+	}
+	s.results[t.Target] = mfs
+	s.probed[t.Target] = ts
+	s.mtx.Unlock()
+
+	for _, p := range s.publishers {
+		if err := p.Publish(t.Target, mfs, ts); err != nil {
+			logger.Errorln("Error publishing the results for " + t.Target + ": " + err.Error())
+		}
+	}
+}
+
+// Gather returns the latest results for all of the targets. It implements
+// prometheus.Gatherer.
+func (s *scheduler) Gather() ([]*dto.MetricFamily, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	gatherers := prometheus.Gatherers{}
+	for target, mfs := range s.results {
+		mfs = withLabels(mfs, map[string]string{"target": target})
+		if s.timestamps {
+			ms := s.probed[target].UnixNano() / int64(time.Millisecond)
+			for _, mf := range mfs {
+				for _, m := range mf.Metric {
+					m.TimestampMs = &ms
+				}
+			}
+		}
+		gatherers = append(gatherers, gathered(mfs))
+	}
+
+	if s.durations != nil {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(s.durations)
+		gatherers = append(gatherers, registry)
+	}
+
+	return gatherers.Gather()
+}
+
+// phaseDurations is a histogram of the duration of each phase of the probes
+// of each target. It keeps the labels of the series of each background
+// target, which are those of each of its ports for a target with several, so
+// that they can be deleted when the target is removed.
+type phaseDurations struct {
+	*prometheus.HistogramVec
+
+	mtx    sync.Mutex
+	series map[string]map[[2]string]bool
+}
+
+func newPhaseDurations() *phaseDurations {
+	return &phaseDurations{
+		HistogramVec: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "probe",
+			Name:      "phase_duration_seconds",
+			Help:      "Duration of the successful phases of the background probes: resolve, dial, handshake and verify",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"target", "phase"}),
+		series: map[string]map[[2]string]bool{},
+	}
+}
+
+// observe records the duration of the phase of a probe of the background
+// target owner
+func (d *phaseDurations) observe(owner, target, phase string, seconds float64) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.series[owner] == nil {
+		d.series[owner] = map[[2]string]bool{}
+	}
+	d.series[owner][[2]string{target, phase}] = true
+	d.WithLabelValues(target, phase).Observe(seconds)
+}
+
+// deleteExcept deletes the series of the background targets that aren't in
+// targets
+func (d *phaseDurations) deleteExcept(targets map[string]Target) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for owner, series := range d.series {
+		if _, ok := targets[owner]; ok {
+			continue
+		}
+		for labels := range series {
+			d.DeleteLabelValues(labels[0], labels[1])
+		}
+		delete(d.series, owner)
+	}
+}
+
+// phaseObserver is a prober.Tracer that records the duration of each
+// successful phase of a probe in a histogram, and passes the phases on to
+// the next Tracer, if there is one. owner is the background target that the
+// probe is for, which is target unless it's one of its ports.
+type phaseObserver struct {
+	owner     string
+	target    string
+	durations *phaseDurations
+	next      prober.Tracer
+}
+
+// StartPhase implements prober.Tracer
+func (o *phaseObserver) StartPhase(ctx context.Context, phase string, attributes map[string]string) func(error) {
+	start := time.Now()
+
+	var end func(error)
+	if o.next != nil {
+		end = o.next.StartPhase(ctx, phase, attributes)
+	}
+
+	return func(err error) {
+		if err == nil {
+			o.durations.observe(o.owner, o.target, phase, time.Since(start).Seconds())
+		}
+		if end != nil {
+			end(err)
+		}
+	}
+}
+
+// gathered is a prometheus.Gatherer that returns metrics that have already
+// been gathered
+type gathered []*dto.MetricFamily
+
+func (g gathered) Gather() ([]*dto.MetricFamily, error) {
+	return g, nil
+}
+
+// withLabels returns a copy of the metric families with the labels added to
+// each metric
+func withLabels(mfs []*dto.MetricFamily, labels map[string]string) []*dto.MetricFamily {
+	var result []*dto.MetricFamily
+	for _, mf := range mfs {
+		lmf := &dto.MetricFamily{
+			Name: mf.Name,
+			Help: mf.Help,
+			Type: mf.Type,
+		}
+		for _, m := range mf.GetMetric() {
+			lm := *m
+			lm.Label = append([]*dto.LabelPair{}, m.GetLabel()...)
+			for name, value := range labels {
+				name, value := name, value
+				lm.Label = append(lm.Label, &dto.LabelPair{Name: &name, Value: &value})
+			}
+			sort.Slice(lm.Label, func(i, j int) bool {
+				return lm.Label[i].GetName() < lm.Label[j].GetName()
+			})
+			lmf.Metric = append(lmf.Metric, &lm)
+		}
+		result = append(result, lmf)
+	}
+
+	return result
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the results of a scheduled probe are gathered with a target label
+func TestSchedulerProbe(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), nil)
+	s.probe(Target{
+		Target:   server.URL,
+		Module:   defaultModule,
+		Interval: time.Minute,
+	})
+
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() != "ssl_tls_connect_success" {
+			continue
+		}
+		found = true
+
+		m := mf.GetMetric()[0]
+		if m.GetGauge().GetValue() != 1 {
+			t.Errorf("expected ssl_tls_connect_success to be 1")
+		}
+		if len(m.GetLabel()) != 1 || m.GetLabel()[0].GetName() != "target" || m.GetLabel()[0].GetValue() != server.URL {
+			t.Errorf("expected a target label with the value %s, got %v", server.URL, m.GetLabel())
+		}
+	}
+	if !found {
+		t.Errorf("expected ssl_tls_connect_success to be gathered")
+	}
+}
+
+// Test that results for several targets can be gathered together
+func TestSchedulerGatherMultipleTargets(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), nil)
+	for _, target := range []string{server.URL, server.URL[len("https://"):]} {
+		s.probe(Target{
+			Target:   target,
+			Module:   defaultModule,
+			Interval: time.Minute,
+		})
+	}
+
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() == "ssl_tls_connect_success" && len(mf.GetMetric()) != 2 {
+			t.Errorf("expected a ssl_tls_connect_success series for each target, got %d", len(mf.GetMetric()))
+		}
+	}
+}
+
+// Test that the results are gathered with the time of the probe when
+// timestamps are enabled
+func TestSchedulerTimestamps(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), nil)
+	s.timestamps = true
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	s.probe(Target{
+		Target:   server.URL,
+		Module:   defaultModule,
+		Interval: time.Minute,
+	})
+
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if m.TimestampMs == nil || m.GetTimestampMs() < before {
+				t.Errorf("expected %s to have the timestamp of the probe, got %v", mf.GetName(), m.TimestampMs)
+			}
+		}
+	}
+}
+
+// Test that the results are labelled with the module when the module label is
+// enabled
+func TestSchedulerModuleLabel(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), nil)
+	s.moduleLabel = true
+
+	s.probe(Target{
+		Target:   server.URL,
+		Module:   defaultModule,
+		Interval: time.Minute,
+	})
+
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["module"] != defaultModule || labels["target"] != server.URL {
+				t.Errorf("expected %s to have the module and target labels, got %v", mf.GetName(), labels)
+			}
+		}
+	}
+}
+
+// Test that the duration of the phases of the probes are recorded in
+// histograms when they're enabled
+func TestSchedulerDurations(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := newScheduler(testModules(&tls.Config{
+		RootCAs: certPool(),
+	}), nil)
+	s.durations = newPhaseDurations()
+
+	target := Target{
+		Target:   strings.TrimPrefix(server.URL, "https://"),
+		Module:   defaultModule,
+		Interval: time.Minute,
+	}
+	s.probe(target)
+	s.probe(target)
+
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phases := map[string]uint64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "ssl_probe_phase_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "phase" {
+					phases[l.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	for _, phase := range []string{"resolve", "dial", "handshake", "verify"} {
+		if phases[phase] != 2 {
+			t.Errorf("expected 2 observations of the %s phase, got %d", phase, phases[phase])
+		}
+	}
+}
+
+// Test that a reload deletes the phase durations of the targets that are
+// gone, including those of each of the ports of a target with several
+func TestSchedulerReloadDurations(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	modules := testModules(&tls.Config{
+		RootCAs: certPool(),
+	})
+	s := newScheduler(modules, nil)
+	s.durations = newPhaseDurations()
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	kept := Target{Target: "127.0.0.1:" + port, Module: defaultModule, Interval: time.Minute}
+	removed := Target{Target: "localhost:" + port + ",1", Module: defaultModule, Interval: time.Minute}
+	s.probe(kept)
+	s.probe(removed)
+
+	durationTargets := func() map[string]bool {
+		mfs, err := s.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets := map[string]bool{}
+		for _, mf := range mfs {
+			if mf.GetName() != "ssl_probe_phase_duration_seconds" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "target" {
+						targets[l.GetValue()] = true
+					}
+				}
+			}
+		}
+		return targets
+	}
+	if !durationTargets()["localhost:"+port] {
+		t.Fatalf("expected phase durations for each of the ports of %s", removed.Target)
+	}
+
+	s.Reload(modules, []Target{kept})
+	defer s.Reload(modules, nil)
+
+	targets := durationTargets()
+	if !targets[kept.Target] {
+		t.Errorf("expected the phase durations of %s to be kept", kept.Target)
+	}
+	for _, target := range []string{"localhost:" + port, "localhost:1"} {
+		if targets[target] {
+			t.Errorf("expected the phase durations of %s to be deleted", target)
+		}
+	}
+}
+
+// Test that the modules with keep_alive share their connections between
+// probes
+func TestSchedulerKeepAlive(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	modules := testModules(&tls.Config{
+		RootCAs: certPool(),
+	})
+	modules[defaultModule].KeepAlive = time.Minute
+
+	s := newScheduler(modules, nil)
+	if s.connections[defaultModule] == nil {
+		t.Fatalf("expected connections for the module with keep_alive")
+	}
+
+	target := Target{
+		Target:   server.URL,
+		Module:   defaultModule,
+		Interval: time.Minute,
+	}
+	for i := 0; i < 2; i++ {
+		s.probe(target)
+
+		mfs, err := s.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == "ssl_tls_connect_success" && mf.GetMetric()[0].GetGauge().GetValue() != 1 {
+				t.Errorf("probe %d: expected ssl_tls_connect_success to be 1", i)
+			}
+		}
+	}
+}
+
+// Test that a reload drops the results of the targets that are gone and keeps
+// the caches of the modules that are the same
+func TestSchedulerReload(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	modules := testModules(&tls.Config{
+		RootCAs: certPool(),
+	})
+	modules[defaultModule].KeepAlive = time.Minute
+
+	s := newScheduler(modules, nil)
+	connections := s.connections[defaultModule]
+	kept := Target{Target: server.URL, Module: defaultModule, Interval: time.Minute}
+	dropped := Target{Target: strings.TrimPrefix(server.URL, "https://"), Module: defaultModule, Interval: time.Minute}
+	s.probe(kept)
+	s.probe(dropped)
+
+	s.Reload(modules, []Target{kept})
+	defer s.Reload(modules, nil)
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.connections[defaultModule] != connections {
+		t.Errorf("expected the connections of the unchanged module to be kept")
+	}
+	if _, ok := s.results[dropped.Target]; ok {
+		t.Errorf("expected the results of %s to be dropped", dropped.Target)
+	}
+	if _, ok := s.results[kept.Target]; !ok {
+		t.Errorf("expected the results of %s to be kept", kept.Target)
+	}
+}
+
+// Test that the targets of a module that a reload removed aren't probed by
+// the loops that were running before it
+func TestSchedulerReloadRemovedModule(t *testing.T) {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	modules := testModules(&tls.Config{
+		RootCAs: certPool(),
+	})
+	modules["removed"] = modules[defaultModule]
+	target := Target{Target: server.URL, Module: "removed", Interval: time.Minute}
+
+	s := newScheduler(modules, nil)
+	s.Run([]Target{target})
+	stop := s.loops[target.Target].stop
+
+	s.Reload(testModules(&tls.Config{RootCAs: certPool()}), nil)
+
+	// The old loop must return without probing, and a probe that was
+	// already past the check must not panic
+	s.run(target, stop)
+	s.probe(target)
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if _, ok := s.results[target.Target]; ok {
+		t.Errorf("expected no results for the target of the removed module")
+	}
+}
+
+// Test that a reload only restarts the loops of the targets that are new or
+// have changed, along with those of the modules that have
+func TestSchedulerReloadLoops(t *testing.T) {
+	modules := testModules(&tls.Config{})
+	modules["other"] = &module{}
+	unchanged := Target{Target: "127.0.0.1:1", Module: defaultModule, Interval: time.Hour}
+	interval := Target{Target: "127.0.0.1:2", Module: defaultModule, Interval: time.Hour}
+	other := Target{Target: "127.0.0.1:3", Module: "other", Interval: time.Hour}
+	removed := Target{Target: "127.0.0.1:4", Module: defaultModule, Interval: time.Hour}
+
+	s := newScheduler(modules, nil)
+	s.Run([]Target{unchanged, interval, other, removed})
+	before := map[string]targetLoop{}
+	for target, l := range s.loops {
+		before[target] = l
+	}
+
+	reloaded := map[string]*module{defaultModule: modules[defaultModule], "other": &module{}}
+	added := Target{Target: "127.0.0.1:5", Module: defaultModule, Interval: time.Hour}
+	interval.Interval = time.Minute
+	s.Reload(reloaded, []Target{unchanged, interval, other, added})
+	defer s.Reload(reloaded, nil)
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.loops[unchanged.Target] != before[unchanged.Target] {
+		t.Errorf("expected the loop of the unchanged target to be kept")
+	}
+	for _, target := range []string{interval.Target, other.Target} {
+		if s.loops[target] == before[target] {
+			t.Errorf("expected the loop of %s to be restarted", target)
+		}
+		select {
+		case <-before[target].stop:
+		default:
+			t.Errorf("expected the previous loop of %s to be stopped", target)
+		}
+	}
+	if _, ok := s.loops[removed.Target]; ok {
+		t.Errorf("expected no loop for the removed target")
+	}
+	if _, ok := s.loops[added.Target]; !ok {
+		t.Errorf("expected a loop for the added target")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/metrics"
+)
+
+// kubernetesProber is the prober whose targets are patterns of TLS secrets in
+// a Kubernetes cluster, like kubernetes/ingress-*/*-tls, whose certificates
+// are read from the API rather than probed
+const kubernetesProber = "kubernetes"
+
+// tlsSecretType is the type of the secrets that the kubernetes prober reads,
+// like those that cert-manager issues
+const tlsSecretType = "kubernetes.io/tls"
+
+// parseSecretPattern parses the target of the kubernetes prober, which is
+// <namespace>/<secret>, optionally after kubernetes/, where both are
+// patterns like those of path.Match
+func parseSecretPattern(target string) (namespace, name string, err error) {
+	parts := strings.Split(target, "/")
+	if len(parts) == 3 && parts[0] == kubernetesProber {
+		parts = parts[1:]
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("invalid target " + target + ", expected kubernetes/<namespace>/<secret>")
+	}
+	for _, p := range parts {
+		if _, err := path.Match(p, ""); err != nil {
+			return "", "", fmt.Errorf("invalid pattern %s: %s", p, err)
+		}
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// probeSecrets reads the certificates in the tls.crt of each of the TLS
+// secrets that the pattern in the target matches, within the timeout, in a
+// span of its own. A pattern for the namespace lists the secrets of every
+// namespace, which the exporter must be allowed to.
+func (e *Exporter) probeSecrets() ([]metrics.SecretResult, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	ctx, span := probeTracer.Start(ctx, "probe", spanKindInternal)
+	span.SetAttribute("target", e.target)
+	span.SetAttribute("probe_id", e.probeID)
+	span.SetAttribute("protocol", kubernetesProber)
+	defer span.End()
+
+	results, err := e.readSecrets(ctx)
+	if err != nil {
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return nil, err
+	}
+	e.logger.Debugln(fmt.Sprintf("The pattern %s matched %d secrets", e.target, len(results)))
+
+	return results, nil
+}
+
+// readSecrets lists the secrets that the target matches and parses their
+// certificates
+func (e *Exporter) readSecrets(ctx context.Context) ([]metrics.SecretResult, error) {
+	namespace, name, err := parseSecretPattern(e.target)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := e.kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	if e.kubernetes.Kubeconfig != "" {
+		defer client.client.CloseIdleConnections()
+	}
+
+	listNamespace := namespace
+	if strings.ContainsAny(namespace, `*?[\`) {
+		listNamespace = ""
+	}
+	secrets, err := client.secrets(ctx, listNamespace, tlsSecretType)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []metrics.SecretResult
+	for _, secret := range secrets {
+		if ok, _ := path.Match(namespace, secret.Metadata.Namespace); !ok {
+			continue
+		}
+		if ok, _ := path.Match(name, secret.Metadata.Name); !ok {
+			continue
+		}
+
+		ref := secret.Metadata.Namespace + "/" + secret.Metadata.Name
+		certs, err := parsePEMCertificates(ref+" tls.crt", secret.Data["tls.crt"])
+		if err != nil {
+			e.logger.Errorln(err)
+		}
+		if e.metricsOptions.LeafOnly && len(certs) > 1 {
+			certs = certs[:1]
+		}
+		results = append(results, metrics.SecretResult{
+			Namespace: secret.Metadata.Namespace,
+			Name:      secret.Metadata.Name,
+			Certs:     certs,
+			Err:       err,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Namespace != results[j].Namespace {
+			return results[i].Namespace < results[j].Namespace
+		}
+		return results[i].Name < results[j].Name
+	})
+
+	return results, nil
+}
+
+// kubernetesClient returns the client for the module's kubeconfig, which is
+// read for every probe so that rotated credentials are picked up, or for the
+// cluster that the exporter runs in without one
+func (e *Exporter) kubernetesClient() (*kubernetesClient, error) {
+	if e.kubernetes.Kubeconfig == "" {
+		return kubernetes()
+	}
+
+	return kubeconfigClient(e.kubernetes.Kubeconfig, e.kubernetes.Context)
+}
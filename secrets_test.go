@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newSecretsAPI returns a Kubernetes API server that lists the secrets, a
+// page of two at a time, to the requests with the token
+func newSecretsAPI(t *testing.T, token string, secrets []kubernetesSecret) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("fieldSelector") != "type=kubernetes.io/tls" {
+			t.Errorf("unexpected fieldSelector %s", r.URL.Query().Get("fieldSelector"))
+		}
+
+		namespace := ""
+		switch {
+		case r.URL.Path == "/api/v1/secrets":
+		case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/") && strings.HasSuffix(r.URL.Path, "/secrets"):
+			namespace = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/secrets")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var matched []kubernetesSecret
+		for _, s := range secrets {
+			if namespace == "" || s.Metadata.Namespace == namespace {
+				matched = append(matched, s)
+			}
+		}
+
+		list := kubernetesSecretList{}
+		start := 0
+		if r.URL.Query().Get("continue") == "2" {
+			start = 2
+		}
+		if start+2 < len(matched) {
+			list.Items = matched[start : start+2]
+			list.Metadata.Continue = "2"
+		} else {
+			list.Items = matched[start:]
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+}
+
+func newTLSSecret(namespace, name, crt string) kubernetesSecret {
+	s := kubernetesSecret{Data: map[string][]byte{"tls.crt": []byte(crt)}}
+	s.Metadata.Namespace, s.Metadata.Name = namespace, name
+
+	return s
+}
+
+// Test that the TLS secrets that the pattern of the target matches are each
+// read by the kubernetes prober, with namespace and secret labels, from every
+// page of the list
+func TestProbeHandlerKubernetes(t *testing.T) {
+	api := newSecretsAPI(t, "token", []kubernetesSecret{
+		newTLSSecret("ingress-public", "example-tls", caCert+"\n"+serverCert),
+		newTLSSecret("ingress-public", "broken-tls", "not a certificate"),
+		newTLSSecret("ingress-internal", "internal-tls", serverCert),
+		newTLSSecret("monitoring", "probe-identity", clientCert),
+	})
+	defer api.Close()
+
+	kubernetesAPI = &kubernetesClient{host: api.URL, token: "token", client: api.Client()}
+	defer func() { kubernetesAPI = nil }()
+
+	c, err := parseConfig([]byte(`
+modules:
+  secrets:
+    prober: kubernetes
+  leaf:
+    prober: kubernetes
+    leaf_only: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		module, target string
+		expected       []string
+		unexpected     []string
+	}{
+		{
+			module: "secrets",
+			target: "kubernetes/ingress-*/*-tls",
+			expected: []string{
+				"ssl_kubernetes_list_success 1",
+				"ssl_kubernetes_secrets_matched 3",
+				`ssl_kubernetes_secret_read_success{namespace="ingress-public",secret="example-tls"} 1`,
+				`ssl_kubernetes_secret_certs{namespace="ingress-public",secret="example-tls"} 2`,
+				`ssl_kubernetes_secret_cert_not_after{issuer_cn="ribbybibby.me",namespace="ingress-internal",secret="internal-tls",serial_no=`,
+				`ssl_kubernetes_secret_read_success{namespace="ingress-public",secret="broken-tls"} 0`,
+			},
+			unexpected: []string{"probe-identity", "ssl_tls_connect_success"},
+		},
+		{
+			module:   "leaf",
+			target:   "ingress-public/example-tls",
+			expected: []string{"ssl_kubernetes_secrets_matched 1", `ssl_kubernetes_secret_certs{namespace="ingress-public",secret="example-tls"} 1`},
+		},
+		{
+			module:   "secrets",
+			target:   "kubernetes/monitoring/*-tls",
+			expected: []string{"ssl_kubernetes_list_success 1", "ssl_kubernetes_secrets_matched 0"},
+		},
+		{
+			module:   "secrets",
+			target:   "kubernetes/monitoring/[tls",
+			expected: []string{"ssl_kubernetes_list_success 0", "ssl_kubernetes_secrets_matched 0"},
+		},
+	} {
+		req, _ := http.NewRequest("GET", "/probe?module="+test.module+"&target="+test.target, nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+
+		for _, want := range test.expected {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Errorf("%s: expected `%s`", test.target, want)
+			}
+		}
+		for _, unwanted := range test.unexpected {
+			if strings.Contains(rr.Body.String(), unwanted) {
+				t.Errorf("%s: expected no `%s`", test.target, unwanted)
+			}
+		}
+	}
+}
+
+// Test the parsing of the targets of the kubernetes prober
+func TestParseSecretPattern(t *testing.T) {
+	for target, want := range map[string][2]string{
+		"kubernetes/ingress/*-tls": {"ingress", "*-tls"},
+		"ingress/example-tls":      {"ingress", "example-tls"},
+		"kubernetes/example-tls":   {"kubernetes", "example-tls"},
+	} {
+		namespace, name, err := parseSecretPattern(target)
+		if err != nil {
+			t.Errorf("%s: %s", target, err)
+			continue
+		}
+		if namespace != want[0] || name != want[1] {
+			t.Errorf("%s: expected %s/%s, got %s/%s", target, want[0], want[1], namespace, name)
+		}
+	}
+
+	for _, target := range []string{"", "example-tls", "kubernetes/a/b/c", "a/b/c", "ingress/", "ingress/[tls"} {
+		if _, _, err := parseSecretPattern(target); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceName is the name the exporter is run under as a Windows service. The
+// service control manager doesn't check it for services that run in their
+// own process.
+const serviceName = namespace + "_exporter"
+
+// windowsService answers the requests of the service control manager
+type windowsService struct {
+	shutdown func()
+	stopped  <-chan struct{}
+}
+
+// Execute implements svc.Handler
+func (s windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(2 * shutdownTimeout / time.Millisecond)}
+				s.shutdown()
+				<-s.stopped
+				return false, 0
+			}
+		case <-s.stopped:
+			// The exporter stopped on its own, like on a Ctrl+C
+			return false, 0
+		}
+	}
+}
+
+// runService runs the exporter as a Windows service, when it was started by
+// the service control manager rather than from a console
+func runService(shutdown func(), stopped <-chan struct{}) (func(), error) {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return nil, err
+	}
+	if interactive {
+		return func() {}, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(serviceName, windowsService{shutdown: shutdown, stopped: stopped}); err != nil {
+			log.Errorln("Error running as a Windows service: " + err.Error())
+			shutdown()
+		}
+	}()
+
+	return func() { <-done }, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	servingCertNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "serving_cert_not_before"),
+		"NotBefore of the certificate that the exporter serves its web endpoints with, expressed as a Unix Epoch Time",
+		[]string{"serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+	servingCertNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "serving_cert_not_after"),
+		"NotAfter of the certificate that the exporter serves its web endpoints with, expressed as a Unix Epoch Time",
+		[]string{"serial_no", "issuer_cn", "subject_cn"}, nil,
+	)
+)
+
+// newServingConfig returns the TLS configuration that the web endpoints are
+// served with. The certificate is taken from the loader for each handshake,
+// so that a renewed one is served as soon as it's reloaded.
+func newServingConfig(l *tlsConfigLoader) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			config := l.Config()
+			if len(config.Certificates) == 0 {
+				return nil, errors.New("no serving certificate loaded")
+			}
+			return &config.Certificates[0], nil
+		},
+	}
+}
+
+// servingCertCollector exposes the expiry of the certificate that the web
+// endpoints are served with, as it was last loaded
+type servingCertCollector struct {
+	loader *tlsConfigLoader
+}
+
+// Describe implements prometheus.Collector
+func (c servingCertCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- servingCertNotBefore
+	ch <- servingCertNotAfter
+}
+
+// Collect implements prometheus.Collector
+func (c servingCertCollector) Collect(ch chan<- prometheus.Metric) {
+	cert := c.loader.leaf()
+	if cert == nil {
+		return
+	}
+
+	labels := []string{cert.SerialNumber.String(), cert.Issuer.CommonName, cert.Subject.CommonName}
+	ch <- prometheus.MustNewConstMetric(servingCertNotBefore, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), labels...)
+	ch <- prometheus.MustNewConstMetric(servingCertNotAfter, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), labels...)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Test that the web endpoints serve the loaded certificate, and that its
+// expiry follows reloads
+func TestServingCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	write := func(cert, key string) {
+		if err := ioutil.WriteFile(certFile, []byte(cert), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, []byte(key), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(serverCert, serverKey)
+
+	loader, err := newTLSConfigLoader("test", TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// StartTLS would add a certificate of its own to the configuration
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener = tls.NewListener(server.Listener, newServingConfig(loader))
+	server.Start()
+	defer server.Close()
+	target := "https://" + server.Listener.Addr().String()
+
+	for _, test := range []struct {
+		cert, key string
+		connect   string
+	}{
+		{serverCert, serverKey, "ssl_tls_connect_success 1"},
+		{expiredCert, expiredKey, "ssl_tls_connect_success 0"},
+	} {
+		write(test.cert, test.key)
+		if err := loader.Reload(); err != nil {
+			t.Fatal(err)
+		}
+
+		rr, err := probe(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(rr.Body.String(), test.connect) {
+			t.Errorf("expected `%s`", test.connect)
+		}
+
+		block, _ := pem.Decode([]byte(test.cert))
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(servingCertCollector{loader: loader})
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, mf := range mfs {
+			if mf.GetName() != "ssl_exporter_serving_cert_not_after" {
+				continue
+			}
+			found = true
+			if v := mf.GetMetric()[0].GetGauge().GetValue(); v != float64(leaf.NotAfter.Unix()) {
+				t.Errorf("expected ssl_exporter_serving_cert_not_after %d, got %v", leaf.NotAfter.Unix(), v)
+			}
+		}
+		if !found {
+			t.Errorf("expected ssl_exporter_serving_cert_not_after")
+		}
+	}
+}
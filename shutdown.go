@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long the requests in progress are given to finish
+// when the exporter is stopped
+const shutdownTimeout = 10 * time.Second
+
+// notifyShutdown closes stop when the exporter is asked to stop: by SIGINT or
+// SIGTERM or, when it runs as a Windows service, by the service control
+// manager. The exporter should close stopped once it has shut down, and then
+// call the returned function, which waits for the service to be reported as
+// stopped.
+func notifyShutdown(stop chan<- struct{}, stopped <-chan struct{}) (func(), error) {
+	var once sync.Once
+	shutdown := func() {
+		once.Do(func() { close(stop) })
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		shutdown()
+	}()
+
+	return runService(shutdown, stopped)
+}
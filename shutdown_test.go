@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Test that SIGTERM asks the exporter to stop rather than killing it
+func TestNotifyShutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals can't be sent to a process on Windows")
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	serviceStopped, err := notifyShutdown(stop, stopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-stop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected SIGTERM to close stop")
+	}
+
+	close(stopped)
+	serviceStopped()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// spiffeProber is the prober whose targets are SPIFFE workloads: the socket
+// of a Workload API, or a TLS server that presents its X.509-SVID
+const spiffeProber = "spiffe"
+
+// trustDomainRE matches the names of SPIFFE trust domains
+var trustDomainRE = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// readBundle returns the trust bundle in the TrustBundle file, or nil if
+// there isn't one. It's read for every probe, like the OCSP certificate, so
+// that a rotation of the bundle is seen.
+func (p SPIFFEProbe) readBundle() (*prober.SPIFFEBundle, error) {
+	if p.TrustBundle == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(p.TrustBundle)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := prober.ParseSPIFFEBundle(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p.TrustBundle, err)
+	}
+	bundle.TrustDomain = p.TrustDomain
+	bundle.Modified = info.ModTime()
+
+	return bundle, nil
+}
+
+// probeSPIFFE fetches the SVIDs of the workload in the target and verifies
+// them against the module's trust bundle, within the timeout, in a span of
+// its own. The bundle is returned even when the probe fails.
+func (e *Exporter) probeSPIFFE() (*prober.SPIFFEResult, *prober.SPIFFEBundle, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	ctx, span := probeTracer.Start(ctx, "probe", spanKindInternal)
+	span.SetAttribute("target", e.target)
+	span.SetAttribute("probe_id", e.probeID)
+	span.SetAttribute("protocol", spiffeProber)
+	defer span.End()
+
+	bundle, err := e.spiffe.readBundle()
+	if err != nil {
+		e.logger.Errorln("Error reading the trust bundle: " + err.Error())
+		span.SetError(err)
+		return nil, nil, err
+	}
+
+	opts := prober.Options{
+		TLSConfig: e.tlsConfig,
+		Logger:    e.logger,
+		Resolver:  e.resolver,
+		TorProxy:  e.torProxy,
+	}
+	opts.Tracer = e.tracer()
+
+	result, err := prober.ProbeSPIFFE(ctx, e.target, bundle, opts)
+	if err != nil {
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return nil, bundle, err
+	}
+	for _, svid := range result.SVIDs {
+		if svid.VerifyErr != nil {
+			e.logger.Errorln("The SVID " + svid.ID + " isn't valid: " + svid.VerifyErr.Error())
+			span.SetError(svid.VerifyErr)
+		}
+	}
+
+	return result, bundle, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the SVID of a TLS server is verified against the trust bundle of
+// the module, and that the bundle is reported
+func TestProbeHandlerSPIFFE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.org"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := url.Parse("spiffe://example.org/payments")
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		URIs:         []*url.URL{id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caTemplate, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	bundle := filepath.Join(dir, "bundle.pem")
+	if err := ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := parseConfig([]byte(`
+modules:
+  spiffe:
+    prober: spiffe
+    spiffe:
+      trust_bundle: ` + bundle + `
+      trust_domain: example.org
+  other:
+    prober: spiffe
+    spiffe:
+      trust_bundle: ` + bundle + `
+      trust_domain: other.org
+  missing:
+    prober: spiffe
+    spiffe:
+      trust_bundle: ` + filepath.Join(dir, "missing.pem") + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := server.Listener.Addr().String()
+	for module, expected := range map[string][]string{
+		"spiffe":  {"ssl_spiffe_probe_success 1", `ssl_spiffe_svid_valid{serial_no="2",spiffe_id="spiffe://example.org/payments",trust_domain="example.org"} 1`, `ssl_spiffe_bundle_certs{source="file",trust_domain="example.org"} 1`, "ssl_spiffe_bundle_modified"},
+		"other":   {"ssl_spiffe_probe_success 1", `ssl_spiffe_svid_valid{serial_no="2",spiffe_id="spiffe://example.org/payments",trust_domain="example.org"} 0`},
+		"missing": {"ssl_spiffe_probe_success 0"},
+	} {
+		req, _ := http.NewRequest("GET", "/probe?module="+module+"&target="+target, nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+
+		for _, want := range expected {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Errorf("%s: expected `%s`", module, want)
+			}
+		}
+		if strings.Contains(rr.Body.String(), "ssl_tls_connect_success") {
+			t.Errorf("%s: expected no metrics of a TLS probe", module)
+		}
+	}
+}
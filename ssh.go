@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// sshProber is the prober whose targets are SSH servers, or files of OpenSSH
+// certificates, whose certificates are reported rather than X.509 ones
+const sshProber = "ssh"
+
+// probeSSH reads the host certificate of the SSH server in the target, or
+// the certificates in the file when the target is an absolute path, within
+// the timeout, in a span of its own
+func (e *Exporter) probeSSH() (*prober.SSHResult, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	ctx, span := probeTracer.Start(ctx, "probe", spanKindInternal)
+	span.SetAttribute("target", e.target)
+	span.SetAttribute("probe_id", e.probeID)
+	span.SetAttribute("protocol", sshProber)
+	defer span.End()
+
+	var (
+		result *prober.SSHResult
+		err    error
+	)
+	if filepath.IsAbs(e.target) {
+		result, err = prober.ReadSSHCertificates(e.target)
+	} else {
+		opts := prober.Options{
+			Logger:   e.logger,
+			Resolver: e.resolver,
+		}
+		opts.Tracer = e.tracer()
+		result, err = prober.ProbeSSH(ctx, e.target, opts)
+	}
+	if err != nil {
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Test that the OpenSSH certificates of a file are reported by the ssh
+// prober, rather than the metrics of a TLS probe
+func TestProbeHandlerSSH(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var signers []ssh.Signer
+	for i := 0; i < 2; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, signer)
+	}
+	cert := &ssh.Certificate{
+		Key:             signers[1].PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "deploy",
+		ValidPrincipals: []string{"deploy"},
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "id_ecdsa-cert.pub"), ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := parseConfig([]byte(`
+modules:
+  openssh:
+    prober: ssh
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules, err := loadModules(c, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for target, expected := range map[string][]string{
+		filepath.Join(dir, "id_ecdsa-cert.pub"): {"ssl_ssh_probe_success 1", "ssl_ssh_certs 1", `ssl_ssh_cert_valid_before{key_fingerprint=`, `key_id="deploy"`},
+		filepath.Join(dir, "missing-cert.pub"):  {"ssl_ssh_probe_success 0"},
+	} {
+		req, _ := http.NewRequest("GET", "/probe?module=openssh&target="+target, nil)
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, modules)
+
+		for _, want := range expected {
+			if !strings.Contains(rr.Body.String(), want) {
+				t.Errorf("%s: expected `%s`", filepath.Base(target), want)
+			}
+		}
+		if strings.Contains(rr.Body.String(), "ssl_tls_connect_success") {
+			t.Errorf("%s: expected no metrics of a TLS probe", filepath.Base(target))
+		}
+	}
+}
@@ -1,254 +1,553 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
+	"github.com/ribbybibby/ssl_exporter/pkg/metrics"
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 const (
-	namespace = "ssl"
-)
-
-var (
-	tlsConnectSuccess = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "tls_connect_success"),
-		"If the TLS connection was a success",
-		nil, nil,
-	)
-	clientProtocol = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "client_protocol"),
-		"The protocol used by the exporter to connect to the target",
-		[]string{"protocol"}, nil,
-	)
-	notBefore = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_not_before"),
-		"NotBefore expressed as a Unix Epoch Time",
-		[]string{"serial_no", "issuer_cn"}, nil,
-	)
-	notAfter = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_not_after"),
-		"NotAfter expressed as a Unix Epoch Time",
-		[]string{"serial_no", "issuer_cn"}, nil,
-	)
-	commonName = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_subject_common_name"),
-		"Subject Common Name",
-		[]string{"serial_no", "issuer_cn", "subject_cn"}, nil,
-	)
-	subjectAlernativeDNSNames = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_subject_alternative_dnsnames"),
-		"Subject Alternative DNS Names",
-		[]string{"serial_no", "issuer_cn", "dnsnames"}, nil,
-	)
-	subjectAlernativeIPs = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_subject_alternative_ips"),
-		"Subject Alternative IPs",
-		[]string{"serial_no", "issuer_cn", "ips"}, nil,
-	)
-	subjectAlernativeEmailAddresses = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_subject_alternative_emails"),
-		"Subject Alternative Email Addresses",
-		[]string{"serial_no", "issuer_cn", "emails"}, nil,
-	)
-	subjectOrganizationUnits = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_subject_organization_units"),
-		"Subject Organization Units",
-		[]string{"serial_no", "issuer_cn", "subject_ou"}, nil,
-	)
+	namespace = metrics.Namespace
 )
 
 // Exporter is the exporter type...
 type Exporter struct {
+	ctx       context.Context
+	probeID   string
+	logger    *probeLogger
 	target    string
 	timeout   time.Duration
 	tlsConfig *tls.Config
+
+	// proberName is the module's prober, for targets without a scheme
+	proberName string
+
+	// keystorePasswords are the passwords of the stores that the
+	// truststore prober reads
+	keystorePasswords KeystorePasswords
+
+	// spiffe is the trust bundle that the spiffe prober verifies the SVIDs
+	// against
+	spiffe SPIFFEProbe
+
+	// kubernetes is the cluster whose secrets the kubernetes prober reads
+	kubernetes KubernetesProbe
+
+	// recordVerifyErrors completes the handshake even when the certificate
+	// chain can't be verified, so that the chain can still be inspected
+	recordVerifyErrors bool
+
+	// metricsOptions chooses the metrics that are collected
+	metricsOptions metrics.Options
+
+	// resolver, if set, looks up the address of the target
+	resolver prober.Resolver
+
+	// connections, if set, keeps the connection to the target open for the
+	// next probe
+	connections *prober.Connections
+
+	// httpRequest, if set, returns the request for https targets
+	httpRequest func() (prober.HTTPRequest, error)
+
+	// grpcRequest configures the probes of grpc targets
+	grpcRequest prober.GRPCRequest
+
+	// kafkaRequest, if set, returns the probes of kafka targets
+	kafkaRequest func() (prober.KafkaRequest, error)
+
+	// trustStores are verified against as well, by name
+	trustStores map[string]*x509.CertPool
+
+	// expected, if set, returns what the leaf that the target serves should
+	// be like
+	expected func() (*metrics.Expectation, error)
+
+	// changes, if set, tracks the changes of the target's leaf between
+	// probes, and webhooks are sent the events about them
+	changes  *changeTracker
+	webhooks webhooks
+
+	// allAddresses also probes each of the addresses of the target
+	allAddresses bool
+
+	// torProxy is the SOCKS proxy of Tor that .onion targets are dialed
+	// through
+	torProxy string
+
+	// proxyURL, if set, is the proxy that the targets are dialed through
+	proxyURL *url.URL
+
+	// clientProfiles are the old clients whose handshakes are tried as well
+	clientProfiles []prober.ClientProfile
+
+	// certCompression also offers to compress the certificate
+	certCompression bool
+
+	// ports are probed for targets without a port of their own
+	ports []int
+
+	// workers is how many of the files that the file prober's pattern
+	// matches are read at the same time, each within itemTimeout if it's
+	// set
+	workers     int
+	itemTimeout time.Duration
+
+	// ctLog, if set, looks up the leaf in the Certificate Transparency logs
+	ctLog *ctLog
+
+	// ocspCheck, if set, asks the leaf's OCSP responder for its status when
+	// the target doesn't staple a response
+	ocspCheck *ocspCache
+
+	// crlCheck, if set, downloads the CRLs of the leaf's distribution points
+	crlCheck *crlCache
+
+	// ocspCerts, if set, makes the target an OCSP responder, which is asked
+	// for the status of the certificate it returns
+	ocspCerts func() (cert, issuer *x509.Certificate, err error)
+
+	// phases, if set, records the duration of the phases of the probe
+	phases *phaseObserver
+
+	// timings, if set, adds up the durations of the phases of the probe, for
+	// the metrics of the probe itself
+	timings *phaseTimings
 }
 
 // Describe metrics
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- tlsConnectSuccess
-	ch <- clientProtocol
-	ch <- notAfter
-	ch <- commonName
-	ch <- subjectAlernativeDNSNames
-	ch <- subjectAlernativeIPs
-	ch <- subjectAlernativeEmailAddresses
-	ch <- subjectOrganizationUnits
+	metrics.Describe(ch)
 }
 
 // Collect metrics
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	var peerCertificates []*x509.Certificate
+	start := time.Now()
+	e.timings = newPhaseTimings()
+	e.collect(ch)
+	metrics.CollectTimings(ch, time.Since(start), e.timings.snapshot())
+}
+
+// collect probes the target with the module's prober and sends the metrics
+// of the probe
+func (e *Exporter) collect(ch chan<- prometheus.Metric) {
+	if e.ocspCerts != nil {
+		result, err := e.probeOCSP()
+		metrics.CollectOCSP(ch, result, err)
+		return
+	}
+	if e.proberName == sshProber {
+		result, err := e.probeSSH()
+		metrics.CollectSSH(ch, result, err)
+		return
+	}
+	if e.proberName == spiffeProber {
+		result, bundle, err := e.probeSPIFFE()
+		metrics.CollectSPIFFE(ch, result, bundle, err, e.metricsOptions)
+		return
+	}
+	if e.proberName == fileProber {
+		results, err := e.probeFiles()
+		metrics.CollectFiles(ch, results, err, e.metricsOptions)
+		return
+	}
+	if e.proberName == kubernetesProber {
+		results, err := e.probeSecrets()
+		metrics.CollectSecrets(ch, results, err, e.metricsOptions)
+		return
+	}
+	if e.proberName == trustStoreProber {
+		certs, err := readTrustStore(e.target, e.keystorePasswords)
+		if err != nil {
+			e.logger.Errorln(err)
+		}
+		metrics.CollectTrustStore(ch, certs, err, e.metricsOptions)
+		return
+	}
 
-	// Parse the target and return the appropriate connection protocol and target address
-	target, proto, err := parseTarget(e.target)
+	targets, err := e.splitPorts()
 	if err != nil {
-		log.Errorln(err)
-		ch <- prometheus.MustNewConstMetric(
-			tlsConnectSuccess, prometheus.GaugeValue, 0,
-		)
+		e.logger.Errorln(err)
+		metrics.CollectWithOptions(ch, nil, err, e.metricsOptions)
+		return
+	}
+	if targets != nil {
+		e.collectPorts(ch, targets)
 		return
 	}
 
-	ch <- prometheus.MustNewConstMetric(
-		clientProtocol, prometheus.GaugeValue, 1, proto,
-	)
+	e.collectTLS(ch)
+}
 
-	if proto == "https" {
-		ch <- prometheus.MustNewConstMetric(
-			clientProtocol, prometheus.GaugeValue, 0, "tcp",
-		)
-
-		// Create the http client
-		client := &http.Client{
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
-			Transport: &http.Transport{
-				TLSClientConfig: e.tlsConfig,
-				Proxy:           http.ProxyFromEnvironment,
-			},
-			Timeout: e.timeout,
-		}
+// collectTLS probes the target with a TLS handshake, and sends the metrics
+// of the certificates and of what's looked up about the leaf
+func (e *Exporter) collectTLS(ch chan<- prometheus.Metric) {
+	result, err := e.probe()
 
-		// Issue a GET request to the target
-		resp, err := client.Get(e.target)
+	opts := e.metricsOptions
+	if e.expected != nil {
+		expected, err := e.expected()
 		if err != nil {
-			log.Errorln(err)
-			ch <- prometheus.MustNewConstMetric(
-				tlsConnectSuccess, prometheus.GaugeValue, 0,
-			)
-			return
+			e.logger.Errorln("Error reading the expected certificate: " + err.Error())
 		}
+		opts.Expected = expected
+	}
+	metrics.CollectWithOptions(ch, result, err, opts)
 
-		// Check if the response from the target is encrypted
-		if resp.TLS == nil {
-			log.Errorln("The response from " + target + " is unencrypted")
-			ch <- prometheus.MustNewConstMetric(
-				tlsConnectSuccess, prometheus.GaugeValue, 0,
-			)
-			return
+	if err != nil || result.State == nil || len(result.State.PeerCertificates) == 0 {
+		return
+	}
+	leaf := result.State.PeerCertificates[0]
+	if e.changes != nil {
+		now := time.Now()
+		o := e.changes.observe(e.target, leaf, now)
+		metrics.CollectChange(ch, o.changed, o.lastChange)
+		if len(e.webhooks) > 0 {
+			e.webhooks.notify(e.target, leaf, o, opts.ExpiryThresholds, now)
 		}
+	}
+	if e.ctLog != nil {
+		e.collectCTLog(ch, leaf)
+	}
+	if e.ocspCheck != nil && len(result.State.OCSPResponse) == 0 {
+		e.collectOCSPCheck(ch, result.State)
+	}
+	if e.crlCheck != nil {
+		e.collectCRLCheck(ch, result.State)
+	}
+}
 
-		peerCertificates = resp.TLS.PeerCertificates
+// collectCTLog looks up the leaf in the Certificate Transparency logs. The
+// metrics are left out when the lookup fails, rather than reporting the
+// leaf as not logged.
+func (e *Exporter) collectCTLog(ch chan<- prometheus.Metric, leaf *x509.Certificate) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
 
-	} else if proto == "tcp" {
-		ch <- prometheus.MustNewConstMetric(
-			clientProtocol, prometheus.GaugeValue, 0, "https",
-		)
+	loggedAt, err := e.ctLog.lookup(ctx, leaf)
+	if err != nil {
+		e.logger.Errorln("Error looking up the leaf in the CT logs: " + err.Error())
+		return
+	}
+	metrics.CollectCTLog(ch, leaf, loggedAt, e.metricsOptions)
+}
+
+// collectOCSPCheck asks the leaf's OCSP responder for its status, as the
+// target didn't staple a response. Like the CT log lookups, the metrics are
+// left out when the request fails.
+func (e *Exporter) collectOCSPCheck(ch chan<- prometheus.Metric, state *tls.ConnectionState) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	opts := prober.Options{Logger: e.logger, Resolver: e.resolver}
+	if probeTracer != nil {
+		opts.Tracer = probeTracer
+	}
+	result, err := e.ocspCheck.lookup(ctx, state.PeerCertificates[0], prober.LeafIssuer(state), opts)
+	if err != nil {
+		e.logger.Errorln("Error checking the OCSP status of the leaf: " + err.Error())
+		return
+	}
+	if result != nil {
+		metrics.CollectOCSPResponse(ch, result)
+	}
+}
 
-		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: e.timeout}, "tcp", target, e.tlsConfig)
+// collectCRLCheck downloads the CRLs of the leaf's distribution points and
+// checks whether the leaf is in them. Unlike the CT log lookups, a CRL that
+// can't be downloaded is reported, as clients that rely on it fail too.
+func (e *Exporter) collectCRLCheck(ch chan<- prometheus.Metric, state *tls.ConnectionState) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	opts := prober.Options{Logger: e.logger, Resolver: e.resolver}
+	if probeTracer != nil {
+		opts.Tracer = probeTracer
+	}
+	leaf, issuer := state.PeerCertificates[0], prober.LeafIssuer(state)
+	for _, u := range crlURLs(leaf) {
+		result, err := e.crlCheck.lookup(ctx, u, issuer, opts)
 		if err != nil {
-			log.Errorln(err)
-			ch <- prometheus.MustNewConstMetric(
-				tlsConnectSuccess, prometheus.GaugeValue, 0,
-			)
-			return
+			e.logger.Errorln("Error downloading the CRL from " + u + ": " + err.Error())
 		}
+		metrics.CollectCRL(ch, u, result, err, leaf)
+	}
+}
 
-		state := conn.ConnectionState()
+// probe probes the target within the timeout, in a span of its own
+func (e *Exporter) probe() (*prober.Result, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	ctx, span := probeTracer.Start(ctx, "probe", spanKindInternal)
+	span.SetAttribute("target", e.target)
+	span.SetAttribute("probe_id", e.probeID)
+	defer span.End()
+
+	opts := prober.Options{
+		TLSConfig:          e.tlsConfig,
+		Logger:             e.logger,
+		Prober:             e.proberName,
+		RecordVerifyErrors: e.recordVerifyErrors,
+		Resolver:           e.resolver,
+		Connections:        e.connections,
+		TrustStores:        e.trustStores,
+		AllAddresses:       e.allAddresses,
+		TorProxy:           e.torProxy,
+		ProxyURL:           e.proxyURL,
+		ClientProfiles:     e.clientProfiles,
+		CertCompression:    e.certCompression,
+		GRPC:               e.grpcRequest,
+	}
+	if e.httpRequest != nil {
+		req, err := e.httpRequest()
+		if err != nil {
+			e.logger.Errorln(err)
+			span.SetError(err)
+			return nil, err
+		}
+		opts.HTTPRequest = req
+	}
+	if e.kafkaRequest != nil {
+		req, err := e.kafkaRequest()
+		if err != nil {
+			e.logger.Errorln(err)
+			span.SetError(err)
+			return nil, err
+		}
+		opts.Kafka = req
+	}
+	opts.Tracer = e.tracer()
 
-		peerCertificates = state.PeerCertificates
+	result, err := prober.Probe(ctx, e.target, opts)
+	if result != nil {
+		span.SetAttribute("protocol", result.Protocol)
+	}
+	if err != nil {
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return result, err
+	}
+	if result.VerifyErr != nil {
+		e.logger.Errorln(result.VerifyErr)
+		span.SetError(result.VerifyErr)
+	}
 
-		if len(peerCertificates) < 1 {
-			log.Errorln("No certificates found in connection state for " + target)
-			ch <- prometheus.MustNewConstMetric(
-				tlsConnectSuccess, prometheus.GaugeValue, 0,
-			)
-			return
-		}
-	} else {
-		log.Errorln("Unrecognised protocol: " + string(proto) + " for target: " + target)
-		ch <- prometheus.MustNewConstMetric(
-			tlsConnectSuccess, prometheus.GaugeValue, 0,
-		)
-		return
+	return result, nil
+}
+
+// probeOCSP probes the OCSP responder within the timeout, in a span of its
+// own
+func (e *Exporter) probeOCSP() (*prober.OCSPResult, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.timeout)
+	defer cancel()
+
+	ctx, span := probeTracer.Start(ctx, "probe", spanKindInternal)
+	span.SetAttribute("target", e.target)
+	span.SetAttribute("probe_id", e.probeID)
+	span.SetAttribute("protocol", ocspProber)
+	defer span.End()
+
+	cert, issuer, err := e.ocspCerts()
+	if err != nil {
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return nil, err
 	}
 
-	ch <- prometheus.MustNewConstMetric(
-		tlsConnectSuccess, prometheus.GaugeValue, 1,
-	)
+	opts := prober.Options{
+		TLSConfig: e.tlsConfig,
+		Logger:    e.logger,
+		Resolver:  e.resolver,
+	}
+	opts.Tracer = e.tracer()
 
-	// Remove duplicate certificates from the response
-	peerCertificates = uniq(peerCertificates)
+	result, err := prober.ProbeOCSP(ctx, e.target, cert, issuer, opts)
+	if err != nil {
+		e.logger.Errorln(err)
+		span.SetError(err)
+		return result, err
+	}
+	if result.ResponseErr != nil {
+		e.logger.Errorln(result.ResponseErr)
+		span.SetError(result.ResponseErr)
+	}
 
-	// Loop through returned certificates and create metrics
-	for _, cert := range peerCertificates {
+	return result, nil
+}
 
-		subjectCN := cert.Subject.CommonName
-		issuerCN := cert.Issuer.CommonName
-		subjectDNSNames := cert.DNSNames
-		subjectEmails := cert.EmailAddresses
-		subjectIPs := cert.IPAddresses
-		serialNum := cert.SerialNumber.String()
-		subjectOUs := cert.Subject.OrganizationalUnit
+func probeHandler(w http.ResponseWriter, r *http.Request, modules map[string]*module) {
+	debug := r.URL.Query().Get("debug") == "true"
 
-		if !cert.NotAfter.IsZero() {
-			ch <- prometheus.MustNewConstMetric(
-				notAfter, prometheus.GaugeValue, float64(cert.NotAfter.UnixNano()/1e9), serialNum, issuerCN,
-			)
-		}
+	targets := requestTargets(r)
+	if len(targets) > 1 && debug {
+		http.Error(w, "The debug output is only available for a single target", http.StatusBadRequest)
+		return
+	}
 
-		if !cert.NotBefore.IsZero() {
-			ch <- prometheus.MustNewConstMetric(
-				notBefore, prometheus.GaugeValue, float64(cert.NotBefore.UnixNano()/1e9), serialNum, issuerCN,
-			)
-		}
+	exporter := newRequestExporter(w, r, modules, debug)
+	if exporter == nil {
+		return
+	}
+	// A cached probe is shared by the requests that wait for it, so it
+	// isn't cancelled with the request that started it. It still ends with
+	// the timeout.
+	if probeResults != nil && !debug {
+		exporter.ctx = context.WithoutCancel(exporter.ctx)
+	}
 
-		if subjectCN != "" {
-			ch <- prometheus.MustNewConstMetric(
-				commonName, prometheus.GaugeValue, 1, serialNum, issuerCN, subjectCN,
-			)
+	// The targets are probed at the same time, with the same module and
+	// timeout, and their results told apart by a target label. Each of them
+	// takes one of the probe slots, as does each of the ports of a target
+	// with several, so those are probed here rather than by its Collect.
+	var limited int32
+	registry := prometheus.NewRegistry()
+	register := func(e *Exporter, labels prometheus.Labels) {
+		prometheus.WrapRegistererWith(labels, registry).MustRegister(&slotCollector{
+			ctx:       r.Context(),
+			collector: e,
+			limited:   &limited,
+		})
+	}
+	if len(targets) < 2 {
+		targets = []string{exporter.target}
+	}
+	for _, target := range targets {
+		e := *exporter
+		e.target = target
+		labels := prometheus.Labels{}
+		if len(targets) > 1 {
+			labels["target"] = target
 		}
 
-		if len(subjectDNSNames) > 0 {
-			ch <- prometheus.MustNewConstMetric(
-				subjectAlernativeDNSNames, prometheus.GaugeValue, 1, serialNum, issuerCN, ","+strings.Join(subjectDNSNames, ",")+",",
-			)
+		ports, err := e.splitPorts()
+		if err != nil || ports == nil {
+			register(&e, labels)
+			continue
 		}
+		for _, t := range ports {
+			portLabels := prometheus.Labels{"port": t.port}
+			for name, value := range labels {
+				portLabels[name] = value
+			}
+			register(e.forPort(t), portLabels)
+		}
+	}
+	gather := func() ([]*dto.MetricFamily, error) {
+		mfs, err := registry.Gather()
+		if atomic.LoadInt32(&limited) != 0 {
+			return nil, errProbeLimit
+		}
+		return mfs, err
+	}
 
-		if len(subjectEmails) > 0 {
-			ch <- prometheus.MustNewConstMetric(
-				subjectAlernativeEmailAddresses, prometheus.GaugeValue, 1, serialNum, issuerCN, ","+strings.Join(subjectEmails, ",")+",",
-			)
+	if debug {
+		mfs, err := gather()
+		if err == errProbeLimit {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
 		}
+		writeDebugOutput(w, exporter.probeID, mfs, err, exporter.logger)
+		return
+	}
+
+	// Probe, unless another request for the same query and timeout has
+	// recently, or is already
+	key := r.URL.Query().Encode() + "&timeout=" + exporter.timeout.String()
+	mfs, err := probeResults.gather(r.Context(), key, gather)
+	if err == errProbeLimit {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "An error has occurred during metrics gathering:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if len(subjectIPs) > 0 {
-			i := ","
-			for _, ip := range subjectIPs {
-				i = i + ip.String() + ","
+	// Serve
+	h := metricsHandler(gathered(mfs))
+	h.ServeHTTP(w, r)
+}
+
+// requestTargets returns the targets of a probe request, which may repeat the
+// target parameter or separate the targets with commas. A bare port after a
+// comma is part of the list of ports of the target before it, like the 8443
+// of host:443,8443.
+func requestTargets(r *http.Request) []string {
+	var targets []string
+	for _, value := range r.URL.Query()["target"] {
+		var parts []string
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if _, err := strconv.Atoi(part); err == nil && len(parts) > 0 {
+				parts[len(parts)-1] += "," + part
+				continue
 			}
-			ch <- prometheus.MustNewConstMetric(
-				subjectAlernativeIPs, prometheus.GaugeValue, 1, serialNum, issuerCN, i,
-			)
+			parts = append(parts, part)
 		}
+		targets = append(targets, parts...)
+	}
 
-		if len(subjectOUs) > 0 {
-			ch <- prometheus.MustNewConstMetric(
-				subjectOrganizationUnits, prometheus.GaugeValue, 1, serialNum, issuerCN, ","+strings.Join(subjectOUs, ",")+",",
-			)
+	var unique []string
+	seen := map[string]bool{}
+	for _, target := range targets {
+		if target == "" || seen[target] {
+			continue
 		}
+		seen[target] = true
+		unique = append(unique, target)
 	}
+	return unique
 }
 
-func probeHandler(w http.ResponseWriter, r *http.Request, tlsConfig *tls.Config) {
+// newRequestExporter returns an Exporter for the target and module in the
+// request. If the request is invalid, it writes an error response and returns
+// nil.
+func newRequestExporter(w http.ResponseWriter, r *http.Request, modules map[string]*module, debug bool) *Exporter {
 	target := r.URL.Query().Get("target")
 
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		moduleName = defaultModule
+	}
+	module, ok := modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return nil
+	}
+
+	timeout, err := scrapeTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	exporter := newModuleExporter(r, target, module, timeout, debug)
+	exporter.setServerName(r.URL.Query().Get("servername"))
+	w.Header().Set(probeIDHeader, exporter.probeID)
+
+	return exporter
+}
+
+// scrapeTimeout returns the timeout that Prometheus set for the request, or
+// the default of 10 seconds if it didn't set one
+func scrapeTimeout(r *http.Request) (time.Duration, error) {
 	// The following timeout block was taken wholly from the blackbox exporter
 	//   https://github.com/prometheus/blackbox_exporter/blob/master/main.go
 	var timeoutSeconds float64
@@ -256,8 +555,7 @@ func probeHandler(w http.ResponseWriter, r *http.Request, tlsConfig *tls.Config)
 		var err error
 		timeoutSeconds, err = strconv.ParseFloat(v, 64)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to parse timeout from Prometheus header: %s", err), http.StatusInternalServerError)
-			return
+			return 0, fmt.Errorf("Failed to parse timeout from Prometheus header: %s", err)
 		}
 	} else {
 		timeoutSeconds = 10
@@ -266,62 +564,70 @@ func probeHandler(w http.ResponseWriter, r *http.Request, tlsConfig *tls.Config)
 		timeoutSeconds = 10
 	}
 
-	timeout := time.Duration((timeoutSeconds) * 1e9)
+	return time.Duration((timeoutSeconds) * 1e9), nil
+}
+
+// newModuleExporter returns an Exporter that probes the target with the
+// module, within the timeout or the module's own timeout if it's shorter
+func newModuleExporter(r *http.Request, target string, module *module, timeout time.Duration, debug bool) *Exporter {
+	if module.Timeout > 0 && module.Timeout < timeout {
+		timeout = module.Timeout
+	}
 
+	probeID := newProbeID()
 	exporter := &Exporter{
+		ctx:       contextWithTraceparent(r.Context(), r.Header.Get("traceparent")),
+		probeID:   probeID,
+		logger:    newProbeLogger(probeID, debug),
 		target:    target,
 		timeout:   timeout,
-		tlsConfig: tlsConfig,
+		tlsConfig: module.tls.Config(),
+
+		proberName:        module.Prober,
+		keystorePasswords: module.KeystorePasswords,
+		spiffe:            module.SPIFFE,
+		kubernetes:        module.Kubernetes,
+
+		metricsOptions:  module.metricsOptions(),
+		resolver:        module.resolver(),
+		httpRequest:     module.httpRequest,
+		grpcRequest:     module.grpcRequest(),
+		kafkaRequest:    module.kafkaRequest,
+		trustStores:     module.trustStores(),
+		ctLog:           module.ct,
+		ocspCheck:       module.ocsp,
+		crlCheck:        module.crl,
+		allAddresses:    module.AllAddresses,
+		torProxy:        module.TorSOCKSAddress,
+		proxyURL:        module.proxyURL(),
+		clientProfiles:  module.clientProfiles(),
+		certCompression: module.CertCompression,
+		ports:           module.Ports,
+		workers:         module.Workers,
+		itemTimeout:     module.ItemTimeout,
 	}
-
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(exporter)
-
-	// Serve
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
-}
-
-func uniq(certs []*x509.Certificate) []*x509.Certificate {
-	r := []*x509.Certificate{}
-
-	for _, c := range certs {
-		if !contains(r, c) {
-			r = append(r, c)
-		}
+	if module.Prober == ocspProber {
+		exporter.ocspCerts = module.ocspCerts
 	}
-
-	return r
-}
-
-func contains(certs []*x509.Certificate, cert *x509.Certificate) bool {
-	for _, c := range certs {
-		if (c.SerialNumber.String() == cert.SerialNumber.String()) && (c.Issuer.CommonName == cert.Issuer.CommonName) {
-			return true
-		}
+	if !module.Expected.empty() {
+		exporter.expected = module.expectation
 	}
-	return false
-}
 
-func parseTarget(target string) (parsedTarget string, proto string, err error) {
-	if !strings.Contains(target, "://") {
-		target = "//" + target
-	}
+	return exporter
+}
 
-	u, err := url.Parse(target)
-	if err != nil {
-		return "", proto, err
+// setServerName replaces the server name of the handshake, and the name that
+// the certificate is verified against, with name, unless it's empty
+func (e *Exporter) setServerName(name string) {
+	if name == "" {
+		return
 	}
-
-	if u.Scheme != "" {
-		if u.Scheme == "https" {
-			return u.String(), "https", nil
-		}
-		return "", proto, errors.New("can't handle the scheme '" + u.Scheme + "' - try providing the target in the format <host>:<port>")
-	} else if u.Port() == "" {
-		return "https://" + u.Host, "https", nil
+	c := &tls.Config{}
+	if e.tlsConfig != nil {
+		c = e.tlsConfig.Clone()
 	}
-	return u.Host, "tcp", nil
+	c.ServerName = name
+	e.tlsConfig = c
 }
 
 func init() {
@@ -330,17 +636,28 @@ func init() {
 
 func main() {
 	var (
-		tlsConfig     *tls.Config
-		certificates  []tls.Certificate
-		rootCAs       *x509.CertPool
-		listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9219").String()
-		metricsPath   = kingpin.Flag("web.metrics-path", "Path under which to expose metrics").Default("/metrics").String()
-		probePath     = kingpin.Flag("web.probe-path", "Path under which to expose the probe endpoint").Default("/probe").String()
-		insecure      = kingpin.Flag("tls.insecure", "Skip certificate verification").Default("false").Bool()
-		clientAuth    = kingpin.Flag("tls.client-auth", "Enable client authentication").Default("false").Bool()
-		caFile        = kingpin.Flag("tls.cacert", "Local path to an alternative CA cert bundle").String()
-		certFile      = kingpin.Flag("tls.cert", "Local path to a client certificate file (for client authentication)").Default("cert.pem").String()
-		keyFile       = kingpin.Flag("tls.key", "Local path to a private key file (for client authentication)").Default("key.pem").String()
+		listenAddress  = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9219").String()
+		metricsPath    = kingpin.Flag("web.metrics-path", "Path under which to expose metrics").Default("/metrics").String()
+		probePath      = kingpin.Flag("web.probe-path", "Path under which to expose the probe endpoint").Default("/probe").String()
+		insecure       = kingpin.Flag("tls.insecure", "Skip certificate verification").Default("false").Bool()
+		clientAuth     = kingpin.Flag("tls.client-auth", "Enable client authentication").Default("false").Bool()
+		caFile         = kingpin.Flag("tls.cacert", "Local path to an alternative CA cert bundle").String()
+		certFile       = kingpin.Flag("tls.cert", "Local path to a client certificate file (for client authentication)").Default("cert.pem").String()
+		keyFile        = kingpin.Flag("tls.key", "Local path to a private key file (for client authentication)").Default("key.pem").String()
+		keyLogFile     = kingpin.Flag("tls.key-log-file", "Append the TLS secrets of the probes to this file, in the format Wireshark reads, to decrypt captures of them. Only for debugging.").String()
+		blackbox       = kingpin.Flag("compat.blackbox", "Also expose probe_success, probe_ssl_earliest_cert_expiry and probe_tls_version_info, like the blackbox exporter").Default("false").Bool()
+		configFile     = kingpin.Flag("config.file", "Path to a configuration file defining modules and targets to probe in the background").String()
+		reloadInterval = kingpin.Flag("tls.reload-interval", "How often to check the CA bundle and client certificate files for changes. Set to 0 to disable.").Default("30s").Duration()
+		timestamps     = kingpin.Flag("targets.timestamps", "Expose the results of the background probes with the time of the probe, rather than the time of the scrape").Default("false").Bool()
+		moduleLabel    = kingpin.Flag("targets.module-label", "Add a module label to the results of the background probes, alongside the target label").Default("false").Bool()
+		dnsCacheTTL    = kingpin.Flag("targets.dns-cache-max-ttl", "The longest time to cache the address of a background target for, if the TTL of its DNS records allows. Set to 0 to disable.").Default("5m").Duration()
+		histograms     = kingpin.Flag("targets.duration-histograms", "Record the duration of each phase of the background probes in a histogram for each target").Default("false").Bool()
+		stateFile      = kingpin.Flag("targets.state-file", "Keep the leaves of the background targets and the cached CT log lookups, OCSP responses and CRLs in this file, so that they survive restarts").String()
+		webCertFile    = kingpin.Flag("web.tls-cert-file", "Serve the web endpoints over TLS with this certificate. It's reloaded like the modules' files.").String()
+		webKeyFile     = kingpin.Flag("web.tls-key-file", "The key of --web.tls-cert-file").String()
+		maxConcurrency = kingpin.Flag("probe.max-concurrency", "The most requests to the probe endpoints, or targets of batch requests, that probe at the same time. The others wait for their turn, until their scrape timeout. Set to 0 for no limit.").Default("0").Int()
+		cacheTTL       = kingpin.Flag("probe.cache-ttl", "How long to reuse the result of a request to the probe endpoint for the requests with the same parameters, like those of several Prometheus servers. Set to 0 to disable.").Default("0s").Duration()
+		otlpEndpoint   = kingpin.Flag("tracing.otlp-endpoint", "Base URL of an OTLP/HTTP endpoint to send probe traces to, e.g. http://localhost:4318. Tracing is disabled when empty.").String()
 	)
 
 	log.AddFlags(kingpin.CommandLine)
@@ -348,36 +665,163 @@ func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 
-	if *caFile != "" {
-		caCert, err := ioutil.ReadFile(*caFile)
+	blackboxMetrics = *blackbox
+	if *maxConcurrency > 0 {
+		probeSlots = make(chan struct{}, *maxConcurrency)
+	}
+	if *cacheTTL > 0 {
+		probeResults = newResultCache(*cacheTTL)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	serviceStopped, err := notifyShutdown(stop, stopped)
+	if err != nil {
+		log.Fatalln("Error checking whether the exporter runs as a Windows service: ", err)
+	}
+
+	if *keyLogFile != "" {
+		w, err := openKeyLog(*keyLogFile)
 		if err != nil {
-			log.Fatalln(err)
+			log.Fatalln("Error opening the key log file: ", err)
 		}
+		keyLogWriter = w
+		log.Warnln("Writing the TLS secrets of the probes to " + *keyLogFile + ", anyone who can read it can decrypt them")
+	}
 
-		rootCAs = x509.NewCertPool()
-		rootCAs.AppendCertsFromPEM(caCert)
+	conf := &Config{}
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalln("Error loading config: ", err)
+		}
+		conf = c
 	}
 
+	defaultTLS := TLSConfig{
+		CAFile:             *caFile,
+		InsecureSkipVerify: *insecure,
+	}
 	if *clientAuth {
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-		if err != nil {
+		defaultTLS.CertFile = *certFile
+		defaultTLS.KeyFile = *keyFile
+	}
+
+	for scheme, p := range conf.Probers {
+		if err := prober.Register(scheme, &prober.ExecProber{Command: p.Command, Port: p.DefaultPort}); err != nil {
 			log.Fatalln(err)
 		}
-		certificates = append(certificates, cert)
 	}
 
-	tlsConfig = &tls.Config{
-		InsecureSkipVerify: *insecure,
-		Certificates:       certificates,
-		RootCAs:            rootCAs,
+	modules, err := loadModules(conf, defaultTLS)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	targets, err := loadTargets(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	reloader := newConfigReloader(*configFile, defaultTLS, conf, modules)
+	prometheus.MustRegister(clientCertCollector{modules: reloader.Modules})
+
+	if *reloadInterval > 0 {
+		reloader.Watch(*reloadInterval)
+	}
+
+	var serving *tlsConfigLoader
+	if *webCertFile != "" || *webKeyFile != "" {
+		if *webCertFile == "" || *webKeyFile == "" {
+			log.Fatalln("--web.tls-cert-file and --web.tls-key-file must be provided together")
+		}
+		serving, err = newTLSConfigLoader("web", TLSConfig{CertFile: *webCertFile, KeyFile: *webKeyFile})
+		if err != nil {
+			log.Fatalln("Error loading the serving certificate: ", err)
+		}
+		if *reloadInterval > 0 {
+			go serving.Watch(*reloadInterval, nil)
+		}
+		prometheus.MustRegister(servingCertCollector{loader: serving})
+	}
+
+	if *otlpEndpoint != "" {
+		probeTracer = newTracer(*otlpEndpoint, namespace+"_exporter")
 	}
 
 	log.Infoln("Starting "+namespace+"_exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
-	http.Handle(*metricsPath, prometheus.Handler())
+	var publishers []publisher
+	if conf.Pushgateway != nil {
+		publishers = append(publishers, &pushgatewayPublisher{config: conf.Pushgateway})
+	}
+	for _, rw := range conf.RemoteWrite {
+		w, err := newRemoteWriter(rw)
+		if err != nil {
+			log.Fatalln("remote_write " + rw.URL + ": " + err.Error())
+		}
+		if *reloadInterval > 0 {
+			go w.tls.Watch(*reloadInterval, nil)
+		}
+		publishers = append(publishers, w)
+	}
+
+	sched := newScheduler(modules, publishers)
+	for _, w := range conf.Webhooks {
+		sched.webhooks = append(sched.webhooks, newWebhook(w))
+	}
+	sched.timestamps = *timestamps
+	sched.moduleLabel = *moduleLabel
+	if *histograms {
+		sched.durations = newPhaseDurations()
+	}
+	if *dnsCacheTTL > 0 {
+		sched.cacheAddresses(*dnsCacheTTL)
+	}
+	reloader.scheduler = sched
+	stateSaved := make(chan struct{})
+	if *stateFile != "" {
+		state := newStateFile(*stateFile, sched.changes, modules)
+		reloader.state = state
+		if err := state.Load(); err != nil {
+			log.Errorln("Error loading the state from " + *stateFile + ", starting without it: " + err.Error())
+		}
+		go func() {
+			state.Run(stateSaveInterval, stop)
+			close(stateSaved)
+		}()
+	} else {
+		close(stateSaved)
+	}
+	reloader.targets = targets
+	reloader.watchTargetFiles(conf)
+	sched.Run(targets)
+	notifyReload(reloader)
+
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		metricsHandler(prometheus.Gatherers{prometheus.DefaultGatherer, sched}),
+	))
 	http.HandleFunc(*probePath, func(w http.ResponseWriter, r *http.Request) {
-		probeHandler(w, r, tlsConfig)
+		if r.Method == http.MethodPost {
+			batchProbeHandler(w, r, reloader.Modules())
+			return
+		}
+		probeHandler(w, r, reloader.Modules())
+	})
+	http.HandleFunc("/api/v1/probe", func(w http.ResponseWriter, r *http.Request) {
+		apiProbeHandler(w, r, reloader.Modules())
+	})
+	http.HandleFunc("/api/v1/probes", func(w http.ResponseWriter, r *http.Request) {
+		apiBatchProbeHandler(w, r, reloader.Modules())
+	})
+	http.HandleFunc("/chain", func(w http.ResponseWriter, r *http.Request) {
+		chainHandler(w, r, reloader.Modules())
+	})
+	http.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		reportHandler(w, r, reloader.Modules())
+	})
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		reloadHandler(w, r, reloader)
 	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -385,11 +829,40 @@ func main() {
 						 <body>
 						 <h1>SSL Exporter</h1>
 						 <p><a href="` + *probePath + `?target=example.com:443">Probe example.com:443 for SSL cert metrics</a></p>
+						 <p><a href="/api/v1/probe?target=example.com:443">Probe example.com:443 for SSL cert details as JSON</a></p>
+						 <p><a href="/chain?target=example.com:443">Download the chain presented by example.com:443</a></p>
+						 <p><a href="/report?target=example.com:443">Report on the certificates of example.com:443</a></p>
 						 <p><a href='` + *metricsPath + `'>Metrics</a></p>
 						 </body>
 						 </html>`))
 	})
 
+	server := &http.Server{Addr: *listenAddress}
+	shutDown := make(chan struct{})
+	go func() {
+		<-stop
+		log.Infoln("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorln("Error shutting down: " + err.Error())
+		}
+		close(shutDown)
+	}()
+
 	log.Infoln("Listening on", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	if serving == nil {
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig = newServingConfig(serving)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-shutDown
+	<-stateSaved
+	close(stopped)
+	serviceStopped()
 }
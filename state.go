@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// stateSaveInterval is how often the state is written to the state file
+const stateSaveInterval = time.Minute
+
+// stateFile keeps what the exporter has learnt about the targets across
+// restarts: the leaves that the background targets served, the lookups in
+// the CT logs, the OCSP responses of the leaves and the CRLs of their
+// distribution points. Without it, a restart forgets the changes of the
+// leaves and asks the APIs, the responders and the distribution points about
+// every certificate at once.
+type stateFile struct {
+	path    string
+	changes *changeTracker
+
+	mtx sync.Mutex
+	// ctLogs are the CT logs of the modules, by the name of the module
+	ctLogs map[string]*ctLog
+	// ocsp are the OCSP caches of the modules, by the name of the module
+	ocsp map[string]*ocspCache
+	// crl are the CRL caches of the modules, by the name of the module
+	crl map[string]*crlCache
+}
+
+// state is the content of the state file
+type state struct {
+	Leaves map[string]leafStateJSON `json:"leaves,omitempty"`
+	// CTLogs are the cached lookups of each module, by the hex encoded
+	// fingerprint of the certificate
+	CTLogs map[string]map[string]ctLogEntryJSON `json:"ct_logs,omitempty"`
+	// OCSP are the cached OCSP responses of each module, by the hex encoded
+	// fingerprint of the leaf
+	OCSP map[string]map[string]ocspEntryJSON `json:"ocsp,omitempty"`
+	// CRL are the cached CRLs of each module, by the URL of the
+	// distribution point
+	CRL map[string]map[string]crlEntryJSON `json:"crl,omitempty"`
+}
+
+type leafStateJSON struct {
+	Fingerprint string    `json:"fingerprint"`
+	Changed     time.Time `json:"changed"`
+	Seen        time.Time `json:"seen"`
+}
+
+type ctLogEntryJSON struct {
+	LoggedAt time.Time `json:"logged_at"`
+	Expires  time.Time `json:"expires"`
+}
+
+type ocspEntryJSON struct {
+	Response []byte    `json:"response"`
+	Refresh  time.Time `json:"refresh"`
+	Expires  time.Time `json:"expires"`
+}
+
+type crlEntryJSON struct {
+	List         []byte    `json:"list"`
+	Refresh      time.Time `json:"refresh"`
+	Expires      time.Time `json:"expires"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+}
+
+func newStateFile(path string, changes *changeTracker, modules map[string]*module) *stateFile {
+	f := &stateFile{path: path, changes: changes}
+	f.setModules(modules)
+	return f
+}
+
+// setModules replaces the modules whose caches are saved, when the
+// configuration is reloaded
+func (f *stateFile) setModules(modules map[string]*module) {
+	ctLogs, ocsp, crl := map[string]*ctLog{}, map[string]*ocspCache{}, map[string]*crlCache{}
+	for name, m := range modules {
+		if m.ct != nil {
+			ctLogs[name] = m.ct
+		}
+		if m.ocsp != nil {
+			ocsp[name] = m.ocsp
+		}
+		if m.crl != nil {
+			crl[name] = m.crl
+		}
+	}
+
+	f.mtx.Lock()
+	f.ctLogs, f.ocsp, f.crl = ctLogs, ocsp, crl
+	f.mtx.Unlock()
+}
+
+// caches returns the CT logs, the OCSP caches and the CRL caches of the
+// current modules
+func (f *stateFile) caches() (map[string]*ctLog, map[string]*ocspCache, map[string]*crlCache) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.ctLogs, f.ocsp, f.crl
+}
+
+// Load restores the state from the file. A missing file isn't an error, as
+// there's nothing to restore on the first start.
+func (f *stateFile) Load() error {
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s state
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	leaves := map[string]leafState{}
+	for target, l := range s.Leaves {
+		fingerprint, ok := decodeFingerprint(l.Fingerprint)
+		if !ok {
+			continue
+		}
+		leaves[target] = leafState{fingerprint: fingerprint, changed: l.Changed, seen: l.Seen}
+	}
+	f.changes.restore(leaves)
+
+	ctLogs, ocsp, crl := f.caches()
+	now := time.Now()
+	for name, entries := range s.CTLogs {
+		l, ok := ctLogs[name]
+		if !ok {
+			continue
+		}
+		cache := map[[sha256.Size]byte]ctLogEntry{}
+		for fp, e := range entries {
+			fingerprint, ok := decodeFingerprint(fp)
+			if !ok || !now.Before(e.Expires) {
+				continue
+			}
+			cache[fingerprint] = ctLogEntry{loggedAt: e.LoggedAt, expires: e.Expires}
+		}
+		l.restore(cache)
+	}
+	for name, entries := range s.OCSP {
+		o, ok := ocsp[name]
+		if !ok {
+			continue
+		}
+		cache := map[[sha256.Size]byte]ocspEntry{}
+		for fp, e := range entries {
+			fingerprint, ok := decodeFingerprint(fp)
+			if !ok || !now.Before(e.Expires) {
+				continue
+			}
+			cache[fingerprint] = ocspEntry{response: e.Response, refresh: e.Refresh, expires: e.Expires}
+		}
+		o.restore(cache)
+	}
+	for name, entries := range s.CRL {
+		l, ok := crl[name]
+		if !ok {
+			continue
+		}
+		cache := map[string]crlEntry{}
+		for u, e := range entries {
+			if !now.Before(e.Expires) {
+				continue
+			}
+			parsed, err := x509.ParseRevocationList(e.List)
+			if err != nil {
+				continue
+			}
+			cache[u] = crlEntry{
+				list:         e.List,
+				parsed:       parsed,
+				refresh:      e.Refresh,
+				expires:      e.Expires,
+				lastModified: e.LastModified,
+				etag:         e.ETag,
+			}
+		}
+		l.restore(cache)
+	}
+
+	return nil
+}
+
+// Save writes the state to the file. It's written to a temporary file first,
+// so that a crash while writing doesn't leave a truncated file behind.
+func (f *stateFile) Save() error {
+	s := state{
+		Leaves: map[string]leafStateJSON{},
+		CTLogs: map[string]map[string]ctLogEntryJSON{},
+		OCSP:   map[string]map[string]ocspEntryJSON{},
+		CRL:    map[string]map[string]crlEntryJSON{},
+	}
+	for target, l := range f.changes.snapshot() {
+		s.Leaves[target] = leafStateJSON{Fingerprint: hex.EncodeToString(l.fingerprint[:]), Changed: l.changed, Seen: l.seen}
+	}
+	ctLogs, ocsp, crl := f.caches()
+	for name, l := range ctLogs {
+		entries := map[string]ctLogEntryJSON{}
+		for fingerprint, e := range l.snapshot() {
+			entries[hex.EncodeToString(fingerprint[:])] = ctLogEntryJSON{LoggedAt: e.loggedAt, Expires: e.expires}
+		}
+		s.CTLogs[name] = entries
+	}
+	for name, o := range ocsp {
+		entries := map[string]ocspEntryJSON{}
+		for fingerprint, e := range o.snapshot() {
+			entries[hex.EncodeToString(fingerprint[:])] = ocspEntryJSON{Response: e.response, Refresh: e.refresh, Expires: e.expires}
+		}
+		s.OCSP[name] = entries
+	}
+	for name, l := range crl {
+		entries := map[string]crlEntryJSON{}
+		for u, e := range l.snapshot() {
+			entries[u] = crlEntryJSON{List: e.list, Refresh: e.refresh, Expires: e.expires, LastModified: e.lastModified, ETag: e.etag}
+		}
+		s.CRL[name] = entries
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Run saves the state on the interval, until stop is closed, and once more
+// when it is
+func (f *stateFile) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			f.save()
+			return
+		}
+		f.save()
+	}
+}
+
+func (f *stateFile) save() {
+	if err := f.Save(); err != nil {
+		log.Errorln("Error saving the state to " + f.path + ": " + err.Error())
+	}
+}
+
+func decodeFingerprint(s string) ([sha256.Size]byte, bool) {
+	var fingerprint [sha256.Size]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return fingerprint, false
+	}
+	copy(fingerprint[:], b)
+	return fingerprint, true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that the leaves, the CT log lookups, the OCSP responses and the CRLs
+// that are saved are restored, except for those that have expired since
+func TestStateFileSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	changed := time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC)
+	first := &x509.Certificate{Raw: []byte("first")}
+	second := &x509.Certificate{Raw: []byte("second")}
+	logged := sha256.Sum256([]byte("logged"))
+	expired := sha256.Sum256([]byte("expired"))
+
+	changes := newChangeTracker()
+	changes.observe("example.com:443", first, changed.Add(-time.Hour))
+	changes.observe("example.com:443", second, changed)
+	modules := map[string]*module{
+		"ct":      {ct: newCTLog(CTLogConfig{})},
+		"ocsp":    {ocsp: newOCSPCache(OCSPCheckConfig{})},
+		"crl":     {crl: newCRLCache(CRLCheckConfig{})},
+		"default": {},
+	}
+	modules["ct"].ct.restore(map[[sha256.Size]byte]ctLogEntry{
+		logged:  {loggedAt: changed, expires: time.Now().Add(time.Hour)},
+		expired: {expires: time.Now().Add(-time.Second)},
+	})
+	refresh := time.Now().Add(time.Hour).Truncate(time.Second)
+	modules["ocsp"].ocsp.restore(map[[sha256.Size]byte]ocspEntry{
+		logged:  {response: []byte("response"), refresh: refresh, expires: refresh.Add(time.Hour)},
+		expired: {response: []byte("stale"), expires: time.Now().Add(-time.Second)},
+	})
+	crl := newOCSPTestChain(t, "").crl(t, time.Hour, 2)
+	modules["crl"].crl.restore(map[string]crlEntry{
+		"http://crl.example.com/ca.crl":    {list: crl, refresh: refresh, expires: refresh.Add(time.Hour), etag: `"v1"`},
+		"http://crl.example.com/stale.crl": {list: crl, expires: time.Now().Add(-time.Second)},
+	})
+
+	if err := newStateFile(path, changes, modules).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing file is an empty state
+	if err := newStateFile(filepath.Join(dir, "missing.json"), newChangeTracker(), modules).Load(); err != nil {
+		t.Errorf("unexpected error loading a missing file: %s", err)
+	}
+
+	restored := newChangeTracker()
+	modules["ct"].ct = newCTLog(CTLogConfig{})
+	modules["ocsp"].ocsp = newOCSPCache(OCSPCheckConfig{})
+	modules["crl"].crl = newCRLCache(CRLCheckConfig{})
+	if err := newStateFile(path, restored, modules).Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	o := restored.observe("example.com:443", second, time.Now())
+	if o.changed || !o.lastChange.Equal(changed) || !o.previous.seen.Equal(changed) {
+		t.Errorf("expected the leaf and the times it changed and was seen to be restored, got %+v", o)
+	}
+	if o := restored.observe("example.com:443", first, time.Now()); !o.changed {
+		t.Errorf("expected another leaf to be a change after a restore")
+	}
+
+	cache := modules["ct"].ct.snapshot()
+	if e, ok := cache[logged]; !ok || !e.loggedAt.Equal(changed) {
+		t.Errorf("expected the lookup of the logged certificate to be restored, got %+v", e)
+	}
+	if _, ok := cache[expired]; ok {
+		t.Errorf("expected the expired lookup not to be restored")
+	}
+
+	responses := modules["ocsp"].ocsp.snapshot()
+	if e, ok := responses[logged]; !ok || string(e.response) != "response" || !e.refresh.Equal(refresh) {
+		t.Errorf("expected the OCSP response to be restored, got %+v", e)
+	}
+	if _, ok := responses[expired]; ok {
+		t.Errorf("expected the expired OCSP response not to be restored")
+	}
+
+	lists := modules["crl"].crl.snapshot()
+	if e, ok := lists["http://crl.example.com/ca.crl"]; !ok || e.parsed == nil || e.etag != `"v1"` || !e.refresh.Equal(refresh) {
+		t.Errorf("expected the CRL to be restored, got %+v", e)
+	}
+	if _, ok := lists["http://crl.example.com/stale.crl"]; ok {
+		t.Errorf("expected the expired CRL not to be restored")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newStateFile(path, newChangeTracker(), modules).Load(); err == nil {
+		t.Errorf("expected an error loading a corrupt file")
+	}
+}
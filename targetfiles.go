@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var targetFilesRefreshSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: "exporter",
+	Name:      "target_files_last_refresh_successful",
+	Help:      "Whether the last periodic read of the target files was successful",
+})
+
+func init() {
+	prometheus.MustRegister(targetFilesRefreshSuccess)
+}
+
+// loadTargets returns the targets of the configuration, followed by those in
+// its target files, in the order of the patterns and then of the paths that
+// they match. A target can't be defined in more than one place.
+func loadTargets(c *Config) ([]Target, error) {
+	targets := append([]Target{}, c.Targets...)
+	if c.TargetFiles == nil {
+		return targets, nil
+	}
+
+	seen := map[string]bool{}
+	for _, t := range targets {
+		seen[t.Target] = true
+	}
+	read := map[string]bool{}
+	for _, pattern := range c.TargetFiles.Files {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("target_files: %s", err)
+		}
+		for _, path := range paths {
+			if read[path] {
+				continue
+			}
+			read[path] = true
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("target_files: %s", err)
+			}
+			var file []Target
+			if err := yaml.UnmarshalStrict(b, &file); err != nil {
+				return nil, fmt.Errorf("target_files: %s: %s", path, err)
+			}
+			if err := c.checkTargets(file, seen); err != nil {
+				return nil, fmt.Errorf("target_files: %s: %s", path, err)
+			}
+			targets = append(targets, file...)
+		}
+	}
+
+	return targets, nil
+}
+
+// watchTargetFiles reads the target files of the configuration every refresh
+// interval, and replaces the targets of the scheduler when they've changed.
+// It stops watching the files of the previous configuration. The targets are
+// left as they were if the files can't be read.
+func (c *configReloader) watchTargetFiles(conf *Config) {
+	if c.targetFilesStop != nil {
+		close(c.targetFilesStop)
+		c.targetFilesStop = nil
+	}
+	if conf.TargetFiles == nil || c.scheduler == nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.targetFilesStop = stop
+	go func() {
+		ticker := time.NewTicker(conf.TargetFiles.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			c.refreshTargets(conf, stop)
+		}
+	}()
+}
+
+// refreshTargets reads the target files of the configuration again, unless
+// the configuration has been reloaded since
+func (c *configReloader) refreshTargets(conf *Config, stop <-chan struct{}) {
+	c.reloadMtx.Lock()
+	defer c.reloadMtx.Unlock()
+
+	select {
+	case <-stop:
+		return
+	default:
+	}
+
+	targets, err := loadTargets(conf)
+	if err != nil {
+		targetFilesRefreshSuccess.Set(0)
+		log.Errorln("Error reading the target files, keeping the previous targets: ", err)
+		return
+	}
+	targetFilesRefreshSuccess.Set(1)
+	if reflect.DeepEqual(targets, c.targets) {
+		return
+	}
+
+	log.Infoln(fmt.Sprintf("The target files have changed, probing %d targets", len(targets)))
+	c.targets = targets
+	c.scheduler.Reload(c.Modules(), targets)
+}
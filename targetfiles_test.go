@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the targets of the target files follow those of the
+// configuration, with the defaults set, and that they can't be defined twice
+func TestLoadTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"a.yml": "- target: a.example.com:443\n  module: tcp\n",
+		"b.yml": "- target: b.example.com:443\n  interval: 5m\n",
+		"c.txt": "not: [targets",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := parseConfig([]byte(`
+modules:
+  tcp:
+    prober: tcp
+targets:
+  - target: example.com:443
+target_files:
+  files:
+    - ` + filepath.Join(dir, "*.yml") + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TargetFiles.RefreshInterval != defaultTargetFilesRefresh {
+		t.Errorf("expected refresh_interval %s, got %s", defaultTargetFilesRefresh, c.TargetFiles.RefreshInterval)
+	}
+
+	targets, err := loadTargets(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Target{
+		{Target: "example.com:443", Module: defaultModule, Interval: defaultInterval},
+		{Target: "a.example.com:443", Module: "tcp", Interval: defaultInterval},
+		{Target: "b.example.com:443", Module: defaultModule, Interval: 5 * time.Minute},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("expected %d targets, got %v", len(expected), targets)
+	}
+	for i := range expected {
+		if targets[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], targets[i])
+		}
+	}
+
+	for content, want := range map[string]string{
+		"- target: example.com:443\n":                   "example.com:443 is defined more than once",
+		"- target: c.example.com:443\n  module: nope\n": "refers to unknown module nope",
+		"- target: c.example.com:443\n  timeout: 10s\n": "field timeout not found",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "c.yml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadTargets(c); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected an error containing %q, got %v", want, err)
+		}
+	}
+}
+
+// Test that the scheduler gets the targets of the files when they change,
+// and keeps them when the files can't be read
+func TestRefreshTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "targets.yml")
+
+	conf := &Config{TargetFiles: &TargetFilesConfig{Files: []string{file}, RefreshInterval: time.Hour}}
+	modules, err := loadModules(conf, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := newConfigReloader("", TLSConfig{}, conf, modules)
+	reloader.scheduler = newScheduler(modules, nil)
+	reloader.watchTargetFiles(conf)
+	defer reloader.watchTargetFiles(&Config{})
+	stop := reloader.targetFilesStop
+
+	if err := ioutil.WriteFile(file, []byte("- target: 127.0.0.1:1\n  interval: 1h\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloader.refreshTargets(conf, stop)
+	defer reloader.scheduler.Reload(modules, nil)
+	if len(reloader.targets) != 1 || reloader.targets[0].Target != "127.0.0.1:1" {
+		t.Fatalf("expected the target of the file, got %v", reloader.targets)
+	}
+	loop := reloader.scheduler.loops["127.0.0.1:1"]
+
+	reloader.refreshTargets(conf, stop)
+	if reloader.scheduler.loops["127.0.0.1:1"] != loop {
+		t.Errorf("expected the scheduler to be left alone when the files haven't changed")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("- target: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloader.refreshTargets(conf, stop)
+	if len(reloader.targets) != 1 || reloader.scheduler.loops["127.0.0.1:1"] != loop {
+		t.Errorf("expected the targets to be kept when the file can't be read")
+	}
+
+	// A target added to the files doesn't restart the loops of the others
+	if err := ioutil.WriteFile(file, []byte("- target: 127.0.0.1:1\n  interval: 1h\n- target: 127.0.0.1:2\n  interval: 1h\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloader.refreshTargets(conf, stop)
+	if len(reloader.targets) != 2 || reloader.scheduler.loops["127.0.0.1:1"] != loop {
+		t.Errorf("expected the loop of the target that was already there to be kept")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/prober"
+)
+
+// phaseTimings adds up how long each phase of a probe took, failed or not,
+// for the ssl_probe_phase_seconds of the probe. The phases of the several
+// connections of a probe, like those of redirects or of each port, are
+// summed.
+type phaseTimings struct {
+	mtx       sync.Mutex
+	durations map[string]time.Duration
+}
+
+func newPhaseTimings() *phaseTimings {
+	return &phaseTimings{durations: map[string]time.Duration{}}
+}
+
+// tracer returns a prober.Tracer that times the phases, and passes them on
+// to next, if it isn't nil
+func (t *phaseTimings) tracer(next prober.Tracer) prober.Tracer {
+	return timingTracer{timings: t, next: next}
+}
+
+// snapshot returns the durations of the phases so far
+func (t *phaseTimings) snapshot() map[string]time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	durations := make(map[string]time.Duration, len(t.durations))
+	for phase, d := range t.durations {
+		durations[phase] = d
+	}
+	return durations
+}
+
+type timingTracer struct {
+	timings *phaseTimings
+	next    prober.Tracer
+}
+
+// StartPhase implements prober.Tracer
+func (t timingTracer) StartPhase(ctx context.Context, phase string, attributes map[string]string) func(error) {
+	start := time.Now()
+
+	var end func(error)
+	if t.next != nil {
+		end = t.next.StartPhase(ctx, phase, attributes)
+	}
+
+	return func(err error) {
+		d := time.Since(start)
+		t.timings.mtx.Lock()
+		t.timings.durations[phase] += d
+		t.timings.mtx.Unlock()
+
+		if end != nil {
+			end(err)
+		}
+	}
+}
+
+// tracer returns the Tracer of the probes of the exporter: the spans of the
+// tracing, if it's on, the histograms of the background probes, and the
+// timings of the phases
+func (e *Exporter) tracer() prober.Tracer {
+	var tracer prober.Tracer
+	if probeTracer != nil {
+		tracer = probeTracer
+	}
+	if e.phases != nil {
+		e.phases.next = tracer
+		tracer = e.phases
+	}
+	if e.timings != nil {
+		tracer = e.timings.tracer(tracer)
+	}
+	return tracer
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that a probe reports how long it took and how long its phases took
+func TestProbeHandlerTimings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	modules, err := loadModules(&Config{}, TLSConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/probe?target="+server.URL, nil)
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, modules)
+
+	for _, want := range []string{
+		"ssl_probe_duration_seconds ",
+		`ssl_probe_phase_seconds{phase="dial"} `,
+		`ssl_probe_phase_seconds{phase="handshake"} `,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected `%s`", want)
+		}
+	}
+}
+
+type recordingTracer []string
+
+func (r *recordingTracer) StartPhase(ctx context.Context, phase string, attributes map[string]string) func(error) {
+	*r = append(*r, phase)
+	return func(error) {}
+}
+
+// Test that the durations of each phase are summed, including those that
+// failed, and that the phases are passed on to the next Tracer
+func TestPhaseTimings(t *testing.T) {
+	timings := newPhaseTimings()
+	next := &recordingTracer{}
+	tracer := timings.tracer(next)
+
+	for i := 0; i < 2; i++ {
+		end := tracer.StartPhase(context.Background(), "dial", nil)
+		time.Sleep(10 * time.Millisecond)
+		end(nil)
+	}
+	tracer.StartPhase(context.Background(), "handshake", nil)(errors.New("handshake failure"))
+
+	durations := timings.snapshot()
+	if d := durations["dial"]; d < 20*time.Millisecond {
+		t.Errorf("expected the dials to be summed, got %s", d)
+	}
+	if _, ok := durations["handshake"]; !ok {
+		t.Errorf("expected the duration of the failed handshake")
+	}
+	if len(*next) != 3 {
+		t.Errorf("expected the phases to be passed on, got %v", *next)
+	}
+
+	// Without a next Tracer, the phases are only timed
+	newPhaseTimings().tracer(nil).StartPhase(context.Background(), "dial", nil)(nil)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	// Values from the OTLP protobuf definitions
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusCodeOk     = 1
+	statusCodeError  = 2
+
+	tracingBatchSize     = 512
+	tracingQueueSize     = 2048
+	tracingFlushInterval = 5 * time.Second
+)
+
+var (
+	// probeTracer is used to trace the phases of each probe. It's nil, and
+	// tracing is disabled, unless an OTLP endpoint is configured.
+	probeTracer *tracer
+
+	tracingSpansDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "tracing_spans_dropped_total",
+		Help:      "Number of spans that couldn't be exported to the OTLP endpoint",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(tracingSpansDropped)
+}
+
+// tracer exports spans to an OpenTelemetry collector using OTLP over HTTP
+// with the JSON encoding
+type tracer struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	queue       chan *span
+}
+
+func newTracer(endpoint, serviceName string) *tracer {
+	t := &tracer{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *span, tracingQueueSize),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// Start creates a new span as a child of the span in ctx, if there is one.
+// It's safe to call on a nil tracer, in which case the returned span doesn't
+// record anything.
+func (t *tracer) Start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if sc, ok := ctx.Value(remoteSpanKey{}).(spanContext); ok {
+		s.traceID = sc.traceID
+		s.parentID = sc.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *tracer) run() {
+	var batch []*span
+
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < tracingBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.export(batch); err != nil {
+			log.Errorln("Error exporting spans: ", err)
+			tracingSpansDropped.Add(float64(len(batch)))
+		}
+		batch = nil
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	var otlpSpans []otlpSpan
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpKeyValue{stringAttribute("service.name", t.serviceName)},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: t.serviceName},
+						Spans: otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response from %s: %s", t.endpoint, resp.Status)
+	}
+
+	return nil
+}
+
+type spanKey struct{}
+
+type remoteSpanKey struct{}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// spanContext identifies a span started outside of the exporter
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// contextWithTraceparent returns a context carrying the span described by
+// a W3C traceparent header, so that probe spans are linked to the trace of
+// the caller
+func contextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+
+	var sc spanContext
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.traceID) {
+		return ctx
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.spanID) {
+		return ctx
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+
+	return context.WithValue(ctx, remoteSpanKey{}, sc)
+}
+
+// span is a single timed operation within a probe. All of its methods are
+// safe to call on a nil span.
+type span struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+
+	mtx   sync.Mutex
+	ended bool
+}
+
+// SetAttribute adds an attribute to the span
+func (s *span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.err = err
+}
+
+// End completes the span and queues it for export. Subsequent calls have
+// no effect.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mtx.Unlock()
+
+	select {
+	case s.tracer.queue <- s:
+	default:
+		tracingSpansDropped.Inc()
+	}
+}
+
+func (s *span) otlp() otlpSpan {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: statusCodeOk},
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attributes {
+		o.Attributes = append(o.Attributes, stringAttribute(k, v))
+	}
+	if s.err != nil {
+		o.Status = otlpStatus{Code: statusCodeError, Message: s.err.Error()}
+	}
+
+	return o
+}
+
+// StartPhase implements prober.Tracer
+func (t *tracer) StartPhase(ctx context.Context, phase string, attributes map[string]string) func(error) {
+	_, s := t.Start(ctx, phase, spanKindClient)
+	for k, v := range attributes {
+		s.SetAttribute(k, v)
+	}
+
+	return func(err error) {
+		s.SetError(err)
+		s.End()
+	}
+}
+
+// The types below mirror the JSON encoding of the OTLP trace protobufs:
+//
+//	https://github.com/open-telemetry/opentelemetry-proto
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
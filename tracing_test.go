@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test that a span is recorded for each phase of a https probe
+func TestTracingHTTPSPhases(t *testing.T) {
+	spans := traceProbe(t, func(url string) {
+		probe(url)
+	})
+
+	testPhases(t, spans, "probe", "dial", "handshake", "verify")
+}
+
+// Test that a span is recorded for each phase of a tcp probe
+func TestTracingTCPPhases(t *testing.T) {
+	spans := traceProbe(t, func(url string) {
+		probe(url[len("https://"):])
+	})
+
+	testPhases(t, spans, "probe", "resolve", "dial", "handshake", "verify")
+}
+
+// Test that spans are exported to the OTLP endpoint
+func TestTracingExport(t *testing.T) {
+	var traces otlpTraces
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(body, &traces); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer collector.Close()
+
+	spans := traceProbe(t, func(url string) {
+		probe(url)
+	})
+
+	tr := &tracer{
+		endpoint:    collector.URL + "/v1/traces",
+		serviceName: "ssl_exporter",
+		client:      http.DefaultClient,
+	}
+	if err := tr.export(spans); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected a single resource and scope")
+	}
+	if n := len(traces.ResourceSpans[0].ScopeSpans[0].Spans); n != len(spans) {
+		t.Errorf("expected %d spans, got %d", len(spans), n)
+	}
+}
+
+// Test that the probe span continues the trace in the traceparent header
+func TestTracingTraceparent(t *testing.T) {
+	tr := &tracer{queue: make(chan *span, 1)}
+
+	ctx := contextWithTraceparent(
+		httptest.NewRequest("GET", "/", nil).Context(),
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	)
+	_, s := tr.Start(ctx, "probe", spanKindInternal)
+
+	if hex.EncodeToString(s.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace id %x", s.traceID)
+	}
+	if hex.EncodeToString(s.parentID[:]) != "00f067aa0ba902b7" {
+		t.Errorf("unexpected parent id %x", s.parentID)
+	}
+}
+
+// traceProbe runs a probe against a test server with tracing enabled and
+// returns the recorded spans
+func traceProbe(t *testing.T, fn func(url string)) []*span {
+	server, err := server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	probeTracer = &tracer{queue: make(chan *span, tracingQueueSize)}
+	defer func() { probeTracer = nil }()
+
+	fn(server.URL)
+
+	var spans []*span
+	for len(probeTracer.queue) > 0 {
+		spans = append(spans, <-probeTracer.queue)
+	}
+
+	return spans
+}
+
+func testPhases(t *testing.T, spans []*span, phases ...string) {
+	names := map[string]*span{}
+	for _, s := range spans {
+		names[s.name] = s
+	}
+
+	root, ok := names["probe"]
+	if !ok {
+		t.Fatalf("expected a probe span")
+	}
+
+	for _, phase := range phases {
+		s, ok := names[phase]
+		if !ok {
+			t.Errorf("expected a %s span", phase)
+			continue
+		}
+		if s.traceID != root.traceID {
+			t.Errorf("expected the %s span to be part of the probe trace", phase)
+		}
+		if s != root && s.parentID != root.spanID {
+			t.Errorf("expected the %s span to be a child of the probe span", phase)
+		}
+		if s.err != nil {
+			t.Errorf("unexpected error in %s span: %s", phase, s.err)
+		}
+	}
+}
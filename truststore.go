@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	_ "embed"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"unicode/utf16"
+
+	"github.com/ribbybibby/ssl_exporter/pkg/metrics"
+)
+
+// TrustStore is the set of roots that a module verifies certificates against
+type TrustStore string
+
+const (
+	// TrustStoreSystem is the roots of the system the exporter runs on. It's
+	// the default without a ca_file.
+	TrustStoreSystem TrustStore = "system"
+	// TrustStoreMozilla is the roots of Mozilla's CA program, which Firefox
+	// and most Linux distributions trust, bundled with the exporter so that
+	// it's the same wherever it runs
+	TrustStoreMozilla TrustStore = "mozilla"
+	// TrustStoreFile is the certificates in the ca_file. It's the default
+	// with one.
+	TrustStoreFile TrustStore = "file"
+	// TrustStoreJava is the certificates in a Java cacerts file, which the
+	// JVM apps using it trust
+	TrustStoreJava TrustStore = "java"
+)
+
+//go:embed cacerts/mozilla.pem
+var mozillaPEM []byte
+
+// mozillaRoots returns a pool of the bundled Mozilla roots
+func mozillaRoots() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(mozillaPEM)
+	return roots
+}
+
+// javaRoots returns a pool of the trusted certificates in a Java cacerts
+// file, which is read with the password if it has one
+func javaRoots(file string, password KeystorePassword) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := password.get()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseJavaKeyStore(b, p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found in " + file)
+	}
+
+	roots := x509.NewCertPool()
+	for _, c := range certs {
+		roots.AddCert(c.Cert)
+	}
+
+	return roots, nil
+}
+
+// parseJavaKeyStore returns the certificates in a Java key store: a JKS, as
+// cacerts was up to Java 17, or a PKCS#12 store without a password, which it
+// is from Java 18. With a password, the integrity of the store is checked
+// and the encrypted certificates of a PKCS#12 store are read too. Each
+// certificate has the alias of its entry.
+func parseJavaKeyStore(b []byte, password string) ([]metrics.TrustStoreCert, error) {
+	if len(b) >= 4 {
+		switch binary.BigEndian.Uint32(b) {
+		case jksMagic, jceksMagic:
+			certs, err := parseJKS(b)
+			if err != nil {
+				return nil, err
+			}
+			if password != "" {
+				if err := verifyJKS(b, password); err != nil {
+					return nil, err
+				}
+			}
+			return certs, nil
+		}
+	}
+	return parsePKCS12Certs(b, password)
+}
+
+const (
+	jksMagic   = 0xfeedfeed
+	jceksMagic = 0xcececece
+)
+
+var errTruncatedJKS = errors.New("truncated JKS")
+
+// jksReader reads the fields of a JKS
+type jksReader struct {
+	*bytes.Reader
+}
+
+func (r jksReader) uint32() (uint32, error) {
+	var v uint32
+	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+		return 0, errTruncatedJKS
+	}
+	return v, nil
+}
+
+// skip skips a field with a length of n bytes
+func (r jksReader) skip(n int) error {
+	var length uint64
+	switch n {
+	case 2:
+		var v uint16
+		if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+			return errTruncatedJKS
+		}
+		length = uint64(v)
+	case 4:
+		v, err := r.uint32()
+		if err != nil {
+			return err
+		}
+		length = uint64(v)
+	}
+	if length > uint64(r.Len()) {
+		return errTruncatedJKS
+	}
+	r.Seek(int64(length), 1)
+	return nil
+}
+
+// utf reads a string, like an alias, which Java writes in its modified UTF-8.
+// That only differs from UTF-8 for NUL and the characters outside of the
+// Basic Multilingual Plane, which aliases don't have.
+func (r jksReader) utf() (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", errTruncatedJKS
+	}
+	if int(n) > r.Len() {
+		return "", errTruncatedJKS
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
+
+// cert reads a certificate, preceded by its type in version 2
+func (r jksReader) cert(version uint32) (*x509.Certificate, error) {
+	if version == 2 {
+		if err := r.skip(2); err != nil {
+			return nil, err
+		}
+	}
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) > uint64(r.Len()) {
+		return nil, errTruncatedJKS
+	}
+	der := make([]byte, n)
+	r.Read(der)
+	return x509.ParseCertificate(der)
+}
+
+// parseJKS returns the trusted certificates of a JKS, and those of the
+// chains of its private keys, with the alias of their entry. The integrity of
+// the store isn't checked, as that needs its password, which verifyJKS checks
+// it with.
+func parseJKS(b []byte) ([]metrics.TrustStoreCert, error) {
+	r := jksReader{bytes.NewReader(b[4:])}
+
+	version, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("unsupported JKS version %d", version)
+	}
+	count, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []metrics.TrustStoreCert
+	for i := uint32(0); i < count; i++ {
+		tag, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		// The alias and the creation time
+		alias, err := r.utf()
+		if err != nil {
+			return nil, err
+		}
+		if r.Len() < 8 {
+			return nil, errTruncatedJKS
+		}
+		r.Seek(8, 1)
+
+		switch tag {
+		case 1:
+			// A private key, which is encrypted, and its chain
+			if err := r.skip(4); err != nil {
+				return nil, err
+			}
+			n, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			for j := uint32(0); j < n; j++ {
+				cert, err := r.cert(version)
+				if err != nil {
+					return nil, err
+				}
+				certs = append(certs, metrics.TrustStoreCert{Alias: alias, Cert: cert})
+			}
+		case 2:
+			cert, err := r.cert(version)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, metrics.TrustStoreCert{Alias: alias, Cert: cert})
+		default:
+			// The secret keys of a JCEKS are serialized Java objects
+			return nil, fmt.Errorf("unsupported JKS entry type %d", tag)
+		}
+	}
+
+	return certs, nil
+}
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+)
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12Attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// friendlyName returns the friendlyName attribute of a bag, which is what
+// keytool shows as the alias of the entry, or "" if it doesn't have one
+func (bag pkcs12SafeBag) friendlyName() string {
+	if len(bag.Attributes.FullBytes) == 0 {
+		return ""
+	}
+	var attrs []pkcs12Attribute
+	if _, err := asn1.UnmarshalWithParams(bag.Attributes.FullBytes, &attrs, "set"); err != nil {
+		return ""
+	}
+	for _, attr := range attrs {
+		if !attr.ID.Equal(oidFriendlyName) {
+			continue
+		}
+		// A BMPString, which is UTF-16 without the surrogates
+		var v asn1.RawValue
+		if _, err := asn1.Unmarshal(attr.Values.Bytes, &v); err != nil || v.Tag != asn1.TagBMPString || len(v.Bytes)%2 != 0 {
+			return ""
+		}
+		s := make([]uint16, len(v.Bytes)/2)
+		for i := range s {
+			s[i] = binary.BigEndian.Uint16(v.Bytes[2*i:])
+		}
+		return string(utf16.Decode(s))
+	}
+	return ""
+}
+
+// parsePKCS12Certs returns the certificates in a PKCS#12 store, with their
+// friendly names. The certificates of a store with a password are usually
+// encrypted, so without the password only those in its unencrypted parts are
+// read.
+func parsePKCS12Certs(b []byte, password string) ([]metrics.TrustStoreCert, error) {
+	var pfx pkcs12PFX
+	if _, err := asn1.Unmarshal(b, &pfx); err != nil {
+		return nil, errors.New("not a JKS or PKCS#12 store")
+	}
+
+	authSafeDER, err := dataContent(pfx.AuthSafe)
+	if err != nil {
+		return nil, err
+	}
+	var authSafe []pkcs12ContentInfo
+	if _, err := asn1.Unmarshal(authSafeDER, &authSafe); err != nil {
+		return nil, err
+	}
+	if password != "" && len(pfx.MacData.FullBytes) > 0 {
+		if err := verifyPKCS12MAC(pfx.MacData, authSafeDER, password); err != nil {
+			return nil, err
+		}
+	}
+
+	var certs []metrics.TrustStoreCert
+	for _, ci := range authSafe {
+		var der []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if der, err = dataContent(ci); err != nil {
+				return nil, err
+			}
+		case ci.ContentType.Equal(oidEncryptedData) && password != "":
+			if der, err = decryptPKCS12Data(ci, password); err != nil {
+				return nil, err
+			}
+		default:
+			// The encrypted parts need the password
+			continue
+		}
+
+		var bags []pkcs12SafeBag
+		if _, err := asn1.Unmarshal(der, &bags); err != nil {
+			return nil, err
+		}
+		for _, bag := range bags {
+			if !bag.ID.Equal(oidCertBag) {
+				continue
+			}
+			var cb pkcs12CertBag
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+				return nil, err
+			}
+			if !cb.ID.Equal(oidX509Certificate) {
+				continue
+			}
+			cert, err := x509.ParseCertificate(cb.Data)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, metrics.TrustStoreCert{Alias: bag.friendlyName(), Cert: cert})
+		}
+	}
+
+	if len(certs) == 0 && password == "" {
+		return nil, errors.New("no unencrypted certificates found, the store may have a password")
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	return certs, nil
+}
+
+// dataContent returns the content of a ContentInfo of the data type, which
+// is an OCTET STRING of DER
+func dataContent(ci pkcs12ContentInfo) ([]byte, error) {
+	if !ci.ContentType.Equal(oidData) {
+		return nil, errors.New("unsupported PKCS#12 content type " + ci.ContentType.String())
+	}
+	var der []byte
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &der); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// trustStoreProber is the prober whose targets are trust store files, whose
+// certificates are read rather than probed so that aging roots get noticed
+const trustStoreProber = "truststore"
+
+// systemTrustStore is the target of the system's bundle of roots, as found
+// by systemBundle
+const systemTrustStore = "system"
+
+// systemBundles are where Linux distributions keep the bundle of the
+// system's roots, as in crypto/x509
+var systemBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// systemBundle returns the path of the system's bundle of roots: the file
+// in SSL_CERT_FILE or the first of systemBundles that exists
+func systemBundle() (string, error) {
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		return file, nil
+	}
+	for _, file := range systemBundles {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", errors.New("no system trust store found")
+}
+
+// readTrustStore returns the certificates in a trust store file, which is a
+// PEM bundle or a Java keystore, read with its password among the passwords.
+// The target system is the system's bundle.
+func readTrustStore(target string, passwords KeystorePasswords) ([]metrics.TrustStoreCert, error) {
+	file := target
+	if target == systemTrustStore {
+		var err error
+		if file, err = systemBundle(); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		password, err := passwords.forFile(file)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseJavaKeyStore(b, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return certs, nil
+	}
+
+	pemCerts, err := parsePEMCertificates(file, b)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]metrics.TrustStoreCert, len(pemCerts))
+	for i, cert := range pemCerts {
+		certs[i].Cert = cert
+	}
+	return certs, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+const (
+	webhookCertChanged     = "certificate_changed"
+	webhookExpiryThreshold = "expiry_threshold_crossed"
+)
+
+var webhookFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "webhook_failures_total",
+		Help:      "Number of times an event couldn't be sent to a webhook",
+	},
+	[]string{"url"},
+)
+
+func init() {
+	prometheus.MustRegister(webhookFailures)
+}
+
+// webhookEvent is the body of the requests to the webhooks
+type webhookEvent struct {
+	Event  string `json:"event"`
+	Target string `json:"target"`
+	// Fingerprint is the SHA-256 of the leaf that the target serves, and
+	// PreviousFingerprint that of the one it served before a change
+	Fingerprint         string    `json:"fingerprint"`
+	PreviousFingerprint string    `json:"previous_fingerprint,omitempty"`
+	SerialNo            string    `json:"serial_no"`
+	SubjectCN           string    `json:"subject_cn"`
+	NotAfter            time.Time `json:"not_after"`
+	// ThresholdSeconds is the expiry threshold that the leaf crossed
+	ThresholdSeconds float64   `json:"threshold_seconds,omitempty"`
+	Time             time.Time `json:"time"`
+}
+
+// webhook sends the events of the background probes to an HTTP endpoint
+type webhook struct {
+	config *WebhookConfig
+	client *http.Client
+}
+
+func newWebhook(c *WebhookConfig) *webhook {
+	return &webhook{
+		config: c,
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		},
+	}
+}
+
+// webhooks are all of the configured webhooks, which get every event
+type webhooks []*webhook
+
+// notify sends the events that the observation of the leaf reveals: that it
+// changed, or that it crossed one of the expiry thresholds since the
+// previous probe. The events are sent in the background, so that a slow
+// endpoint doesn't hold up the probes.
+func (ws webhooks) notify(target string, leaf *x509.Certificate, o observation, thresholds []time.Duration, now time.Time) {
+	for _, event := range webhookEvents(target, leaf, o, thresholds, now) {
+		for _, w := range ws {
+			go w.send(event)
+		}
+	}
+}
+
+func webhookEvents(target string, leaf *x509.Certificate, o observation, thresholds []time.Duration, now time.Time) []webhookEvent {
+	if !o.known {
+		return nil
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	event := webhookEvent{
+		Target:      target,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		SerialNo:    leaf.SerialNumber.String(),
+		SubjectCN:   leaf.Subject.CommonName,
+		NotAfter:    leaf.NotAfter,
+		Time:        now,
+	}
+
+	if o.changed {
+		event.Event = webhookCertChanged
+		event.PreviousFingerprint = hex.EncodeToString(o.previous.fingerprint[:])
+		return []webhookEvent{event}
+	}
+
+	// A threshold is crossed when the leaf enters it between the previous
+	// probe and this one, so it's only sent once however often the target
+	// is probed
+	var events []webhookEvent
+	for _, t := range thresholds {
+		crossing := leaf.NotAfter.Add(-t)
+		if o.previous.seen.IsZero() || !o.previous.seen.Before(crossing) || now.Before(crossing) {
+			continue
+		}
+		e := event
+		e.Event = webhookExpiryThreshold
+		e.ThresholdSeconds = t.Seconds()
+		events = append(events, e)
+	}
+	return events
+}
+
+func (w *webhook) send(event webhookEvent) {
+	if err := w.post(event); err != nil {
+		webhookFailures.WithLabelValues(w.config.URL).Inc()
+		log.Errorln("Error sending the " + event.Event + " event for " + event.Target + " to the webhook: " + err.Error())
+	}
+}
+
+func (w *webhook) post(event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", namespace+"_exporter/"+version.Version)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d while sending to %s: %s", resp.StatusCode, w.config.URL, b)
+	}
+
+	return nil
+}
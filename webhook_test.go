@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that a change is sent on the probe where the leaf changed, and a
+// threshold on the probe where the leaf entered it
+func TestWebhookEvents(t *testing.T) {
+	start := time.Date(2023, 5, 1, 9, 30, 0, 0, time.UTC)
+	first := &x509.Certificate{
+		Raw:          []byte("first"),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotAfter:     start.Add(7*24*time.Hour + 90*time.Second),
+	}
+	second := &x509.Certificate{
+		Raw:          []byte("second"),
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotAfter:     start.Add(90 * 24 * time.Hour),
+	}
+	thresholds := []time.Duration{7 * 24 * time.Hour, 30 * 24 * time.Hour}
+
+	tracker := newChangeTracker()
+	for i, tc := range []struct {
+		leaf   *x509.Certificate
+		events []string
+	}{
+		{leaf: first},
+		{leaf: first},
+		{leaf: first, events: []string{webhookExpiryThreshold}},
+		{leaf: first},
+		{leaf: second, events: []string{webhookCertChanged}},
+		{leaf: second},
+	} {
+		now := start.Add(time.Duration(i) * time.Minute)
+		events := webhookEvents("example.com:443", tc.leaf, tracker.observe("example.com:443", tc.leaf, now), thresholds, now)
+		if len(events) != len(tc.events) {
+			t.Errorf("%d: expected %v, got %+v", i, tc.events, events)
+			continue
+		}
+		for j, e := range events {
+			if e.Event != tc.events[j] || e.Target != "example.com:443" || !e.NotAfter.Equal(tc.leaf.NotAfter) {
+				t.Errorf("%d: expected a %s event for the leaf, got %+v", i, tc.events[j], e)
+			}
+			switch e.Event {
+			case webhookExpiryThreshold:
+				if e.ThresholdSeconds != thresholds[0].Seconds() {
+					t.Errorf("%d: expected the threshold of 7d, got %vs", i, e.ThresholdSeconds)
+				}
+			case webhookCertChanged:
+				if e.PreviousFingerprint == "" || e.PreviousFingerprint == e.Fingerprint || e.SerialNo != "2" {
+					t.Errorf("%d: expected the previous and the new leaf, got %+v", i, e)
+				}
+			}
+		}
+	}
+}
+
+// Test that an event is posted as JSON with the configured headers
+func TestWebhookSend(t *testing.T) {
+	received := make(chan webhookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Team") != "platform" {
+			t.Errorf("unexpected request %s with headers %v", r.Method, r.Header)
+		}
+		var e webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer server.Close()
+
+	w := newWebhook(&WebhookConfig{URL: server.URL, Timeout: time.Second, Headers: map[string]string{"X-Team": "platform"}})
+	webhooks{w}.notify("example.com:443", &x509.Certificate{Raw: []byte("second"), SerialNumber: big.NewInt(2)}, observation{
+		changed: true,
+		known:   true,
+	}, nil, time.Now())
+
+	select {
+	case e := <-received:
+		if e.Event != webhookCertChanged || e.Target != "example.com:443" {
+			t.Errorf("expected a certificate_changed event for example.com:443, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the event to be sent")
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	w = newWebhook(&WebhookConfig{URL: missing.URL, Timeout: time.Second})
+	if err := w.post(webhookEvent{Event: webhookCertChanged}); err == nil {
+		t.Errorf("expected an error for a 404")
+	}
+}